@@ -5,15 +5,21 @@ import (
 	"flag"
 	"fmt"
 	"path/filepath"
+	"strings"
+	"time"
 
 	appsv1 "k8s.io/api/apps/v1"
 	apiv1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/tools/clientcmd"
 	"k8s.io/client-go/util/homedir"
 )
 
+// 默认值，可以用 -namespace 等参数或 -values 文件修改，见 values.go
 const (
 	NAMESPACE       = "test-clientset"
 	DEPLOYMENT_NAME = "client-test-deployment"
@@ -27,77 +33,287 @@ func main() {
 	} else {
 		kubeconfig = flag.String("kubeconfig", "", "absolute path to the kubeconfig file")
 	}
-	operate := flag.String("operate", "create", "operate type: create or clean")
+	operate := flag.String("operate", "create", "operate type: create, validate or clean")
+	propagation := flag.String("propagation", "background", "clean: deletion propagation policy, foreground, background or orphan")
+	gracePeriod := flag.Int64("grace-period", -1, "clean: grace period in seconds for deleted objects, negative means the object's default")
+	waitClean := flag.Bool("wait", false, "clean: block until the deployment's pods and the namespace are gone")
+	timeout := flag.Duration("timeout", 5*time.Minute, "clean: how long -wait blocks before giving up")
+	flag.StringVar(&errorFormat, "error-format", errorFormat, "how errors are reported on stderr: text or json")
+	valuesFile := flag.String("values", "", "YAML file with namespace, deploymentName, serviceName, image, replicas, port and nodePort")
+	namespace := flag.String("namespace", NAMESPACE, "namespace of the stack")
+	deploymentName := flag.String("deployment-name", DEPLOYMENT_NAME, "name of the deployment")
+	serviceName := flag.String("service-name", SERVICE_NAME, "name of the service")
+	image := flag.String("image", DEFAULT_IMAGE, "container image of the deployment")
+	replicas := flag.Int("replicas", -1, "replicas of the deployment, negative leaves it to the API server default")
+	port := flag.Int("port", DEFAULT_PORT, "container and service port")
+	nodePort := flag.Int("node-port", DEFAULT_NODE_PORT, fmt.Sprintf("node port of the service, %d-%d, or 0 to let the API server allocate one", NODE_PORT_MIN, NODE_PORT_MAX))
 	flag.Parse()
 
+	if format := errorFormat; format != "text" && format != "json" {
+		errorFormat = "text"
+		exitUsage("unknown error format %q, must be text or json", format)
+	}
+
+	// 命令行中显式指定的参数覆盖 -values 文件
+	if *valuesFile != "" {
+		if err := loadValuesFile(*valuesFile, &stack); err != nil {
+			exitUsage("%v", err)
+		}
+	}
+
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "namespace":
+			stack.Namespace = *namespace
+		case "deployment-name":
+			stack.DeploymentName = *deploymentName
+		case "service-name":
+			stack.ServiceName = *serviceName
+		case "image":
+			stack.Image = *image
+		case "replicas":
+			if *replicas >= 0 {
+				r := int32(*replicas)
+				stack.Replicas = &r
+			}
+		case "port":
+			stack.Port = int32(*port)
+		case "node-port":
+			stack.NodePort = int32(*nodePort)
+		}
+	})
+
+	if err := stack.validate(); err != nil {
+		exitUsage("%v", err)
+	}
+
+	// validate 只检查本地构造的对象，不需要连接集群
+	if *operate == "validate" {
+		exitOnError(validate())
+		return
+	}
+
 	config, err := clientcmd.BuildConfigFromFlags("", *kubeconfig)
 	if err != nil {
-		panic(err.Error())
+		exitOnError(err)
 	}
 
 	clientset, err := kubernetes.NewForConfig(config)
 
 	if err != nil {
-		panic(err.Error())
+		exitOnError(err)
 	}
 
 	fmt.Printf("operate is %v\n", *operate)
 
 	if "clean" == *operate {
-		clean(clientset)
+		propagationPolicy, err := parsePropagationPolicy(*propagation)
+		if err != nil {
+			exitUsage("%v", err)
+		}
+
+		err = clean(clientset, cleanOptions{
+			propagation: propagationPolicy,
+			gracePeriod: *gracePeriod,
+			wait:        *waitClean,
+			timeout:     *timeout,
+		})
+		if err != nil {
+			exitOnError(err)
+		}
 	} else {
-		createNamespace(clientset)
-		createDeployment(clientset)
-		createService(clientset)
+		if err := create(clientset); err != nil {
+			exitOnError(err)
+		}
+	}
+}
+
+// create 依次创建命名空间、Deployment 和 Service，遇到第一个错误就返回
+func create(clientset kubernetes.Interface) error {
+	if err := createNamespace(clientset); err != nil {
+		return err
+	}
+
+	if err := createDeployment(clientset); err != nil {
+		return err
 	}
+
+	return createService(clientset)
 }
 
-func clean(clientset *kubernetes.Clientset) {
-	emptyDeleteOptions := metav1.DeleteOptions{}
+// cleanOptions 保存 clean 操作的命令行参数，gracePeriod 小于 0 表示使用对象自身的默认值
+type cleanOptions struct {
+	propagation metav1.DeletionPropagation
+	gracePeriod int64
+	wait        bool
+	timeout     time.Duration
+}
 
-	if err := clientset.CoreV1().Services(NAMESPACE).Delete(context.TODO(), SERVICE_NAME, emptyDeleteOptions); err != nil {
-		panic(err.Error())
+func parsePropagationPolicy(policy string) (metav1.DeletionPropagation, error) {
+	switch strings.ToLower(policy) {
+	case "foreground":
+		return metav1.DeletePropagationForeground, nil
+	case "background":
+		return metav1.DeletePropagationBackground, nil
+	case "orphan":
+		return metav1.DeletePropagationOrphan, nil
 	}
 
-	if err := clientset.AppsV1().Deployments(NAMESPACE).Delete(context.TODO(), DEPLOYMENT_NAME, emptyDeleteOptions); err != nil {
-		panic(err.Error())
+	return "", fmt.Errorf("unknown propagation policy %q, must be foreground, background or orphan", policy)
+}
+
+// clean 删除 Service、Deployment 和命名空间，对象不存在时跳过，其他错误直接返回
+func clean(clientset kubernetes.Interface, options cleanOptions) error {
+	deleteOptions := metav1.DeleteOptions{PropagationPolicy: &options.propagation}
+	if options.gracePeriod >= 0 {
+		deleteOptions.GracePeriodSeconds = &options.gracePeriod
 	}
 
-	if err := clientset.CoreV1().Namespaces().Delete(context.TODO(), NAMESPACE, emptyDeleteOptions); err != nil {
-		panic(err.Error())
+	err := clientset.CoreV1().Services(stack.Namespace).Delete(context.TODO(), stack.ServiceName, deleteOptions)
+	if err := reportDelete("service", stack.ServiceName, err); err != nil {
+		return err
 	}
+
+	var podSelector labels.Selector
+	if deployment, err := clientset.AppsV1().Deployments(stack.Namespace).Get(context.TODO(), stack.DeploymentName, metav1.GetOptions{}); err == nil {
+		if podSelector, err = metav1.LabelSelectorAsSelector(deployment.Spec.Selector); err != nil {
+			return err
+		}
+	}
+
+	err = clientset.AppsV1().Deployments(stack.Namespace).Delete(context.TODO(), stack.DeploymentName, deleteOptions)
+	if err := reportDelete("deployment", stack.DeploymentName, err); err != nil {
+		return err
+	}
+
+	// Orphan 策略会保留 Pod，这时不需要等待
+	if options.wait && podSelector != nil && options.propagation != metav1.DeletePropagationOrphan {
+		err = wait.PollUntilContextTimeout(context.TODO(), time.Second, options.timeout, true, func(ctx context.Context) (bool, error) {
+			pods, err := clientset.CoreV1().Pods(stack.Namespace).List(ctx, metav1.ListOptions{LabelSelector: podSelector.String()})
+			if err != nil {
+				return false, err
+			}
+
+			if len(pods.Items) > 0 {
+				fmt.Printf("Waiting for %d pod(s) of deployment %s to terminate\n", len(pods.Items), stack.DeploymentName)
+				return false, nil
+			}
+
+			return true, nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	err = clientset.CoreV1().Namespaces().Delete(context.TODO(), stack.Namespace, deleteOptions)
+	if err := reportDelete("namespace", stack.Namespace, err); err != nil {
+		return err
+	}
+
+	// Delete 返回时命名空间还处于 Terminating 状态，立即重建同名命名空间会失败
+	if options.wait {
+		err = wait.PollUntilContextTimeout(context.TODO(), time.Second, options.timeout, true, func(ctx context.Context) (bool, error) {
+			ns, err := clientset.CoreV1().Namespaces().Get(ctx, stack.Namespace, metav1.GetOptions{})
+			if apierrors.IsNotFound(err) {
+				return true, nil
+			}
+
+			if err != nil {
+				return false, err
+			}
+
+			fmt.Printf("Waiting for namespace %s to terminate, phase is %s\n", stack.Namespace, ns.Status.Phase)
+			return false, nil
+		})
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("Namespace %s is gone\n", stack.Namespace)
+	}
+
+	return nil
 }
 
-func createNamespace(clientset *kubernetes.Clientset) {
-	namespaceClient := clientset.CoreV1().Namespaces()
+// reportDelete 忽略 NotFound，这样 clean 可以重复执行，其他错误原样返回
+func reportDelete(kind, name string, err error) error {
+	if apierrors.IsNotFound(err) {
+		fmt.Printf("%s %s not found, skip\n", kind, name)
+		return nil
+	}
 
-	namespace := &apiv1.Namespace{
-		ObjectMeta: metav1.ObjectMeta{
-			Name: NAMESPACE,
-		},
+	if err != nil {
+		return err
 	}
 
+	fmt.Printf("Delete %s %s \n", kind, name)
+	return nil
+}
+
+func createNamespace(clientset kubernetes.Interface) error {
+	namespaceClient := clientset.CoreV1().Namespaces()
+
+	namespace := newNamespace()
+
 	result, err := namespaceClient.Create(context.TODO(), namespace, metav1.CreateOptions{})
 
 	if err != nil {
-		panic(err.Error())
+		return err
 	}
 
 	fmt.Printf("Create namespace %s \n", result.GetName())
+	return nil
+}
+
+func createService(clientset kubernetes.Interface) error {
+	serviceClient := clientset.CoreV1().Services(stack.Namespace)
+
+	service := newService()
+
+	result, err := serviceClient.Create(context.TODO(), service, metav1.CreateOptions{})
+
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Create service %s \n", result.GetName())
+	return nil
+}
+
+func createDeployment(clientset kubernetes.Interface) error {
+	deploymentClient := clientset.AppsV1().Deployments(stack.Namespace)
+
+	deployment := newDeployment()
+
+	result, err := deploymentClient.Create(context.TODO(), deployment, metav1.CreateOptions{})
+
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Create deployment %s \n", result.GetName())
+	return nil
 }
 
-func createService(clientset *kubernetes.Clientset) {
-	serviceClient := clientset.CoreV1().Services(NAMESPACE)
+func newNamespace() *apiv1.Namespace {
+	return &apiv1.Namespace{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: stack.Namespace,
+		},
+	}
+}
 
-	service := &apiv1.Service{
+func newService() *apiv1.Service {
+	return &apiv1.Service{
 		ObjectMeta: metav1.ObjectMeta{
-			Name: SERVICE_NAME,
+			Name: stack.ServiceName,
 		},
 		Spec: apiv1.ServiceSpec{
 			Ports: []apiv1.ServicePort{{
 				Name:     "http",
-				Port:     8080,
-				NodePort: 30080,
+				Port:     stack.Port,
+				NodePort: stack.NodePort,
 			},
 			},
 			Selector: map[string]string{
@@ -106,25 +322,15 @@ func createService(clientset *kubernetes.Clientset) {
 			Type: apiv1.ServiceTypeNodePort,
 		},
 	}
-
-	result, err := serviceClient.Create(context.TODO(), service, metav1.CreateOptions{})
-
-	if err != nil {
-		panic(err.Error())
-	}
-
-	fmt.Printf("Create service %s \n", result.GetName())
-
 }
 
-func createDeployment(clientset *kubernetes.Clientset) {
-	deploymentClient := clientset.AppsV1().Deployments(NAMESPACE)
-
-	deployment := &appsv1.Deployment{
+func newDeployment() *appsv1.Deployment {
+	return &appsv1.Deployment{
 		ObjectMeta: metav1.ObjectMeta{
-			Name: DEPLOYMENT_NAME,
+			Name: stack.DeploymentName,
 		},
 		Spec: appsv1.DeploymentSpec{
+			Replicas: stack.Replicas,
 			Selector: &metav1.LabelSelector{
 				MatchLabels: map[string]string{
 					"app": "tomcat",
@@ -140,13 +346,13 @@ func createDeployment(clientset *kubernetes.Clientset) {
 					Containers: []apiv1.Container{
 						{
 							Name:            "tomcat",
-							Image:           "tomcat:8.0.18-jre8",
+							Image:           stack.Image,
 							ImagePullPolicy: "IfNotPresent",
 							Ports: []apiv1.ContainerPort{
 								{
 									Name:          "http",
 									Protocol:      apiv1.ProtocolSCTP,
-									ContainerPort: 8080,
+									ContainerPort: stack.Port,
 								},
 							},
 						},
@@ -155,12 +361,4 @@ func createDeployment(clientset *kubernetes.Clientset) {
 			},
 		},
 	}
-
-	result, err := deploymentClient.Create(context.TODO(), deployment, metav1.CreateOptions{})
-
-	if err != nil {
-		panic(err.Error())
-	}
-
-	fmt.Printf("Create deployment %s \n", result.GetName())
 }
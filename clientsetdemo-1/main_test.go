@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	apiv1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+// failOn 返回一个 reactor，对 resource 的 verb 请求返回 err，其他请求交给默认的 object tracker 处理
+func failOn(verb, resource string, err error) (string, string, k8stesting.ReactionFunc) {
+	return verb, resource, func(action k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, err
+	}
+}
+
+func TestCreate(t *testing.T) {
+	tests := []struct {
+		name     string
+		existing []runtime.Object
+		verb     string
+		resource string
+		err      error
+		// wantErr 判断 create 返回的错误，为 nil 表示期望成功
+		wantErr func(error) bool
+		// wantDeployments 和 wantServices 是 create 之后应该存在的对象数量
+		wantDeployments int
+		wantServices    int
+	}{
+		{
+			name:            "creates the whole stack",
+			wantDeployments: 1,
+			wantServices:    1,
+		},
+		{
+			name:     "namespace already exists",
+			existing: []runtime.Object{&apiv1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: NAMESPACE}}},
+			wantErr:  apierrors.IsAlreadyExists,
+		},
+		{
+			name:            "service already exists",
+			verb:            "create",
+			resource:        "services",
+			err:             apierrors.NewAlreadyExists(schema.GroupResource{Resource: "services"}, SERVICE_NAME),
+			wantErr:         apierrors.IsAlreadyExists,
+			wantDeployments: 1,
+		},
+		{
+			name:     "deployment create conflicts",
+			verb:     "create",
+			resource: "deployments",
+			err:      apierrors.NewConflict(schema.GroupResource{Group: "apps", Resource: "deployments"}, DEPLOYMENT_NAME, nil),
+			wantErr:  apierrors.IsConflict,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clientset := fake.NewSimpleClientset(tt.existing...)
+			if tt.err != nil {
+				clientset.PrependReactor(failOn(tt.verb, tt.resource, tt.err))
+			}
+
+			err := create(clientset)
+
+			if tt.wantErr == nil && err != nil {
+				t.Fatalf("create: unexpected error %v", err)
+			}
+
+			if tt.wantErr != nil && !tt.wantErr(err) {
+				t.Fatalf("create: got error %v", err)
+			}
+
+			deployments, _ := clientset.AppsV1().Deployments(NAMESPACE).List(context.TODO(), metav1.ListOptions{})
+			if len(deployments.Items) != tt.wantDeployments {
+				t.Errorf("got %d deployment(s), want %d", len(deployments.Items), tt.wantDeployments)
+			}
+
+			services, _ := clientset.CoreV1().Services(NAMESPACE).List(context.TODO(), metav1.ListOptions{})
+			if len(services.Items) != tt.wantServices {
+				t.Errorf("got %d service(s), want %d", len(services.Items), tt.wantServices)
+			}
+		})
+	}
+}
+
+func TestClean(t *testing.T) {
+	options := cleanOptions{propagation: metav1.DeletePropagationBackground, gracePeriod: -1}
+
+	tests := []struct {
+		name string
+		// create 为 true 时先用 create 创建整套对象
+		create   bool
+		verb     string
+		resource string
+		err      error
+		wantErr  func(error) bool
+		// wantNamespace 表示 clean 之后命名空间是否还存在
+		wantNamespace bool
+	}{
+		{
+			name:   "removes the whole stack",
+			create: true,
+		},
+		{
+			name: "nothing to clean",
+		},
+		{
+			name:     "deployment already deleted by someone else",
+			create:   true,
+			verb:     "delete",
+			resource: "deployments",
+			err:      apierrors.NewNotFound(schema.GroupResource{Group: "apps", Resource: "deployments"}, DEPLOYMENT_NAME),
+		},
+		{
+			name:          "service delete conflicts",
+			create:        true,
+			verb:          "delete",
+			resource:      "services",
+			err:           apierrors.NewConflict(schema.GroupResource{Resource: "services"}, SERVICE_NAME, nil),
+			wantErr:       apierrors.IsConflict,
+			wantNamespace: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clientset := fake.NewSimpleClientset()
+
+			if tt.create {
+				if err := create(clientset); err != nil {
+					t.Fatalf("create: %v", err)
+				}
+			}
+
+			if tt.err != nil {
+				clientset.PrependReactor(failOn(tt.verb, tt.resource, tt.err))
+			}
+
+			err := clean(clientset, options)
+
+			if tt.wantErr == nil && err != nil {
+				t.Fatalf("clean: unexpected error %v", err)
+			}
+
+			if tt.wantErr != nil && !tt.wantErr(err) {
+				t.Fatalf("clean: got error %v", err)
+			}
+
+			_, err = clientset.CoreV1().Namespaces().Get(context.TODO(), NAMESPACE, metav1.GetOptions{})
+			if exists := err == nil; exists != tt.wantNamespace {
+				t.Errorf("namespace exists = %v, want %v", exists, tt.wantNamespace)
+			}
+		})
+	}
+}
+
+func TestCleanDeleteOptions(t *testing.T) {
+	clientset := fake.NewSimpleClientset()
+	if err := create(clientset); err != nil {
+		t.Fatalf("create: %v", err)
+	}
+
+	if err := clean(clientset, cleanOptions{propagation: metav1.DeletePropagationForeground, gracePeriod: 0}); err != nil {
+		t.Fatalf("clean: %v", err)
+	}
+
+	for _, action := range clientset.Actions() {
+		deleteAction, ok := action.(k8stesting.DeleteAction)
+		if !ok {
+			continue
+		}
+
+		options := deleteAction.GetDeleteOptions()
+		if options.PropagationPolicy == nil || *options.PropagationPolicy != metav1.DeletePropagationForeground {
+			t.Errorf("delete %s: propagation policy %v, want Foreground", deleteAction.GetResource().Resource, options.PropagationPolicy)
+		}
+
+		if options.GracePeriodSeconds == nil || *options.GracePeriodSeconds != 0 {
+			t.Errorf("delete %s: grace period %v, want 0", deleteAction.GetResource().Resource, options.GracePeriodSeconds)
+		}
+	}
+}
+
+func TestValidateStack(t *testing.T) {
+	tests := []struct {
+		name string
+		// protocol 是 Deployment 容器端口的协议
+		protocol     apiv1.Protocol
+		templateApp  string
+		wantErrors   int
+		wantWarnings int
+	}{
+		{name: "consistent stack", protocol: apiv1.ProtocolTCP, templateApp: "tomcat"},
+		{name: "SCTP container port behind a TCP service", protocol: apiv1.ProtocolSCTP, templateApp: "tomcat", wantErrors: 1},
+		{name: "selector does not match the template", protocol: apiv1.ProtocolTCP, templateApp: "tomcat8", wantErrors: 1, wantWarnings: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			deployment := newDeployment()
+			deployment.Spec.Template.Spec.Containers[0].Ports[0].Protocol = tt.protocol
+			deployment.Spec.Template.Labels["app"] = tt.templateApp
+
+			errors, warnings := 0, 0
+			for _, f := range validateStack(newNamespace(), deployment, newService()) {
+				if f.warning {
+					warnings++
+				} else {
+					errors++
+				}
+			}
+
+			if errors != tt.wantErrors || warnings != tt.wantWarnings {
+				t.Errorf("got %d error(s) and %d warning(s), want %d and %d", errors, warnings, tt.wantErrors, tt.wantWarnings)
+			}
+		})
+	}
+}
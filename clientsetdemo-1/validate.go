@@ -0,0 +1,290 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+
+	appsv1 "k8s.io/api/apps/v1"
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+)
+
+// finding 是 validate 发现的一个问题，warning 表示 API Server 不会拒绝但多半是写错了
+type finding struct {
+	warning bool
+	object  string
+	err     *field.Error
+}
+
+func (f finding) String() string {
+	severity := "error"
+	if f.warning {
+		severity = "warning"
+	}
+
+	return fmt.Sprintf("%-7s %s: %s", severity, f.object, f.err.Error())
+}
+
+// validateStack 在本地检查 create 将要创建的三个对象，不访问 API Server：
+// 名字和标签格式、selector 与 Pod 模板标签、重复的端口、NodePort 范围，
+// 以及 Service 的 targetPort 能否找到名字和协议都一致的容器端口
+func validateStack(namespace *apiv1.Namespace, deployment *appsv1.Deployment, service *apiv1.Service) []finding {
+	var findings []finding
+
+	report := func(object string, warning bool, errs ...*field.Error) {
+		for _, err := range errs {
+			findings = append(findings, finding{warning: warning, object: object, err: err})
+		}
+	}
+
+	namespaceObject := "Namespace " + namespace.Name
+	deploymentObject := "Deployment " + stack.Namespace + "/" + deployment.Name
+	serviceObject := "Service " + stack.Namespace + "/" + service.Name
+
+	report(namespaceObject, false, validateName(namespace.Name, validation.IsDNS1123Label)...)
+	report(namespaceObject, false, validateLabels(namespace.Labels, field.NewPath("metadata", "labels"))...)
+	report(deploymentObject, false, validateName(deployment.Name, validation.IsDNS1123Subdomain)...)
+	report(deploymentObject, false, validateLabels(deployment.Labels, field.NewPath("metadata", "labels"))...)
+	report(deploymentObject, false, validateDeployment(deployment)...)
+	report(serviceObject, false, validateName(service.Name, validation.IsDNS1035Label)...)
+	report(serviceObject, false, validateLabels(service.Labels, field.NewPath("metadata", "labels"))...)
+	report(serviceObject, false, validateServicePorts(service)...)
+
+	warnings, errs := validateServiceTargets(service, deployment)
+	report(serviceObject, false, errs...)
+	report(serviceObject, true, warnings...)
+
+	return findings
+}
+
+func validateName(name string, rule func(string) []string) field.ErrorList {
+	var errs field.ErrorList
+
+	for _, message := range rule(name) {
+		errs = append(errs, field.Invalid(field.NewPath("metadata", "name"), name, message))
+	}
+
+	return errs
+}
+
+func validateLabels(objectLabels map[string]string, path *field.Path) field.ErrorList {
+	var errs field.ErrorList
+
+	keys := make([]string, 0, len(objectLabels))
+	for key := range objectLabels {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		for _, message := range validation.IsQualifiedName(key) {
+			errs = append(errs, field.Invalid(path, key, message))
+		}
+
+		for _, message := range validation.IsValidLabelValue(objectLabels[key]) {
+			errs = append(errs, field.Invalid(path.Key(key), objectLabels[key], message))
+		}
+	}
+
+	return errs
+}
+
+// validateDeployment 检查 selector 能否选中 Pod 模板，以及容器名和容器端口是否合法、是否重复
+func validateDeployment(deployment *appsv1.Deployment) field.ErrorList {
+	var errs field.ErrorList
+	templatePath := field.NewPath("spec", "template")
+	template := deployment.Spec.Template
+
+	errs = append(errs, validateLabels(template.Labels, templatePath.Child("metadata", "labels"))...)
+
+	if deployment.Spec.Selector == nil {
+		errs = append(errs, field.Required(field.NewPath("spec", "selector"), ""))
+	} else if selector, err := metav1.LabelSelectorAsSelector(deployment.Spec.Selector); err != nil {
+		errs = append(errs, field.Invalid(field.NewPath("spec", "selector"), deployment.Spec.Selector, err.Error()))
+	} else if selector.Empty() {
+		errs = append(errs, field.Invalid(field.NewPath("spec", "selector"), deployment.Spec.Selector, "empty selector is invalid for deployment"))
+	} else if !selector.Matches(labels.Set(template.Labels)) {
+		errs = append(errs, field.Invalid(templatePath.Child("metadata", "labels"), template.Labels, "`selector` does not match template `labels`"))
+	}
+
+	names := map[string]bool{}
+	// 端口号和端口名在整个 Pod 内唯一
+	portNames := map[string]bool{}
+	ports := map[string]bool{}
+
+	for i, container := range template.Spec.Containers {
+		containerPath := templatePath.Child("spec", "containers").Index(i)
+
+		for _, message := range validation.IsDNS1123Label(container.Name) {
+			errs = append(errs, field.Invalid(containerPath.Child("name"), container.Name, message))
+		}
+
+		if names[container.Name] {
+			errs = append(errs, field.Duplicate(containerPath.Child("name"), container.Name))
+		}
+		names[container.Name] = true
+
+		for j, port := range container.Ports {
+			portPath := containerPath.Child("ports").Index(j)
+
+			if port.Name != "" {
+				for _, message := range validation.IsValidPortName(port.Name) {
+					errs = append(errs, field.Invalid(portPath.Child("name"), port.Name, message))
+				}
+
+				if portNames[port.Name] {
+					errs = append(errs, field.Duplicate(portPath.Child("name"), port.Name))
+				}
+				portNames[port.Name] = true
+			}
+
+			for _, message := range validation.IsValidPortNum(int(port.ContainerPort)) {
+				errs = append(errs, field.Invalid(portPath.Child("containerPort"), port.ContainerPort, message))
+			}
+
+			key := fmt.Sprintf("%d/%s", port.ContainerPort, protocolOf(port.Protocol))
+			if ports[key] {
+				errs = append(errs, field.Duplicate(portPath, key))
+			}
+			ports[key] = true
+		}
+	}
+
+	return errs
+}
+
+// validateServicePorts 检查 Service 的端口名、端口号、重复端口和 NodePort 范围
+func validateServicePorts(service *apiv1.Service) field.ErrorList {
+	var errs field.ErrorList
+	names := map[string]bool{}
+	ports := map[string]bool{}
+	exposesNodePort := service.Spec.Type == apiv1.ServiceTypeNodePort || service.Spec.Type == apiv1.ServiceTypeLoadBalancer
+
+	for i, port := range service.Spec.Ports {
+		portPath := field.NewPath("spec", "ports").Index(i)
+
+		if port.Name == "" && len(service.Spec.Ports) > 1 {
+			errs = append(errs, field.Required(portPath.Child("name"), "required when the service has more than one port"))
+		}
+
+		if port.Name != "" {
+			for _, message := range validation.IsDNS1123Label(port.Name) {
+				errs = append(errs, field.Invalid(portPath.Child("name"), port.Name, message))
+			}
+
+			if names[port.Name] {
+				errs = append(errs, field.Duplicate(portPath.Child("name"), port.Name))
+			}
+			names[port.Name] = true
+		}
+
+		for _, message := range validation.IsValidPortNum(int(port.Port)) {
+			errs = append(errs, field.Invalid(portPath.Child("port"), port.Port, message))
+		}
+
+		key := fmt.Sprintf("%d/%s", port.Port, protocolOf(port.Protocol))
+		if ports[key] {
+			errs = append(errs, field.Duplicate(portPath, key))
+		}
+		ports[key] = true
+
+		if port.NodePort == 0 {
+			continue
+		}
+
+		if !exposesNodePort {
+			errs = append(errs, field.Forbidden(portPath.Child("nodePort"), fmt.Sprintf("may not be used when `type` is '%s'", service.Spec.Type)))
+		} else if port.NodePort < NODE_PORT_MIN || port.NodePort > NODE_PORT_MAX {
+			errs = append(errs, field.Invalid(portPath.Child("nodePort"), port.NodePort, fmt.Sprintf("must be in the range %d-%d", NODE_PORT_MIN, NODE_PORT_MAX)))
+		}
+	}
+
+	return errs
+}
+
+// validateServiceTargets 检查 Service 的每个端口能否转发到 Deployment 的容器端口，返回警告和错误。
+// 名字形式的 targetPort 找不到、或者协议与 Service 端口不同是错误；数字 targetPort 没有在容器中声明只是警告。
+func validateServiceTargets(service *apiv1.Service, deployment *appsv1.Deployment) (field.ErrorList, field.ErrorList) {
+	var warnings, errs field.ErrorList
+
+	if len(service.Spec.Selector) == 0 {
+		return nil, nil
+	}
+
+	if !labels.SelectorFromSet(service.Spec.Selector).Matches(labels.Set(deployment.Spec.Template.Labels)) {
+		warnings = append(warnings, field.NotFound(field.NewPath("spec", "selector"), service.Spec.Selector))
+		return warnings, nil
+	}
+
+	for i, port := range service.Spec.Ports {
+		targetPath := field.NewPath("spec", "ports").Index(i).Child("targetPort")
+		protocol := protocolOf(port.Protocol)
+
+		// 没有写 targetPort 时使用 port
+		target := port.TargetPort
+		if target.Type == intstr.Int && target.IntVal == 0 {
+			target = intstr.FromInt32(port.Port)
+		}
+
+		containerPort, found := findContainerPort(&deployment.Spec.Template, target)
+
+		switch {
+		case !found && target.Type == intstr.String:
+			errs = append(errs, field.NotFound(targetPath, fmt.Sprintf("%s (no container port with this name)", target.String())))
+		case !found:
+			warnings = append(warnings, field.NotFound(targetPath, fmt.Sprintf("%s (not declared by any container)", target.String())))
+		case protocolOf(containerPort.Protocol) != protocol:
+			errs = append(errs, field.Invalid(targetPath, target.String(),
+				fmt.Sprintf("service port protocol is %s but container port %s (%d) uses %s", protocol, containerPort.Name, containerPort.ContainerPort, protocolOf(containerPort.Protocol))))
+		}
+	}
+
+	return warnings, errs
+}
+
+func findContainerPort(template *apiv1.PodTemplateSpec, target intstr.IntOrString) (apiv1.ContainerPort, bool) {
+	for _, container := range template.Spec.Containers {
+		for _, port := range container.Ports {
+			if (target.Type == intstr.String && port.Name == target.StrVal) || (target.Type == intstr.Int && port.ContainerPort == target.IntVal) {
+				return port, true
+			}
+		}
+	}
+
+	return apiv1.ContainerPort{}, false
+}
+
+// protocolOf 返回端口协议，没有写时默认是 TCP
+func protocolOf(protocol apiv1.Protocol) apiv1.Protocol {
+	if protocol == "" {
+		return apiv1.ProtocolTCP
+	}
+
+	return protocol
+}
+
+// validate 输出 validateStack 发现的问题，有错误时返回 invalidError
+func validate() error {
+	findings := validateStack(newNamespace(), newDeployment(), newService())
+	errorCount := 0
+
+	for _, f := range findings {
+		fmt.Println(f.String())
+
+		if !f.warning {
+			errorCount++
+		}
+	}
+
+	fmt.Printf("Validated 3 object(s): %d error(s), %d warning(s)\n", errorCount, len(findings)-errorCount)
+
+	if errorCount > 0 {
+		return &invalidError{message: fmt.Sprintf("%d object validation error(s)", errorCount)}
+	}
+
+	return nil
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/util/validation"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	DEFAULT_IMAGE     = "tomcat:8.0.18-jre8"
+	DEFAULT_PORT      = 8080
+	DEFAULT_NODE_PORT = 30080
+
+	// kube-apiserver --service-node-port-range 的默认范围
+	NODE_PORT_MIN = 30000
+	NODE_PORT_MAX = 32767
+)
+
+// stackValues 是 create 和 clean 使用的名字、镜像、副本数和端口，可以来自 -values 文件，命令行参数优先
+type stackValues struct {
+	Namespace      string `json:"namespace"`
+	DeploymentName string `json:"deploymentName"`
+	ServiceName    string `json:"serviceName"`
+	Image          string `json:"image"`
+	// Replicas 为 nil 时不设置 spec.replicas，由 API Server 使用默认值 1
+	Replicas *int32 `json:"replicas,omitempty"`
+	Port     int32  `json:"port"`
+	// NodePort 为 0 表示由 API Server 自动分配
+	NodePort int32 `json:"nodePort"`
+}
+
+var stack = defaultStackValues()
+
+func defaultStackValues() stackValues {
+	return stackValues{
+		Namespace:      NAMESPACE,
+		DeploymentName: DEPLOYMENT_NAME,
+		ServiceName:    SERVICE_NAME,
+		Image:          DEFAULT_IMAGE,
+		Port:           DEFAULT_PORT,
+		NodePort:       DEFAULT_NODE_PORT,
+	}
+}
+
+// loadValuesFile 用 YAML 文件覆盖 values 中的字段，未知字段视为错误
+func loadValuesFile(path string, values *stackValues) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	if err := yaml.UnmarshalStrict(data, values); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+
+	return nil
+}
+
+// validate 按 API Server 的规则检查名字和端口，一次返回全部问题
+func (v stackValues) validate() error {
+	var problems []string
+
+	check := func(field string, messages []string) {
+		for _, message := range messages {
+			problems = append(problems, field+": "+message)
+		}
+	}
+
+	check(fmt.Sprintf("namespace %q", v.Namespace), validation.IsDNS1123Label(v.Namespace))
+	check(fmt.Sprintf("deploymentName %q", v.DeploymentName), validation.IsDNS1123Subdomain(v.DeploymentName))
+	check(fmt.Sprintf("serviceName %q", v.ServiceName), validation.IsDNS1035Label(v.ServiceName))
+
+	if strings.TrimSpace(v.Image) == "" {
+		problems = append(problems, "image: must not be empty")
+	}
+
+	if v.Replicas != nil && *v.Replicas < 0 {
+		problems = append(problems, fmt.Sprintf("replicas %d: must be greater than or equal to 0", *v.Replicas))
+	}
+
+	check(fmt.Sprintf("port %d", v.Port), validation.IsValidPortNum(int(v.Port)))
+
+	if v.NodePort != 0 && (v.NodePort < NODE_PORT_MIN || v.NodePort > NODE_PORT_MAX) {
+		problems = append(problems, fmt.Sprintf("nodePort %d: must be 0 (allocated by the API server) or in the range %d-%d", v.NodePort, NODE_PORT_MIN, NODE_PORT_MAX))
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid values: %s", strings.Join(problems, "; "))
+	}
+
+	return nil
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/utils/pointer"
+)
+
+// FIELD_MANAGER 是 server-side apply 时使用的字段管理者名称。
+// 名称必须固定，API Server 才会把多次运行视为同一个管理者，重复执行时收敛为同一份期望状态，而不是产生字段冲突。
+const FIELD_MANAGER = "clientsetdemo"
+
+// applyPatchOptions 返回 server-side apply 使用的 PatchOptions。
+// Force 为 true 表示当字段被其他管理者（例如 kubectl edit）修改过时，以本程序的期望状态为准，把字段的所有权抢回来。
+func applyPatchOptions() metav1.PatchOptions {
+	return metav1.PatchOptions{
+		FieldManager: FIELD_MANAGER,
+		Force:        pointer.BoolPtr(true),
+		DryRun:       dryRun,
+	}
+}
+
+// applyBody 把对象序列化为 server-side apply 的请求体。
+// apply 的请求体必须带上 apiVersion 和 kind，stackObjects 返回的对象都已经设置好了 GroupVersionKind。
+func applyBody(obj runtime.Object) ([]byte, error) {
+	return json.Marshal(obj)
+}
+
+// existingObject 处理 Get 的返回值，对象不存在时返回 nil，其他错误原样返回
+func existingObject[T runtime.Object](obj T, err error) (runtime.Object, error) {
+	if apierrors.IsNotFound(err) {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return obj, nil
+}
+
+// qualifiedKind 返回 kubectl 输出中使用的类型名，例如 namespace、deployment.apps、ingress.networking.k8s.io
+func qualifiedKind(obj runtime.Object) string {
+	gvk := obj.GetObjectKind().GroupVersionKind()
+
+	if gvk.Group == "" {
+		return strings.ToLower(gvk.Kind)
+	}
+
+	return strings.ToLower(gvk.Kind) + "." + gvk.Group
+}
+
+// resourceClient 返回操作 obj 的 dynamic client 和对象的名字，资源名由 kind 推断，与 createChecks 相同
+func resourceClient(dynamicClient dynamic.Interface, obj runtime.Object) (dynamic.ResourceInterface, string, error) {
+	accessor, err := meta.Accessor(obj)
+
+	if err != nil {
+		return nil, "", err
+	}
+
+	gvr, _ := meta.UnsafeGuessKindToResource(obj.GetObjectKind().GroupVersionKind())
+
+	if accessor.GetNamespace() == "" {
+		return dynamicClient.Resource(gvr), accessor.GetName(), nil
+	}
+
+	return dynamicClient.Resource(gvr).Namespace(accessor.GetNamespace()), accessor.GetName(), nil
+}
+
+// printApplyResult 按照 kubectl apply 的格式输出一次 apply 的结果，live 是 apply 之前的对象，不存在时为 nil。
+// 比较 apply 前后的 resourceVersion 是否变化，就能像 kubectl apply 一样区分 created / configured / unchanged。
+// dry run 时 API Server 不会写入 etcd，resourceVersion 也就不会变化，因此改为比较去掉噪音字段之后的对象内容。
+func printApplyResult(out io.Writer, kind string, live runtime.Object, result runtime.Object) error {
+	accessor, err := meta.Accessor(result)
+
+	if err != nil {
+		return err
+	}
+
+	status := "configured"
+
+	if live == nil {
+		status = "created"
+	} else if len(dryRun) > 0 {
+		liveYAML, err := normalizeForDiff(live)
+
+		if err != nil {
+			return err
+		}
+
+		resultYAML, err := normalizeForDiff(result)
+
+		if err != nil {
+			return err
+		}
+
+		if liveYAML == resultYAML {
+			status = "unchanged"
+		}
+	} else if liveAccessor, err := meta.Accessor(live); err == nil && liveAccessor.GetResourceVersion() == accessor.GetResourceVersion() {
+		status = "unchanged"
+	}
+
+	fmt.Fprintf(out, "%s/%s %s%s\n", kind, accessor.GetName(), status, dryRunSuffix())
+	return nil
+}
+
+// applyStack 使用 server-side apply 按 createStack 的顺序创建或更新 stackObjects(values) 中的全部对象，重复执行不会因为 AlreadyExists 而失败。
+// 除了命名空间、工作负载和 Service，还包括开启了的 ConfigMap、Secret、Provision 和其他配套对象，
+// Pod 引用的 ConfigMap、Secret 和 ServiceAccount 因此总是与 Deployment 一起存在
+func applyStack(out io.Writer, dynamicClient dynamic.Interface, values stackValues) error {
+	for _, obj := range stackObjects(values) {
+		if err := applyObject(out, dynamicClient, obj); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// applyObject 使用 server-side apply 创建或更新一个对象并输出结果
+func applyObject(out io.Writer, dynamicClient dynamic.Interface, obj runtime.Object) error {
+	client, name, err := resourceClient(dynamicClient, obj)
+
+	if err != nil {
+		return err
+	}
+
+	live, err := existingObject(client.Get(context.TODO(), name, metav1.GetOptions{}))
+
+	if err != nil {
+		return err
+	}
+
+	data, err := applyBody(obj)
+
+	if err != nil {
+		return err
+	}
+
+	result, err := client.Patch(context.TODO(), name, types.ApplyPatchType, data, applyPatchOptions())
+
+	if err != nil {
+		return fmt.Errorf("apply %s %s: %w", qualifiedKind(obj), name, err)
+	}
+
+	return printApplyResult(out, qualifiedKind(obj), live, result)
+}
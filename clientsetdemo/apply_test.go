@@ -0,0 +1,48 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes/scheme"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func TestApplyStackIncludesCompanions(t *testing.T) {
+	values := defaultStackValues()
+	values.ConfigMap, values.ConfigData = true, map[string]string{"app.properties": "greeting=hello"}
+	values.Secret, values.SecretData = true, map[string]string{"DB_PASSWORD": "secret"}
+	values.Provision = true
+
+	dynamicClient := dynamicfake.NewSimpleDynamicClient(scheme.Scheme)
+
+	// fake 的 object tracker 不能通过 apply 创建对象，这里记下每次 apply 的资源，并把请求体原样作为结果返回
+	var applied []string
+	dynamicClient.PrependReactor("patch", "*", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		patch := action.(k8stesting.PatchAction)
+		applied = append(applied, patch.GetResource().Resource)
+
+		obj := &unstructured.Unstructured{}
+		return true, obj, json.Unmarshal(patch.GetPatch(), &obj.Object)
+	})
+
+	if err := applyStack(io.Discard, dynamicClient, values); err != nil {
+		t.Fatalf("applyStack: %v", err)
+	}
+
+	got := map[string]bool{}
+	for _, resource := range applied {
+		got[resource] = true
+	}
+
+	// Deployment 的 Pod 引用了 ConfigMap、Secret 和 ServiceAccount，它们必须一起 apply
+	for _, resource := range []string{"namespaces", "configmaps", "secrets", "serviceaccounts", "deployments", "services"} {
+		if !got[resource] {
+			t.Errorf("apply did not include %s, applied %v", resource, applied)
+		}
+	}
+}
@@ -0,0 +1,408 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+	"sigs.k8s.io/yaml"
+)
+
+/*
+backup 把一个命名空间中的全部对象保存到本地的 tar.gz 文件中，restore 再把它们重新创建出来，可以恢复到另一个命名空间。
+
+与 clean 一样，backup 通过 discovery 找出集群支持的全部命名空间级资源类型，再用 dynamic client 列出每一种资源，
+所以 CRD 定义的对象也会被保存。以下对象不保存：
+  - 由控制器创建、带有 controller ownerReference 的对象（ReplicaSet、Pod、ControllerRevision 等），恢复工作负载后控制器会重新创建它们；
+  - Event、Endpoints 和 EndpointSlice，它们是集群根据其他对象生成的；
+  - 每个命名空间中都会自动创建的 default ServiceAccount、kube-root-ca.crt ConfigMap 和 ServiceAccount token Secret。
+
+归档中每个对象是一个 YAML 文件，路径是 <resource>[.<group>]/<name>.yaml（与 kubectl 的写法相同，例如 deployments.apps/tomcat.yaml），
+命名空间本身保存在 namespaces/<name>.yaml 中，restore 据此得到每个对象的 GroupVersionResource，不需要再做 discovery。
+*/
+
+// skippedResources 是 backup 不保存的资源类型，key 是 resource.group
+var skippedResources = map[string]bool{
+	"events":                          true,
+	"events.events.k8s.io":            true,
+	"endpoints":                       true,
+	"endpointslices.discovery.k8s.io": true,
+	"pods.metrics.k8s.io":             true,
+	"controllerrevisions.apps":        true,
+	"localsubjectaccessreviews.authorization.k8s.io": true,
+}
+
+// archiveDir 返回 gvr 在归档中的目录名，核心组的资源没有 .group 后缀
+func archiveDir(gvr schema.GroupVersionResource) string {
+	if gvr.Group == "" {
+		return gvr.Resource
+	}
+
+	return gvr.Resource + "." + gvr.Group
+}
+
+// isGenerated 判断对象是否由集群自动生成，不需要保存
+func isGenerated(obj *unstructured.Unstructured) bool {
+	if metav1.GetControllerOf(obj) != nil {
+		return true
+	}
+
+	switch obj.GetKind() {
+	case "ServiceAccount":
+		return obj.GetName() == "default"
+	case "ConfigMap":
+		return obj.GetName() == "kube-root-ca.crt"
+	case "Secret":
+		secretType, _, _ := unstructured.NestedString(obj.Object, "type")
+		return secretType == "kubernetes.io/service-account-token"
+	}
+
+	return false
+}
+
+// stripServerFields 删除由 API Server 或控制器填充的字段，剩下的内容可以直接用来创建对象
+func stripServerFields(obj *unstructured.Unstructured) {
+	for _, field := range []string{"uid", "resourceVersion", "managedFields", "creationTimestamp", "generation", "selfLink", "ownerReferences", "deletionTimestamp", "deletionGracePeriodSeconds"} {
+		unstructured.RemoveNestedField(obj.Object, "metadata", field)
+	}
+
+	unstructured.RemoveNestedField(obj.Object, "status")
+
+	switch obj.GetKind() {
+	case "Namespace":
+		// spec.finalizers 由 API Server 填充
+		unstructured.RemoveNestedField(obj.Object, "spec")
+	case "Service":
+		unstructured.RemoveNestedField(obj.Object, "spec", "clusterIP")
+		unstructured.RemoveNestedField(obj.Object, "spec", "clusterIPs")
+	case "PersistentVolumeClaim":
+		// 绑定的 PV 属于原来的 PVC，恢复后的 PVC 重新申请存储
+		unstructured.RemoveNestedField(obj.Object, "spec", "volumeName")
+
+		annotations := obj.GetAnnotations()
+		for key := range annotations {
+			if strings.HasPrefix(key, "pv.kubernetes.io/") || strings.HasPrefix(key, "volume.beta.kubernetes.io/") || strings.HasPrefix(key, "volume.kubernetes.io/") {
+				delete(annotations, key)
+			}
+		}
+		obj.SetAnnotations(annotations)
+	case "Job":
+		// Job 的 selector 和 Pod 模板中的 controller-uid 标签是 API Server 按 Job 的 uid 生成的，带着它们创建会被拒绝
+		unstructured.RemoveNestedField(obj.Object, "spec", "selector")
+
+		for _, label := range []string{"controller-uid", "batch.kubernetes.io/controller-uid", "job-name", "batch.kubernetes.io/job-name"} {
+			unstructured.RemoveNestedField(obj.Object, "spec", "template", "metadata", "labels", label)
+		}
+	}
+}
+
+// backupNamespace 把 namespace 中的对象写到 archive 指定的 tar.gz 文件
+func backupNamespace(clientset kubernetes.Interface, dynamicClient dynamic.Interface, namespace, archive string) error {
+	ns, err := dynamicClient.Resource(schema.GroupVersionResource{Version: "v1", Resource: "namespaces"}).Get(context.TODO(), namespace, metav1.GetOptions{})
+
+	if err != nil {
+		return err
+	}
+
+	resourceLists, err := discovery.ServerPreferredNamespacedResources(clientset.Discovery())
+
+	if err != nil && !discovery.IsGroupDiscoveryFailedError(err) {
+		return err
+	}
+
+	file, err := os.Create(archive)
+
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	gzipWriter := gzip.NewWriter(file)
+	tarWriter := tar.NewWriter(gzipWriter)
+
+	stripServerFields(ns)
+	if err := writeArchiveObject(tarWriter, "namespaces", ns); err != nil {
+		return err
+	}
+
+	count := 0
+
+	for _, resourceList := range resourceLists {
+		gv, err := schema.ParseGroupVersion(resourceList.GroupVersion)
+
+		if err != nil {
+			return err
+		}
+
+		for _, resource := range resourceList.APIResources {
+			gvr := gv.WithResource(resource.Name)
+
+			// 只保存恢复时能重新创建的资源
+			if strings.Contains(resource.Name, "/") || !hasVerbs(resource.Verbs, "list", "create") || skippedResources[archiveDir(gvr)] {
+				continue
+			}
+
+			list, err := dynamicClient.Resource(gvr).Namespace(namespace).List(context.TODO(), metav1.ListOptions{})
+
+			if err != nil {
+				return fmt.Errorf("list %s: %w", gvr.String(), err)
+			}
+
+			for i := range list.Items {
+				obj := &list.Items[i]
+
+				if isGenerated(obj) {
+					continue
+				}
+
+				stripServerFields(obj)
+
+				if err := writeArchiveObject(tarWriter, archiveDir(gvr), obj); err != nil {
+					return err
+				}
+
+				fmt.Printf("Back up %s %s\n", strings.ToLower(obj.GetKind()), obj.GetName())
+				count++
+			}
+		}
+	}
+
+	if err := tarWriter.Close(); err != nil {
+		return err
+	}
+
+	if err := gzipWriter.Close(); err != nil {
+		return err
+	}
+
+	fmt.Printf("Backed up namespace %s with %d object(s) to %s\n", namespace, count, archive)
+	return file.Close()
+}
+
+// writeArchiveObject 把对象以 YAML 格式写成归档中的 dir/<name>.yaml
+func writeArchiveObject(tarWriter *tar.Writer, dir string, obj *unstructured.Unstructured) error {
+	data, err := yaml.Marshal(obj.Object)
+
+	if err != nil {
+		return err
+	}
+
+	header := &tar.Header{
+		Name:     path.Join(dir, obj.GetName()+".yaml"),
+		Mode:     0o644,
+		Size:     int64(len(data)),
+		ModTime:  time.Now(),
+		Typeflag: tar.TypeReg,
+	}
+
+	if err := tarWriter.WriteHeader(header); err != nil {
+		return err
+	}
+
+	_, err = tarWriter.Write(data)
+	return err
+}
+
+// archivedObject 是从归档中读出的一个对象
+type archivedObject struct {
+	gvr    schema.GroupVersionResource
+	object *unstructured.Unstructured
+}
+
+// readArchive 读取 backupNamespace 写出的归档，返回命名空间对象和其余的对象
+func readArchive(archive string) (*unstructured.Unstructured, []archivedObject, error) {
+	file, err := os.Open(archive)
+
+	if err != nil {
+		return nil, nil, err
+	}
+	defer file.Close()
+
+	gzipReader, err := gzip.NewReader(file)
+
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: %w", archive, err)
+	}
+
+	tarReader := tar.NewReader(gzipReader)
+
+	var namespace *unstructured.Unstructured
+	var objects []archivedObject
+
+	for {
+		header, err := tarReader.Next()
+
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s: %w", archive, err)
+		}
+
+		if header.Typeflag != tar.TypeReg || path.Ext(header.Name) != ".yaml" {
+			continue
+		}
+
+		data, err := io.ReadAll(tarReader)
+
+		if err != nil {
+			return nil, nil, err
+		}
+
+		obj := &unstructured.Unstructured{}
+		if err := yaml.Unmarshal(data, &obj.Object); err != nil {
+			return nil, nil, fmt.Errorf("%s: %s: %w", archive, header.Name, err)
+		}
+
+		// 目录名是 resource.group，版本来自对象自己的 apiVersion
+		resource, group, _ := strings.Cut(path.Dir(header.Name), ".")
+		gvr := schema.GroupVersionResource{Group: group, Version: obj.GroupVersionKind().Version, Resource: resource}
+
+		if gvr.Group == "" && gvr.Resource == "namespaces" {
+			namespace = obj
+			continue
+		}
+
+		objects = append(objects, archivedObject{gvr: gvr, object: obj})
+	}
+
+	if namespace == nil {
+		return nil, nil, fmt.Errorf("%s: no namespace found, not an archive written by backup", archive)
+	}
+
+	return namespace, objects, nil
+}
+
+// restoreNamespace 按依赖顺序重新创建归档中的对象，target 为空时恢复到原来的命名空间，细节见 recreateObjects
+func restoreNamespace(dynamicClient dynamic.Interface, archive, target string) error {
+	namespace, objects, err := readArchive(archive)
+
+	if err != nil {
+		return err
+	}
+
+	if target == "" {
+		target = namespace.GetName()
+	}
+
+	if err := recreateObjects(dynamicClient, namespace, objects, target); err != nil {
+		return err
+	}
+
+	fmt.Printf("Restored %d object(s) from %s into namespace %s\n", len(objects), archive, target)
+	return nil
+}
+
+// recreateObjects 在 target 命名空间中按依赖顺序创建 objects，它们原来属于 namespace 这个命名空间，已经去掉了服务端填充的字段。
+// target 与原命名空间不同时，对象的 namespace 字段、RoleBinding 中指向原命名空间的 subject 都会改写为 target，
+// Service 的 nodePort 也会去掉，由 API Server 重新分配，避免与原命名空间中仍然存在的 Service 冲突。
+// 命名空间不存在时先以 namespace 为模板创建它；对象已经存在时跳过，不会覆盖。
+func recreateObjects(dynamicClient dynamic.Interface, namespace *unstructured.Unstructured, objects []archivedObject, target string) error {
+	source := namespace.GetName()
+	namespace.SetName(target)
+
+	namespaceResource := schema.GroupVersionResource{Version: "v1", Resource: "namespaces"}
+	if err := restoreObject(dynamicClient, namespaceResource, namespace); err != nil {
+		return err
+	}
+
+	// 稳定排序，kindOrder 中没有的类型（例如 Ingress、CRD 定义的对象）排在最后
+	rank := func(kind string) int {
+		if r := kindRank(kind); r >= 0 {
+			return r
+		}
+
+		return len(kindOrder)
+	}
+
+	sort.SliceStable(objects, func(i, j int) bool {
+		return rank(objects[i].object.GetKind()) < rank(objects[j].object.GetKind())
+	})
+
+	for _, o := range objects {
+		o.object.SetNamespace(target)
+
+		if target != source {
+			relocate(o.object, source, target)
+		}
+
+		if err := restoreObject(dynamicClient, o.gvr, o.object); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// relocate 改写对象中与原命名空间相关的字段
+func relocate(obj *unstructured.Unstructured, source, target string) {
+	switch obj.GetKind() {
+	case "RoleBinding":
+		subjects, _, _ := unstructured.NestedSlice(obj.Object, "subjects")
+
+		for _, subject := range subjects {
+			if s, ok := subject.(map[string]interface{}); ok && s["namespace"] == source {
+				s["namespace"] = target
+			}
+		}
+
+		if subjects != nil {
+			_ = unstructured.SetNestedSlice(obj.Object, subjects, "subjects")
+		}
+	case "Service":
+		dropNodePorts(obj)
+	}
+}
+
+// dropNodePorts 删除 Service 每个端口上的 nodePort，创建时由 API Server 重新分配
+func dropNodePorts(obj *unstructured.Unstructured) {
+	ports, _, _ := unstructured.NestedSlice(obj.Object, "spec", "ports")
+
+	for _, port := range ports {
+		if p, ok := port.(map[string]interface{}); ok {
+			delete(p, "nodePort")
+		}
+	}
+
+	if ports != nil {
+		_ = unstructured.SetNestedSlice(obj.Object, ports, "spec", "ports")
+	}
+}
+
+// restoreObject 创建一个对象，已经存在时打印提示并跳过
+func restoreObject(dynamicClient dynamic.Interface, gvr schema.GroupVersionResource, obj *unstructured.Unstructured) error {
+	var resource dynamic.ResourceInterface = dynamicClient.Resource(gvr)
+	if obj.GetNamespace() != "" {
+		resource = dynamicClient.Resource(gvr).Namespace(obj.GetNamespace())
+	}
+
+	kind := strings.ToLower(obj.GetKind())
+	_, err := resource.Create(context.TODO(), obj, createOptions())
+
+	if apierrors.IsAlreadyExists(err) {
+		fmt.Printf("%s %s already exists, skip\n", kind, obj.GetName())
+		return nil
+	}
+
+	if err != nil {
+		return fmt.Errorf("restore %s %s: %w", kind, obj.GetName(), err)
+	}
+
+	fmt.Printf("Restore %s %s%s \n", kind, obj.GetName(), dryRunSuffix())
+	return nil
+}
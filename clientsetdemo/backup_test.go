@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	appsv1 "k8s.io/api/apps/v1"
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/kubernetes/scheme"
+)
+
+var (
+	configMapsResource  = schema.GroupVersionResource{Version: "v1", Resource: "configmaps"}
+	replicaSetsResource = schema.GroupVersionResource{Group: "apps", Version: "v1", Resource: "replicasets"}
+)
+
+func TestBackupRestore(t *testing.T) {
+	clientset := fake.NewSimpleClientset()
+	clientset.Resources = []*metav1.APIResourceList{
+		{
+			GroupVersion: "v1",
+			APIResources: []metav1.APIResource{
+				{Name: "services", Kind: "Service", Namespaced: true, Verbs: metav1.Verbs{"create", "list"}},
+				{Name: "configmaps", Kind: "ConfigMap", Namespaced: true, Verbs: metav1.Verbs{"create", "list"}},
+				{Name: "events", Kind: "Event", Namespaced: true, Verbs: metav1.Verbs{"create", "list"}},
+			},
+		},
+		{
+			GroupVersion: "apps/v1",
+			APIResources: []metav1.APIResource{
+				{Name: "deployments", Kind: "Deployment", Namespaced: true, Verbs: metav1.Verbs{"create", "list"}},
+				{Name: "deployments/scale", Kind: "Scale", Namespaced: true, Verbs: metav1.Verbs{"get", "update"}},
+				{Name: "replicasets", Kind: "ReplicaSet", Namespaced: true, Verbs: metav1.Verbs{"create", "list"}},
+			},
+		},
+	}
+
+	namespace := newNamespace(stack)
+	deployment := newDeployment(stack)
+	deployment.Namespace = NAMESPACE
+	deployment.UID = "deployment-uid"
+	deployment.ResourceVersion = "42"
+	deployment.Status.Replicas = 2
+
+	service := newService(stack)
+	service.Namespace = NAMESPACE
+	service.Spec.ClusterIP = "10.96.0.10"
+	service.Spec.ClusterIPs = []string{"10.96.0.10"}
+
+	replicaSet := &appsv1.ReplicaSet{ObjectMeta: metav1.ObjectMeta{Name: DEPLOYMENT_NAME + "-abc", Namespace: NAMESPACE}}
+	replicaSet.OwnerReferences = []metav1.OwnerReference{*metav1.NewControllerRef(deployment, appsv1.SchemeGroupVersion.WithKind("Deployment"))}
+
+	rootCA := &apiv1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: "kube-root-ca.crt", Namespace: NAMESPACE}}
+	config := &apiv1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: "tomcat-config", Namespace: NAMESPACE}, Data: map[string]string{"key": "value"}}
+	event := &apiv1.Event{ObjectMeta: metav1.ObjectMeta{Name: "event", Namespace: NAMESPACE}}
+
+	source := dynamicfake.NewSimpleDynamicClient(scheme.Scheme, namespace, deployment, service, replicaSet, rootCA, config, event)
+
+	archive := filepath.Join(t.TempDir(), "backup.tar.gz")
+	if err := backupNamespace(clientset, source, NAMESPACE, archive); err != nil {
+		t.Fatalf("backup: %v", err)
+	}
+
+	_, objects, err := readArchive(archive)
+	if err != nil {
+		t.Fatalf("readArchive: %v", err)
+	}
+
+	// 只有 Deployment、Service 和用户自己的 ConfigMap
+	if len(objects) != 3 {
+		var names []string
+		for _, o := range objects {
+			names = append(names, o.gvr.Resource+"/"+o.object.GetName())
+		}
+		t.Fatalf("archived %v, want the deployment, the service and tomcat-config", names)
+	}
+
+	for _, o := range objects {
+		if o.object.GetUID() != "" || o.object.GetResourceVersion() != "" {
+			t.Errorf("%s %s: uid %q resourceVersion %q were not stripped", o.gvr.Resource, o.object.GetName(), o.object.GetUID(), o.object.GetResourceVersion())
+		}
+
+		if _, found := o.object.Object["status"]; found {
+			t.Errorf("%s %s: status was not stripped", o.gvr.Resource, o.object.GetName())
+		}
+	}
+
+	target := dynamicfake.NewSimpleDynamicClient(scheme.Scheme)
+	if err := restoreNamespace(target, archive, "restored"); err != nil {
+		t.Fatalf("restore: %v", err)
+	}
+
+	if _, err := target.Resource(schema.GroupVersionResource{Version: "v1", Resource: "namespaces"}).Get(context.TODO(), "restored", metav1.GetOptions{}); err != nil {
+		t.Errorf("get restored namespace: %v", err)
+	}
+
+	restored, err := target.Resource(servicesResource).Namespace("restored").Get(context.TODO(), SERVICE_NAME, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("get restored service: %v", err)
+	}
+
+	if _, found, _ := unstructured.NestedString(restored.Object, "spec", "clusterIP"); found {
+		t.Errorf("restored service still has a clusterIP")
+	}
+
+	ports, _, _ := unstructured.NestedSlice(restored.Object, "spec", "ports")
+	if len(ports) != 1 || ports[0].(map[string]interface{})["nodePort"] != nil {
+		t.Errorf("restored service ports %v, want the nodePort dropped for another namespace", ports)
+	}
+
+	for _, gvr := range []schema.GroupVersionResource{deploymentsResource, configMapsResource} {
+		list, err := target.Resource(gvr).Namespace("restored").List(context.TODO(), metav1.ListOptions{})
+		if err != nil {
+			t.Fatalf("list %s: %v", gvr.Resource, err)
+		}
+
+		if len(list.Items) != 1 {
+			t.Errorf("restored %d %s, want 1", len(list.Items), gvr.Resource)
+		}
+	}
+
+	list, err := target.Resource(replicaSetsResource).Namespace("restored").List(context.TODO(), metav1.ListOptions{})
+	if err != nil {
+		t.Fatalf("list replicasets: %v", err)
+	}
+
+	if len(list.Items) != 0 {
+		t.Errorf("restored %d replicaset(s) owned by the deployment", len(list.Items))
+	}
+}
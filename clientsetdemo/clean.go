@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+)
+
+// cleanOptions 保存 clean 操作的命令行参数
+type cleanOptions struct {
+	// propagation 是级联删除策略：Foreground、Background 或 Orphan
+	propagation metav1.DeletionPropagation
+	// gracePeriod 是删除的优雅终止时间（秒），小于 0 表示使用对象自身的默认值
+	gracePeriod int64
+	// wait 为 true 时，clean 会阻塞到工作负载的 Pod 和命名空间真正从集群中消失
+	wait bool
+	// timeout 是 wait 的最长等待时间
+	timeout time.Duration
+	// pvcRetention 决定删除 StatefulSet 时保留（Retain）还是删除（Delete）它的 PVC，见 workload.go
+	pvcRetention appsv1.PersistentVolumeClaimRetentionPolicyType
+}
+
+// parsePropagationPolicy 把 -propagation 参数转换成 metav1.DeletionPropagation，大小写不敏感
+func parsePropagationPolicy(policy string) (metav1.DeletionPropagation, error) {
+	switch strings.ToLower(policy) {
+	case "foreground":
+		return metav1.DeletePropagationForeground, nil
+	case "background":
+		return metav1.DeletePropagationBackground, nil
+	case "orphan":
+		return metav1.DeletePropagationOrphan, nil
+	}
+
+	return "", fmt.Errorf("unknown propagation policy %q, must be foreground, background or orphan", policy)
+}
+
+// deleteOptions 根据命令行参数构造每次 Delete 调用使用的 DeleteOptions
+func (o cleanOptions) deleteOptions() metav1.DeleteOptions {
+	propagation := o.propagation
+	options := metav1.DeleteOptions{PropagationPolicy: &propagation, DryRun: dryRun}
+
+	if o.gracePeriod >= 0 {
+		gracePeriod := o.gracePeriod
+		options.GracePeriodSeconds = &gracePeriod
+	}
+
+	return options
+}
+
+// reportDelete 输出一次删除的结果。对象已经不存在时只打印提示并返回 nil，
+// 这样 clean 可以重复执行，也可以清理只创建了一半的资源；其他错误原样返回。
+func reportDelete(out io.Writer, kind, name string, err error) error {
+	if apierrors.IsNotFound(err) {
+		fmt.Fprintf(out, "%s %s not found, skip\n", kind, name)
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(out, "Delete %s %s%s \n", kind, name, dryRunSuffix())
+	return nil
+}
+
+// waitForPodsGone 轮询命名空间中匹配 selector 的 Pod，直到全部终止或者超时，workload 只用于输出进度
+func waitForPodsGone(out io.Writer, clientset kubernetes.Interface, namespace string, selector labels.Selector, workload string, timeout time.Duration) error {
+	return wait.PollUntilContextTimeout(context.TODO(), time.Second, timeout, true, func(ctx context.Context) (bool, error) {
+		pods, err := clientset.CoreV1().Pods(namespace).List(ctx, metav1.ListOptions{LabelSelector: selector.String()})
+
+		if err != nil {
+			return false, err
+		}
+
+		if len(pods.Items) > 0 {
+			fmt.Fprintf(out, "Waiting for %d pod(s) of %s to terminate\n", len(pods.Items), workload)
+			return false, nil
+		}
+
+		return true, nil
+	})
+}
+
+// waitForNamespaceGone 轮询命名空间，直到 Get 返回 NotFound 或者超时。
+// 命名空间处于 Terminating 状态时重新创建同名命名空间会失败，所以紧接着重建之前需要等它真正消失。
+func waitForNamespaceGone(out io.Writer, clientset kubernetes.Interface, namespace string, timeout time.Duration) error {
+	return wait.PollUntilContextTimeout(context.TODO(), time.Second, timeout, true, func(ctx context.Context) (bool, error) {
+		ns, err := clientset.CoreV1().Namespaces().Get(ctx, namespace, metav1.GetOptions{})
+
+		if apierrors.IsNotFound(err) {
+			return true, nil
+		}
+
+		if err != nil {
+			return false, err
+		}
+
+		fmt.Fprintf(out, "Waiting for namespace %s to terminate, phase is %s\n", namespace, ns.Status.Phase)
+		return false, nil
+	})
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	apiv1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes/scheme"
+)
+
+func TestCloneNamespace(t *testing.T) {
+	deployment := newDeployment(stack)
+	deployment.Namespace = NAMESPACE
+
+	service := newService(stack)
+	service.Namespace = NAMESPACE
+	service.Spec.ClusterIP = "10.96.0.10"
+
+	binding := &rbacv1.RoleBinding{
+		ObjectMeta: metav1.ObjectMeta{Name: "tomcat", Namespace: NAMESPACE},
+		Subjects:   []rbacv1.Subject{{Kind: "ServiceAccount", Name: "tomcat", Namespace: NAMESPACE}},
+		RoleRef:    rbacv1.RoleRef{APIGroup: "rbac.authorization.k8s.io", Kind: "Role", Name: "tomcat"},
+	}
+
+	client := dynamicfake.NewSimpleDynamicClient(scheme.Scheme,
+		newNamespace(stack), deployment, service, binding,
+		&apiv1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Name: "default", Namespace: NAMESPACE}},
+		&apiv1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Name: "tomcat", Namespace: NAMESPACE}},
+	)
+
+	if err := cloneNamespace(client, client, NAMESPACE, "copy"); err != nil {
+		t.Fatalf("clone: %v", err)
+	}
+
+	copied, err := client.Resource(servicesResource).Namespace("copy").Get(context.TODO(), SERVICE_NAME, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("get copied service: %v", err)
+	}
+
+	if _, found, _ := unstructured.NestedString(copied.Object, "spec", "clusterIP"); found {
+		t.Errorf("copied service still has a clusterIP")
+	}
+
+	ports, _, _ := unstructured.NestedSlice(copied.Object, "spec", "ports")
+	if len(ports) != 1 || ports[0].(map[string]interface{})["nodePort"] != nil {
+		t.Errorf("copied service ports %v, want the nodePort dropped", ports)
+	}
+
+	rolebindings := schema.GroupVersionResource{Group: "rbac.authorization.k8s.io", Version: "v1", Resource: "rolebindings"}
+	copiedBinding, err := client.Resource(rolebindings).Namespace("copy").Get(context.TODO(), "tomcat", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("get copied rolebinding: %v", err)
+	}
+
+	subjects, _, _ := unstructured.NestedSlice(copiedBinding.Object, "subjects")
+	if len(subjects) != 1 || subjects[0].(map[string]interface{})["namespace"] != "copy" {
+		t.Errorf("copied rolebinding subjects %v, want the service account in namespace copy", subjects)
+	}
+
+	serviceAccounts, err := client.Resource(schema.GroupVersionResource{Version: "v1", Resource: "serviceaccounts"}).Namespace("copy").List(context.TODO(), metav1.ListOptions{})
+	if err != nil {
+		t.Fatalf("list service accounts: %v", err)
+	}
+
+	if len(serviceAccounts.Items) != 1 || serviceAccounts.Items[0].GetName() != "tomcat" {
+		t.Errorf("copied %d service account(s), want only tomcat", len(serviceAccounts.Items))
+	}
+
+	if _, err := client.Resource(deploymentsResource).Namespace("copy").Get(context.TODO(), DEPLOYMENT_NAME, metav1.GetOptions{}); err != nil {
+		t.Errorf("get copied deployment: %v", err)
+	}
+}
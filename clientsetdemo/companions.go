@@ -0,0 +1,281 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	autoscalingv2 "k8s.io/api/autoscaling/v2"
+	apiv1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	policyv1 "k8s.io/api/policy/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/utils/pointer"
+)
+
+/*
+除了命名空间、Deployment 和 Service 之外，create 还可以创建以下配套对象，每一种都由 stackValues 中的一个开关控制，默认都不创建：
+  - ConfigMap <deploymentName>-config，每个 key 是一个文件，只读挂载到 tomcat 容器的 CONFIG_MOUNT_PATH 目录；
+  - Secret <deploymentName>-secret，每个 key 通过 envFrom 成为 tomcat 容器的一个环境变量；
+  - Ingress <serviceName>，把 ingressHost（为空时是任意主机）的全部路径转发到 Service 的 http 端口；
+  - HorizontalPodAutoscaler <deploymentName>（autoscaling/v2），按 CPU 使用率在 replicas 和 hpaMaxReplicas 之间伸缩；
+  - PodDisruptionBudget <deploymentName>，驱逐 Pod（例如节点维护）时至少保留 pdbMinAvailable 个可用的 Pod。
+
+它们都带有 ownershipLabels，clean 通过 discovery 找到并删除它们，不需要额外的处理。
+*/
+
+const (
+	// CONFIG_MOUNT_PATH 是 ConfigMap 在 tomcat 容器中的挂载目录
+	CONFIG_MOUNT_PATH = "/usr/local/tomcat/conf/clientsetdemo"
+	// CPU_REQUEST 是开启 HPA 时 tomcat 容器的 CPU request，HPA 按 request 计算 CPU 使用率，没有 request 时无法伸缩
+	CPU_REQUEST = "100m"
+
+	DEFAULT_HPA_MAX_REPLICAS  = 5
+	DEFAULT_HPA_CPU_PERCENT   = 80
+	DEFAULT_PDB_MIN_AVAILABLE = 1
+)
+
+// literalMap 实现了 flag.Value 接口，-config-literal 和 -secret-literal 参数的格式是 key=value，可以重复出现
+type literalMap map[string]string
+
+func (m literalMap) String() string {
+	var literals []string
+	for key, value := range m {
+		literals = append(literals, key+"="+value)
+	}
+
+	sort.Strings(literals)
+	return strings.Join(literals, ",")
+}
+
+func (m literalMap) Set(value string) error {
+	key, val, ok := strings.Cut(value, "=")
+	if !ok || key == "" {
+		return fmt.Errorf("%q is not in the form key=value", value)
+	}
+
+	m[key] = val
+	return nil
+}
+
+// mergeLiterals 把命令行中的 literals 合并到 -values 文件中的 data，同一个 key 以命令行为准
+func mergeLiterals(data map[string]string, literals literalMap) map[string]string {
+	merged := map[string]string{}
+
+	for key, value := range data {
+		merged[key] = value
+	}
+
+	for key, value := range literals {
+		merged[key] = value
+	}
+
+	return merged
+}
+
+func configMapName(values stackValues) string {
+	return values.DeploymentName + "-config"
+}
+
+func secretName(values stackValues) string {
+	return values.DeploymentName + "-secret"
+}
+
+// newConfigObjects 返回开启了的 ConfigMap 和 Secret。Deployment 引用它们，所以要在 Deployment 之前创建
+func newConfigObjects(values stackValues) []runtime.Object {
+	var objects []runtime.Object
+
+	if values.ConfigMap {
+		configMap := &apiv1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      configMapName(values),
+				Namespace: values.Namespace,
+				Labels:    ownershipLabels(),
+			},
+			Data: values.ConfigData,
+		}
+		configMap.SetGroupVersionKind(apiv1.SchemeGroupVersion.WithKind("ConfigMap"))
+
+		objects = append(objects, configMap)
+	}
+
+	if values.Secret {
+		// StringData 由 API Server 编码后合并到 Data 中，这里不需要自己做 base64
+		secret := &apiv1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      secretName(values),
+				Namespace: values.Namespace,
+				Labels:    ownershipLabels(),
+			},
+			Type:       apiv1.SecretTypeOpaque,
+			StringData: values.SecretData,
+		}
+		secret.SetGroupVersionKind(apiv1.SchemeGroupVersion.WithKind("Secret"))
+
+		objects = append(objects, secret)
+	}
+
+	return objects
+}
+
+// newPolicyObjects 返回开启了的 Ingress、HorizontalPodAutoscaler 和 PodDisruptionBudget，它们指向 Service 或 Deployment，在其之后创建
+func newPolicyObjects(values stackValues) []runtime.Object {
+	var objects []runtime.Object
+
+	if values.Ingress {
+		pathType := networkingv1.PathTypePrefix
+
+		ingress := &networkingv1.Ingress{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      values.ServiceName,
+				Namespace: values.Namespace,
+				Labels:    ownershipLabels(),
+			},
+			Spec: networkingv1.IngressSpec{
+				Rules: []networkingv1.IngressRule{{
+					Host: values.IngressHost,
+					IngressRuleValue: networkingv1.IngressRuleValue{
+						HTTP: &networkingv1.HTTPIngressRuleValue{
+							Paths: []networkingv1.HTTPIngressPath{{
+								Path:     "/",
+								PathType: &pathType,
+								Backend: networkingv1.IngressBackend{
+									Service: &networkingv1.IngressServiceBackend{
+										Name: values.ServiceName,
+										Port: networkingv1.ServiceBackendPort{Name: "http"},
+									},
+								},
+							}},
+						},
+					},
+				}},
+			},
+		}
+
+		if values.IngressClass != "" {
+			ingress.Spec.IngressClassName = pointer.String(values.IngressClass)
+		}
+
+		ingress.SetGroupVersionKind(networkingv1.SchemeGroupVersion.WithKind("Ingress"))
+		objects = append(objects, ingress)
+	}
+
+	if values.HPA {
+		// HPA 的 minReplicas 不能为 0
+		minReplicas := values.Replicas
+		if minReplicas < 1 {
+			minReplicas = 1
+		}
+
+		hpa := &autoscalingv2.HorizontalPodAutoscaler{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      values.DeploymentName,
+				Namespace: values.Namespace,
+				Labels:    ownershipLabels(),
+			},
+			Spec: autoscalingv2.HorizontalPodAutoscalerSpec{
+				ScaleTargetRef: autoscalingv2.CrossVersionObjectReference{
+					APIVersion: "apps/v1",
+					Kind:       workloadKinds[values.Workload],
+					Name:       values.DeploymentName,
+				},
+				MinReplicas: pointer.Int32(minReplicas),
+				MaxReplicas: values.HPAMaxReplicas,
+				Metrics: []autoscalingv2.MetricSpec{{
+					Type: autoscalingv2.ResourceMetricSourceType,
+					Resource: &autoscalingv2.ResourceMetricSource{
+						Name: apiv1.ResourceCPU,
+						Target: autoscalingv2.MetricTarget{
+							Type:               autoscalingv2.UtilizationMetricType,
+							AverageUtilization: pointer.Int32(values.HPACPUPercent),
+						},
+					},
+				}},
+			},
+		}
+		hpa.SetGroupVersionKind(autoscalingv2.SchemeGroupVersion.WithKind("HorizontalPodAutoscaler"))
+
+		objects = append(objects, hpa)
+	}
+
+	if values.PDB {
+		minAvailable := intstr.FromInt(int(values.PDBMinAvailable))
+
+		pdb := &policyv1.PodDisruptionBudget{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      values.DeploymentName,
+				Namespace: values.Namespace,
+				Labels:    ownershipLabels(),
+			},
+			Spec: policyv1.PodDisruptionBudgetSpec{
+				MinAvailable: &minAvailable,
+				Selector: &metav1.LabelSelector{
+					MatchLabels: map[string]string{
+						"app": "tomcat",
+					},
+				},
+			},
+		}
+		pdb.SetGroupVersionKind(policyv1.SchemeGroupVersion.WithKind("PodDisruptionBudget"))
+
+		objects = append(objects, pdb)
+	}
+
+	return objects
+}
+
+// addCompanionsToPodSpec 把开启了的 ConfigMap、Secret 和 HPA 需要的设置加到 tomcat 容器上
+func addCompanionsToPodSpec(values stackValues, spec *apiv1.PodSpec) {
+	container := &spec.Containers[0]
+
+	if values.ConfigMap {
+		spec.Volumes = append(spec.Volumes, apiv1.Volume{
+			Name: "config",
+			VolumeSource: apiv1.VolumeSource{
+				ConfigMap: &apiv1.ConfigMapVolumeSource{
+					LocalObjectReference: apiv1.LocalObjectReference{Name: configMapName(values)},
+				},
+			},
+		})
+
+		container.VolumeMounts = append(container.VolumeMounts, apiv1.VolumeMount{
+			Name:      "config",
+			MountPath: CONFIG_MOUNT_PATH,
+			ReadOnly:  true,
+		})
+	}
+
+	if values.Secret {
+		container.EnvFrom = append(container.EnvFrom, apiv1.EnvFromSource{
+			SecretRef: &apiv1.SecretEnvSource{
+				LocalObjectReference: apiv1.LocalObjectReference{Name: secretName(values)},
+			},
+		})
+	}
+
+	if values.HPA {
+		container.Resources.Requests = apiv1.ResourceList{
+			apiv1.ResourceCPU: resource.MustParse(CPU_REQUEST),
+		}
+	}
+}
+
+// createCompanions 逐个创建 objects 并把结果写到 out，遇到第一个错误就返回
+func createCompanions(out io.Writer, clientset kubernetes.Interface, objects []runtime.Object) error {
+	for _, obj := range objects {
+		result, err := createObject(clientset, obj)
+
+		if err != nil {
+			return err
+		}
+
+		fmt.Fprintf(out, "Create %s %s%s \n", strings.ToLower(objectKind(obj)), result.GetName(), dryRunSuffix())
+	}
+
+	return nil
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestCreateStackWithCompanions(t *testing.T) {
+	values := defaultStackValues()
+	values.ConfigMap, values.ConfigData = true, map[string]string{"app.properties": "greeting=hello"}
+	values.Secret, values.SecretData = true, map[string]string{"DB_PASSWORD": "secret"}
+	values.Ingress, values.IngressHost = true, "tomcat.example.com"
+	values.HPA, values.PDB = true, true
+
+	clientset := fake.NewSimpleClientset()
+	if err := createStack(os.Stdout, clientset, values); err != nil {
+		t.Fatalf("createStack: %v", err)
+	}
+
+	ctx := context.TODO()
+
+	if _, err := clientset.CoreV1().ConfigMaps(NAMESPACE).Get(ctx, configMapName(values), metav1.GetOptions{}); err != nil {
+		t.Errorf("get configmap: %v", err)
+	}
+
+	if _, err := clientset.CoreV1().Secrets(NAMESPACE).Get(ctx, secretName(values), metav1.GetOptions{}); err != nil {
+		t.Errorf("get secret: %v", err)
+	}
+
+	ingress, err := clientset.NetworkingV1().Ingresses(NAMESPACE).Get(ctx, SERVICE_NAME, metav1.GetOptions{})
+	if err != nil {
+		t.Errorf("get ingress: %v", err)
+	} else if backend := ingress.Spec.Rules[0].HTTP.Paths[0].Backend.Service; backend.Name != SERVICE_NAME {
+		t.Errorf("ingress routes to %s, want %s", backend.Name, SERVICE_NAME)
+	}
+
+	hpa, err := clientset.AutoscalingV2().HorizontalPodAutoscalers(NAMESPACE).Get(ctx, DEPLOYMENT_NAME, metav1.GetOptions{})
+	if err != nil {
+		t.Errorf("get hpa: %v", err)
+	} else if *hpa.Spec.MinReplicas != DEFAULT_REPLICAS || hpa.Spec.MaxReplicas != DEFAULT_HPA_MAX_REPLICAS {
+		t.Errorf("hpa scales between %d and %d, want %d and %d", *hpa.Spec.MinReplicas, hpa.Spec.MaxReplicas, DEFAULT_REPLICAS, DEFAULT_HPA_MAX_REPLICAS)
+	}
+
+	pdb, err := clientset.PolicyV1().PodDisruptionBudgets(NAMESPACE).Get(ctx, DEPLOYMENT_NAME, metav1.GetOptions{})
+	if err != nil {
+		t.Errorf("get pdb: %v", err)
+	} else if !isOwned(pdb) {
+		t.Errorf("pdb is missing the ownership labels: %v", pdb.Labels)
+	}
+
+	deployment, err := clientset.AppsV1().Deployments(NAMESPACE).Get(ctx, DEPLOYMENT_NAME, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("get deployment: %v", err)
+	}
+
+	spec := deployment.Spec.Template.Spec
+	container := spec.Containers[0]
+
+	if len(spec.Volumes) != 1 || spec.Volumes[0].ConfigMap == nil || len(container.VolumeMounts) != 1 || container.VolumeMounts[0].MountPath != CONFIG_MOUNT_PATH {
+		t.Errorf("the configmap is not mounted at %s: volumes %v, mounts %v", CONFIG_MOUNT_PATH, spec.Volumes, container.VolumeMounts)
+	}
+
+	if len(container.EnvFrom) != 1 || container.EnvFrom[0].SecretRef == nil || container.EnvFrom[0].SecretRef.Name != secretName(values) {
+		t.Errorf("the secret is not exposed as environment variables: %v", container.EnvFrom)
+	}
+
+	if _, ok := container.Resources.Requests[apiv1.ResourceCPU]; !ok {
+		t.Errorf("the container has no CPU request for the hpa")
+	}
+}
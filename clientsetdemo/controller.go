@@ -0,0 +1,480 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	apiv1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	appslisters "k8s.io/client-go/listers/apps/v1"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/workqueue"
+)
+
+/*
+-operate=controller 不再是一次性的 create，而是一直运行，让 stack.Namespace 中的 Deployment 和 Service 保持期望状态：
+  - 两个 shared informer 分别监听命名空间中的 Deployment 和 Service，名字是 stack.DeploymentName 或 stack.ServiceName 的对象发生变化时，
+    把对应的 kind 放入限速的 workqueue；informer 每 CONTROLLER_RESYNC 重新投递一次全部对象，错过的变化也会被修复；
+  - worker 从 workqueue 取出 kind 后对比线上对象和 newDeployment、newService 生成的期望对象：对象不存在时重新创建（命名空间不存在时先创建命名空间），
+    副本数、镜像、端口、selector 等本程序管理的字段被改动时改回来，其他字段（例如服务端填充的默认值）不管；
+  - 每次创建、修复或失败都以 Kubernetes Event 记录在对应的对象上，kubectl describe 可以看到；失败的 kind 按指数退避重新入队；
+  - 收到 SIGTERM 或 SIGINT 时停止接收新的任务，等正在处理的任务完成后退出。
+
+配套对象（ConfigMap、Ingress 等）和 Provision 不在 controller 的管理范围内，开启它们时 -operate=controller 以用法错误退出。
+修复只改回 deploymentDrift 和 serviceDrift 列出的字段，restart 写入的 RESTARTED_AT_ANNOTATION 等其他字段保持原样。
+release 和 promote 会在 Service 的选择器中加上 VERSION_LABEL，把流量切到 candidate，serviceDrift 不把这个标签算作改动。
+Deployment 同样要让位给 release（见 reconcileDeployment）：有 candidate 时 canary 缩容后的 stable 不算漂移，整个发布期间不修复 Deployment；
+promote 删除 stack.DeploymentName 之后，controller 跟随带有 TRACK_LABEL=stable 的新 stable，而不是把旧的 Deployment 以全部副本数重新创建出来。
+*/
+
+const (
+	// CONTROLLER_RESYNC 是 informer 重新投递全部对象的周期
+	CONTROLLER_RESYNC = 10 * time.Minute
+
+	// 以下是 controller 记录的 Event 的 reason
+	REASON_CREATED          = "Created"
+	REASON_REPAIRED         = "Repaired"
+	REASON_RECONCILE_FAILED = "ReconcileFailed"
+)
+
+// stackController 是 -operate=controller 使用的控制器，workqueue 中的元素是 "Deployment" 或 "Service"
+type stackController struct {
+	clientset kubernetes.Interface
+	values    stackValues
+	recorder  record.EventRecorder
+
+	factory     informers.SharedInformerFactory
+	deployments appslisters.DeploymentLister
+	services    corelisters.ServiceLister
+	synced      []cache.InformerSynced
+
+	queue workqueue.RateLimitingInterface
+}
+
+// newStackController 创建只监听 values.Namespace 的 informer，recorder 用于记录 Event，测试中可以传入 record.NewFakeRecorder
+func newStackController(clientset kubernetes.Interface, values stackValues, recorder record.EventRecorder) *stackController {
+	factory := informers.NewSharedInformerFactoryWithOptions(clientset, CONTROLLER_RESYNC, informers.WithNamespace(values.Namespace))
+	deploymentInformer := factory.Apps().V1().Deployments()
+	serviceInformer := factory.Core().V1().Services()
+
+	c := &stackController{
+		clientset:   clientset,
+		values:      values,
+		recorder:    recorder,
+		factory:     factory,
+		deployments: deploymentInformer.Lister(),
+		services:    serviceInformer.Lister(),
+		synced:      []cache.InformerSynced{deploymentInformer.Informer().HasSynced, serviceInformer.Informer().HasSynced},
+		queue:       workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter()),
+	}
+
+	deploymentInformer.Informer().AddEventHandler(c.handlerFor("Deployment", values.DeploymentName, true))
+	serviceInformer.Informer().AddEventHandler(c.handlerFor("Service", values.ServiceName, false))
+
+	return c
+}
+
+// handlerFor 返回只关心名为 name 的对象的事件处理函数，新增、修改和删除都把 kind 放入 workqueue。
+// tracked 为 true 时带有 TRACK_LABEL 的对象也算，release 的 candidate 出现或消失、promote 产生新的 stable 时都要重新检查
+func (c *stackController) handlerFor(kind, name string, tracked bool) cache.ResourceEventHandler {
+	enqueue := func(obj interface{}) {
+		if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok && tracked {
+			obj = tombstone.Obj
+		}
+
+		if accessor, err := meta.Accessor(obj); tracked && err == nil {
+			if _, found := accessor.GetLabels()[TRACK_LABEL]; found {
+				c.queue.Add(kind)
+				return
+			}
+		}
+
+		// 删除事件可能是 DeletedFinalStateUnknown，key 中同样带有名字
+		key, err := cache.DeletionHandlingMetaNamespaceKeyFunc(obj)
+
+		if err != nil {
+			utilruntime.HandleError(err)
+			return
+		}
+
+		if _, objectName, _ := cache.SplitMetaNamespaceKey(key); objectName == name {
+			c.queue.Add(kind)
+		}
+	}
+
+	return cache.ResourceEventHandlerFuncs{
+		AddFunc:    enqueue,
+		UpdateFunc: func(_, obj interface{}) { enqueue(obj) },
+		DeleteFunc: enqueue,
+	}
+}
+
+// run 启动 informer 和 workers 个 worker，一直运行到 ctx 被取消，返回前等待正在处理的任务完成
+func (c *stackController) run(ctx context.Context, workers int) error {
+	defer c.queue.ShutDown()
+
+	c.factory.Start(ctx.Done())
+	defer c.factory.Shutdown()
+
+	if !cache.WaitForCacheSync(ctx.Done(), c.synced...) {
+		return fmt.Errorf("timed out waiting for the informer caches of namespace %s to sync", c.values.Namespace)
+	}
+
+	fmt.Printf("Controller is watching deployment %s and service %s in namespace %s\n", c.values.DeploymentName, c.values.ServiceName, c.values.Namespace)
+
+	// 对象一开始就不存在时 informer 不会产生任何事件，先各检查一次
+	c.queue.Add("Deployment")
+	c.queue.Add("Service")
+
+	var wg sync.WaitGroup
+
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+			wait.UntilWithContext(ctx, c.runWorker, time.Second)
+		}()
+	}
+
+	<-ctx.Done()
+	fmt.Println("Controller is shutting down")
+
+	c.queue.ShutDown()
+	wg.Wait()
+
+	return nil
+}
+
+func (c *stackController) runWorker(ctx context.Context) {
+	for c.processNextItem(ctx) {
+	}
+}
+
+// processNextItem 处理 workqueue 中的一个 kind，workqueue 关闭时返回 false
+func (c *stackController) processNextItem(ctx context.Context) bool {
+	item, shutdown := c.queue.Get()
+
+	if shutdown {
+		return false
+	}
+
+	defer c.queue.Done(item)
+
+	kind := item.(string)
+
+	if err := c.reconcile(ctx, kind); err != nil {
+		fmt.Printf("Reconcile %s failed, retry: %v\n", kind, err)
+		c.queue.AddRateLimited(item)
+		return true
+	}
+
+	c.queue.Forget(item)
+	return true
+}
+
+// reconcile 让 kind 对应的对象符合期望状态
+func (c *stackController) reconcile(ctx context.Context, kind string) error {
+	switch kind {
+	case "Deployment":
+		return c.reconcileDeployment(ctx)
+	case "Service":
+		return c.reconcileService(ctx)
+	}
+
+	return fmt.Errorf("unknown kind %q", kind)
+}
+
+// reconcileDeployment 让 stable Deployment 符合期望状态。release 进行中（存在 candidate）时什么都不做：canary 缩容 stable、
+// candidate 的副本数都由 release、promote 和 abort 管理，修复它们会打乱发布。promote 之后 stack.DeploymentName 已被删除，
+// 这时修复的是带有 TRACK_LABEL=stable 的 Deployment，见 trackedStable
+func (c *stackController) reconcileDeployment(ctx context.Context) error {
+	stable, releasing, err := c.trackedStable()
+
+	if err != nil {
+		return err
+	}
+
+	if releasing {
+		return nil
+	}
+
+	desired := newDeployment(c.values)
+	desired.Namespace = c.values.Namespace
+
+	if stable != nil {
+		desired = newTrackedStable(c.values, stable)
+	}
+
+	live, err := c.deployments.Deployments(c.values.Namespace).Get(desired.Name)
+
+	if apierrors.IsNotFound(err) {
+		return c.recreate(ctx, "Deployment", desired.Name, desired, func() (runtime.Object, error) {
+			return c.clientset.AppsV1().Deployments(desired.Namespace).Create(ctx, desired, metav1.CreateOptions{})
+		})
+	}
+
+	if err != nil {
+		return err
+	}
+
+	drift := deploymentDrift(live, desired)
+	if len(drift) == 0 {
+		return nil
+	}
+
+	// lister 返回的是缓存中的对象，不能直接修改。只改回 deploymentDrift 比较的字段，
+	// Pod 模板的注解（例如 restart 写入的 RESTARTED_AT_ANNOTATION）、资源请求等其他字段保持原样
+	repaired := live.DeepCopy()
+	repaired.Spec.Replicas = desired.Spec.Replicas
+	repaired.Spec.Selector = desired.Spec.Selector
+	repaired.Spec.Template.Labels = desired.Spec.Template.Labels
+	setOwnershipLabels(repaired)
+
+	containers := repaired.Spec.Template.Spec.Containers
+	if len(containers) != len(desired.Spec.Template.Spec.Containers) {
+		repaired.Spec.Template.Spec.Containers = desired.Spec.Template.Spec.Containers
+	} else {
+		for i, want := range desired.Spec.Template.Spec.Containers {
+			containers[i].Name = want.Name
+			containers[i].Image = want.Image
+			containers[i].Ports = want.Ports
+		}
+	}
+
+	return c.repair("Deployment", live.Name, live, drift, func() error {
+		_, err := c.clientset.AppsV1().Deployments(repaired.Namespace).Update(ctx, repaired, metav1.UpdateOptions{})
+		return err
+	})
+}
+
+// trackedStable 在 informer 缓存中查找带有 TRACK_LABEL 的 Deployment：有 candidate 时 releasing 为 true；
+// 否则返回 promote 留下的 TRACK_LABEL=stable 的 Deployment，没有时为 nil，即 stable 仍是 stack.DeploymentName
+func (c *stackController) trackedStable() (stable *appsv1.Deployment, releasing bool, err error) {
+	selector := labels.SelectorFromSet(ownershipLabels())
+	deployments, err := c.deployments.Deployments(c.values.Namespace).List(selector)
+
+	if err != nil {
+		return nil, false, err
+	}
+
+	for _, deployment := range deployments {
+		switch deployment.Labels[TRACK_LABEL] {
+		case TRACK_CANDIDATE:
+			return nil, true, nil
+		case TRACK_STABLE:
+			stable = deployment
+		}
+	}
+
+	return stable, false, nil
+}
+
+// newTrackedStable 返回 promote 留下的 stable 的期望状态：与 newCandidate 相同，名字是 stable 自己的，选择器和 Pod 模板带有它的 VERSION_LABEL
+func newTrackedStable(values stackValues, stable *appsv1.Deployment) *appsv1.Deployment {
+	values.DeploymentName = stable.Name
+
+	deployment := newDeployment(values)
+	deployment.Namespace = values.Namespace
+	deployment.Labels[TRACK_LABEL] = TRACK_STABLE
+
+	if version, found := stable.Labels[VERSION_LABEL]; found {
+		deployment.Labels[VERSION_LABEL] = version
+		deployment.Spec.Selector.MatchLabels[VERSION_LABEL] = version
+		deployment.Spec.Template.Labels[VERSION_LABEL] = version
+	}
+
+	return deployment
+}
+
+func (c *stackController) reconcileService(ctx context.Context) error {
+	desired := newService(c.values)
+	desired.Namespace = c.values.Namespace
+
+	live, err := c.services.Services(c.values.Namespace).Get(c.values.ServiceName)
+
+	if apierrors.IsNotFound(err) {
+		return c.recreate(ctx, "Service", desired.Name, desired, func() (runtime.Object, error) {
+			return c.clientset.CoreV1().Services(desired.Namespace).Create(ctx, desired, metav1.CreateOptions{})
+		})
+	}
+
+	if err != nil {
+		return err
+	}
+
+	drift := serviceDrift(live, desired)
+	if len(drift) == 0 {
+		return nil
+	}
+
+	repaired := live.DeepCopy()
+	repaired.Spec.Type = desired.Spec.Type
+	repaired.Spec.Selector = desired.Spec.Selector
+	repaired.Spec.Ports = desired.Spec.Ports
+	setOwnershipLabels(repaired)
+
+	// 发布中的 Service 选择 candidate 的 Pod，修复其他字段时保留 release 写入的 VERSION_LABEL
+	if version, found := live.Spec.Selector[VERSION_LABEL]; found {
+		repaired.Spec.Selector = map[string]string{VERSION_LABEL: version}
+
+		for key, value := range desired.Spec.Selector {
+			repaired.Spec.Selector[key] = value
+		}
+	}
+
+	// nodePort 为 0 时保留 API Server 已经分配的端口
+	for i := range repaired.Spec.Ports {
+		if repaired.Spec.Ports[i].NodePort == 0 && usesNodePort(c.values.ServiceType) && i < len(live.Spec.Ports) {
+			repaired.Spec.Ports[i].NodePort = live.Spec.Ports[i].NodePort
+		}
+	}
+
+	return c.repair("Service", live.Name, live, drift, func() error {
+		_, err := c.clientset.CoreV1().Services(repaired.Namespace).Update(ctx, repaired, metav1.UpdateOptions{})
+		return err
+	})
+}
+
+// recreate 调用 create 重新创建不存在的 desired，命名空间也不存在时先创建命名空间，结果以 Event 记录。
+// informer 缓存中的对象没有 TypeMeta，所以 kind 和 name 由调用者传入
+func (c *stackController) recreate(ctx context.Context, kind, name string, desired runtime.Object, create func() (runtime.Object, error)) error {
+	created, err := create()
+
+	if apierrors.IsNotFound(err) {
+		if _, err := c.clientset.CoreV1().Namespaces().Create(ctx, newNamespace(c.values), metav1.CreateOptions{}); err != nil && !apierrors.IsAlreadyExists(err) {
+			return c.failed(desired, err)
+		}
+
+		fmt.Printf("Create namespace %s\n", c.values.Namespace)
+		created, err = create()
+	}
+
+	// 缓存还没有看到刚创建的对象，informer 随后会再次投递
+	if apierrors.IsAlreadyExists(err) {
+		return nil
+	}
+
+	if err != nil {
+		return c.failed(desired, err)
+	}
+
+	fmt.Printf("Create %s %s\n", strings.ToLower(kind), name)
+	c.recorder.Eventf(created, apiv1.EventTypeNormal, REASON_CREATED, "%s %s was missing and has been recreated", kind, name)
+	return nil
+}
+
+// repair 调用 update 把 drift 中列出的改动改回来，结果以 Event 记录
+func (c *stackController) repair(kind, name string, live runtime.Object, drift []string, update func() error) error {
+	if err := update(); err != nil {
+		return c.failed(live, err)
+	}
+
+	fmt.Printf("Repair %s %s: %s\n", strings.ToLower(kind), name, strings.Join(drift, ", "))
+	c.recorder.Eventf(live, apiv1.EventTypeNormal, REASON_REPAIRED, "Reverted %s", strings.Join(drift, ", "))
+	return nil
+}
+
+// failed 记录一个 Warning Event 并原样返回 err，由 processNextItem 重新入队
+func (c *stackController) failed(obj runtime.Object, err error) error {
+	c.recorder.Eventf(obj, apiv1.EventTypeWarning, REASON_RECONCILE_FAILED, "Reconcile failed: %v", err)
+	return err
+}
+
+// deploymentDrift 返回 live 中与 desired 不同的、由本程序管理的字段
+func deploymentDrift(live, desired *appsv1.Deployment) []string {
+	var drift []string
+
+	if live.Spec.Replicas == nil || *live.Spec.Replicas != *desired.Spec.Replicas {
+		drift = append(drift, fmt.Sprintf("replicas (want %d)", *desired.Spec.Replicas))
+	}
+
+	if !reflect.DeepEqual(live.Spec.Selector, desired.Spec.Selector) {
+		drift = append(drift, "selector")
+	}
+
+	if !reflect.DeepEqual(live.Spec.Template.Labels, desired.Spec.Template.Labels) {
+		drift = append(drift, "pod template labels")
+	}
+
+	if len(live.Spec.Template.Spec.Containers) != len(desired.Spec.Template.Spec.Containers) {
+		return append(drift, "containers")
+	}
+
+	for i, want := range desired.Spec.Template.Spec.Containers {
+		got := live.Spec.Template.Spec.Containers[i]
+
+		if got.Name != want.Name || got.Image != want.Image {
+			drift = append(drift, fmt.Sprintf("container %s image (want %s)", want.Name, want.Image))
+		}
+
+		if !reflect.DeepEqual(got.Ports, want.Ports) {
+			drift = append(drift, fmt.Sprintf("container %s ports", want.Name))
+		}
+	}
+
+	return drift
+}
+
+// serviceDrift 返回 live 中与 desired 不同的、由本程序管理的字段。desired 的 nodePort 为 0 时任何已分配的 nodePort 都可以。
+// 选择器中的 VERSION_LABEL 是 release 和 promote 切换流量时写入的，不算改动，否则 controller 会把流量切回 stable
+func serviceDrift(live, desired *apiv1.Service) []string {
+	var drift []string
+
+	if live.Spec.Type != desired.Spec.Type {
+		drift = append(drift, fmt.Sprintf("type (want %s)", desired.Spec.Type))
+	}
+
+	selector := map[string]string{}
+	for key, value := range live.Spec.Selector {
+		if key != VERSION_LABEL {
+			selector[key] = value
+		}
+	}
+
+	if !reflect.DeepEqual(selector, desired.Spec.Selector) {
+		drift = append(drift, "selector")
+	}
+
+	if len(live.Spec.Ports) != len(desired.Spec.Ports) {
+		return append(drift, "ports")
+	}
+
+	for i, want := range desired.Spec.Ports {
+		got := live.Spec.Ports[i]
+
+		if got.Name != want.Name || got.Port != want.Port || (want.NodePort != 0 && got.NodePort != want.NodePort) {
+			drift = append(drift, fmt.Sprintf("port %s", want.Name))
+		}
+	}
+
+	return drift
+}
+
+// runController 以 -operate=controller 运行，Event 通过 clientset 写入集群，ctx 被取消（收到 SIGTERM）时返回
+func runController(ctx context.Context, clientset kubernetes.Interface, values stackValues, workers int) error {
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: clientset.CoreV1().Events("")})
+	defer broadcaster.Shutdown()
+
+	recorder := broadcaster.NewRecorder(scheme.Scheme, apiv1.EventSource{Component: MANAGED_BY})
+
+	return newStackController(clientset, values, recorder).run(ctx, workers)
+}
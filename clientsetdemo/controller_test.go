@@ -0,0 +1,253 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/utils/pointer"
+)
+
+// waitForEvent 从 recorder 中读取 Event，直到出现包含 want 的一条
+func waitForEvent(t *testing.T, recorder *record.FakeRecorder, want string) {
+	t.Helper()
+
+	timeout := time.After(10 * time.Second)
+
+	for {
+		select {
+		case event := <-recorder.Events:
+			if strings.Contains(event, want) {
+				return
+			}
+		case <-timeout:
+			t.Fatalf("no event containing %q", want)
+		}
+	}
+}
+
+func TestStackControllerRepairs(t *testing.T) {
+	clientset := fake.NewSimpleClientset()
+	recorder := record.NewFakeRecorder(100)
+
+	// 与 API Server 一样，命名空间不存在时不能在其中创建对象
+	clientset.PrependReactor("create", "*", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		namespace := action.GetNamespace()
+		if namespace == "" {
+			return false, nil, nil
+		}
+
+		if _, err := clientset.Tracker().Get(apiv1.SchemeGroupVersion.WithResource("namespaces"), "", namespace); err != nil {
+			return true, nil, err
+		}
+
+		return false, nil, nil
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+
+	go func() {
+		done <- newStackController(clientset, stack, recorder).run(ctx, 1)
+	}()
+
+	// 一开始什么都没有，命名空间、Deployment 和 Service 都被创建出来
+	waitForEvent(t, recorder, "Deployment "+DEPLOYMENT_NAME+" was missing")
+	waitForEvent(t, recorder, "Service "+SERVICE_NAME+" was missing")
+
+	if _, err := clientset.CoreV1().Namespaces().Get(context.TODO(), NAMESPACE, metav1.GetOptions{}); err != nil {
+		t.Errorf("get namespace: %v", err)
+	}
+
+	// 有人把副本数改掉，之前还 restart 过一次
+	deployment, err := clientset.AppsV1().Deployments(NAMESPACE).Get(context.TODO(), DEPLOYMENT_NAME, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("get deployment: %v", err)
+	}
+
+	deployment.Spec.Replicas = pointer.Int32(5)
+	deployment.Spec.Template.Annotations = map[string]string{RESTARTED_AT_ANNOTATION: "2024-01-01T00:00:00Z"}
+	if _, err := clientset.AppsV1().Deployments(NAMESPACE).Update(context.TODO(), deployment, metav1.UpdateOptions{}); err != nil {
+		t.Fatalf("update deployment: %v", err)
+	}
+
+	waitForEvent(t, recorder, "Repaired")
+
+	err = wait.PollUntilContextTimeout(context.TODO(), 10*time.Millisecond, 10*time.Second, true, func(ctx context.Context) (bool, error) {
+		deployment, err := clientset.AppsV1().Deployments(NAMESPACE).Get(ctx, DEPLOYMENT_NAME, metav1.GetOptions{})
+		return err == nil && *deployment.Spec.Replicas == DEFAULT_REPLICAS, err
+	})
+	if err != nil {
+		t.Errorf("replicas were not reverted: %v", err)
+	}
+
+	// 修复只改回副本数，restart 的注解不能被去掉，否则会再触发一次 rollout
+	deployment, err = clientset.AppsV1().Deployments(NAMESPACE).Get(context.TODO(), DEPLOYMENT_NAME, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("get deployment: %v", err)
+	}
+
+	if deployment.Spec.Template.Annotations[RESTARTED_AT_ANNOTATION] == "" {
+		t.Errorf("repair removed the %s annotation", RESTARTED_AT_ANNOTATION)
+	}
+
+	// 有人删掉了 Service
+	if err := clientset.CoreV1().Services(NAMESPACE).Delete(context.TODO(), SERVICE_NAME, metav1.DeleteOptions{}); err != nil {
+		t.Fatalf("delete service: %v", err)
+	}
+
+	waitForEvent(t, recorder, "Service "+SERVICE_NAME+" was missing")
+
+	cancel()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("run: %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("controller did not stop after the context was cancelled")
+	}
+}
+
+func TestDrift(t *testing.T) {
+	desiredDeployment := newDeployment(stack)
+	live := desiredDeployment.DeepCopy()
+
+	// 服务端填充的默认值不算漂移
+	live.Spec.Template.Spec.Containers[0].TerminationMessagePath = "/dev/termination-log"
+	live.Spec.Strategy.Type = appsv1.RollingUpdateDeploymentStrategyType
+
+	if drift := deploymentDrift(live, desiredDeployment); len(drift) != 0 {
+		t.Errorf("deploymentDrift = %v, want none", drift)
+	}
+
+	live.Spec.Template.Spec.Containers[0].Image = "nginx"
+	if drift := deploymentDrift(live, desiredDeployment); len(drift) != 1 {
+		t.Errorf("deploymentDrift = %v, want the image", drift)
+	}
+
+	values := stack
+	values.NodePort = 0
+	desiredService := newService(values)
+
+	liveService := desiredService.DeepCopy()
+	liveService.Spec.Ports[0].NodePort = 31234
+	liveService.Spec.Ports[0].Protocol = apiv1.ProtocolTCP
+
+	if drift := serviceDrift(liveService, desiredService); len(drift) != 0 {
+		t.Errorf("serviceDrift = %v, want none for an allocated node port", drift)
+	}
+
+	// release 把流量切到 candidate 时加上的版本标签不算漂移
+	liveService.Spec.Selector[VERSION_LABEL] = "v2"
+	if drift := serviceDrift(liveService, desiredService); len(drift) != 0 {
+		t.Errorf("serviceDrift = %v, want none for a selector switched by release", drift)
+	}
+}
+
+func TestReconcileDeploymentDuringRelease(t *testing.T) {
+	stable := newDeployment(stack)
+	stable.Namespace = NAMESPACE
+
+	candidate := newCandidate(releaseOptions{strategy: STRATEGY_CANARY, version: "v2"}, stable, DEFAULT_REPLICAS, 1)
+	candidate.Namespace = NAMESPACE
+
+	// promote 之后 stack.DeploymentName 已被删除，candidate 成为 TRACK_LABEL=stable 的新 stable
+	promoted := candidate.DeepCopy()
+	promoted.Labels[TRACK_LABEL] = TRACK_STABLE
+	promoted.Annotations = nil
+	promoted.Spec.Replicas = pointer.Int32(DEFAULT_REPLICAS)
+
+	drifted := promoted.DeepCopy()
+	drifted.Spec.Replicas = pointer.Int32(5)
+
+	tests := []struct {
+		name    string
+		objects []*appsv1.Deployment
+		// wantWrite 是期望的写请求，格式为 verb/name，为空表示不应该修改任何 Deployment
+		wantWrite string
+	}{
+		{
+			// canary 把 stable 缩容到总副本数减去 candidate 的副本数，不是漂移
+			name:    "canary in progress",
+			objects: []*appsv1.Deployment{scaled(stable, DEFAULT_REPLICAS-1), candidate},
+		},
+		{
+			name:    "blue/green stable deleted before promote finished",
+			objects: []*appsv1.Deployment{candidate},
+		},
+		{
+			name:    "promoted stable",
+			objects: []*appsv1.Deployment{promoted},
+		},
+		{
+			name:      "promoted stable drifted",
+			objects:   []*appsv1.Deployment{drifted},
+			wantWrite: "update/" + promoted.Name,
+		},
+		{
+			name:      "no release",
+			objects:   []*appsv1.Deployment{scaled(stable, 5)},
+			wantWrite: "update/" + DEPLOYMENT_NAME,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clientset := fake.NewSimpleClientset()
+			c := newStackController(clientset, stack, record.NewFakeRecorder(100))
+
+			// 直接填充 informer 的缓存，不需要启动 informer
+			indexer := c.factory.Apps().V1().Deployments().Informer().GetIndexer()
+			for _, deployment := range tt.objects {
+				if err := indexer.Add(deployment); err != nil {
+					t.Fatalf("add %s to the cache: %v", deployment.Name, err)
+				}
+
+				if _, err := clientset.AppsV1().Deployments(NAMESPACE).Create(context.TODO(), deployment, metav1.CreateOptions{}); err != nil {
+					t.Fatalf("create %s: %v", deployment.Name, err)
+				}
+			}
+
+			clientset.ClearActions()
+
+			if err := c.reconcileDeployment(context.TODO()); err != nil {
+				t.Fatalf("reconcileDeployment: %v", err)
+			}
+
+			var writes []string
+			for _, action := range clientset.Actions() {
+				// UpdateAction 同样满足 CreateAction 接口，只能按 verb 区分
+				if verb := action.GetVerb(); verb == "create" || verb == "update" {
+					writes = append(writes, verb+"/"+action.(k8stesting.CreateAction).GetObject().(metav1.Object).GetName())
+				}
+			}
+
+			var want []string
+			if tt.wantWrite != "" {
+				want = []string{tt.wantWrite}
+			}
+
+			if strings.Join(writes, ",") != strings.Join(want, ",") {
+				t.Errorf("writes = %v, want %v", writes, want)
+			}
+		})
+	}
+}
+
+// scaled 返回副本数为 replicas 的 deployment 的副本
+func scaled(deployment *appsv1.Deployment, replicas int32) *appsv1.Deployment {
+	deployment = deployment.DeepCopy()
+	deployment.Spec.Replicas = pointer.Int32(replicas)
+	return deployment
+}
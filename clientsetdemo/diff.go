@@ -0,0 +1,151 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// DIFF_CONTEXT 是统一 diff 格式中每个改动前后保留的上下文行数，与 diff -u 的默认值相同
+const DIFF_CONTEXT = 3
+
+// diffLine 是逐行比较的一个结果，kind 为 ' '（两边相同）、'-'（只在旧文本中）或 '+'（只在新文本中）
+type diffLine struct {
+	kind byte
+	text string
+}
+
+// diffLines 基于最长公共子序列逐行比较两段文本。这里比较的是 Kubernetes 对象序列化后的 YAML，
+// 只有几十到几百行，O(n*m) 的动态规划足够用了。
+func diffLines(a, b []string) []diffLine {
+	// lcs[i][j] 是 a[i:] 和 b[j:] 的最长公共子序列长度
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	var lines []diffLine
+	i, j := 0, 0
+
+	for i < len(a) && j < len(b) {
+		switch {
+		case a[i] == b[j]:
+			lines = append(lines, diffLine{' ', a[i]})
+			i++
+			j++
+		case lcs[i+1][j] >= lcs[i][j+1]:
+			lines = append(lines, diffLine{'-', a[i]})
+			i++
+		default:
+			lines = append(lines, diffLine{'+', b[j]})
+			j++
+		}
+	}
+
+	for ; i < len(a); i++ {
+		lines = append(lines, diffLine{'-', a[i]})
+	}
+
+	for ; j < len(b); j++ {
+		lines = append(lines, diffLine{'+', b[j]})
+	}
+
+	return lines
+}
+
+// unifiedDiff 以 diff -u 的格式输出 from 到 to 的差异，两段文本相同时返回空字符串
+func unifiedDiff(fromName, toName, from, to string) string {
+	lines := diffLines(splitLines(from), splitLines(to))
+
+	// 找出所有改动行，把每个改动前后 DIFF_CONTEXT 行的范围合并成若干个 hunk
+	type hunk struct{ start, end int }
+	var hunks []hunk
+
+	for i, line := range lines {
+		if line.kind == ' ' {
+			continue
+		}
+
+		start, end := max(0, i-DIFF_CONTEXT), min(len(lines), i+DIFF_CONTEXT+1)
+
+		if len(hunks) > 0 && start <= hunks[len(hunks)-1].end {
+			hunks[len(hunks)-1].end = end
+		} else {
+			hunks = append(hunks, hunk{start, end})
+		}
+	}
+
+	if len(hunks) == 0 {
+		return ""
+	}
+
+	var out strings.Builder
+	fmt.Fprintf(&out, "--- %s\n+++ %s\n", fromName, toName)
+
+	// aLine 和 bLine 是当前位置之前两边已经消耗的行数
+	aLine, bLine, pos := 0, 0, 0
+
+	for _, h := range hunks {
+		for ; pos < h.start; pos++ {
+			aLine, bLine = aLine+1, bLine+1
+		}
+
+		aLen, bLen := 0, 0
+		for _, line := range lines[h.start:h.end] {
+			if line.kind != '+' {
+				aLen++
+			}
+			if line.kind != '-' {
+				bLen++
+			}
+		}
+
+		fmt.Fprintf(&out, "@@ -%s +%s @@\n", hunkRange(aLine, aLen), hunkRange(bLine, bLen))
+
+		for _, line := range lines[h.start:h.end] {
+			fmt.Fprintf(&out, "%c%s\n", line.kind, line.text)
+
+			if line.kind != '+' {
+				aLine++
+			}
+			if line.kind != '-' {
+				bLine++
+			}
+		}
+
+		pos = h.end
+	}
+
+	return out.String()
+}
+
+// hunkRange 生成 hunk 头中的 "起始行,行数"。按照统一 diff 的约定，行数为 0 时起始行是改动位置之前的那一行
+func hunkRange(consumed, length int) string {
+	if length == 0 {
+		return fmt.Sprintf("%d,0", consumed)
+	}
+
+	return fmt.Sprintf("%d,%d", consumed+1, length)
+}
+
+// splitLines 按行拆分文本，忽略末尾的换行
+func splitLines(text string) []string {
+	text = strings.TrimSuffix(text, "\n")
+
+	if text == "" {
+		return nil
+	}
+
+	return strings.Split(text, "\n")
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"reflect"
+
+	apiv1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/dynamic"
+	"sigs.k8s.io/yaml"
+)
+
+// dryRun 是所有写操作使用的 DryRun 参数。-dry-run=server 时为 []string{metav1.DryRunAll}，
+// API Server 会完整执行准入控制、默认值填充和校验，但不会把结果写入 etcd。
+var dryRun []string
+
+// parseDryRun 解析 -dry-run 参数，只支持 none 和 server 两种取值
+func parseDryRun(value string) ([]string, error) {
+	switch value {
+	case "", "none":
+		return nil, nil
+	case "server":
+		return []string{metav1.DryRunAll}, nil
+	}
+
+	return nil, fmt.Errorf("unknown dry run mode %q, must be none or server", value)
+}
+
+// createOptions 返回 Create 使用的 CreateOptions，带上 -dry-run 的设置
+func createOptions() metav1.CreateOptions {
+	return metav1.CreateOptions{DryRun: dryRun}
+}
+
+// dryRunSuffix 与 kubectl 一样，在 dry run 的输出后面加上 "(server dry run)"，避免误以为对象已经创建
+func dryRunSuffix() string {
+	if len(dryRun) > 0 {
+		return " (server dry run)"
+	}
+
+	return ""
+}
+
+// diffNoiseFields 是比较对象时要去掉的字段。它们由 API Server 维护，每次写入都会变化，
+// 与期望状态无关，留在 diff 里只会淹没真正的改动。
+var diffNoiseFields = [][]string{
+	{"apiVersion"},
+	{"kind"},
+	{"status"},
+	{"metadata", "managedFields"},
+	{"metadata", "resourceVersion"},
+	{"metadata", "uid"},
+	{"metadata", "creationTimestamp"},
+	{"metadata", "generation"},
+}
+
+// normalizeForDiff 把对象去掉 diffNoiseFields 后序列化为 YAML，对象为 nil（不存在）时返回空字符串
+func normalizeForDiff(obj runtime.Object) (string, error) {
+	content, err := diffContent(obj)
+
+	if err != nil {
+		return "", err
+	}
+
+	return marshalForDiff(content)
+}
+
+// diffContent 把对象转换为 map 并去掉 diffNoiseFields，对象为 nil（不存在）时返回 nil
+func diffContent(obj runtime.Object) (map[string]interface{}, error) {
+	if obj == nil {
+		return nil, nil
+	}
+
+	content, err := runtime.DefaultUnstructuredConverter.ToUnstructured(obj)
+
+	if err != nil {
+		return nil, err
+	}
+
+	for _, field := range diffNoiseFields {
+		unstructured.RemoveNestedField(content, field...)
+	}
+
+	return content, nil
+}
+
+// marshalForDiff 把 diffContent 的结果序列化为 YAML，content 为 nil 时返回空字符串
+func marshalForDiff(content map[string]interface{}) (string, error) {
+	if content == nil {
+		return "", nil
+	}
+
+	data, err := yaml.Marshal(content)
+
+	if err != nil {
+		return "", err
+	}
+
+	return string(data), nil
+}
+
+// SECRET_MASK 与 kubectl diff 相同，Secret 中的值在 diff 里都显示为它；值发生变化时两边分别加上 (before) 和 (after)
+const SECRET_MASK = "***"
+
+// maskSecretData 像 kubectl diff 一样把 Secret 的 data 和 stringData 中的值替换为 SECRET_MASK，
+// diff 中只能看出哪些键被增加、删除或修改，看不到值本身。live 或 merged 为 nil 表示对象不存在。
+func maskSecretData(live, merged map[string]interface{}) {
+	for _, field := range []string{"data", "stringData"} {
+		// NestedMap 返回的是副本，修改之后要写回去
+		liveData, liveFound, _ := unstructured.NestedMap(live, field)
+		mergedData, mergedFound, _ := unstructured.NestedMap(merged, field)
+
+		for key, before := range liveData {
+			after, ok := mergedData[key]
+
+			if ok && !reflect.DeepEqual(before, after) {
+				liveData[key], mergedData[key] = SECRET_MASK+" (before)", SECRET_MASK+" (after)"
+				continue
+			}
+
+			liveData[key] = SECRET_MASK
+			if ok {
+				mergedData[key] = SECRET_MASK
+			}
+		}
+
+		for key := range mergedData {
+			if _, ok := liveData[key]; !ok {
+				mergedData[key] = SECRET_MASK
+			}
+		}
+
+		if liveFound {
+			unstructured.SetNestedMap(live, liveData, field)
+		}
+
+		if mergedFound {
+			unstructured.SetNestedMap(merged, mergedData, field)
+		}
+	}
+}
+
+// dryRunApplyOptions 返回 diff 使用的 PatchOptions：与 apply 完全相同，只是一定以 dry run 的方式提交
+func dryRunApplyOptions() metav1.PatchOptions {
+	options := applyPatchOptions()
+	options.DryRun = []string{metav1.DryRunAll}
+
+	return options
+}
+
+// printObjectDiff 把线上对象与 dry run 结果之间的统一 diff 写到 out，返回两者是否不同。Secret 的值会被 maskSecretData 遮盖
+func printObjectDiff(out io.Writer, kind, name string, live, merged runtime.Object) (bool, error) {
+	liveContent, err := diffContent(live)
+
+	if err != nil {
+		return false, err
+	}
+
+	mergedContent, err := diffContent(merged)
+
+	if err != nil {
+		return false, err
+	}
+
+	if kind == "secret" {
+		maskSecretData(liveContent, mergedContent)
+	}
+
+	liveYAML, err := marshalForDiff(liveContent)
+
+	if err != nil {
+		return false, err
+	}
+
+	mergedYAML, err := marshalForDiff(mergedContent)
+
+	if err != nil {
+		return false, err
+	}
+
+	diff := unifiedDiff("live/"+kind+"/"+name, "merged/"+kind+"/"+name, liveYAML, mergedYAML)
+
+	fmt.Fprint(out, diff)
+
+	return diff != "", nil
+}
+
+// diffStack 把 stackObjects(values) 中的全部对象（与 applyStack 相同，包括 ConfigMap、Secret、Provision 等配套对象）
+// 以 dry run 的 server-side apply 提交，再与线上对象比较，把一次真正的 apply 会带来的改动写到 out。有差异时返回 true。
+// 命名空间还不存在时，命名空间级对象无法 dry run（API Server 会返回 NotFound），此时直接与本地构造的对象比较，结果中没有服务端默认值。
+func diffStack(out io.Writer, dynamicClient dynamic.Interface, values stackValues) (bool, error) {
+	changed := false
+	namespaceExists := true
+
+	for _, obj := range stackObjects(values) {
+		client, name, err := resourceClient(dynamicClient, obj)
+
+		if err != nil {
+			return changed, err
+		}
+
+		live, err := existingObject(client.Get(context.TODO(), name, metav1.GetOptions{}))
+
+		if err != nil {
+			return changed, err
+		}
+
+		// stackObjects 中命名空间排在最前面
+		if _, ok := obj.(*apiv1.Namespace); ok {
+			namespaceExists = live != nil
+		}
+
+		data, err := applyBody(obj)
+
+		if err != nil {
+			return changed, err
+		}
+
+		merged := obj
+
+		if result, err := client.Patch(context.TODO(), name, types.ApplyPatchType, data, dryRunApplyOptions()); err == nil {
+			merged = result
+		} else if !apierrors.IsNotFound(err) || namespaceExists {
+			return changed, fmt.Errorf("dry run apply %s %s: %w", qualifiedKind(obj), name, err)
+		}
+
+		different, err := printObjectDiff(out, qualifiedKind(obj), name, live, merged)
+
+		if err != nil {
+			return changed, err
+		}
+
+		changed = changed || different
+	}
+
+	return changed, nil
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"strings"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes/scheme"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func TestDiffStackIncludesCompanions(t *testing.T) {
+	live := defaultStackValues()
+
+	values := live
+	values.ConfigMap, values.ConfigData = true, map[string]string{"app.properties": "greeting=hello"}
+
+	dynamicClient := dynamicfake.NewSimpleDynamicClient(scheme.Scheme, stackObjects(live)...)
+
+	// fake 不支持 dry run 的 apply，这里记下 dry run 的资源，并把请求体原样作为合并结果返回
+	var diffed []string
+	dynamicClient.PrependReactor("patch", "*", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		patch := action.(k8stesting.PatchAction)
+		diffed = append(diffed, patch.GetResource().Resource)
+
+		obj := &unstructured.Unstructured{}
+		return true, obj, json.Unmarshal(patch.GetPatch(), &obj.Object)
+	})
+
+	changed, err := diffStack(io.Discard, dynamicClient, live)
+	if err != nil {
+		t.Fatalf("diffStack: %v", err)
+	}
+
+	if changed {
+		t.Errorf("diffStack reported changes for the stack that is already applied")
+	}
+
+	diffed = nil
+
+	changed, err = diffStack(io.Discard, dynamicClient, values)
+	if err != nil {
+		t.Fatalf("diffStack: %v", err)
+	}
+
+	if !changed {
+		t.Errorf("diffStack did not report the new configmap")
+	}
+
+	got := map[string]bool{}
+	for _, resource := range diffed {
+		got[resource] = true
+	}
+
+	if !got["configmaps"] {
+		t.Errorf("diff did not include configmaps, diffed %v", diffed)
+	}
+}
+
+func TestDiffStackMasksSecretValues(t *testing.T) {
+	live := defaultStackValues()
+	live.Secret, live.SecretData = true, map[string]string{"DB_PASSWORD": "old-password", "API_KEY": "same-key"}
+
+	values := live
+	values.SecretData = map[string]string{"DB_PASSWORD": "new-password", "API_KEY": "same-key", "TOKEN": "new-token"}
+
+	dynamicClient := dynamicfake.NewSimpleDynamicClient(scheme.Scheme, stackObjects(live)...)
+
+	// 与 TestDiffStackIncludesCompanions 相同，把请求体原样作为 dry run 的合并结果返回
+	dynamicClient.PrependReactor("patch", "*", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		obj := &unstructured.Unstructured{}
+		return true, obj, json.Unmarshal(action.(k8stesting.PatchAction).GetPatch(), &obj.Object)
+	})
+
+	var out bytes.Buffer
+	changed, err := diffStack(&out, dynamicClient, values)
+	if err != nil {
+		t.Fatalf("diffStack: %v", err)
+	}
+
+	if !changed {
+		t.Fatalf("diffStack did not report the changed secret")
+	}
+
+	diff := out.String()
+
+	for _, value := range []string{"old-password", "new-password", "same-key", "new-token"} {
+		if strings.Contains(diff, value) {
+			t.Errorf("diff shows the secret value %q:\n%s", value, diff)
+		}
+	}
+
+	// 与 kubectl diff 一样能看出哪个键被修改、哪个键是新增的，没有变化的键两边都是 ***
+	for _, want := range []string{"-  DB_PASSWORD: '*** (before)'", "+  DB_PASSWORD: '*** (after)'", "+  TOKEN: '***'", "   API_KEY: '***'"} {
+		if !strings.Contains(diff, want) {
+			t.Errorf("diff does not contain %q:\n%s", want, diff)
+		}
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+// 进程退出码。脚本可以根据退出码判断失败的原因，而不需要解析错误信息：
+//
+//	0  成功
+//	1  其他错误
+//	2  命令行参数错误
+//	3  NotFound：对象不存在
+//	4  AlreadyExists：对象已经存在，或者 Service 的名字、NodePort 与已有的 Service 冲突
+//	5  Forbidden：当前用户没有权限，或者 create、clean 的权限预检发现缺少权限
+//	6  Conflict：对象在读取之后被其他人修改
+//	7  Timeout：API Server 超时，或者 -wait、-wait-rollout 等待超时
+//	8  Unauthorized：认证失败，通常是 kubeconfig 中的凭据过期
+//	9  RolloutFailed：-wait-rollout 发现 rollout 失败
+//	10 DiffFound：-operate=diff 发现线上对象与期望状态不同
+//	11 Invalid：-operate=validate 发现对象有错误，或者 API Server 的校验拒绝了对象
+const (
+	EXIT_OK             = 0
+	EXIT_ERROR          = 1
+	EXIT_USAGE          = 2
+	EXIT_NOT_FOUND      = 3
+	EXIT_ALREADY_EXISTS = 4
+	EXIT_FORBIDDEN      = 5
+	EXIT_CONFLICT       = 6
+	EXIT_TIMEOUT        = 7
+	EXIT_UNAUTHORIZED   = 8
+	EXIT_ROLLOUT_FAILED = 9
+	EXIT_DIFF_FOUND     = 10
+	EXIT_INVALID        = 11
+)
+
+// errorFormat 是错误的输出格式，由 -error-format 参数指定：text 输出一行可读的信息，json 输出一个 JSON 对象
+var errorFormat = "text"
+
+// rolloutError 表示 rollout 本身失败（ProgressDeadlineExceeded、镜像拉取失败、CrashLoopBackOff 等），而不是 API 调用失败
+type rolloutError struct {
+	message string
+}
+
+func (e *rolloutError) Error() string {
+	return e.message
+}
+
+// usageError 表示命令行参数错误
+type usageError struct {
+	message string
+}
+
+func (e *usageError) Error() string {
+	return e.message
+}
+
+// invalidError 表示 -operate=validate 在本地发现了对象的错误，具体的问题已经输出到标准输出
+type invalidError struct {
+	message string
+}
+
+func (e *invalidError) Error() string {
+	return e.message
+}
+
+// permissionError 表示权限预检发现当前用户缺少权限，缺少的权限已经以矩阵输出到标准输出
+type permissionError struct {
+	message string
+}
+
+func (e *permissionError) Error() string {
+	return e.message
+}
+
+// serviceConflictError 表示 Service 的名字或 NodePort 与集群中已有的 Service 冲突，冲突报告已经输出到标准输出
+type serviceConflictError struct {
+	message string
+}
+
+func (e *serviceConflictError) Error() string {
+	return e.message
+}
+
+// classifyError 根据 apierrors 把错误归类，返回退出码和类别名称
+func classifyError(err error) (int, string) {
+	var rollout *rolloutError
+	var usage *usageError
+	var invalid *invalidError
+	var permission *permissionError
+	var serviceConflict *serviceConflictError
+
+	switch {
+	case errors.As(err, &usage):
+		return EXIT_USAGE, "Usage"
+	case apierrors.IsNotFound(err):
+		return EXIT_NOT_FOUND, "NotFound"
+	case errors.As(err, &serviceConflict), apierrors.IsAlreadyExists(err):
+		return EXIT_ALREADY_EXISTS, "AlreadyExists"
+	case errors.As(err, &permission), apierrors.IsForbidden(err):
+		return EXIT_FORBIDDEN, "Forbidden"
+	case errors.As(err, &invalid), apierrors.IsInvalid(err):
+		return EXIT_INVALID, "Invalid"
+	case apierrors.IsConflict(err):
+		return EXIT_CONFLICT, "Conflict"
+	case apierrors.IsTimeout(err), apierrors.IsServerTimeout(err), wait.Interrupted(err), errors.Is(err, context.DeadlineExceeded):
+		return EXIT_TIMEOUT, "Timeout"
+	case apierrors.IsUnauthorized(err):
+		return EXIT_UNAUTHORIZED, "Unauthorized"
+	case errors.As(err, &rollout):
+		return EXIT_ROLLOUT_FAILED, "RolloutFailed"
+	}
+
+	return EXIT_ERROR, "Error"
+}
+
+// errorReport 是 -error-format=json 时输出的内容
+type errorReport struct {
+	Reason   string `json:"reason"`
+	ExitCode int    `json:"exitCode"`
+	Message  string `json:"message"`
+	// 以下字段只有 API Server 返回的错误才有
+	HTTPStatus int32  `json:"httpStatus,omitempty"`
+	Kind       string `json:"kind,omitempty"`
+	Name       string `json:"name,omitempty"`
+}
+
+// exitOnError 在 err 不为 nil 时按 -error-format 把错误输出到标准错误，并以对应的退出码结束进程。
+// 之前这里都是 panic(err.Error())，会把整段调用栈打印到 CI 日志里。
+func exitOnError(err error) {
+	if err == nil {
+		return
+	}
+
+	code, reason := classifyError(err)
+	report := errorReport{
+		Reason:   reason,
+		ExitCode: code,
+		Message:  strings.ReplaceAll(err.Error(), "\n", " "),
+	}
+
+	var status apierrors.APIStatus
+	if errors.As(err, &status) {
+		report.HTTPStatus = status.Status().Code
+
+		if details := status.Status().Details; details != nil {
+			report.Kind = details.Kind
+			report.Name = details.Name
+		}
+	}
+
+	if errorFormat == "json" {
+		data, _ := json.Marshal(report)
+		fmt.Fprintln(os.Stderr, string(data))
+	} else {
+		fmt.Fprintf(os.Stderr, "error: %s: %s\n", reason, report.Message)
+	}
+
+	os.Exit(code)
+}
+
+// exitUsage 以命令行参数错误结束进程
+func exitUsage(format string, args ...interface{}) {
+	exitOnError(&usageError{message: fmt.Sprintf(format, args...)})
+}
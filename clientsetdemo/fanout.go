@@ -0,0 +1,262 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+)
+
+// namespaceList 实现了 flag.Value 接口，-namespaces 参数用逗号分隔多个命名空间，也可以重复出现
+type namespaceList []string
+
+func (l *namespaceList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *namespaceList) Set(value string) error {
+	for _, namespace := range strings.Split(value, ",") {
+		if namespace = strings.TrimSpace(namespace); namespace != "" {
+			*l = append(*l, namespace)
+		}
+	}
+
+	return nil
+}
+
+// fanOutResult 是 fan-out 中一个命名空间的执行结果，-report=json 时按这个结构输出
+type fanOutResult struct {
+	Namespace string `json:"namespace"`
+	Succeeded bool   `json:"succeeded"`
+	// Reason 和 ExitCode 是 classifyError 对错误的分类，成功时为空
+	Reason   string `json:"reason,omitempty"`
+	ExitCode int    `json:"exitCode,omitempty"`
+	Error    string `json:"error,omitempty"`
+	Duration string `json:"duration"`
+
+	// err 是原始的错误，用于决定进程的退出码
+	err error
+}
+
+// selectNamespaces 返回标签匹配 selector 的全部命名空间，按名字排序
+func selectNamespaces(clientset kubernetes.Interface, selector string) ([]string, error) {
+	list, err := clientset.CoreV1().Namespaces().List(context.TODO(), metav1.ListOptions{LabelSelector: selector})
+
+	if err != nil {
+		return nil, err
+	}
+
+	var namespaces []string
+	for _, namespace := range list.Items {
+		namespaces = append(namespaces, namespace.Name)
+	}
+
+	sort.Strings(namespaces)
+
+	return namespaces, nil
+}
+
+// fanOut 用最多 concurrency 个 worker 并发地对每个命名空间执行 run，等全部完成后按 namespaces 的顺序返回结果。
+// 一个命名空间失败不会影响其他命名空间。
+func fanOut(namespaces []string, concurrency int, run func(namespace string) error) []fanOutResult {
+	results := make([]fanOutResult, len(namespaces))
+	indexes := make(chan int)
+
+	var wg sync.WaitGroup
+
+	for i := 0; i < concurrency && i < len(namespaces); i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			for index := range indexes {
+				start := time.Now()
+				err := run(namespaces[index])
+
+				result := fanOutResult{
+					Namespace: namespaces[index],
+					Succeeded: err == nil,
+					Duration:  time.Since(start).Round(time.Millisecond).String(),
+				}
+
+				if err != nil {
+					result.err = err
+					result.ExitCode, result.Reason = classifyError(err)
+					result.Error = strings.ReplaceAll(err.Error(), "\n", " ")
+				}
+
+				results[index] = result
+			}
+		}()
+	}
+
+	for i := range namespaces {
+		indexes <- i
+	}
+
+	close(indexes)
+	wg.Wait()
+
+	return results
+}
+
+// createInNamespace 在 namespace 中创建整套对象，进度写到 out。开发者的命名空间通常已经存在，这时直接使用它，
+// 不算失败；clean 只会删除带有 ownershipLabels 的命名空间，已有的命名空间不会被删掉。
+// 创建之前先由 services 检查 Service 冲突，各个命名空间的 Service 会分到不同的 NodePort。
+func createInNamespace(out io.Writer, clientset kubernetes.Interface, namespace string, services *servicePreflight) error {
+	values := stack
+	values.Namespace = namespace
+
+	values, err := services.check(out, clientset, values)
+
+	if err != nil {
+		return err
+	}
+
+	if err := createNamespace(out, clientset, values); err != nil {
+		if !apierrors.IsAlreadyExists(err) {
+			return err
+		}
+
+		fmt.Fprintf(out, "namespace %s already exists, reuse it\n", namespace)
+	}
+
+	return createStackObjects(out, clientset, values)
+}
+
+// fanOutOperate 对每个命名空间执行 create 或 clean，返回每个命名空间的结果。有命名空间失败时还返回包装了第一个失败的命名空间的错误，
+// 进程的退出码因此与这个错误的类别相同，例如全部因为权限不足失败时是 EXIT_FORBIDDEN。
+// waitRollout 为 true 时 create 还要等到 Deployment rollout 完成才算成功。每个命名空间的进度都写到 out，与最后的报告分开。
+//
+// 每个命名空间的 Service 使用同一个 -node-port，一个 NodePort 在集群中只能属于一个 Service，按 -node-port-conflict=fail
+// 除了第一个命名空间全都会失败。所以 fan-out 总是以 allocate 方式检查 Service 冲突：第一个命名空间使用 -node-port，
+// 其余的命名空间从 -node-port-range 中分到各自的空闲端口，-node-port-conflict 对 fan-out 不起作用。
+func fanOutOperate(out io.Writer, clientset kubernetes.Interface, dynamicClient dynamic.Interface, operate string, namespaces []string, concurrency int, options cleanOptions, waitRollout bool) ([]fanOutResult, error) {
+	services := newServicePreflight(true)
+
+	// 各个命名空间的进度并发地写到 out，每一行前面加上命名空间，同一行不会被其他命名空间的输出打断
+	var mu sync.Mutex
+
+	results := fanOut(namespaces, concurrency, func(namespace string) error {
+		out := &prefixWriter{mu: &mu, out: out, prefix: "[" + namespace + "] "}
+		defer out.flush()
+
+		if operate == "clean" {
+			return cleanOwned(out, clientset, dynamicClient, []string{namespace}, options)
+		}
+
+		if err := createInNamespace(out, clientset, namespace, services); err != nil {
+			return err
+		}
+
+		if waitRollout && len(dryRun) == 0 {
+			return waitForWorkload(out, clientset, workloadKinds[stack.Workload], namespace, stack.DeploymentName, options.timeout)
+		}
+
+		return nil
+	})
+
+	for _, result := range results {
+		if !result.Succeeded {
+			return results, fmt.Errorf("%s failed in %d of %d namespace(s), first failure in %s: %w", operate, countFailed(results), len(results), result.Namespace, result.err)
+		}
+	}
+
+	return results, nil
+}
+
+// prefixWriter 在写到 out 的每一行前面加上 prefix。不完整的行先缓存在 buf 中，等到换行符或者 flush 时
+// 才在 mu 的保护下整行写出，多个共享 mu 的 prefixWriter 并发写同一个 out 时各自的行不会交错
+type prefixWriter struct {
+	mu     *sync.Mutex
+	out    io.Writer
+	prefix string
+	buf    []byte
+}
+
+func (w *prefixWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			return len(p), nil
+		}
+
+		if err := w.writeLine(w.buf[:i+1]); err != nil {
+			return len(p), err
+		}
+
+		w.buf = w.buf[i+1:]
+	}
+}
+
+// flush 写出缓存中没有换行符结尾的最后一行
+func (w *prefixWriter) flush() {
+	if len(w.buf) > 0 {
+		w.writeLine(append(w.buf, '\n'))
+		w.buf = nil
+	}
+}
+
+func (w *prefixWriter) writeLine(line []byte) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	_, err := io.WriteString(w.out, w.prefix+string(line))
+	return err
+}
+
+func countFailed(results []fanOutResult) int {
+	failed := 0
+
+	for _, result := range results {
+		if !result.Succeeded {
+			failed++
+		}
+	}
+
+	return failed
+}
+
+// printFanOutReport 把每个命名空间的结果写到 out，format 为 table 或 json
+func printFanOutReport(out io.Writer, results []fanOutResult, format string) {
+	if format == "json" {
+		data, err := json.MarshalIndent(results, "", "  ")
+
+		if err != nil {
+			exitOnError(err)
+		}
+
+		fmt.Fprintln(out, string(data))
+		return
+	}
+
+	writer := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(writer, "NAMESPACE\tSTATUS\tDURATION\tERROR")
+
+	for _, result := range results {
+		status, message := "Succeeded", ""
+		if !result.Succeeded {
+			status, message = "Failed ("+result.Reason+")", result.Error
+		}
+
+		fmt.Fprintf(writer, "%s\t%s\t%s\t%s\n", result.Namespace, status, result.Duration, message)
+	}
+
+	writer.Flush()
+
+	fmt.Fprintf(out, "%d succeeded, %d failed\n", len(results)-countFailed(results), countFailed(results))
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+
+	apiv1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func TestFanOutConcurrency(t *testing.T) {
+	namespaces := []string{"a", "b", "c", "d", "e", "f", "g"}
+
+	var mu sync.Mutex
+	running, peak := 0, 0
+
+	results := fanOut(namespaces, 3, func(namespace string) error {
+		mu.Lock()
+		running++
+		if running > peak {
+			peak = running
+		}
+		mu.Unlock()
+
+		defer func() {
+			mu.Lock()
+			running--
+			mu.Unlock()
+		}()
+
+		if namespace == "c" {
+			return errors.New("boom")
+		}
+
+		return nil
+	})
+
+	if peak > 3 {
+		t.Errorf("%d namespaces ran at the same time, want at most 3", peak)
+	}
+
+	if len(results) != len(namespaces) {
+		t.Fatalf("got %d results, want %d", len(results), len(namespaces))
+	}
+
+	for i, result := range results {
+		if result.Namespace != namespaces[i] {
+			t.Errorf("result %d is for %s, want %s", i, result.Namespace, namespaces[i])
+		}
+
+		if wantSucceeded := result.Namespace != "c"; result.Succeeded != wantSucceeded {
+			t.Errorf("%s: succeeded = %v, want %v", result.Namespace, result.Succeeded, wantSucceeded)
+		}
+	}
+}
+
+func TestFanOutOperateCreate(t *testing.T) {
+	// alice 已经存在，bob 的 Service 创建被拒绝，carol 从零开始创建
+	clientset := fake.NewSimpleClientset(&apiv1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "alice"}})
+	clientset.PrependReactor("create", "services", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if action.GetNamespace() == "bob" {
+			return true, nil, apierrors.NewForbidden(servicesResource.GroupResource(), SERVICE_NAME, errors.New("denied"))
+		}
+
+		return false, nil, nil
+	})
+
+	var progress bytes.Buffer
+	results, err := fanOutOperate(&progress, clientset, nil, "create", []string{"alice", "bob", "carol"}, 2, cleanOptions{}, false)
+
+	if !apierrors.IsForbidden(err) {
+		t.Fatalf("fanOutOperate: got error %v, want the Forbidden error from bob", err)
+	}
+
+	if code, _ := classifyError(err); code != EXIT_FORBIDDEN {
+		t.Errorf("exit code %d, want %d", code, EXIT_FORBIDDEN)
+	}
+
+	for _, namespace := range []string{"alice", "carol"} {
+		if _, err := clientset.CoreV1().Services(namespace).Get(context.TODO(), SERVICE_NAME, metav1.GetOptions{}); err != nil {
+			t.Errorf("%s: get service: %v", namespace, err)
+		}
+	}
+
+	// 并发的命名空间写出的每一行进度都以自己的命名空间开头
+	for _, line := range strings.Split(strings.TrimSuffix(progress.String(), "\n"), "\n") {
+		if !strings.HasPrefix(line, "[alice] ") && !strings.HasPrefix(line, "[bob] ") && !strings.HasPrefix(line, "[carol] ") {
+			t.Errorf("progress line %q has no namespace prefix", line)
+		}
+	}
+
+	if !strings.Contains(progress.String(), "[alice] namespace alice already exists, reuse it\n") {
+		t.Errorf("progress of alice is missing:\n%s", progress.String())
+	}
+
+	var out bytes.Buffer
+	printFanOutReport(&out, results, "json")
+
+	var report []fanOutResult
+	if err := json.Unmarshal(out.Bytes(), &report); err != nil {
+		t.Fatalf("the json report does not parse: %v\n%s", err, out.String())
+	}
+
+	want := map[string]bool{"alice": true, "bob": false, "carol": true}
+	for _, result := range report {
+		if result.Succeeded != want[result.Namespace] {
+			t.Errorf("%s: succeeded = %v, want %v", result.Namespace, result.Succeeded, want[result.Namespace])
+		}
+
+		if !result.Succeeded && result.Reason != "Forbidden" {
+			t.Errorf("%s: reason %q, want Forbidden", result.Namespace, result.Reason)
+		}
+	}
+}
+
+func TestFanOutOperateNodePorts(t *testing.T) {
+	// 默认的 -node-port 和 -node-port-conflict，三个命名空间的 Service 不能都使用同一个 NodePort
+	clientset := fake.NewSimpleClientset()
+	namespaces := []string{"alice", "bob", "carol"}
+
+	// concurrency 为 1，只有一个 worker 写 progress
+	var progress bytes.Buffer
+	if _, err := fanOutOperate(&progress, clientset, nil, "create", namespaces, 1, cleanOptions{}, false); err != nil {
+		t.Fatalf("fanOutOperate: %v", err)
+	}
+
+	if !strings.Contains(progress.String(), "Create namespace carol") {
+		t.Errorf("progress %q does not report the namespaces being created", progress.String())
+	}
+
+	used := map[int32]string{}
+	for _, namespace := range namespaces {
+		service, err := clientset.CoreV1().Services(namespace).Get(context.TODO(), SERVICE_NAME, metav1.GetOptions{})
+		if err != nil {
+			t.Fatalf("%s: get service: %v", namespace, err)
+		}
+
+		port := service.Spec.Ports[0].NodePort
+		if owner, found := used[port]; found {
+			t.Errorf("%s and %s both got node port %d", owner, namespace, port)
+		}
+
+		used[port] = namespace
+	}
+
+	if used[DEFAULT_NODE_PORT] != "alice" {
+		t.Errorf("node ports %v, want the first namespace to keep %d", used, DEFAULT_NODE_PORT)
+	}
+}
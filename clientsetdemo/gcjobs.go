@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	batchv1 "k8s.io/api/batch/v1"
+	apiv1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+)
+
+// JOB_NAME_LABEL 是 Job controller 加在它创建的 Pod 上的标签。
+// 1.27 之后还会加上 batch.kubernetes.io/job-name，但为了兼容旧集群仍然保留了这个标签，按它筛选两种集群都适用。
+const JOB_NAME_LABEL = "job-name"
+
+// gcSummary 统计一次 gc-jobs 的结果
+type gcSummary struct {
+	succeeded   int
+	failed      int
+	orphanPods  int
+	skipped     int
+	deleteError int
+}
+
+// jobFinishedAt 判断 Job 是否已经结束（Complete 或 Failed 条件为 True），返回结束时间和最终状态
+func jobFinishedAt(job *batchv1.Job) (time.Time, batchv1.JobConditionType, bool) {
+	for _, condition := range job.Status.Conditions {
+		if condition.Status != apiv1.ConditionTrue {
+			continue
+		}
+
+		if condition.Type == batchv1.JobComplete || condition.Type == batchv1.JobFailed {
+			finishedAt := condition.LastTransitionTime.Time
+
+			if condition.Type == batchv1.JobComplete && job.Status.CompletionTime != nil {
+				finishedAt = job.Status.CompletionTime.Time
+			}
+
+			return finishedAt, condition.Type, true
+		}
+	}
+
+	return time.Time{}, "", false
+}
+
+// gcJobs 删除 namespace 中结束时间早于 minAge 之前的 Job（成功或失败都算），namespace 为空表示全部命名空间。
+// Job 使用 Background 策略删除，由垃圾回收器在后台清理它创建的 Pod。
+// 之后再删除那些 ownerReference 指向的 Job 已经不存在的 Pod，例如垃圾回收器还没来得及处理就被中断而遗留下来的 Pod。
+// Job 和 Pod 是分两次 list 的，删除 Pod 之前先用 jobOwnersGone 向 API Server 确认它的 Job 确实不存在，
+// 删除时带上 Pod 的 UID 作为前置条件，期间被替换成同名新 Pod 时不会误删。
+// -dry-run=server 时只输出将要删除的对象。
+// 个别对象删除失败时继续处理其余的对象，最后返回包装了第一个失败的错误，退出码与这个错误的类别相同。
+func gcJobs(clientset kubernetes.Interface, namespace string, minAge time.Duration) error {
+	background := metav1.DeletePropagationBackground
+	deleteOptions := metav1.DeleteOptions{PropagationPolicy: &background, DryRun: dryRun}
+
+	jobs, err := clientset.BatchV1().Jobs(namespace).List(context.TODO(), metav1.ListOptions{})
+
+	if err != nil {
+		return err
+	}
+
+	summary := gcSummary{}
+	now := time.Now()
+
+	// firstErr 是第一个删除失败的错误
+	var firstErr error
+
+	// remaining 是删除之后仍然存在的 Job，deleted 是本次删除的 Job，两者都不是孤儿 Pod 的所有者
+	remaining := map[types.UID]bool{}
+	deleted := map[types.UID]bool{}
+
+	for i := range jobs.Items {
+		job := &jobs.Items[i]
+		finishedAt, result, finished := jobFinishedAt(job)
+
+		if !finished || now.Sub(finishedAt) < minAge {
+			remaining[job.UID] = true
+			summary.skipped++
+			continue
+		}
+
+		err := clientset.BatchV1().Jobs(job.Namespace).Delete(context.TODO(), job.Name, deleteOptions)
+
+		if err != nil {
+			fmt.Printf("Delete job %s/%s failed: %v\n", job.Namespace, job.Name, err)
+			remaining[job.UID] = true
+			summary.deleteError++
+
+			if firstErr == nil {
+				firstErr = fmt.Errorf("delete job %s/%s: %w", job.Namespace, job.Name, err)
+			}
+			continue
+		}
+
+		deleted[job.UID] = true
+
+		if result == batchv1.JobComplete {
+			summary.succeeded++
+		} else {
+			summary.failed++
+		}
+
+		fmt.Printf("Delete job %s/%s (%s %v ago)%s \n", job.Namespace, job.Name, result, now.Sub(finishedAt).Round(time.Second), dryRunSuffix())
+	}
+
+	pods, err := clientset.CoreV1().Pods(namespace).List(context.TODO(), metav1.ListOptions{LabelSelector: JOB_NAME_LABEL})
+
+	if err != nil {
+		return err
+	}
+
+	for i := range pods.Items {
+		pod := &pods.Items[i]
+
+		if !isOrphanJobPod(pod, remaining, deleted) {
+			continue
+		}
+
+		gone, err := jobOwnersGone(clientset, pod)
+
+		if err != nil {
+			fmt.Printf("Check the job of pod %s/%s failed: %v\n", pod.Namespace, pod.Name, err)
+			summary.deleteError++
+
+			if firstErr == nil {
+				firstErr = fmt.Errorf("check the job of pod %s/%s: %w", pod.Namespace, pod.Name, err)
+			}
+			continue
+		}
+
+		// 例如在两次 list 之间创建的 Job，它的 Pod 正在运行
+		if !gone {
+			continue
+		}
+
+		podDeleteOptions := deleteOptions
+		podDeleteOptions.Preconditions = metav1.NewUIDPreconditions(string(pod.UID))
+
+		err = clientset.CoreV1().Pods(pod.Namespace).Delete(context.TODO(), pod.Name, podDeleteOptions)
+
+		if err != nil {
+			fmt.Printf("Delete orphaned pod %s/%s failed: %v\n", pod.Namespace, pod.Name, err)
+			summary.deleteError++
+
+			if firstErr == nil {
+				firstErr = fmt.Errorf("delete orphaned pod %s/%s: %w", pod.Namespace, pod.Name, err)
+			}
+			continue
+		}
+
+		summary.orphanPods++
+		fmt.Printf("Delete orphaned pod %s/%s (job %s is gone)%s \n", pod.Namespace, pod.Name, pod.Labels[JOB_NAME_LABEL], dryRunSuffix())
+	}
+
+	fmt.Printf("Deleted %d succeeded job(s), %d failed job(s) and %d orphaned pod(s), kept %d job(s) still running or younger than %v, %d error(s)%s\n",
+		summary.succeeded, summary.failed, summary.orphanPods, summary.skipped, minAge, summary.deleteError, dryRunSuffix())
+
+	if summary.deleteError > 0 {
+		return fmt.Errorf("gc-jobs failed to delete %d object(s), first failure: %w", summary.deleteError, firstErr)
+	}
+
+	return nil
+}
+
+// isOrphanJobPod 判断 Pod 是否是孤儿：它有 kind 为 Job 的 ownerReference，并且这些 Job（按 UID）都已经不存在。
+// 只带有 job-name 标签、没有 Job ownerReference 的 Pod 可能是别人手工创建的，不算孤儿；
+// 本次刚删除的 Job 的 Pod 由垃圾回收器负责，也不算孤儿。
+func isOrphanJobPod(pod *apiv1.Pod, remaining, deleted map[types.UID]bool) bool {
+	orphan := false
+
+	for _, owner := range pod.OwnerReferences {
+		if !isJobOwner(owner) {
+			continue
+		}
+
+		if remaining[owner.UID] || deleted[owner.UID] {
+			return false
+		}
+
+		orphan = true
+	}
+
+	return orphan
+}
+
+// jobOwnersGone 向 API Server 确认 Pod 的每个 Job ownerReference 都已经不存在：按名字读取不到，或者同名的 Job 已经是另一个 UID。
+// isOrphanJobPod 只依据之前 list 到的 Job，在那之后创建的 Job 不在其中，它的 Pod 会被误判为孤儿。
+func jobOwnersGone(clientset kubernetes.Interface, pod *apiv1.Pod) (bool, error) {
+	for _, owner := range pod.OwnerReferences {
+		if !isJobOwner(owner) {
+			continue
+		}
+
+		job, err := clientset.BatchV1().Jobs(pod.Namespace).Get(context.TODO(), owner.Name, metav1.GetOptions{})
+
+		if apierrors.IsNotFound(err) {
+			continue
+		}
+
+		if err != nil {
+			return false, err
+		}
+
+		if job.UID == owner.UID {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
+
+// isJobOwner 判断 ownerReference 是否指向 batch API 组中的 Job
+func isJobOwner(owner metav1.OwnerReference) bool {
+	return owner.Kind == "Job" && strings.HasPrefix(owner.APIVersion, batchv1.GroupName+"/")
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	batchv1 "k8s.io/api/batch/v1"
+	apiv1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+// gcJobsObjects 返回 gc-jobs 测试使用的 Job 和 Pod：
+// 两小时前结束的 old、一分钟前结束的 young、还在运行的 running，以及各种带 job-name 标签的 Pod
+func gcJobsObjects() []runtime.Object {
+	job := func(name string, finished time.Duration) *batchv1.Job {
+		job := &batchv1.Job{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: NAMESPACE, UID: types.UID(name + "-uid")}}
+
+		if finished > 0 {
+			job.Status.Conditions = []batchv1.JobCondition{{
+				Type:               batchv1.JobComplete,
+				Status:             apiv1.ConditionTrue,
+				LastTransitionTime: metav1.NewTime(time.Now().Add(-finished)),
+			}}
+		}
+
+		return job
+	}
+
+	pod := func(name, ownerKind, ownerUID string) *apiv1.Pod {
+		pod := &apiv1.Pod{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: NAMESPACE, UID: types.UID(name + "-pod-uid"), Labels: map[string]string{JOB_NAME_LABEL: name}}}
+
+		if ownerKind != "" {
+			apiVersion := "batch/v1"
+			if ownerKind == "ReplicaSet" {
+				apiVersion = "apps/v1"
+			}
+
+			pod.OwnerReferences = []metav1.OwnerReference{{APIVersion: apiVersion, Kind: ownerKind, Name: name, UID: types.UID(ownerUID)}}
+		}
+
+		return pod
+	}
+
+	return []runtime.Object{
+		job("old", 2*time.Hour),
+		job("young", time.Minute),
+		job("running", 0),
+		pod("orphan", "Job", "gone-uid"),
+		pod("of-running", "Job", "running-uid"),
+		pod("no-owner", "", ""),
+		pod("of-replicaset", "ReplicaSet", "gone-uid"),
+	}
+}
+
+// remainingNames 返回 list 之后仍然存在的对象的名字，按名字排序
+func remainingNames(t *testing.T, clientset *fake.Clientset) (jobs, pods []string) {
+	t.Helper()
+
+	jobList, err := clientset.BatchV1().Jobs(NAMESPACE).List(context.TODO(), metav1.ListOptions{})
+	if err != nil {
+		t.Fatalf("list jobs: %v", err)
+	}
+
+	for _, job := range jobList.Items {
+		jobs = append(jobs, job.Name)
+	}
+
+	podList, err := clientset.CoreV1().Pods(NAMESPACE).List(context.TODO(), metav1.ListOptions{})
+	if err != nil {
+		t.Fatalf("list pods: %v", err)
+	}
+
+	for _, pod := range podList.Items {
+		pods = append(pods, pod.Name)
+	}
+
+	sort.Strings(jobs)
+	sort.Strings(pods)
+
+	return jobs, pods
+}
+
+func TestGCJobs(t *testing.T) {
+	clientset := fake.NewSimpleClientset(gcJobsObjects()...)
+
+	if err := gcJobs(clientset, NAMESPACE, time.Hour); err != nil {
+		t.Fatalf("gcJobs: %v", err)
+	}
+
+	jobs, pods := remainingNames(t, clientset)
+
+	// 只有结束超过一小时的 old 被删除
+	if want := []string{"running", "young"}; !reflect.DeepEqual(jobs, want) {
+		t.Errorf("jobs after gc = %v, want %v", jobs, want)
+	}
+
+	// 只有 ownerReference 指向已经不存在的 Job 的 orphan 被删除
+	if want := []string{"no-owner", "of-replicaset", "of-running"}; !reflect.DeepEqual(pods, want) {
+		t.Errorf("pods after gc = %v, want %v", pods, want)
+	}
+}
+
+func TestGCJobsDryRun(t *testing.T) {
+	dryRun = []string{metav1.DryRunAll}
+	defer func() { dryRun = nil }()
+
+	clientset := fake.NewSimpleClientset(gcJobsObjects()...)
+
+	if err := gcJobs(clientset, NAMESPACE, time.Hour); err != nil {
+		t.Fatalf("gcJobs: %v", err)
+	}
+
+	// fake clientset 不理会 dryRun，这里检查每个删除请求都带着它
+	deletes := 0
+	for _, action := range clientset.Actions() {
+		if action, ok := action.(k8stesting.DeleteAction); ok {
+			deletes++
+
+			if options := action.GetDeleteOptions(); len(options.DryRun) != 1 || options.DryRun[0] != metav1.DryRunAll {
+				t.Errorf("delete %s %s without dryRun: %+v", action.GetResource().Resource, action.GetName(), options)
+			}
+		}
+	}
+
+	if deletes != 2 {
+		t.Errorf("%d delete request(s), want 2 for the old job and the orphaned pod", deletes)
+	}
+}
+
+func TestGCJobsDeleteError(t *testing.T) {
+	clientset := fake.NewSimpleClientset(gcJobsObjects()...)
+	clientset.PrependReactor("delete", "jobs", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, apierrors.NewForbidden(batchv1.Resource("jobs"), action.(k8stesting.DeleteAction).GetName(), errors.New("denied"))
+	})
+
+	err := gcJobs(clientset, NAMESPACE, time.Hour)
+
+	if !apierrors.IsForbidden(err) {
+		t.Fatalf("gcJobs returned %v, want the Forbidden error", err)
+	}
+
+	// Job 删除失败不影响孤儿 Pod 的清理
+	if _, pods := remainingNames(t, clientset); len(pods) != 3 {
+		t.Errorf("pods after gc = %v, want the orphaned pod deleted", pods)
+	}
+}
+
+func TestGCJobsJobCreatedBetweenLists(t *testing.T) {
+	late := &apiv1.Pod{ObjectMeta: metav1.ObjectMeta{
+		Name:            "late-abcde",
+		Namespace:       NAMESPACE,
+		UID:             "late-abcde-pod-uid",
+		Labels:          map[string]string{JOB_NAME_LABEL: "late"},
+		OwnerReferences: []metav1.OwnerReference{{APIVersion: "batch/v1", Kind: "Job", Name: "late", UID: "late-uid"}},
+	}}
+
+	clientset := fake.NewSimpleClientset(append(gcJobsObjects(), late)...)
+
+	// 在 list Job 之后、list Pod 之前创建 Job late，它不在 gcJobs 看到的 Job 列表中
+	clientset.PrependReactor("list", "pods", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		job := &batchv1.Job{ObjectMeta: metav1.ObjectMeta{Name: "late", Namespace: NAMESPACE, UID: "late-uid"}}
+
+		// reactor 在 fake clientset 的锁中执行，直接写入 tracker；返回 false 让默认的 reactor 继续 list
+		if err := clientset.Tracker().Add(job); err != nil && !apierrors.IsAlreadyExists(err) {
+			return true, nil, err
+		}
+
+		return false, nil, nil
+	})
+
+	if err := gcJobs(clientset, NAMESPACE, time.Hour); err != nil {
+		t.Fatalf("gcJobs: %v", err)
+	}
+
+	// late 的 Pod 仍然有 Job，不是孤儿；只有 orphan 被删除
+	if _, pods := remainingNames(t, clientset); !reflect.DeepEqual(pods, []string{"late-abcde", "no-owner", "of-replicaset", "of-running"}) {
+		t.Errorf("pods after gc = %v, want the pod of job late kept", pods)
+	}
+
+	// 删除孤儿 Pod 时带着它的 UID 作为前置条件
+	for _, action := range clientset.Actions() {
+		if action, ok := action.(k8stesting.DeleteAction); ok && action.GetResource().Resource == "pods" {
+			if preconditions := action.GetDeleteOptions().Preconditions; preconditions == nil || preconditions.UID == nil || *preconditions.UID != "orphan-pod-uid" {
+				t.Errorf("delete pod %s with preconditions %+v, want its UID", action.GetName(), preconditions)
+			}
+		}
+	}
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"text/tabwriter"
+
+	appsv1 "k8s.io/api/apps/v1"
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/util/retry"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	// REVISION_ANNOTATION 是 Deployment controller 写在 ReplicaSet 上的修订号
+	REVISION_ANNOTATION = "deployment.kubernetes.io/revision"
+	// CHANGE_CAUSE_ANNOTATION 记录这次修改的原因，kubectl 的 --record 和 kubectl annotate 都会写入它
+	CHANGE_CAUSE_ANNOTATION = "kubernetes.io/change-cause"
+)
+
+// revision 是 Deployment 的一个历史版本，对应一个由它控制的 ReplicaSet
+type revision struct {
+	number     int64
+	replicaSet *appsv1.ReplicaSet
+}
+
+// listRevisions 列出 Deployment 控制的全部 ReplicaSet，按修订号从小到大排序
+func listRevisions(clientset kubernetes.Interface, deployment *appsv1.Deployment) ([]revision, error) {
+	selector, err := metav1.LabelSelectorAsSelector(deployment.Spec.Selector)
+
+	if err != nil {
+		return nil, err
+	}
+
+	replicaSets, err := clientset.AppsV1().ReplicaSets(deployment.Namespace).List(context.TODO(), metav1.ListOptions{LabelSelector: selector.String()})
+
+	if err != nil {
+		return nil, err
+	}
+
+	var revisions []revision
+
+	for i := range replicaSets.Items {
+		rs := &replicaSets.Items[i]
+
+		// selector 相同的 ReplicaSet 不一定属于这个 Deployment，只保留 ownerReference 指向它的
+		if !metav1.IsControlledBy(rs, deployment) {
+			continue
+		}
+
+		number, err := strconv.ParseInt(rs.Annotations[REVISION_ANNOTATION], 10, 64)
+
+		if err != nil {
+			continue
+		}
+
+		revisions = append(revisions, revision{number: number, replicaSet: rs})
+	}
+
+	sort.Slice(revisions, func(i, j int) bool {
+		return revisions[i].number < revisions[j].number
+	})
+
+	return revisions, nil
+}
+
+// podTemplateYAML 把 ReplicaSet 的 Pod 模板序列化为 YAML。
+// pod-template-hash 标签是 Deployment controller 为每个 ReplicaSet 单独生成的，每个版本都不同，比较前先去掉。
+func podTemplateYAML(template apiv1.PodTemplateSpec) (string, error) {
+	template = *template.DeepCopy()
+	delete(template.Labels, appsv1.DefaultDeploymentUniqueLabelKey)
+
+	data, err := yaml.Marshal(template)
+
+	if err != nil {
+		return "", err
+	}
+
+	return string(data), nil
+}
+
+// showHistory 把 Deployment 的修订历史写到 out，每个版本附带与上一个版本之间 Pod 模板的差异
+func showHistory(out io.Writer, clientset kubernetes.Interface, name string) error {
+	deployment, err := clientset.AppsV1().Deployments(stack.Namespace).Get(context.TODO(), name, metav1.GetOptions{})
+
+	if err != nil {
+		return err
+	}
+
+	revisions, err := listRevisions(clientset, deployment)
+
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(out, "deployment.apps/%s\n", name)
+
+	writer := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(writer, "REVISION\tREPLICASET\tREPLICAS\tCHANGE-CAUSE")
+
+	for _, r := range revisions {
+		changeCause := r.replicaSet.Annotations[CHANGE_CAUSE_ANNOTATION]
+		if changeCause == "" {
+			changeCause = "<none>"
+		}
+
+		fmt.Fprintf(writer, "%d\t%s\t%d\t%s\n", r.number, r.replicaSet.Name, r.replicaSet.Status.Replicas, changeCause)
+	}
+
+	writer.Flush()
+
+	for i := 1; i < len(revisions); i++ {
+		previous, current := revisions[i-1], revisions[i]
+
+		previousYAML, err := podTemplateYAML(previous.replicaSet.Spec.Template)
+
+		if err != nil {
+			return err
+		}
+
+		currentYAML, err := podTemplateYAML(current.replicaSet.Spec.Template)
+
+		if err != nil {
+			return err
+		}
+
+		diff := unifiedDiff(
+			fmt.Sprintf("revision %d (%s)", previous.number, previous.replicaSet.Name),
+			fmt.Sprintf("revision %d (%s)", current.number, current.replicaSet.Name),
+			previousYAML,
+			currentYAML,
+		)
+
+		fmt.Fprintf(out, "\n%s", diff)
+	}
+
+	return nil
+}
+
+// rollbackDeployment 把修订号为 toRevision 的 ReplicaSet 的 Pod 模板写回 Deployment，toRevision 为 0 表示回滚到上一个版本。
+// Deployment controller 发现模板与旧 ReplicaSet 相同时会直接复用它并赋予新的修订号，效果与 kubectl rollout undo 相同。结果写到 out。
+func rollbackDeployment(out io.Writer, clientset kubernetes.Interface, name string, toRevision int64) error {
+	deploymentClient := clientset.AppsV1().Deployments(stack.Namespace)
+
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		deployment, err := deploymentClient.Get(context.TODO(), name, metav1.GetOptions{})
+
+		if err != nil {
+			return err
+		}
+
+		revisions, err := listRevisions(clientset, deployment)
+
+		if err != nil {
+			return err
+		}
+
+		target, err := findRevision(revisions, toRevision)
+
+		if err != nil {
+			return err
+		}
+
+		template := target.replicaSet.Spec.Template.DeepCopy()
+		delete(template.Labels, appsv1.DefaultDeploymentUniqueLabelKey)
+
+		targetYAML, err := podTemplateYAML(*template)
+
+		if err != nil {
+			return err
+		}
+
+		currentYAML, err := podTemplateYAML(deployment.Spec.Template)
+
+		if err != nil {
+			return err
+		}
+
+		if targetYAML == currentYAML {
+			fmt.Fprintf(out, "deployment %s is already at the template of revision %d, skip rollback\n", name, target.number)
+			return nil
+		}
+
+		deployment.Spec.Template = *template
+
+		// 把目标版本的 change-cause 一起带回来，history 中就能看出这是一次回滚到哪个版本的修改
+		if changeCause, ok := target.replicaSet.Annotations[CHANGE_CAUSE_ANNOTATION]; ok {
+			if deployment.Annotations == nil {
+				deployment.Annotations = map[string]string{}
+			}
+			deployment.Annotations[CHANGE_CAUSE_ANNOTATION] = changeCause
+		}
+
+		if _, err := deploymentClient.Update(context.TODO(), deployment, metav1.UpdateOptions{DryRun: dryRun}); err != nil {
+			return err
+		}
+
+		fmt.Fprintf(out, "Rollback deployment %s to revision %d%s \n", name, target.number, dryRunSuffix())
+		return nil
+	})
+}
+
+// findRevision 在按修订号排序的版本列表中找出目标版本，toRevision 为 0 时返回倒数第二个版本
+func findRevision(revisions []revision, toRevision int64) (revision, error) {
+	if toRevision == 0 {
+		if len(revisions) < 2 {
+			return revision{}, fmt.Errorf("no previous revision to roll back to")
+		}
+
+		return revisions[len(revisions)-2], nil
+	}
+
+	for _, r := range revisions {
+		if r.number == toRevision {
+			return r, nil
+		}
+	}
+
+	return revision{}, fmt.Errorf("revision %d not found", toRevision)
+}
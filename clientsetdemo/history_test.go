@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	appsv1 "k8s.io/api/apps/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+// historyObjects 返回 stack Deployment 和它的 ReplicaSet：修订号 2、9、10 分别使用镜像 tomcat:2、tomcat:9、tomcat:10，
+// Deployment 当前的模板与修订号 10 相同；另有一个 selector 相同但不属于它的 ReplicaSet。
+// 修订号故意按字符串排序与按数字排序不同的顺序给出
+func historyObjects() []runtime.Object {
+	deployment := newDeployment(stack)
+	deployment.Namespace = stack.Namespace
+	deployment.UID = "deployment-uid"
+	deployment.Spec.Template.Spec.Containers[0].Image = "tomcat:10"
+
+	replicaSet := func(name string, number int, owner *appsv1.Deployment) *appsv1.ReplicaSet {
+		template := deployment.Spec.Template.DeepCopy()
+		template.Spec.Containers[0].Image = "tomcat:" + strconv.Itoa(number)
+		template.Labels[appsv1.DefaultDeploymentUniqueLabelKey] = name
+
+		rs := &appsv1.ReplicaSet{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        name,
+				Namespace:   stack.Namespace,
+				Labels:      template.Labels,
+				Annotations: map[string]string{REVISION_ANNOTATION: strconv.Itoa(number)},
+			},
+			Spec: appsv1.ReplicaSetSpec{Selector: deployment.Spec.Selector, Template: *template},
+		}
+
+		if owner != nil {
+			rs.OwnerReferences = []metav1.OwnerReference{*metav1.NewControllerRef(owner, appsv1.SchemeGroupVersion.WithKind("Deployment"))}
+		}
+
+		return rs
+	}
+
+	return []runtime.Object{
+		deployment,
+		replicaSet("rev-10", 10, deployment),
+		replicaSet("rev-2", 2, deployment),
+		replicaSet("rev-9", 9, deployment),
+		replicaSet("other", 11, nil),
+	}
+}
+
+func TestListRevisions(t *testing.T) {
+	objects := historyObjects()
+	clientset := fake.NewSimpleClientset(objects...)
+
+	revisions, err := listRevisions(clientset, objects[0].(*appsv1.Deployment))
+
+	if err != nil {
+		t.Fatalf("listRevisions: %v", err)
+	}
+
+	var numbers []int64
+	for _, r := range revisions {
+		numbers = append(numbers, r.number)
+	}
+
+	// 按修订号的数值排序，不属于这个 Deployment 的 ReplicaSet 不在其中
+	if want := []int64{2, 9, 10}; !reflect.DeepEqual(numbers, want) {
+		t.Errorf("revisions = %v, want %v", numbers, want)
+	}
+}
+
+func TestRollbackDeployment(t *testing.T) {
+	tests := []struct {
+		name       string
+		toRevision int64
+		// wantImage 是回滚之后 Deployment 的镜像，为空表示期望返回错误
+		wantImage string
+		// wantUpdate 为 false 时不应该有 update 请求
+		wantUpdate bool
+	}{
+		{name: "previous revision by default", toRevision: 0, wantImage: "tomcat:9", wantUpdate: true},
+		{name: "explicit revision", toRevision: 2, wantImage: "tomcat:2", wantUpdate: true},
+		{name: "current revision is skipped", toRevision: 10, wantImage: "tomcat:10"},
+		{name: "unknown revision", toRevision: 7},
+		{name: "revision of another deployment", toRevision: 11},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clientset := fake.NewSimpleClientset(historyObjects()...)
+
+			var out bytes.Buffer
+			err := rollbackDeployment(&out, clientset, stack.DeploymentName, tt.toRevision)
+
+			if tt.wantImage == "" {
+				if err == nil || !strings.Contains(err.Error(), "not found") {
+					t.Fatalf("rollbackDeployment returned %v, want a revision not found error", err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("rollbackDeployment: %v", err)
+			}
+
+			if image := getStackDeployment(t, clientset).Spec.Template.Spec.Containers[0].Image; image != tt.wantImage {
+				t.Errorf("image = %s, want %s", image, tt.wantImage)
+			}
+
+			updated := false
+			for _, action := range clientset.Actions() {
+				if _, ok := action.(k8stesting.UpdateAction); ok {
+					updated = true
+				}
+			}
+
+			if updated != tt.wantUpdate {
+				t.Errorf("updated = %v, want %v; output:\n%s", updated, tt.wantUpdate, out.String())
+			}
+		})
+	}
+}
+
+func TestShowHistory(t *testing.T) {
+	clientset := fake.NewSimpleClientset(historyObjects()...)
+
+	var out bytes.Buffer
+	if err := showHistory(&out, clientset, stack.DeploymentName); err != nil {
+		t.Fatalf("showHistory: %v", err)
+	}
+
+	// 表格按修订号排序，之后是相邻版本之间的差异
+	output := out.String()
+	if rev2, rev9, rev10 := strings.Index(output, "\n2 "), strings.Index(output, "\n9 "), strings.Index(output, "\n10 "); rev2 < 0 || rev2 > rev9 || rev9 > rev10 {
+		t.Errorf("revisions are not listed in order:\n%s", output)
+	}
+
+	if !strings.Contains(output, "+  - image: tomcat:10") {
+		t.Errorf("history does not show the image change of revision 10:\n%s", output)
+	}
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+
+	batchv1 "k8s.io/api/batch/v1"
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/utils/pointer"
+)
+
+/*
+-operate=run-job 在 stack.Namespace 中运行一个一次性的 Job，用于在 CI 中执行数据库迁移、冒烟测试等，kubeconfig 的处理与其他操作相同：
+  - 容器使用 -image 指定的镜像，-- 之后的参数是容器的 command，没有参数时使用镜像自己的 ENTRYPOINT 和 CMD；
+  - Job 不重试（backoffLimit 为 0，restartPolicy 为 Never），只会创建一个 Pod；
+  - Pod 中的容器开始运行后以 follow 方式把日志实时复制到标准输出，进度信息都写到标准错误，标准输出中只有容器的日志；
+  - 容器结束后进程以容器的退出码结束，CI 可以直接据此判断成功与否；
+  - 结束之后（包括失败、超时和 Ctrl+C）以 Background 策略删除 Job 和它的 Pod，-keep 时保留下来，之后可以用 gc-jobs 清理。
+
+Pod 无法启动（例如镜像拉取失败）时返回 rolloutError，超过 -timeout 时返回超时错误，这两种情况的退出码见 errors.go。
+*/
+
+// RUN_JOB_CONTAINER 是 run-job 创建的容器的名字，读取日志和退出码时用它找到容器
+const RUN_JOB_CONTAINER = "run"
+
+// runJobOptions 保存 run-job 操作的命令行参数
+type runJobOptions struct {
+	namespace string
+	image     string
+	// command 是 -- 之后的参数，为空时使用镜像自己的 ENTRYPOINT 和 CMD
+	command []string
+	// keep 为 true 时结束后保留 Job
+	keep bool
+	// timeout 是从创建 Job 到容器结束的最长时间
+	timeout time.Duration
+}
+
+// newRunJob 返回 run-job 要创建的 Job，名字由 API Server 在 MANAGED_BY-run- 之后加上随机后缀生成
+func newRunJob(options runJobOptions) *batchv1.Job {
+	return &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			GenerateName: MANAGED_BY + "-run-",
+			Namespace:    options.namespace,
+			Labels:       ownershipLabels(),
+		},
+		Spec: batchv1.JobSpec{
+			BackoffLimit: pointer.Int32(0),
+			Template: apiv1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{
+					Labels: ownershipLabels(),
+				},
+				Spec: apiv1.PodSpec{
+					RestartPolicy: apiv1.RestartPolicyNever,
+					Containers: []apiv1.Container{{
+						Name:            RUN_JOB_CONTAINER,
+						Image:           options.image,
+						ImagePullPolicy: apiv1.PullIfNotPresent,
+						Command:         options.command,
+					}},
+				},
+			},
+		},
+	}
+}
+
+// runJob 创建 Job，把容器的日志写到 out、进度信息写到 progress，返回容器的退出码。返回之前按 options.keep 删除或保留 Job；
+// 删除失败时如果没有其他错误，返回删除的错误
+func runJob(ctx context.Context, clientset kubernetes.Interface, options runJobOptions, out, progress io.Writer) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, options.timeout)
+	defer cancel()
+
+	job, err := clientset.BatchV1().Jobs(options.namespace).Create(ctx, newRunJob(options), metav1.CreateOptions{})
+
+	if err != nil {
+		return 0, err
+	}
+
+	fmt.Fprintf(progress, "Create job %s\n", job.Name)
+
+	code, err := followJob(ctx, clientset, job, out, progress)
+
+	if err != nil && ctx.Err() == context.DeadlineExceeded {
+		err = fmt.Errorf("timed out after %v running job %s: %w", options.timeout, job.Name, err)
+	}
+
+	if options.keep {
+		fmt.Fprintf(progress, "Keep job %s\n", job.Name)
+		return code, err
+	}
+
+	// ctx 可能已经超时或者被 Ctrl+C 取消，删除使用新的 context
+	background := metav1.DeletePropagationBackground
+	deleteErr := clientset.BatchV1().Jobs(job.Namespace).Delete(context.TODO(), job.Name, metav1.DeleteOptions{PropagationPolicy: &background})
+
+	if deleteErr = reportDelete(progress, "job", job.Name, deleteErr); deleteErr != nil && err == nil {
+		err = deleteErr
+	}
+
+	return code, err
+}
+
+// followJob 等待 Job 的 Pod 开始运行，把容器日志跟随写到 out 直到容器结束，然后返回容器的退出码
+func followJob(ctx context.Context, clientset kubernetes.Interface, job *batchv1.Job, out, progress io.Writer) (int, error) {
+	pod, err := waitForJobPod(ctx, clientset, job, progress)
+
+	if err != nil {
+		return 0, err
+	}
+
+	fmt.Fprintf(progress, "Pod %s of job %s is %s, following its logs\n", pod.Name, job.Name, pod.Status.Phase)
+
+	stream, err := clientset.CoreV1().Pods(pod.Namespace).GetLogs(pod.Name, &apiv1.PodLogOptions{Container: RUN_JOB_CONTAINER, Follow: true}).Stream(ctx)
+
+	if err != nil {
+		return 0, err
+	}
+
+	_, err = io.Copy(out, stream)
+	stream.Close()
+
+	if err != nil {
+		return 0, fmt.Errorf("follow logs of pod %s: %w", pod.Name, err)
+	}
+
+	// 日志流在容器结束时关闭，但 kubelet 可能稍后才把退出码写到 Pod 状态中
+	return waitForExitCode(ctx, clientset, pod, progress)
+}
+
+// waitForJobPod 等待 Job controller 创建 Pod，并且容器开始运行或者已经结束，此时才能读取日志，等待的进度写到 progress。
+// 容器因为镜像拉取失败等原因无法启动时返回 rolloutError
+func waitForJobPod(ctx context.Context, clientset kubernetes.Interface, job *batchv1.Job, progress io.Writer) (*apiv1.Pod, error) {
+	w := &rolloutWatcher{
+		out:      progress,
+		name:     job.Name,
+		reported: map[string]bool{},
+		since:    time.Now(),
+	}
+
+	selector := labels.SelectorFromSet(labels.Set{JOB_NAME_LABEL: job.Name}).String()
+	var started *apiv1.Pod
+
+	err := wait.PollUntilContextCancel(ctx, time.Second, true, func(ctx context.Context) (bool, error) {
+		pods, err := clientset.CoreV1().Pods(job.Namespace).List(ctx, metav1.ListOptions{LabelSelector: selector})
+
+		if err != nil {
+			return false, err
+		}
+
+		if len(pods.Items) == 0 {
+			w.progress(fmt.Sprintf("Waiting for job %s to create its pod...", job.Name))
+			return false, nil
+		}
+
+		// backoffLimit 为 0，Job 只会有一个 Pod
+		pod := &pods.Items[0]
+
+		if err := w.checkPod(pod); err != nil {
+			return false, err
+		}
+
+		if status := runContainerStatus(pod); status != nil && (status.State.Running != nil || status.State.Terminated != nil) {
+			started = pod
+			return true, nil
+		}
+
+		// 例如节点资源不足被驱逐，容器还没有启动 Pod 就已经失败了
+		if pod.Status.Phase == apiv1.PodFailed {
+			return false, &rolloutError{fmt.Sprintf("pod %s of job %s failed before its container started: %s %s", pod.Name, job.Name, pod.Status.Reason, pod.Status.Message)}
+		}
+
+		w.progress(fmt.Sprintf("Waiting for pod %s of job %s to start, phase is %s...", pod.Name, job.Name, pod.Status.Phase))
+		return false, nil
+	})
+
+	return started, err
+}
+
+// waitForExitCode 等待容器进入 Terminated 状态，返回它的退出码
+func waitForExitCode(ctx context.Context, clientset kubernetes.Interface, pod *apiv1.Pod, progress io.Writer) (int, error) {
+	code := 0
+
+	err := wait.PollUntilContextCancel(ctx, time.Second, true, func(ctx context.Context) (bool, error) {
+		current, err := clientset.CoreV1().Pods(pod.Namespace).Get(ctx, pod.Name, metav1.GetOptions{})
+
+		if err != nil {
+			return false, err
+		}
+
+		if status := runContainerStatus(current); status != nil && status.State.Terminated != nil {
+			terminated := status.State.Terminated
+			code = int(terminated.ExitCode)
+			fmt.Fprintf(progress, "Container %s of pod %s exited with code %d (%s)\n", RUN_JOB_CONTAINER, pod.Name, code, terminated.Reason)
+			return true, nil
+		}
+
+		return false, nil
+	})
+
+	return code, err
+}
+
+// runContainerStatus 返回 RUN_JOB_CONTAINER 容器的状态，kubelet 还没有上报时返回 nil
+func runContainerStatus(pod *apiv1.Pod) *apiv1.ContainerStatus {
+	for i := range pod.Status.ContainerStatuses {
+		if pod.Status.ContainerStatuses[i].Name == RUN_JOB_CONTAINER {
+			return &pod.Status.ContainerStatuses[i]
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	batchv1 "k8s.io/api/batch/v1"
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+// fakeJobController 代替 API Server 生成 Job 的名字，并代替 Job controller 创建一个容器状态为 state 的 Pod
+func fakeJobController(clientset *fake.Clientset, state apiv1.ContainerState) {
+	clientset.PrependReactor("create", "jobs", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		job := action.(k8stesting.CreateAction).GetObject().(*batchv1.Job)
+		job.Name = job.GenerateName + "x7k2p"
+
+		pod := &apiv1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: job.Name + "-abcde", Namespace: job.Namespace, Labels: map[string]string{JOB_NAME_LABEL: job.Name}},
+			Status: apiv1.PodStatus{
+				Phase:             apiv1.PodRunning,
+				ContainerStatuses: []apiv1.ContainerStatus{{Name: RUN_JOB_CONTAINER, State: state}},
+			},
+		}
+
+		// reactor 在 fake clientset 的锁中执行，直接写入 tracker；返回 false 让默认的 reactor 继续创建 Job
+		return false, nil, clientset.Tracker().Add(pod)
+	})
+}
+
+func TestRunJob(t *testing.T) {
+	exited := func(code int32) apiv1.ContainerState {
+		return apiv1.ContainerState{Terminated: &apiv1.ContainerStateTerminated{ExitCode: code, Reason: "Completed"}}
+	}
+
+	tests := []struct {
+		name     string
+		state    apiv1.ContainerState
+		keep     bool
+		wantCode int
+		// wantExit 是错误对应的退出码，EXIT_OK 表示不应该有错误
+		wantExit int
+		wantJobs int
+	}{
+		{name: "success deletes the job", state: exited(0)},
+		{name: "exit code is propagated", state: exited(3), wantCode: 3},
+		{name: "keep leaves the job", state: exited(0), keep: true, wantJobs: 1},
+		{
+			name:     "image pull failure",
+			state:    apiv1.ContainerState{Waiting: &apiv1.ContainerStateWaiting{Reason: "ImagePullBackOff"}},
+			wantExit: EXIT_ROLLOUT_FAILED,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clientset := fake.NewSimpleClientset()
+			fakeJobController(clientset, tt.state)
+
+			var out, progress bytes.Buffer
+			options := runJobOptions{namespace: NAMESPACE, image: "busybox", command: []string{"sh", "-c", "exit 3"}, keep: tt.keep, timeout: time.Minute}
+			code, err := runJob(context.TODO(), clientset, options, &out, &progress)
+
+			exit := EXIT_OK
+			if err != nil {
+				exit, _ = classifyError(err)
+			}
+
+			if exit != tt.wantExit {
+				t.Fatalf("runJob returned %v (exit code %d), want exit code %d", err, exit, tt.wantExit)
+			}
+
+			if code != tt.wantCode {
+				t.Errorf("container exit code = %d, want %d", code, tt.wantCode)
+			}
+
+			// fake clientset 的 GetLogs 总是返回 "fake logs"，进度信息不能混进日志
+			if err == nil && out.String() != "fake logs" {
+				t.Errorf("logs = %q, want %q", out.String(), "fake logs")
+			}
+
+			if !strings.Contains(progress.String(), "Create job "+MANAGED_BY+"-run-x7k2p") {
+				t.Errorf("progress %q does not report the job", progress.String())
+			}
+
+			jobs, err := clientset.BatchV1().Jobs(NAMESPACE).List(context.TODO(), metav1.ListOptions{})
+			if err != nil {
+				t.Fatalf("list jobs: %v", err)
+			}
+
+			if len(jobs.Items) != tt.wantJobs {
+				t.Errorf("%d job(s) left, want %d", len(jobs.Items), tt.wantJobs)
+			}
+		})
+	}
+}
+
+func TestNewRunJob(t *testing.T) {
+	job := newRunJob(runJobOptions{namespace: NAMESPACE, image: "migrate:1.2", command: []string{"migrate", "up"}})
+
+	if *job.Spec.BackoffLimit != 0 || job.Spec.Template.Spec.RestartPolicy != apiv1.RestartPolicyNever {
+		t.Errorf("job retries: backoffLimit %d, restartPolicy %s", *job.Spec.BackoffLimit, job.Spec.Template.Spec.RestartPolicy)
+	}
+
+	container := job.Spec.Template.Spec.Containers[0]
+	if container.Image != "migrate:1.2" || len(container.Command) != 2 || container.Command[1] != "up" {
+		t.Errorf("container = %+v, want image migrate:1.2 with command migrate up", container)
+	}
+
+	if !isOwned(job) {
+		t.Errorf("job labels %v do not include the ownership labels", job.Labels)
+	}
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/uuid"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+)
+
+/*
+长时间运行的模式（目前是 -operate=controller）可以同时运行多个副本，-leader-elect 开启后通过 coordination.k8s.io 的 Lease 选出一个 leader，
+只有 leader 真正工作，其他副本等待接替：
+  - leader 每隔 retryPeriod 续约一次，renewDeadline 之内续约不成功就放弃 leader 身份；
+  - 其他副本在 Lease 超过 leaseDuration 没有续约之后接替，所以 leaseDuration 必须大于 renewDeadline；
+  - 失去 leader 身份时立即取消工作使用的 context，等工作停下来之后以非 0 退出码结束，由 Deployment 重启后重新参加选举；
+  - 收到 SIGTERM 时主动释放 Lease，其他副本不需要等到 leaseDuration 就能接替。
+
+获得和失去 leader 身份都会输出日志，并通过 -metrics-address 上的 /metrics 以 Prometheus 文本格式暴露。
+*/
+
+const (
+	DEFAULT_LEASE_DURATION = 15 * time.Second
+	DEFAULT_RENEW_DEADLINE = 10 * time.Second
+	DEFAULT_RETRY_PERIOD   = 2 * time.Second
+)
+
+// leaderElectionOptions 是 -leader-elect 相关的参数
+type leaderElectionOptions struct {
+	enabled       bool
+	leaseName     string
+	namespace     string
+	identity      string
+	leaseDuration time.Duration
+	renewDeadline time.Duration
+	retryPeriod   time.Duration
+}
+
+// defaultIdentity 返回主机名（在 Pod 中是 Pod 名）加上一个随机后缀，同一台机器上的多个进程也不会重复
+func defaultIdentity() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = MANAGED_BY
+	}
+
+	return hostname + "_" + string(uuid.NewUUID())
+}
+
+// validate 检查时间参数之间的关系，与 leaderelection.NewLeaderElector 的要求相同，但在连接集群之前报告
+func (o leaderElectionOptions) validate() error {
+	if !o.enabled {
+		return nil
+	}
+
+	switch {
+	case o.leaseName == "" || o.namespace == "" || o.identity == "":
+		return errors.New("-lease-name, -lease-namespace and -identity must not be empty")
+	case o.retryPeriod <= 0:
+		return errors.New("-retry-period must be greater than zero")
+	case o.renewDeadline <= time.Duration(leaderelection.JitterFactor*float64(o.retryPeriod)):
+		return fmt.Errorf("-renew-deadline must be greater than %v times -retry-period", leaderelection.JitterFactor)
+	case o.leaseDuration <= o.renewDeadline:
+		return errors.New("-lease-duration must be greater than -renew-deadline")
+	}
+
+	return nil
+}
+
+// leaderMetrics 记录本进程的 leader 状态，由 /metrics 输出
+type leaderMetrics struct {
+	lease    string
+	identity string
+
+	leader   atomic.Int32
+	acquired atomic.Int64
+	lost     atomic.Int64
+}
+
+// ServeHTTP 以 Prometheus 文本格式输出指标
+func (m *leaderMetrics) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	labels := fmt.Sprintf("lease=%q,identity=%q", m.lease, m.identity)
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	fmt.Fprintf(w, "# HELP clientsetdemo_leader Whether this process currently holds the lease.\n")
+	fmt.Fprintf(w, "# TYPE clientsetdemo_leader gauge\n")
+	fmt.Fprintf(w, "clientsetdemo_leader{%s} %d\n", labels, m.leader.Load())
+	fmt.Fprintf(w, "# HELP clientsetdemo_leadership_acquired_total Times this process acquired the lease.\n")
+	fmt.Fprintf(w, "# TYPE clientsetdemo_leadership_acquired_total counter\n")
+	fmt.Fprintf(w, "clientsetdemo_leadership_acquired_total{%s} %d\n", labels, m.acquired.Load())
+	fmt.Fprintf(w, "# HELP clientsetdemo_leadership_lost_total Times this process lost the lease.\n")
+	fmt.Fprintf(w, "# TYPE clientsetdemo_leadership_lost_total counter\n")
+	fmt.Fprintf(w, "clientsetdemo_leadership_lost_total{%s} %d\n", labels, m.lost.Load())
+}
+
+// serveMetrics 在 address 上提供 /metrics，address 为空时不启动。返回的函数关闭服务
+func serveMetrics(address string, handler http.Handler) func() {
+	if address == "" {
+		return func() {}
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", handler)
+	server := &http.Server{Addr: address, Handler: mux}
+
+	go func() {
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			fmt.Fprintf(os.Stderr, "metrics server on %s: %v\n", address, err)
+		}
+	}()
+
+	return func() { server.Close() }
+}
+
+// runWithLeaderElection 在成为 leader 之后调用 run。没有开启选举时直接调用 run。
+// ctx 被取消时释放 Lease 并返回 run 的结果；失去 leader 身份时取消 run 的 context，等它返回之后返回错误
+func runWithLeaderElection(ctx context.Context, clientset kubernetes.Interface, options leaderElectionOptions, metrics *leaderMetrics, run func(ctx context.Context) error) error {
+	if !options.enabled {
+		return run(ctx)
+	}
+
+	lock := &resourcelock.LeaseLock{
+		LeaseMeta:  metav1.ObjectMeta{Name: options.leaseName, Namespace: options.namespace},
+		Client:     clientset.CoordinationV1(),
+		LockConfig: resourcelock.ResourceLockConfig{Identity: options.identity},
+	}
+
+	lease := options.namespace + "/" + options.leaseName
+	leading := make(chan context.Context, 1)
+
+	elector, err := leaderelection.NewLeaderElector(leaderelection.LeaderElectionConfig{
+		Lock:            lock,
+		LeaseDuration:   options.leaseDuration,
+		RenewDeadline:   options.renewDeadline,
+		RetryPeriod:     options.retryPeriod,
+		ReleaseOnCancel: true,
+		Name:            lease,
+		Callbacks: leaderelection.LeaderCallbacks{
+			// leaderCtx 在续约失败或 electionCtx 被取消时取消，工作在下面的 select 中进行
+			OnStartedLeading: func(leaderCtx context.Context) {
+				leading <- leaderCtx
+			},
+			// 日志和指标在 run 返回之后处理，这里不需要做什么，但 NewLeaderElector 要求提供
+			OnStoppedLeading: func() {},
+			OnNewLeader: func(identity string) {
+				if identity != options.identity {
+					fmt.Printf("Lease %s is held by %s, waiting\n", lease, identity)
+				}
+			},
+		},
+	})
+
+	if err != nil {
+		return err
+	}
+
+	electionCtx, cancelElection := context.WithCancel(ctx)
+	defer cancelElection()
+
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		elector.Run(electionCtx)
+	}()
+
+	fmt.Printf("Waiting to acquire lease %s as %s\n", lease, options.identity)
+
+	var leaderCtx context.Context
+	select {
+	case leaderCtx = <-leading:
+	case <-stopped:
+		// 还没有成为 leader 就收到了 SIGTERM
+		return nil
+	}
+
+	metrics.leader.Store(1)
+	metrics.acquired.Add(1)
+	fmt.Printf("Acquired lease %s\n", lease)
+
+	runErr := run(leaderCtx)
+	// 必须在 cancelElection 之前判断：leaderCtx 被取消而 ctx 没有，说明是续约失败
+	lost := leaderCtx.Err() != nil && ctx.Err() == nil
+
+	// run 自己出错返回时也要停止续约并释放 Lease
+	cancelElection()
+	<-stopped
+
+	metrics.leader.Store(0)
+
+	if lost {
+		metrics.lost.Add(1)
+		fmt.Fprintf(os.Stderr, "Lost lease %s, stopped working\n", lease)
+		return fmt.Errorf("lost leadership of lease %s", lease)
+	}
+
+	fmt.Printf("Released lease %s\n", lease)
+	return runErr
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+// testElection 返回时间很短的选举参数，测试不需要等待默认的 15 秒
+func testElection(identity string) leaderElectionOptions {
+	return leaderElectionOptions{
+		enabled:       true,
+		leaseName:     "clientsetdemo-test",
+		namespace:     metav1.NamespaceDefault,
+		identity:      identity,
+		leaseDuration: 600 * time.Millisecond,
+		renewDeadline: 400 * time.Millisecond,
+		retryPeriod:   100 * time.Millisecond,
+	}
+}
+
+func TestLeaderElectionReleasesOnCancel(t *testing.T) {
+	clientset := fake.NewSimpleClientset()
+	metrics := &leaderMetrics{}
+	ctx, cancel := context.WithCancel(context.Background())
+
+	err := runWithLeaderElection(ctx, clientset, testElection("first"), metrics, func(ctx context.Context) error {
+		if metrics.leader.Load() != 1 {
+			t.Errorf("leader metric is %d while running, want 1", metrics.leader.Load())
+		}
+
+		lease, err := clientset.CoordinationV1().Leases(metav1.NamespaceDefault).Get(context.TODO(), "clientsetdemo-test", metav1.GetOptions{})
+		if err != nil || *lease.Spec.HolderIdentity != "first" {
+			t.Errorf("lease %v, %v: want it held by first", lease, err)
+		}
+
+		cancel()
+		<-ctx.Done()
+		return nil
+	})
+
+	if err != nil {
+		t.Fatalf("runWithLeaderElection: %v", err)
+	}
+
+	if metrics.leader.Load() != 0 || metrics.acquired.Load() != 1 || metrics.lost.Load() != 0 {
+		t.Errorf("metrics leader=%d acquired=%d lost=%d, want 0, 1 and 0", metrics.leader.Load(), metrics.acquired.Load(), metrics.lost.Load())
+	}
+
+	recorder := httptest.NewRecorder()
+	metrics.ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+
+	if !strings.Contains(recorder.Body.String(), "clientsetdemo_leadership_acquired_total{") {
+		t.Errorf("metrics output:\n%s", recorder.Body.String())
+	}
+}
+
+func TestLeaderElectionStopsWhenLost(t *testing.T) {
+	clientset := fake.NewSimpleClientset()
+
+	// 成为 leader 之后续约全部失败，例如与 API Server 之间的网络断开
+	var partitioned atomic.Bool
+	clientset.PrependReactor("update", "leases", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if partitioned.Load() {
+			return true, nil, errors.New("connection refused")
+		}
+
+		return false, nil, nil
+	})
+
+	metrics := &leaderMetrics{}
+	stoppedAfter := make(chan time.Duration, 1)
+
+	err := runWithLeaderElection(context.Background(), clientset, testElection("first"), metrics, func(ctx context.Context) error {
+		partitioned.Store(true)
+		start := time.Now()
+
+		<-ctx.Done()
+		stoppedAfter <- time.Since(start)
+		return nil
+	})
+
+	if err == nil || !strings.Contains(err.Error(), "lost leadership") {
+		t.Fatalf("runWithLeaderElection returned %v, want the lost leadership error", err)
+	}
+
+	// 工作应该在 renewDeadline 之后很快停下来，而不是等到 leaseDuration
+	if elapsed := <-stoppedAfter; elapsed > time.Second {
+		t.Errorf("work stopped %v after the renewals started failing", elapsed)
+	}
+
+	if metrics.leader.Load() != 0 || metrics.lost.Load() != 1 {
+		t.Errorf("metrics leader=%d lost=%d, want 0 and 1", metrics.leader.Load(), metrics.lost.Load())
+	}
+}
+
+func TestLeaderElectionOptionsValidate(t *testing.T) {
+	options := testElection("first")
+	options.leaseDuration = options.renewDeadline
+
+	if err := options.validate(); err == nil {
+		t.Errorf("validate accepted a lease duration equal to the renew deadline")
+	}
+
+	options.enabled = false
+	if err := options.validate(); err != nil {
+		t.Errorf("validate checked disabled options: %v", err)
+	}
+}
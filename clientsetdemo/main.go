@@ -16,11 +16,21 @@ import (
 	   以上函数都有类似的使用方法。它们的第一个参数是要解析的命令行参数的名称，第二个参数是该参数的默认值，第三个参数是参数的说明信息。
 	*/
 	"fmt"
+	"io"
+	"os"
+	"os/signal"
 	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
 
 	appsv1 "k8s.io/api/apps/v1"
 	apiv1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/tools/clientcmd"
 	"k8s.io/client-go/util/homedir"
@@ -33,6 +43,7 @@ import (
 // 建议对导出的变量和函数都加上注释。
 // 根据 Kubernetes 命名规范，命名空间的名称必须符合 RFC 1123 标准，即名称由小写字母、数字和 "-"（减号）组成，长度不能超过 253 个字符。此外，名称不能以 "-" 开头或结尾。
 // 因此，当你尝试创建名称为 "test_clientset" 的命名空间时，系统会报告这个错误，因为命名空间的名称以 "_clientset" 结尾，不符合命名空间名称的规则。
+// 这三个常量现在只是默认值，实际使用的名字来自 -namespace、-deployment-name、-service-name 参数或 -values 文件，见 values.go。
 const (
 	NAMESPACE       = "test-clientset"
 	DEPLOYMENT_NAME = "client-test-deployment"
@@ -60,12 +71,400 @@ func main() {
 	// operate 是一个存储操作类型值的变量。程序通过读取用户在命令行中输入的操作类型的值（也就是输入的参数值），
 	// 并把它保存到 operate 这个变量中，来获取从命令行输入的操作类型。
 	// 在 Go 语言中，flag.String() 用于解析一个字符串类型的命令行参数，并返回一个指针，该指针指向解析参数所存储值的引用
-	operate := flag.String("operate", "create", "operate type : create or clean")
+	// apply 与 create 创建的是同一组对象，区别在于 apply 使用 server-side apply，重复执行会收敛而不是因为 AlreadyExists 而 panic
+	// diff 以 dry run 的方式提交 apply，输出线上对象与提交后结果之间的差异；有差异时退出码为 EXIT_DIFF_FOUND
+	// gc-jobs 删除已经结束的 Job 以及所属 Job 已经不存在的 Pod
+	// validate 只在本地检查将要创建的对象，不连接集群，有错误时退出码为 EXIT_INVALID
+	// release、promote 和 abort 以 blue/green 或 canary 的方式发布新版本，见 release.go
+	// backup 把 -namespace 中的对象保存到 -archive，restore 从 -archive 重新创建它们，见 backup.go
+	// clone 把 -from 中的对象复制到 -to，可以是另一个集群，见 clone.go
+	// controller 一直运行，发现 Deployment 或 Service 被删除、被修改时把它们恢复到期望状态，见 controller.go
+	operate := flag.String("operate", "create", "operate type : create, apply, diff, validate, clean, scale, set-image, restart, history, rollback, gc-jobs, release, promote, abort, backup, restore, clone, controller or run-job")
+
+	// -dry-run=server 时 create、apply、clean、gc-jobs 以及 scale、set-image、restart、rollback 的写请求都会带上 DryRun: All，由 API Server 完成校验和默认值填充但不真正写入
+	dryRunMode := flag.String("dry-run", "none", "create/apply/clean/gc-jobs/scale/set-image/restart/rollback: none or server")
+
+	// -error-format 决定出错时的输出格式，退出码见 errors.go
+	flag.StringVar(&errorFormat, "error-format", errorFormat, "how errors are reported on stderr: text or json")
+
+	// -f 指定包含 YAML/JSON 清单的文件或目录，可以重复出现。指定后 create 和 clean 操作的对象来自清单，而不是代码里写死的 tomcat Deployment 和 Service
+	var manifests manifestPaths
+	flag.Var(&manifests, "f", "create/clean: manifest files or directories of multi-document YAML/JSON, may be repeated")
+
+	// -instance 是写在每个对象 app.kubernetes.io/instance 标签上的值，clean 和 prune 只处理带有这个标签的对象
+	flag.StringVar(&instance, "instance", instance, "value of the app.kubernetes.io/instance label put on every created object")
+	// -prune 在 create 或 apply 之后删除带有本程序标签、但已经不在期望集合中的对象
+	pruneStale := flag.Bool("prune", false, "create/apply: delete labelled objects that are no longer in the desired set")
+
+	// -preflight 让 create 和 clean 先用 SelfSubjectAccessReview 确认全部权限，缺少权限时什么都不修改
+	preflightCheck := flag.Bool("preflight", true, "create/clean: check every needed permission with access reviews before changing anything")
+
+	// 以下参数只对 clean 操作生效
+	propagation := flag.String("propagation", "background", "clean: deletion propagation policy, foreground, background or orphan")
+	gracePeriod := flag.Int64("grace-period", -1, "clean: grace period in seconds for deleted objects, negative means the object's default")
+	waitClean := flag.Bool("wait", false, "clean: block until the deployment's pods and the namespace are gone")
+	timeout := flag.Duration("timeout", 5*time.Minute, "clean/create/release/promote/run-job: how long -wait, -wait-rollout, a release or a job blocks before giving up")
+
+	// -wait-rollout 只对 create 和 apply 生效，创建完成后一直等到 Deployment 的 Pod 全部更新并可用，失败或超时时以非 0 退出码结束
+	waitRollout := flag.Bool("wait-rollout", false, "create/apply/scale/set-image/restart/rollback: wait until the rollout of the deployment, statefulset or daemonset finishes, exit non-zero on failure")
+
+	// 以下参数决定 create、apply、diff 和 clean 操作的那一组对象，默认值见 values.go。
+	// -values 指定一个 YAML 文件，其中的字段与 stackValues 相同；同时指定时命令行参数优先。
+	valuesFile := flag.String("values", "", "YAML file with namespace, deploymentName, serviceName, image, replicas, port, nodePort and the companion object settings")
+	namespace := flag.String("namespace", NAMESPACE, "namespace of the stack")
+	deploymentName := flag.String("deployment-name", DEPLOYMENT_NAME, "name of the stack's deployment, statefulset or daemonset")
+	serviceName := flag.String("service-name", SERVICE_NAME, "name of the stack's service")
+	port := flag.Int("port", DEFAULT_PORT, "container and service port of the stack")
+	nodePort := flag.Int("node-port", DEFAULT_NODE_PORT, "node port of the stack's service, in -node-port-range, or 0 to let the API server allocate one")
+	serviceType := flag.String("service-type", DEFAULT_SERVICE_TYPE, "type of the stack's service: ClusterIP, NodePort or LoadBalancer")
+	nodePortRange := flag.String("node-port-range", DEFAULT_NODE_PORT_RANGE, "the cluster's --service-node-port-range, free node ports are allocated from it")
+	// -workload 决定 tomcat 以 Deployment、StatefulSet 还是 DaemonSet 运行，后面几个参数只对 StatefulSet 生效，见 workload.go
+	workload := flag.String("workload", WORKLOAD_DEPLOYMENT, "create/clean: kind of the stack's workload, deployment, statefulset or daemonset")
+	storageSize := flag.String("storage-size", DEFAULT_STORAGE_SIZE, "create -workload=statefulset: size of the volume claimed for every pod")
+	storageClass := flag.String("storage-class", "", "create -workload=statefulset: storage class of the claimed volumes, empty uses the cluster default")
+	pvcRetention := flag.String("pvc-retention", string(appsv1.RetainPersistentVolumeClaimRetentionPolicyType), "create/clean -workload=statefulset: Retain or Delete the statefulset's volume claims when it is deleted, clean keeps the namespace of retained claims")
+	// -node-port-conflict 决定 create 发现 NodePort 已经被其他 Service 占用时的处理方式，见 nodeport.go
+	nodePortConflict := flag.String("node-port-conflict", NODE_PORT_CONFLICT_FAIL, "create: fail, or allocate a free port from -node-port-range, when the node port is already used; -namespaces and -namespace-selector always allocate")
+
+	// 以下参数把 create 或 clean 分别在多个命名空间中各执行一次，每个命名空间都是一套独立的对象，名字和其他参数相同。
+	// -namespaces 直接列出命名空间，-namespace-selector 按标签选择已有的命名空间，两者只能指定一个，指定后 -namespace 不再生效
+	var fanOutNamespaces namespaceList
+	flag.Var(&fanOutNamespaces, "namespaces", "create/clean: comma separated namespaces to run in, may be repeated, instead of -namespace")
+	namespaceSelector := flag.String("namespace-selector", "", "create/clean: label selector of existing namespaces to run in, instead of -namespace")
+	concurrency := flag.Int("concurrency", 4, "-namespaces/-namespace-selector: how many namespaces are processed at the same time")
+	report := flag.String("report", "table", "-namespaces/-namespace-selector: format of the per-namespace report, table or json")
+
+	// 以下参数开启 create 同时创建的配套对象，默认都不创建，见 companions.go
+	withConfigMap := flag.Bool("with-configmap", false, "create: also create a ConfigMap mounted into the tomcat container at "+CONFIG_MOUNT_PATH)
+	configLiterals := literalMap{}
+	flag.Var(configLiterals, "config-literal", "create: file=content entry of the ConfigMap, may be repeated")
+	withSecret := flag.Bool("with-secret", false, "create: also create a Secret exposed to the tomcat container as environment variables")
+	secretLiterals := literalMap{}
+	flag.Var(secretLiterals, "secret-literal", "create: NAME=value entry of the Secret, may be repeated")
+	withIngress := flag.Bool("with-ingress", false, "create: also create an Ingress routing to the service")
+	ingressHost := flag.String("ingress-host", "", "create: host of the Ingress rule, empty matches any host")
+	ingressClass := flag.String("ingress-class", "", "create: ingress class name, empty uses the cluster default")
+	withHPA := flag.Bool("with-hpa", false, "create: also create a HorizontalPodAutoscaler scaling the deployment on CPU")
+	hpaMaxReplicas := flag.Int("hpa-max-replicas", DEFAULT_HPA_MAX_REPLICAS, "create: maximum replicas of the HorizontalPodAutoscaler")
+	hpaCPUPercent := flag.Int("hpa-cpu-percent", DEFAULT_HPA_CPU_PERCENT, "create: target average CPU utilization of the HorizontalPodAutoscaler")
+	withPDB := flag.Bool("with-pdb", false, "create: also create a PodDisruptionBudget for the deployment's pods")
+	pdbMinAvailable := flag.Int("pdb-min-available", DEFAULT_PDB_MIN_AVAILABLE, "create: minAvailable of the PodDisruptionBudget")
+
+	// -provision 让 create 同时配置 Pod Security 标签、专用的 ServiceAccount、Role、ResourceQuota 和 LimitRange，见 provision.go
+	provision := flag.Bool("provision", false, "create: also provision pod security labels, a service account with a role, a resource quota and a limit range")
+	podSecurity := flag.String("pod-security", DEFAULT_POD_SECURITY, "create -provision: pod security level of the namespace, privileged, baseline or restricted")
+	roleVerbsFlag := flag.String("role-verbs", strings.Join(defaultRoleVerbs, ","), "create -provision: comma separated verbs the service account gets on "+strings.Join(roleResources, ", "))
+	quotaCPU := flag.String("quota-cpu", DEFAULT_QUOTA_CPU, "create -provision: total CPU requests and limits allowed in the namespace")
+	quotaMemory := flag.String("quota-memory", DEFAULT_QUOTA_MEMORY, "create -provision: total memory requests and limits allowed in the namespace")
+	quotaPods := flag.Int("quota-pods", DEFAULT_QUOTA_PODS, "create -provision: number of pods allowed in the namespace")
+	requestCPU := flag.String("default-cpu-request", DEFAULT_REQUEST_CPU, "create -provision: CPU request of containers that do not set one")
+	limitCPU := flag.String("default-cpu-limit", DEFAULT_LIMIT_CPU, "create -provision: CPU limit of containers that do not set one")
+	requestMemory := flag.String("default-memory-request", DEFAULT_REQUEST_MEMORY, "create -provision: memory request of containers that do not set one")
+	limitMemory := flag.String("default-memory-limit", DEFAULT_LIMIT_MEMORY, "create -provision: memory limit of containers that do not set one")
+
+	// 以下参数用于 scale、set-image、restart、history 和 rollback 操作，它们都作用于一个已经存在的 Deployment，默认是 -deployment-name
+	// -replicas 和 -image 同时也是 create、apply 和 diff 使用的副本数和镜像
+	name := flag.String("name", "", "scale/set-image/restart/history/rollback: name of the deployment in -namespace, defaults to -deployment-name")
+	replicas := flag.Int("replicas", -1, fmt.Sprintf("scale: desired number of replicas; create/apply/diff: replicas of the stack, default %d", DEFAULT_REPLICAS))
+	image := flag.String("image", "", fmt.Sprintf("set-image: new container image; run-job: image of the job; create/apply/diff: image of the stack, default %s", DEFAULT_IMAGE))
+	container := flag.String("container", "", "set-image: container to update, may be omitted when the deployment has a single container")
+	toRevision := flag.Int64("to-revision", 0, "rollback: revision to roll back to, 0 means the previous revision")
+
+	// 以下参数用于 release 操作，新版本的镜像由 -image 指定
+	strategy := flag.String("strategy", "", "release: bluegreen or canary")
+	version := flag.String("version", "", "release: version label of the new deployment, also appended to its name")
+	canaryPercent := flag.Int("canary-percent", 10, "release: percentage of the replicas that run the new version in a canary release, 1-99")
+
+	// 以下参数用于 backup 和 restore 操作
+	archive := flag.String("archive", "", "backup/restore: tar.gz archive to write or read, backup defaults to <namespace>.tar.gz")
+	targetNamespace := flag.String("target-namespace", "", "restore: namespace to restore into, defaults to the namespace the archive was taken from")
+
+	// 以下参数用于 clone 操作
+	cloneFrom := flag.String("from", "", "clone: namespace to copy from, defaults to -namespace")
+	cloneTo := flag.String("to", "", "clone: namespace to copy into")
+	toContext := flag.String("to-context", "", "clone: kubeconfig context of the cluster to copy into, defaults to the current cluster")
+
+	// 以下参数用于 controller 操作
+	workers := flag.Int("workers", 1, "controller: number of workers reconciling the stack")
+
+	// 以下参数让 controller 的多个副本通过 Lease 选出一个 leader，只有 leader 工作，见 leaderelection.go
+	leaderElect := flag.Bool("leader-elect", false, "controller: only work while holding a coordination.k8s.io Lease, so several replicas can run safely")
+	leaseName := flag.String("lease-name", "", "controller -leader-elect: name of the Lease, defaults to clientsetdemo-<instance>")
+	leaseNamespace := flag.String("lease-namespace", metav1.NamespaceDefault, "controller -leader-elect: namespace of the Lease")
+	identity := flag.String("identity", defaultIdentity(), "controller -leader-elect: holder identity written to the Lease, defaults to the hostname with a random suffix")
+	leaseDuration := flag.Duration("lease-duration", DEFAULT_LEASE_DURATION, "controller -leader-elect: how long other replicas wait before taking over a lease that is not renewed")
+	renewDeadline := flag.Duration("renew-deadline", DEFAULT_RENEW_DEADLINE, "controller -leader-elect: how long the leader keeps retrying to renew before it stops working")
+	retryPeriod := flag.Duration("retry-period", DEFAULT_RETRY_PERIOD, "controller -leader-elect: interval between attempts to acquire or renew the lease")
+	metricsAddress := flag.String("metrics-address", "", "controller: address such as :9090 to serve leader election metrics on /metrics, empty disables it")
+
+	// 以下参数用于 gc-jobs 操作
+	minAge := flag.Duration("min-age", time.Hour, "gc-jobs: only delete jobs that finished at least this long ago")
+	allNamespaces := flag.Bool("all-namespaces", false, "gc-jobs: collect jobs in all namespaces instead of -namespace")
+
+	// 以下参数用于 run-job 操作，Job 的命令写在 -- 之后，见 jobrun.go
+	keep := flag.Bool("keep", false, "run-job: keep the job and its pod after it finishes instead of deleting them")
 
 	flag.Parse()
+
+	if format := errorFormat; format != "text" && format != "json" {
+		errorFormat = "text"
+		exitUsage("unknown error format %q, must be text or json", format)
+	}
 	// flag.Parse() 函数来解析命令行参数，这个函数会遍历 os.Args 切片，并根据类型解析每个参数值。在解析每个参数值后，
 	// flag.Parse() 会将解析结果存储到对应的变量中，使我们能够在程序中使用这些变量，读取和控制命令行参数对程序的影响
 
+	// 先读取 -values 文件，再用命令行中显式指定的参数覆盖，最后在连接集群之前统一校验
+	if *valuesFile != "" {
+		if err := loadValuesFile(*valuesFile, &stack); err != nil {
+			exitUsage("%v", err)
+		}
+	}
+
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "namespace":
+			stack.Namespace = *namespace
+		case "deployment-name":
+			stack.DeploymentName = *deploymentName
+		case "service-name":
+			stack.ServiceName = *serviceName
+		case "port":
+			stack.Port = int32(*port)
+		case "node-port":
+			stack.NodePort = int32(*nodePort)
+		case "service-type":
+			stack.ServiceType = *serviceType
+		case "node-port-range":
+			stack.NodePortRange = *nodePortRange
+		case "workload":
+			stack.Workload = *workload
+		case "storage-size":
+			stack.StorageSize = *storageSize
+		case "storage-class":
+			stack.StorageClass = *storageClass
+		case "pvc-retention":
+			stack.PVCRetention = *pvcRetention
+		case "replicas":
+			stack.Replicas = int32(*replicas)
+		case "image":
+			stack.Image = *image
+		case "with-configmap":
+			stack.ConfigMap = *withConfigMap
+		case "config-literal":
+			stack.ConfigData = mergeLiterals(stack.ConfigData, configLiterals)
+		case "with-secret":
+			stack.Secret = *withSecret
+		case "secret-literal":
+			stack.SecretData = mergeLiterals(stack.SecretData, secretLiterals)
+		case "with-ingress":
+			stack.Ingress = *withIngress
+		case "ingress-host":
+			stack.IngressHost = *ingressHost
+		case "ingress-class":
+			stack.IngressClass = *ingressClass
+		case "with-hpa":
+			stack.HPA = *withHPA
+		case "hpa-max-replicas":
+			stack.HPAMaxReplicas = int32(*hpaMaxReplicas)
+		case "hpa-cpu-percent":
+			stack.HPACPUPercent = int32(*hpaCPUPercent)
+		case "with-pdb":
+			stack.PDB = *withPDB
+		case "pdb-min-available":
+			stack.PDBMinAvailable = int32(*pdbMinAvailable)
+		case "provision":
+			stack.Provision = *provision
+		case "pod-security":
+			stack.PodSecurity = *podSecurity
+		case "role-verbs":
+			stack.RoleVerbs = roleVerbList(*roleVerbsFlag)
+		case "quota-cpu":
+			stack.QuotaCPU = *quotaCPU
+		case "quota-memory":
+			stack.QuotaMemory = *quotaMemory
+		case "quota-pods":
+			stack.QuotaPods = int32(*quotaPods)
+		case "default-cpu-request":
+			stack.RequestCPU = *requestCPU
+		case "default-cpu-limit":
+			stack.LimitCPU = *limitCPU
+		case "default-memory-request":
+			stack.RequestMemory = *requestMemory
+		case "default-memory-limit":
+			stack.LimitMemory = *limitMemory
+		}
+	})
+
+	if err := stack.validate(); err != nil {
+		exitUsage("%v", err)
+	}
+
+	if *name == "" {
+		*name = stack.DeploymentName
+	}
+
+	// apply、diff、发布、controller 以及 scale、set-image、restart、history 和 rollback 这些更新操作只处理 Deployment。
+	// 更新操作按 -name 找 Deployment，-workload=statefulset 或 daemonset 时找不到，与其返回 NotFound，不如直接说明不支持
+	switch *operate {
+	case "apply", "diff", "release", "promote", "abort", "controller", "scale", "set-image", "restart", "history", "rollback":
+		if stack.Workload != WORKLOAD_DEPLOYMENT {
+			exitUsage("%s only supports -workload=deployment, not %s", *operate, stack.Workload)
+		}
+	}
+
+	if *operate == "controller" && *workers < 1 {
+		exitUsage("-workers must be at least 1")
+	}
+
+	// controller 只管理 Deployment 和 Service。配套对象开启时 Pod 模板引用了 ConfigMap、Secret 和 ServiceAccount，
+	// controller 只重建 Deployment 的话 Pod 会因为这些对象不存在而无法启动，所以直接拒绝
+	if *operate == "controller" && (stack.ConfigMap || stack.Secret || stack.Ingress || stack.HPA || stack.PDB || stack.Provision) {
+		exitUsage("controller does not manage companion or provision objects, create or apply them instead")
+	}
+
+	if *leaseName == "" {
+		*leaseName = MANAGED_BY + "-" + instance
+	}
+
+	election := leaderElectionOptions{
+		enabled:       *leaderElect,
+		leaseName:     *leaseName,
+		namespace:     *leaseNamespace,
+		identity:      *identity,
+		leaseDuration: *leaseDuration,
+		renewDeadline: *renewDeadline,
+		retryPeriod:   *retryPeriod,
+	}
+
+	if err := election.validate(); err != nil {
+		exitUsage("%v", err)
+	}
+
+	if *nodePortConflict != NODE_PORT_CONFLICT_FAIL && *nodePortConflict != NODE_PORT_CONFLICT_ALLOCATE {
+		exitUsage("unknown -node-port-conflict %q, must be fail or allocate", *nodePortConflict)
+	}
+
+	if *operate == "release" {
+		if *strategy != STRATEGY_BLUEGREEN && *strategy != STRATEGY_CANARY {
+			exitUsage("release requires -strategy=bluegreen or -strategy=canary")
+		}
+
+		if problems := validation.IsValidLabelValue(*version); *version == "" || len(problems) > 0 {
+			exitUsage("release requires -version to be a valid label value: %s", strings.Join(problems, "; "))
+		}
+
+		if problems := validation.IsDNS1123Subdomain(candidateName(*version)); len(problems) > 0 {
+			exitUsage("deployment name %q for -version %q: %s", candidateName(*version), *version, strings.Join(problems, "; "))
+		}
+
+		if *canaryPercent < 1 || *canaryPercent > 99 {
+			exitUsage("-canary-percent must be between 1 and 99")
+		}
+	}
+
+	if *operate == "restore" {
+		if *archive == "" {
+			exitUsage("restore requires -archive")
+		}
+
+		// restore 先创建目标命名空间再写入其中的对象，dry run 时命名空间并不存在，后面的请求都会返回 NotFound
+		if *dryRunMode != "none" {
+			exitUsage("restore does not support -dry-run")
+		}
+
+		if problems := validation.IsDNS1123Label(*targetNamespace); *targetNamespace != "" && len(problems) > 0 {
+			exitUsage("-target-namespace %q: %s", *targetNamespace, strings.Join(problems, "; "))
+		}
+	}
+
+	if *operate == "clone" {
+		if *cloneFrom == "" {
+			*cloneFrom = stack.Namespace
+		}
+
+		if problems := validation.IsDNS1123Label(*cloneTo); len(problems) > 0 {
+			exitUsage("clone requires -to to be a valid namespace name: %s", strings.Join(problems, "; "))
+		}
+
+		if *cloneTo == *cloneFrom && *toContext == "" {
+			exitUsage("clone into the same namespace requires -to-context")
+		}
+
+		// clone 同样先创建目标命名空间，dry run 时后面写入对象的请求都会返回 NotFound
+		if *dryRunMode != "none" {
+			exitUsage("clone does not support -dry-run")
+		}
+	}
+
+	// progress 是 create、clean 以及等待 rollout 时输出进度信息的地方
+	progress := io.Writer(os.Stdout)
+	fanOutMode := len(fanOutNamespaces) > 0 || *namespaceSelector != ""
+	if fanOutMode {
+		if len(fanOutNamespaces) > 0 && *namespaceSelector != "" {
+			exitUsage("-namespaces and -namespace-selector are mutually exclusive")
+		}
+
+		if *operate != "create" && *operate != "clean" {
+			exitUsage("-namespaces and -namespace-selector only support create and clean, not %s", *operate)
+		}
+
+		if len(manifests) > 0 || *pruneStale {
+			exitUsage("-namespaces and -namespace-selector do not support -f or -prune")
+		}
+
+		if *concurrency < 1 {
+			exitUsage("-concurrency must be at least 1")
+		}
+
+		if *report != "table" && *report != "json" {
+			exitUsage("unknown report format %q, must be table or json", *report)
+		}
+
+		for _, namespace := range fanOutNamespaces {
+			if problems := validation.IsDNS1123Label(namespace); len(problems) > 0 {
+				exitUsage("-namespaces %q: %s", namespace, strings.Join(problems, "; "))
+			}
+		}
+
+		// -report=json 时标准输出只留给最后的报告，每个命名空间的进度信息写到标准错误
+		if *report == "json" {
+			progress = os.Stderr
+		}
+	}
+
+	if *operate == "run-job" {
+		if *image == "" {
+			exitUsage("run-job requires -image")
+		}
+
+		// Job 必须真正运行才有日志和退出码
+		if *dryRunMode != "none" {
+			exitUsage("run-job does not support -dry-run")
+		}
+
+		// 标准输出只留给容器的日志，进度信息写到标准错误
+		progress = os.Stderr
+	}
+
+	var objects []runtime.Object
+	if len(manifests) > 0 {
+		var err error
+		if objects, err = loadManifests(manifests); err != nil {
+			exitOnError(err)
+		}
+	}
+
+	// validate 不需要 kubeconfig，在连接集群之前完成
+	if *operate == "validate" {
+		desired := objects
+		if desired == nil {
+			desired = stackObjects(stack)
+		}
+
+		exitOnError(validate(desired))
+		return
+	}
+
 	/*
 	   clientcmd 是 Kubernetes Go 客户端的一部分，是 client-go/tools/clientcmd 包中的一个子包，
 	   用于加载和生成 kubernetes/client-go/rest.Config 配置对象。该包提供了一些函数，
@@ -83,7 +482,7 @@ func main() {
 	config, err := clientcmd.BuildConfigFromFlags("", *kubeconfig)
 
 	if err != nil {
-		panic(err.Error())
+		exitOnError(err)
 	}
 
 	/*
@@ -99,74 +498,350 @@ func main() {
 	clientset, err := kubernetes.NewForConfig(config)
 
 	if err != nil {
-		panic(err.Error())
+		exitOnError(err)
 	}
 
-	fmt.Printf("operate is %v\n", *operate)
+	// dynamic client 可以操作任意类型的资源，clean 和 prune 用它删除通过 discovery 找到的对象
+	dynamicClient, err := dynamic.NewForConfig(config)
 
-	if "clean" == *operate {
-		clean(clientset)
-	} else {
-		createNamespace(clientset)
-		createDeployment(clientset)
-		createService(clientset)
+	if err != nil {
+		exitOnError(err)
+	}
+
+	fmt.Fprintf(progress, "operate is %v\n", *operate)
+
+	if dryRun, err = parseDryRun(*dryRunMode); err != nil {
+		exitUsage("%v", err)
+	}
+
+	propagationPolicy, err := parsePropagationPolicy(*propagation)
+
+	if err != nil {
+		exitUsage("%v", err)
+	}
+
+	options := cleanOptions{
+		propagation: propagationPolicy,
+		gracePeriod: *gracePeriod,
+		wait:        *waitClean,
+		timeout:     *timeout,
+
+		pvcRetention: appsv1.PersistentVolumeClaimRetentionPolicyType(stack.PVCRetention),
+	}
+
+	// namespaces 是 create 或 clean 涉及的命名空间
+	namespaces := []string{stack.Namespace}
+	if objects != nil {
+		if namespaces, err = objectNamespaces(objects); err != nil {
+			exitOnError(err)
+		}
+	}
+
+	if fanOutMode {
+		namespaces = fanOutNamespaces
+
+		if *namespaceSelector != "" {
+			if namespaces, err = selectNamespaces(clientset, *namespaceSelector); err != nil {
+				exitOnError(err)
+			}
+
+			if len(namespaces) == 0 {
+				exitUsage("no namespace matches -namespace-selector %q", *namespaceSelector)
+			}
+		}
+	}
+
+	// 权限预检在修改任何对象之前完成，缺少权限时不会留下只创建或删除了一半的对象，见 preflight.go
+	if *preflightCheck && (*operate == "create" || *operate == "clean") {
+		checks, err := operateChecks(clientset, *operate, namespaces, objects, options, *waitRollout && len(dryRun) == 0, *pruneStale)
+
+		if err != nil {
+			exitOnError(err)
+		}
+
+		exitOnError(preflight(progress, clientset, checks))
+	}
+
+	// create 在创建任何对象之前检查 Service 的名字和 NodePort 是否与集群中已有的 Service 冲突，-f 中的 Service 不检查，
+	// fan-out 在每个命名空间中自己检查，见 fanOutOperate
+	if *operate == "create" && objects == nil && !fanOutMode {
+		services := newServicePreflight(*nodePortConflict == NODE_PORT_CONFLICT_ALLOCATE)
+
+		if stack, err = services.check(progress, clientset, stack); err != nil {
+			exitOnError(err)
+		}
+	}
+
+	if fanOutMode {
+		results, err := fanOutOperate(progress, clientset, dynamicClient, *operate, namespaces, *concurrency, options, *waitRollout)
+		printFanOutReport(os.Stdout, results, *report)
+		exitOnError(err)
+		return
+	}
+
+	switch *operate {
+	case "clean":
+		if objects != nil {
+			err = cleanOwned(progress, clientset, dynamicClient, namespaces, options)
+		} else {
+			err = clean(progress, clientset, dynamicClient, options)
+		}
+
+		if err != nil {
+			exitOnError(err)
+		}
+	case "apply":
+		if objects != nil {
+			exitUsage("apply does not support -f yet, use create")
+		}
+
+		if err := applyStack(progress, dynamicClient, stack); err != nil {
+			exitOnError(err)
+		}
+	case "diff":
+		changed, err := diffStack(os.Stdout, dynamicClient, stack)
+
+		if err != nil {
+			exitOnError(err)
+		}
+
+		if changed {
+			os.Exit(EXIT_DIFF_FOUND)
+		}
+	case "scale":
+		if *replicas < 0 {
+			exitUsage("scale requires -replicas")
+		}
+
+		if err := scaleDeployment(progress, clientset, *name, int32(*replicas)); err != nil {
+			exitOnError(err)
+		}
+	case "set-image":
+		if *image == "" {
+			exitUsage("set-image requires -image")
+		}
+
+		if err := setImage(progress, clientset, *name, *container, *image); err != nil {
+			exitOnError(err)
+		}
+	case "restart":
+		if err := restartDeployment(progress, clientset, *name); err != nil {
+			exitOnError(err)
+		}
+	case "history":
+		if err := showHistory(os.Stdout, clientset, *name); err != nil {
+			exitOnError(err)
+		}
+	case "rollback":
+		if err := rollbackDeployment(progress, clientset, *name, *toRevision); err != nil {
+			exitOnError(err)
+		}
+	case "release", "promote", "abort":
+		// 发布需要等待新版本真正可用，dry run 不会创建任何 Pod
+		if len(dryRun) > 0 {
+			exitUsage("%s does not support -dry-run", *operate)
+		}
+
+		release := releaseOptions{
+			strategy:      *strategy,
+			version:       *version,
+			canaryPercent: *canaryPercent,
+			timeout:       *timeout,
+			clean:         options,
+		}
+
+		switch *operate {
+		case "release":
+			err = releaseStack(progress, clientset, release)
+		case "promote":
+			err = promoteRelease(progress, clientset, release)
+		case "abort":
+			err = abortRelease(progress, clientset, release)
+		}
+
+		if err != nil {
+			exitOnError(err)
+		}
+	case "backup":
+		path := *archive
+		if path == "" {
+			path = stack.Namespace + ".tar.gz"
+		}
+
+		if err := backupNamespace(clientset, dynamicClient, stack.Namespace, path); err != nil {
+			exitOnError(err)
+		}
+	case "restore":
+		if err := restoreNamespace(dynamicClient, *archive, *targetNamespace); err != nil {
+			exitOnError(err)
+		}
+	case "clone":
+		target, err := targetDynamicClient(dynamicClient, *kubeconfig, *toContext)
+
+		if err != nil {
+			exitOnError(err)
+		}
+
+		if err := cloneNamespace(dynamicClient, target, *cloneFrom, *cloneTo); err != nil {
+			exitOnError(err)
+		}
+	case "controller":
+		if len(dryRun) > 0 {
+			exitUsage("controller does not support -dry-run")
+		}
+
+		// SIGTERM（例如 Pod 被删除）和 Ctrl+C 都让 controller 处理完手上的任务后退出
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+
+		metrics := &leaderMetrics{lease: election.namespace + "/" + election.leaseName, identity: election.identity}
+		closeMetrics := serveMetrics(*metricsAddress, metrics)
+
+		err := runWithLeaderElection(ctx, clientset, election, metrics, func(ctx context.Context) error {
+			return runController(ctx, clientset, stack, *workers)
+		})
+
+		closeMetrics()
+		stop()
+
+		if err != nil {
+			exitOnError(err)
+		}
+	case "run-job":
+		// Ctrl+C 和 SIGTERM 停止跟随日志，Job 照常被删除
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+
+		code, err := runJob(ctx, clientset, runJobOptions{
+			namespace: stack.Namespace,
+			image:     *image,
+			command:   flag.Args(),
+			keep:      *keep,
+			timeout:   *timeout,
+		}, os.Stdout, progress)
+
+		stop()
+
+		if err != nil {
+			exitOnError(err)
+		}
+
+		os.Exit(code)
+	case "gc-jobs":
+		namespace := stack.Namespace
+		if *allNamespaces {
+			namespace = metav1.NamespaceAll
+		}
+
+		if err := gcJobs(clientset, namespace, *minAge); err != nil {
+			exitOnError(err)
+		}
+	default:
+		if objects != nil {
+			if err := createManifests(progress, clientset, objects); err != nil {
+				exitOnError(err)
+			}
+			break
+		}
+
+		if err := createStack(progress, clientset, stack); err != nil {
+			exitOnError(err)
+		}
+	}
+
+	if *pruneStale && (*operate == "create" || *operate == "apply") {
+		desired := objects
+		if desired == nil {
+			desired = stackObjects(stack)
+		}
+
+		if err := prune(progress, clientset, dynamicClient, desired); err != nil {
+			exitOnError(err)
+		}
+	}
+
+	// dry run 并没有真正创建任何对象，也就没有 rollout 可以等待
+	if *waitRollout && len(dryRun) == 0 {
+		switch *operate {
+		case "create", "apply":
+			waitForRollouts(progress, clientset, objects, *timeout)
+		case "scale", "set-image", "restart", "rollback":
+			exitOnRolloutFailure(progress, clientset, stack.Namespace, *name, *timeout)
+		}
 	}
 
 }
 
+// waitForRollouts 等待本次创建的所有 Deployment、StatefulSet 和 DaemonSet 完成 rollout。没有使用 -f 时等待的是 stack 的工作负载。
+// 任何一个工作负载失败都会结束进程，流水线可以据此判断发布是否成功。进度写到 out。
+func waitForRollouts(out io.Writer, clientset kubernetes.Interface, objects []runtime.Object, timeout time.Duration) {
+	if objects == nil {
+		objects = newWorkloadObjects(stack)
+	}
+
+	for _, obj := range objects {
+		switch workload := obj.(type) {
+		case *appsv1.Deployment, *appsv1.StatefulSet, *appsv1.DaemonSet:
+			accessor, err := meta.Accessor(workload)
+
+			if err != nil {
+				exitOnError(err)
+			}
+
+			exitOnError(waitForWorkload(out, clientset, objectKind(obj), accessor.GetNamespace(), accessor.GetName(), timeout))
+		}
+	}
+}
+
+// exitOnRolloutFailure 等待一个 Deployment 完成 rollout，失败时以 EXIT_ROLLOUT_FAILED 或 EXIT_TIMEOUT 结束进程
+func exitOnRolloutFailure(out io.Writer, clientset kubernetes.Interface, namespace, name string, timeout time.Duration) {
+	exitOnError(waitForRollout(out, clientset, namespace, name, timeout))
+}
+
 /*
-具体来说，该函数（clean）使用传递进来的 Kubernetes 客户端集合 clientset，调用 Kubernetes API Server 中与 Job/Pod 操作相关的函数和方法。
-在函数内部，它调用了 clientset.BatchV1().Jobs(namespace).List() 方法，以获取 namespace 命名空间中所有的 Job 集合，
-然后使用 clientset.BatchV1().Jobs(namespace).Delete() 方法删除所有已完成的 Job。
-删除作业时，它还会使用 clientset.CoreV1().Pods(namespace).Delete() 方法，删除与已完成作业相关的 Pod。
-clean() 函数的作用是清理指定命名空间中已完成的任务和它们关联的 Pod，以释放 Kubernetes 集群资源并提高集群效率。
- 这个函数通过传递 Kubernetes 客户端集合来完成，因此在编写这个函数时，需要先通过 kubernetes.NewForConfig() 函数创建 Kubernetes 客户端集合对象，并将其传递到这个函数中。
+clean 删除 stack.Namespace 中所有由本程序创建的对象，最后删除命名空间本身。
+之前这里按写死的名字依次删除 Service、Deployment 和命名空间，命名空间里其他由本程序创建的对象就会遗留下来。
+现在本程序创建的每个对象都带有 ownershipLabels（app.kubernetes.io/managed-by 和 app.kubernetes.io/instance），
+clean 通过 discovery 找出集群中所有命名空间级的资源类型，再用 dynamic client 按标签选择器列出并删除属于本程序的对象。
+删除参数由命令行决定：PropagationPolicy 控制是否级联删除 ReplicaSet 和 Pod，GracePeriodSeconds 控制 Pod 的优雅终止时间。
+对象已经不存在（NotFound）时只打印提示并继续，因此 clean 可以重复执行，也可以清理只创建了一半的资源。
 */
-// 参数是一个指向 kubernetes.Clientset 类型的指针 clientset，用于传递 Kubernetes 客户端集合。
-// 这个函数的作用是删除指定命名空间中已经完成的 Job 和它们创建的 Pod。
-func clean(clientset *kubernetes.Clientset) {
-
-	/*这行代码的含义是创建了一个名为 emptyDeleteOptions 的变量，类型为 metav1.DeleteOptions{}，并将其初始化，使其为空。
-	在 Kubernetes 中，当我们删除某个资源对象时，需要传递一组可选参数，用于指定如何删除这个对象。
-	这些参数被定义在 metav1.DeleteOptions{} 类型中，并包括了以下字段：GracePeriodSeconds、Preconditions、PropagationPolicy 和 DryRun。
-	如果删除资源对象时不需要使用任何可选参数，可以创建一个空的 metav1.DeleteOptions 对象，
-	将其作为删除函数的参数传递给 Kubernetes 客户端函数，这样就可以使用默认设置删除资源对象*/
-	// 在后续的代码中，这个空 DeleteOptions 对象被用于删除 Job 和 Pod 对象，因为这些资源对象都可以使用默认的参数来进行删除。
-	// 另外，在不需要删除资源对象时，也可以直接使用 nil 值来指定删除参数，以达到与空的 DeleteOptions 对象相同的作用
-	emptyDeleteOptions := metav1.DeleteOptions{}
-
-	// 删除service
-	/*
-		clientset.CoreV1().Services(NAMESPACE).Delete(context.TODO(), SEVRICE_NAME, emptyDeleteOptions)：删除指定名称空间（NAMESPACE）中名为 SEVRICE_NAME 的 Service 资源对象。
-		该操作使用 CoreV1() 方法来获取核心 API 的资源对象，并使用 Services(NAMESPACE) 方法来访问该命名空间下的 Service 列表。
-		删除 Service 对象时，使用 Delete() 方法，传递 emptyDeleteOptions 作为删除选项，以使用默认设置从 Kubernetes API Server 删除资源对象。如果删除失败，则会出现一个 panic，将错误信息输出到控制台
-	*/
-	if err := clientset.CoreV1().Services(NAMESPACE).Delete(context.TODO(), SERVICE_NAME, emptyDeleteOptions); err != nil {
-		panic(err.Error())
+// 参数 clientset 用于 discovery 和命名空间操作，dynamicClient 用于删除任意类型的对象。
+// 两者都是接口，测试中可以传入 k8s.io/client-go/kubernetes/fake 和 k8s.io/client-go/dynamic/fake 提供的实现。进度写到 out。
+func clean(out io.Writer, clientset kubernetes.Interface, dynamicClient dynamic.Interface, options cleanOptions) error {
+	return cleanOwned(out, clientset, dynamicClient, []string{stack.Namespace}, options)
+}
+
+// createStack 按 values 依次创建命名空间和其中的全部对象，进度写到 out，遇到第一个错误就返回，由调用者决定如何处理
+func createStack(out io.Writer, clientset kubernetes.Interface, values stackValues) error {
+	if err := createNamespace(out, clientset, values); err != nil {
+		return err
 	}
 
-	// 删除deployment
-	/*
-		clientset.AppsV1().Deployments(NAMESPACE).Delete(context.TODO(), DEPLOYMENT_NAME, emptyDeleteOptions)：删除指定名称空间（NAMESPACE）中名为 DEPLOYMENT_NAME 的 Deployment 资源对象。
-		该操作使用 AppsV1() 方法来获取应用程序 API 的资源对象，并使用 Deployments(NAMESPACE) 方法来访问该命名空间下的 Deployment 列表。
-		删除 Deployment 对象时，使用 Delete() 方法并传递 emptyDeleteOptions。如果删除失败，则会出现一个 panic，将错误信息输出到控制台
-	*/
-	if err := clientset.AppsV1().Deployments(NAMESPACE).Delete(context.TODO(), DEPLOYMENT_NAME, emptyDeleteOptions); err != nil {
-		panic(err.Error())
+	return createStackObjects(out, clientset, values)
+}
+
+// createStackObjects 在已经存在的 values.Namespace 中按依赖顺序创建配额、权限、ConfigMap 和 Secret、工作负载、Service，
+// 以及 Ingress、HorizontalPodAutoscaler 和 PodDisruptionBudget，可选的对象只在 values 中开启时创建
+func createStackObjects(out io.Writer, clientset kubernetes.Interface, values stackValues) error {
+	if err := createCompanions(out, clientset, newProvisionObjects(values)); err != nil {
+		return err
 	}
 
-	// 删除namespace
-	/*
-		clientset.CoreV1().Namespaces().Delete(context.TODO(), NAMESPACE, emptyDeleteOptions)：删除名为 NAMESPACE 的命名空间。
-		该操作使用 CoreV1() 方法来获取核心 API 的资源对象，并使用 Namespaces() 方法来访问 Kubernetes 中所有的命名空间资源对象。
-		删除 Namespace 对象时，使用 Delete() 方法并传递 emptyDeleteOptions。如果删除失败，则会出现一个 panic，将错误信息输出到控制台。
-	*/
-	if err := clientset.CoreV1().Namespaces().Delete(context.TODO(), NAMESPACE, emptyDeleteOptions); err != nil {
-		panic(err.Error())
+	if err := createCompanions(out, clientset, newConfigObjects(values)); err != nil {
+		return err
+	}
+
+	if err := createWorkload(out, clientset, values); err != nil {
+		return err
+	}
+
+	if err := createService(out, clientset, values); err != nil {
+		return err
 	}
+
+	return createCompanions(out, clientset, newPolicyObjects(values))
 }
 
-func createNamespace(clientset *kubernetes.Clientset) {
+func createNamespace(out io.Writer, clientset kubernetes.Interface, values stackValues) error {
 	// 通过调用 clientset.CoreV1().Namespaces() 来获取命名空间客户端的函数，我们可以获得一个用于创建和操作命名空间资源的客户端，并通过调用它访问 Kubernetes API 中的命名空间，以实现对命名空间资源的操作。
 	/*
 		CoreV1() 方法用于访问 Kubernetes 核心 API 的资源对象。
@@ -179,128 +854,202 @@ func createNamespace(clientset *kubernetes.Clientset) {
 	// 定义了一个变量 namespace，它是一个指向 apiv1.Namespace 类型对象的指针。这个变量用于存放新创建的命名空间的元数据信息。
 	/*
 		ObjectMeta 包含 Kubernetes API 资源对象的元数据信息，这里指定了要创建的命名空间的名称。
-		Name 表示要创建的命名空间的名称，它是一个常量 NAMESPACE。
+		Name 表示要创建的命名空间的名称，它是 values.Namespace，默认是常量 NAMESPACE。
 		metav1.ObjectMeta 是一个具有元数据的对象，用于定义 Kubernetes 资源对象的基本信息。在这里，我们指定这个 ObjectMeta 对象的属性为新命名空间的名称。
 	*/
-	namespace := &apiv1.Namespace{
-		ObjectMeta: metav1.ObjectMeta{
-			Name: NAMESPACE,
-		},
-	}
+	namespace := newNamespace(values)
 
 	// 通过调用 namespaceClient.Create() 方法来创建一个新的命名空间，并将其存储在 namespace 变量中
 	// 使用客户端集合和命名空间客户端 namespaceClient 来创建一个新的 Kubernetes 命名空间对象，并返回一个包含命名空间详细信息的 corev1.Namespace 对象（result）以及任何可能发生的错误（err）
 	/*
 		context.TODO() 是一个空的上下文，代表函数不需要任何特殊的上下文信息。
 		namespace 是我们之前定义的用于存放新命名空间元数据信息的 Namespace 对象，它指定了新命名空间的名称和其他元数据。
-		metav1.CreateOptions{} 表示在创建命名空间时不传递任何额外的选项和参数。
+		createOptions() 在没有指定 -dry-run 时等同于 metav1.CreateOptions{}，表示在创建命名空间时不传递任何额外的选项和参数；-dry-run=server 时会带上 DryRun: All。
 	*/
-	result, err := namespaceClient.Create(context.TODO(), namespace, metav1.CreateOptions{})
+	result, err := namespaceClient.Create(context.TODO(), namespace, createOptions())
 
 	if err != nil {
-		panic(err.Error())
+		return err
 	}
 
 	// %s 表示字符串参数
-	fmt.Printf("Create namespace %s \n", result.GetName())
+	fmt.Fprintf(out, "Create namespace %s%s \n", result.GetName(), dryRunSuffix())
+	return nil
 }
 
-func createService(clientset *kubernetes.Clientset) {
-	// 使用 CoreV1() 函数获取 Kubernetes API 中 Core API 资源对象的客户端集合，然后使用 Services(NAMESPACE) 方法访问 NAMESPACE 命名空间中的所有服务（Services）资源对象，并创建与之交互的 Kubernetes 客户端。
+func createService(out io.Writer, clientset kubernetes.Interface, values stackValues) error {
+	// 使用 CoreV1() 函数获取 Kubernetes API 中 Core API 资源对象的客户端集合，然后使用 Services(values.Namespace) 方法访问该命名空间中的所有服务（Services）资源对象，并创建与之交互的 Kubernetes 客户端。
 	/*
 		clientset 是之前通过 kubernetes.NewForConfig() 函数创建的 Kubernetes 客户端集合对象，它提供了与 API Server 通信的便捷方法和函数。
 		通过使用 clientset.CoreV1() 方法来获取 Kubernetes Core API 相关的客户端方法和函数。
-		serviceClient := clientset.CoreV1().Services(NAMESPACE) 中的 Services(NAMESPACE) 方法用于获取 Kubernetes API Server 中与服务资源对象相关的客户端集合，并且指定命名空间（NAMESPACE）用于限制服务的范围。
+		serviceClient := clientset.CoreV1().Services(values.Namespace) 中的 Services(values.Namespace) 方法用于获取 Kubernetes API Server 中与服务资源对象相关的客户端集合，并且指定命名空间（values.Namespace）用于限制服务的范围。
 	*/
-	serviceClient := clientset.CoreV1().Services(NAMESPACE)
+	serviceClient := clientset.CoreV1().Services(values.Namespace)
 
 	// 定义了一个 apiv1.Service 类型的指针变量 service，用于存储已定义的新服务资源对象的元数据信息。
 	/*
-		ObjectMeta 包含 Kubernetes API 资源对象的元数据信息，这里指定了要创建的服务的名称为 SERVICE_NAME。
-		Name 表示要创建的服务的名称，它是一个常量 SERVICE_NAME。
-		Spec 表示服务的详细信息，包括所使用的端口、服务类型（NodePort）和选择器，以及与服务可能关联的其它信息。
-		Ports 表示服务监听的端口号，它只有唯一一项，是用于监听 HTTP 流量的，命名为 "http"，容器端口号为 8080，然后将它们绑定到节点的 30080 端口。
+		ObjectMeta 包含 Kubernetes API 资源对象的元数据信息，这里指定了要创建的服务的名称为 values.ServiceName。
+		Name 表示要创建的服务的名称，默认是常量 SERVICE_NAME。
+		Spec 表示服务的详细信息，包括所使用的端口、服务类型（values.ServiceType，默认 NodePort）和选择器，以及与服务可能关联的其它信息。
+		Ports 表示服务监听的端口号，它只有唯一一项，是用于监听 HTTP 流量的，命名为 "http"，端口号为 values.Port（默认 8080），然后将它们绑定到节点的 values.NodePort 端口（默认 30080）。
 		Selector 指定了将要选择的标签，以便建立与端点 Pod 的关联，这里定义了一个标签 (app:tomcat)。
-		Type 表示 Kubernetes 服务类型，这里使用的是 apiv1.ServiceTypeNodePort，可以使用任何类型的 Kubernetes 服务类型，根据特定的应用程序需要选择不同类型的服务对象。
+		Type 表示 Kubernetes 服务类型，由 -service-type 决定，可以是 ClusterIP、NodePort 或 LoadBalancer，根据特定的应用程序需要选择不同类型的服务对象。
 	*/
-	service := &apiv1.Service{
-		ObjectMeta: metav1.ObjectMeta{
-			Name: SERVICE_NAME,
-		},
-		Spec: apiv1.ServiceSpec{
-			Ports: []apiv1.ServicePort{{
-				Name:     "http",
-				Port:     8080,
-				NodePort: 30080,
-			},
-			},
-			Selector: map[string]string{
-				"app": "tomcat",
-			},
-			Type: apiv1.ServiceTypeNodePort,
-		},
-	}
+	service := newService(values)
 
-	result, err := serviceClient.Create(context.TODO(), service, metav1.CreateOptions{})
+	result, err := serviceClient.Create(context.TODO(), service, createOptions())
 
 	if err != nil {
-		panic(err.Error())
+		return err
 	}
 
-	fmt.Printf("Create service %s \n", result.GetName())
-
+	fmt.Fprintf(out, "Create service %s%s \n", result.GetName(), dryRunSuffix())
+	return nil
 }
 
-func createDeployment(clientset *kubernetes.Clientset) {
+func createDeployment(out io.Writer, clientset kubernetes.Interface, values stackValues) error {
 	// 使用 Kubernetes 客户端对象集合和应用程序 API 资源对象的客户端方法和函数，来访问和管理 Kubernetes 部署资源对象。
 	/*
 		clientset 是之前通过 kubernetes.NewForConfig() 函数创建的 Kubernetes 客户端集合对象，它提供了与 API Server 通信的便捷方法和函数。
 		通过调用 AppsV1() 方法来获取 Kubernetes 应用程序 API 的客户端方法和函数。
-		deploymentClient := clientset.AppsV1().Deployments(NAMESPACE) 中的 Deployments(NAMESPACE) 方法用于获取 Kubernetes API Server 中与部署资源对象相关的客户端集合，并且指定命名空间（NAMESPACE）用于限制部署操作的范围。
+		deploymentClient := clientset.AppsV1().Deployments(values.Namespace) 中的 Deployments(values.Namespace) 方法用于获取 Kubernetes API Server 中与部署资源对象相关的客户端集合，并且指定命名空间（values.Namespace）用于限制部署操作的范围。
 	*/
-	deploymentClient := clientset.AppsV1().Deployments(NAMESPACE)
+	deploymentClient := clientset.AppsV1().Deployments(values.Namespace)
 
 	// 定义了一个指向 appsv1.Deployment 类型的指针变量 deployment，用于存储要创建的新部署资源的元数据信息。
 	/*
-		ObjectMeta 包含 Kubernetes API 资源对象的元数据信息，这里指定了要创建的部署资源对象的名称为 DEPLOYMENT_NAME。
-		Name 表示要创建的部署资源对象的名称，它是一个常量 DEPLOYMENT_NAME。
+		ObjectMeta 包含 Kubernetes API 资源对象的元数据信息，这里指定了要创建的部署资源对象的名称为 values.DeploymentName。
+		Name 表示要创建的部署资源对象的名称，默认是常量 DEPLOYMENT_NAME。
 		Spec 表示部署的详细信息，包括复制数、选择器、定义 Pod 模板等等。
-		Replicas 表示需要部署的 Pod 的个数，这里设置为 2。
+		Replicas 表示需要部署的 Pod 的个数，由 values.Replicas 决定，默认为 2。
 		Selector 指定了部署的机制，以此用于根据特定的选择器匹配进入部署的每一个 Pod 实例。在这里选择了选择器 app:tomcat。
 		Template 是一个定义在部署之中的 Pod 模板，提供容器的元数据和其他相关信息，可以用恰当的方式定义出必要的容器属性等。
 		Labels 定义了模板中容器的元数据，用于匹配 Selector 中的标签，以便向部署中添加 Pod。在这里选择了选择器 app:tomcat。
 		Containers 是包含部署中容器的列表，每个容器都有一个预定义的设置，如容器名称、镜像名称、端口号等
 	*/
-	deployment := &appsv1.Deployment{
+	deployment := newDeployment(values)
+
+	// 调用 deploymentClient.Create() 方法来将定义的新部署资源对象 deployment 存储在 Kubernetes 中，并将相关参数传递给此函数。
+	/*
+		context.TODO() 是一个空的上下文，代表函数不需要任何特殊的上下文信息。虽然，在某些情况下，调用函数时必须传递一个上下文参数，例如取消请求和处理超时等。但是，在本例里，我们使用了一个简单的 TODO() 空上下文。
+		deployment 是用于存储新部署资源对象元数据信息的 Deployment 对象。这个对象包含了要部署的副本数、所使用的选择器和相关其他信息，用于标识和管理该部署。
+		这个参数是通过之前定义的指向 appsv1.Deployment 类型的指针来传递的，以便在 Kubernetes 中使用。
+		createOptions() 在没有指定 -dry-run 时等同于 metav1.CreateOptions{}，表示创建部署资源对象时不需要传递任何附加的选项和参数。这个参数用于传递 Kubernetes 资源对象的附加选项信息和其他注释信息等上下文参数。
+	*/
+	result, err := deploymentClient.Create(context.TODO(), deployment, createOptions())
+
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(out, "Create deployment %s%s \n", result.GetName(), dryRunSuffix())
+	return nil
+}
+
+// stackObjects 返回没有使用 -f 时按 values 创建的期望对象集合，与 createStack 创建的对象相同。
+// 与清单解码出来的对象一样设置好 GroupVersionKind 和命名空间，prune 等按 kind 处理对象的逻辑可以同时用于两者。
+func stackObjects(values stackValues) []runtime.Object {
+	namespace := newNamespace(values)
+	namespace.SetGroupVersionKind(apiv1.SchemeGroupVersion.WithKind("Namespace"))
+
+	service := newService(values)
+	service.Namespace = values.Namespace
+	service.SetGroupVersionKind(apiv1.SchemeGroupVersion.WithKind("Service"))
+
+	objects := []runtime.Object{namespace}
+	objects = append(objects, newProvisionObjects(values)...)
+	objects = append(objects, newConfigObjects(values)...)
+	objects = append(objects, newWorkloadObjects(values)...)
+	objects = append(objects, service)
+
+	return append(objects, newPolicyObjects(values)...)
+}
+
+// newNamespace 返回要创建的命名空间对象，create 和 apply 两种操作共用这一份定义。
+// Provision 开启时命名空间还带有 Pod Security Admission 标签
+func newNamespace(values stackValues) *apiv1.Namespace {
+	namespace := &apiv1.Namespace{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   values.Namespace,
+			Labels: ownershipLabels(),
+		},
+	}
+
+	if values.Provision {
+		for key, value := range podSecurityLabels(values.PodSecurity) {
+			namespace.Labels[key] = value
+		}
+	}
+
+	return namespace
+}
+
+// newService 返回要创建的 Service 对象，类型由 values.ServiceType 决定，ClusterIP 类型不设置 NodePort
+func newService(values stackValues) *apiv1.Service {
+	nodePort := values.NodePort
+	if !usesNodePort(values.ServiceType) {
+		nodePort = 0
+	}
+
+	return &apiv1.Service{
 		ObjectMeta: metav1.ObjectMeta{
-			Name: DEPLOYMENT_NAME,
+			Name:   values.ServiceName,
+			Labels: ownershipLabels(),
+		},
+		Spec: apiv1.ServiceSpec{
+			Ports: []apiv1.ServicePort{{
+				Name:     "http",
+				Port:     values.Port,
+				NodePort: nodePort,
+			},
+			},
+			Selector: map[string]string{
+				"app": "tomcat",
+			},
+			Type: apiv1.ServiceType(values.ServiceType),
+		},
+	}
+}
+
+// newDeployment 返回要创建的 tomcat Deployment 对象，名字和副本数来自 values，Pod 模板见 newPodTemplate
+func newDeployment(values stackValues) *appsv1.Deployment {
+	return &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   values.DeploymentName,
+			Labels: ownershipLabels(),
 		},
 		Spec: appsv1.DeploymentSpec{
-			Replicas: pointer.Int32Ptr(2),
+			Replicas: pointer.Int32Ptr(values.Replicas),
 			Selector: &metav1.LabelSelector{
 				MatchLabels: map[string]string{
 					"app": "tomcat",
 				},
 			},
-			Template: apiv1.PodTemplateSpec{
-				ObjectMeta: metav1.ObjectMeta{
-					Labels: map[string]string{
-						"app": "tomcat",
-					},
-				},
-				Spec: apiv1.PodSpec{
-					Containers: []apiv1.Container{
+			Template: newPodTemplate(values),
+		},
+	}
+}
+
+// newPodTemplate 返回 Deployment、StatefulSet 和 DaemonSet 共用的 tomcat Pod 模板，镜像和端口来自 values，
+// 开启了 ConfigMap、Secret 或 HPA 时还会加上对应的挂载、环境变量和 CPU request，开启 Provision 时以专用的 ServiceAccount 运行
+func newPodTemplate(values stackValues) apiv1.PodTemplateSpec {
+	template := apiv1.PodTemplateSpec{
+		ObjectMeta: metav1.ObjectMeta{
+			Labels: map[string]string{
+				"app": "tomcat",
+			},
+		},
+		Spec: apiv1.PodSpec{
+			Containers: []apiv1.Container{
+				{
+					Name:            "tomcat",
+					Image:           values.Image,
+					ImagePullPolicy: "IfNotPresent",
+					Ports: []apiv1.ContainerPort{
 						{
-							Name:            "tomcat",
-							Image:           "tomcat:8.0.18-jre8",
-							ImagePullPolicy: "IfNotPresent",
-							Ports: []apiv1.ContainerPort{
-								{
-									Name:          "http",
-									Protocol:      apiv1.ProtocolSCTP,
-									ContainerPort: 8080,
-								},
-							},
+							Name:          "http",
+							Protocol:      apiv1.ProtocolSCTP,
+							ContainerPort: values.Port,
 						},
 					},
 				},
@@ -308,18 +1057,11 @@ func createDeployment(clientset *kubernetes.Clientset) {
 		},
 	}
 
-	// 调用 deploymentClient.Create() 方法来将定义的新部署资源对象 deployment 存储在 Kubernetes 中，并将相关参数传递给此函数。
-	/*
-		context.TODO() 是一个空的上下文，代表函数不需要任何特殊的上下文信息。虽然，在某些情况下，调用函数时必须传递一个上下文参数，例如取消请求和处理超时等。但是，在本例里，我们使用了一个简单的 TODO() 空上下文。
-		deployment 是用于存储新部署资源对象元数据信息的 Deployment 对象。这个对象包含了要部署的副本数、所使用的选择器和相关其他信息，用于标识和管理该部署。
-		这个参数是通过之前定义的指向 appsv1.Deployment 类型的指针来传递的，以便在 Kubernetes 中使用。
-		metav1.CreateOptions{} 表示创建部署资源对象时不需要传递任何附加的选项和参数。这个参数用于传递 Kubernetes 资源对象的附加选项信息和其他注释信息等上下文参数。
-	*/
-	result, err := deploymentClient.Create(context.TODO(), deployment, metav1.CreateOptions{})
+	addCompanionsToPodSpec(values, &template.Spec)
 
-	if err != nil {
-		panic(err.Error())
+	if values.Provision {
+		template.Spec.ServiceAccountName = serviceAccountName(values)
 	}
 
-	fmt.Printf("Create deployment %s \n", result.GetName())
+	return template
 }
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	apiv1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/kubernetes/scheme"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+var (
+	servicesResource    = schema.GroupVersionResource{Version: "v1", Resource: "services"}
+	deploymentsResource = schema.GroupVersionResource{Group: "apps", Version: "v1", Resource: "deployments"}
+)
+
+// failOn 返回一个 reactor，对 resource 的 verb 请求返回 err，其他请求交给默认的 object tracker 处理
+func failOn(verb, resource string, err error) (string, string, k8stesting.ReactionFunc) {
+	return verb, resource, func(action k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, err
+	}
+}
+
+// newFakeClients 返回 fake clientset 和 fake dynamic client。create 为 true 时先用 createStack 创建整套对象，
+// 再把命名空间级的对象复制到 dynamic client 中，clean 通过 dynamic client 找到并删除它们。
+// clientset 的 discovery 只声明了 Service 和 Deployment 两种资源。
+func newFakeClients(t *testing.T, create bool) (*fake.Clientset, *dynamicfake.FakeDynamicClient) {
+	t.Helper()
+
+	clientset := fake.NewSimpleClientset()
+	clientset.Resources = []*metav1.APIResourceList{
+		{
+			GroupVersion: "v1",
+			APIResources: []metav1.APIResource{{Name: "services", Kind: "Service", Namespaced: true, Verbs: metav1.Verbs{"create", "list", "delete"}}},
+		},
+		{
+			GroupVersion: "apps/v1",
+			APIResources: []metav1.APIResource{{Name: "deployments", Kind: "Deployment", Namespaced: true, Verbs: metav1.Verbs{"create", "list", "delete"}}},
+		},
+	}
+
+	var objects []runtime.Object
+
+	if create {
+		if err := createStack(os.Stdout, clientset, stack); err != nil {
+			t.Fatalf("createStack: %v", err)
+		}
+
+		deployment, err := clientset.AppsV1().Deployments(NAMESPACE).Get(context.TODO(), DEPLOYMENT_NAME, metav1.GetOptions{})
+		if err != nil {
+			t.Fatalf("get deployment: %v", err)
+		}
+
+		service, err := clientset.CoreV1().Services(NAMESPACE).Get(context.TODO(), SERVICE_NAME, metav1.GetOptions{})
+		if err != nil {
+			t.Fatalf("get service: %v", err)
+		}
+
+		objects = append(objects, deployment, service)
+	}
+
+	return clientset, dynamicfake.NewSimpleDynamicClient(scheme.Scheme, objects...)
+}
+
+func TestCreateStack(t *testing.T) {
+	tests := []struct {
+		name     string
+		existing []runtime.Object
+		verb     string
+		resource string
+		err      error
+		// wantErr 判断 createStack 返回的错误，为 nil 表示期望成功
+		wantErr func(error) bool
+		// wantDeployments 和 wantServices 是 createStack 之后应该存在的对象数量
+		wantDeployments int
+		wantServices    int
+	}{
+		{
+			name:            "creates the whole stack",
+			wantDeployments: 1,
+			wantServices:    1,
+		},
+		{
+			name:     "namespace already exists",
+			existing: []runtime.Object{&apiv1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: NAMESPACE}}},
+			wantErr:  apierrors.IsAlreadyExists,
+		},
+		{
+			name:            "service already exists",
+			verb:            "create",
+			resource:        "services",
+			err:             apierrors.NewAlreadyExists(servicesResource.GroupResource(), SERVICE_NAME),
+			wantErr:         apierrors.IsAlreadyExists,
+			wantDeployments: 1,
+		},
+		{
+			name:     "deployment create conflicts",
+			verb:     "create",
+			resource: "deployments",
+			err:      apierrors.NewConflict(deploymentsResource.GroupResource(), DEPLOYMENT_NAME, nil),
+			wantErr:  apierrors.IsConflict,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clientset := fake.NewSimpleClientset(tt.existing...)
+			if tt.err != nil {
+				clientset.PrependReactor(failOn(tt.verb, tt.resource, tt.err))
+			}
+
+			err := createStack(os.Stdout, clientset, stack)
+
+			if tt.wantErr == nil && err != nil {
+				t.Fatalf("createStack: unexpected error %v", err)
+			}
+
+			if tt.wantErr != nil && !tt.wantErr(err) {
+				t.Fatalf("createStack: got error %v", err)
+			}
+
+			deployments, _ := clientset.AppsV1().Deployments(NAMESPACE).List(context.TODO(), metav1.ListOptions{})
+			if len(deployments.Items) != tt.wantDeployments {
+				t.Errorf("got %d deployment(s), want %d", len(deployments.Items), tt.wantDeployments)
+			}
+
+			services, _ := clientset.CoreV1().Services(NAMESPACE).List(context.TODO(), metav1.ListOptions{})
+			if len(services.Items) != tt.wantServices {
+				t.Errorf("got %d service(s), want %d", len(services.Items), tt.wantServices)
+			}
+
+			for _, deployment := range deployments.Items {
+				if !isOwned(&deployment) {
+					t.Errorf("deployment %s is missing the ownership labels: %v", deployment.Name, deployment.Labels)
+				}
+			}
+		})
+	}
+}
+
+func TestClean(t *testing.T) {
+	options := cleanOptions{propagation: metav1.DeletePropagationBackground, gracePeriod: -1}
+
+	tests := []struct {
+		name string
+		// create 为 true 时先用 createStack 创建整套对象
+		create bool
+		// unowned 为 true 时命名空间不带 ownershipLabels，clean 只能删除其中的对象
+		unowned bool
+		// 注入到 dynamic client 的错误
+		verb     string
+		resource string
+		err      error
+		wantErr  func(error) bool
+		// wantNamespace 表示 clean 之后命名空间是否还存在，wantObjects 是 dynamic client 中剩下的对象数量
+		wantNamespace bool
+		wantObjects   int
+	}{
+		{
+			name:   "removes the whole stack",
+			create: true,
+		},
+		{
+			name: "nothing to clean",
+		},
+		{
+			name:          "keeps a namespace it does not own",
+			create:        true,
+			unowned:       true,
+			wantNamespace: true,
+		},
+		{
+			name:        "deployment already deleted by someone else",
+			create:      true,
+			verb:        "delete",
+			resource:    "deployments",
+			err:         apierrors.NewNotFound(deploymentsResource.GroupResource(), DEPLOYMENT_NAME),
+			wantObjects: 1,
+		},
+		{
+			name:          "service delete conflicts",
+			create:        true,
+			verb:          "delete",
+			resource:      "services",
+			err:           apierrors.NewConflict(servicesResource.GroupResource(), SERVICE_NAME, nil),
+			wantErr:       apierrors.IsConflict,
+			wantNamespace: true,
+			wantObjects:   1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clientset, dynamicClient := newFakeClients(t, tt.create)
+
+			if tt.unowned {
+				namespace, _ := clientset.CoreV1().Namespaces().Get(context.TODO(), NAMESPACE, metav1.GetOptions{})
+				namespace.Labels = nil
+
+				if _, err := clientset.CoreV1().Namespaces().Update(context.TODO(), namespace, metav1.UpdateOptions{}); err != nil {
+					t.Fatalf("update namespace: %v", err)
+				}
+			}
+
+			if tt.err != nil {
+				dynamicClient.PrependReactor(failOn(tt.verb, tt.resource, tt.err))
+			}
+
+			err := clean(os.Stdout, clientset, dynamicClient, options)
+
+			if tt.wantErr == nil && err != nil {
+				t.Fatalf("clean: unexpected error %v", err)
+			}
+
+			if tt.wantErr != nil && !tt.wantErr(err) {
+				t.Fatalf("clean: got error %v", err)
+			}
+
+			_, err = clientset.CoreV1().Namespaces().Get(context.TODO(), NAMESPACE, metav1.GetOptions{})
+			if exists := err == nil; exists != tt.wantNamespace {
+				t.Errorf("namespace exists = %v, want %v", exists, tt.wantNamespace)
+			}
+
+			remaining := 0
+			for _, gvr := range []schema.GroupVersionResource{servicesResource, deploymentsResource} {
+				list, err := dynamicClient.Resource(gvr).Namespace(NAMESPACE).List(context.TODO(), metav1.ListOptions{})
+				if err != nil {
+					t.Fatalf("list %s: %v", gvr.Resource, err)
+				}
+
+				remaining += len(list.Items)
+			}
+
+			if remaining != tt.wantObjects {
+				t.Errorf("%d object(s) left after clean, want %d", remaining, tt.wantObjects)
+			}
+		})
+	}
+}
+
+func TestCleanDeleteOptions(t *testing.T) {
+	clientset, dynamicClient := newFakeClients(t, true)
+
+	if err := clean(os.Stdout, clientset, dynamicClient, cleanOptions{propagation: metav1.DeletePropagationForeground, gracePeriod: 0}); err != nil {
+		t.Fatalf("clean: %v", err)
+	}
+
+	// fake dynamic client 记录的 DeleteAction 不带 DeleteOptions，这里只能检查命名空间的删除参数和对象的删除顺序
+	var deleted []string
+	for _, action := range dynamicClient.Actions() {
+		if deleteAction, ok := action.(k8stesting.DeleteAction); ok {
+			deleted = append(deleted, deleteAction.GetResource().Resource)
+		}
+	}
+
+	if len(deleted) != 2 || deleted[0] != "deployments" || deleted[1] != "services" {
+		t.Errorf("deleted %v, want the deployment before the service", deleted)
+	}
+
+	for _, action := range clientset.Actions() {
+		deleteAction, ok := action.(k8stesting.DeleteAction)
+		if !ok {
+			continue
+		}
+
+		options := deleteAction.GetDeleteOptions()
+		if options.PropagationPolicy == nil || *options.PropagationPolicy != metav1.DeletePropagationForeground {
+			t.Errorf("delete %s: propagation policy %v, want Foreground", deleteAction.GetResource().Resource, options.PropagationPolicy)
+		}
+
+		if options.GracePeriodSeconds == nil || *options.GracePeriodSeconds != 0 {
+			t.Errorf("delete %s: grace period %v, want 0", deleteAction.GetResource().Resource, options.GracePeriodSeconds)
+		}
+	}
+}
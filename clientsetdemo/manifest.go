@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	appsv1 "k8s.io/api/apps/v1"
+	autoscalingv2 "k8s.io/api/autoscaling/v2"
+	batchv1 "k8s.io/api/batch/v1"
+	apiv1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	policyv1 "k8s.io/api/policy/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/yaml"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+)
+
+// manifestPaths 实现了 flag.Value 接口，-f 参数可以重复出现，也可以用逗号分隔多个文件或目录
+type manifestPaths []string
+
+func (p *manifestPaths) String() string {
+	return strings.Join(*p, ",")
+}
+
+func (p *manifestPaths) Set(value string) error {
+	for _, path := range strings.Split(value, ",") {
+		if path != "" {
+			*p = append(*p, path)
+		}
+	}
+
+	return nil
+}
+
+// kindOrder 是创建资源时的依赖顺序：命名空间最先，其次是被工作负载引用的配置和权限对象，然后是工作负载，
+// 最后是指向 Service 或工作负载的 Ingress、HPA 和 PDB。
+// clean 时按相反的顺序删除。
+var kindOrder = []string{
+	"Namespace",
+	"ResourceQuota",
+	"LimitRange",
+	"ServiceAccount",
+	"Secret",
+	"ConfigMap",
+	"PersistentVolumeClaim",
+	"Role",
+	"RoleBinding",
+	"Service",
+	"DaemonSet",
+	"Deployment",
+	"StatefulSet",
+	"Job",
+	"Ingress",
+	"HorizontalPodAutoscaler",
+	"PodDisruptionBudget",
+}
+
+// kindRank 返回 kind 在 kindOrder 中的位置，不支持的 kind 返回 -1
+func kindRank(kind string) int {
+	for i, k := range kindOrder {
+		if k == kind {
+			return i
+		}
+	}
+
+	return -1
+}
+
+// objectKind 返回对象的 Kind，decodeManifest 解码时已经把 GroupVersionKind 写回了对象
+func objectKind(obj runtime.Object) string {
+	return obj.GetObjectKind().GroupVersionKind().Kind
+}
+
+// loadManifests 读取 -f 指定的文件或目录（目录只读取第一层的 .yaml、.yml 和 .json 文件），
+// 用 client-go 的 scheme 解码其中的每一个 YAML/JSON 文档，并按照 kindOrder 排好序返回。
+// 没有写 namespace 的命名空间级对象会被放到 -namespace 指定的命名空间中，所有对象都会加上 ownershipLabels。
+func loadManifests(paths []string) ([]runtime.Object, error) {
+	var files []string
+
+	for _, path := range paths {
+		info, err := os.Stat(path)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if !info.IsDir() {
+			files = append(files, path)
+			continue
+		}
+
+		entries, err := os.ReadDir(path)
+
+		if err != nil {
+			return nil, err
+		}
+
+		for _, entry := range entries {
+			switch filepath.Ext(entry.Name()) {
+			case ".yaml", ".yml", ".json":
+				if !entry.IsDir() {
+					files = append(files, filepath.Join(path, entry.Name()))
+				}
+			}
+		}
+	}
+
+	var objects []runtime.Object
+
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+
+		if err != nil {
+			return nil, err
+		}
+
+		decoded, err := decodeManifest(data)
+
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", file, err)
+		}
+
+		objects = append(objects, decoded...)
+	}
+
+	// 稳定排序，同一种 kind 保持文件中出现的顺序
+	sort.SliceStable(objects, func(i, j int) bool {
+		return kindRank(objectKind(objects[i])) < kindRank(objectKind(objects[j]))
+	})
+
+	return objects, nil
+}
+
+// decodeManifest 把一个文件的内容拆成多个文档并逐个解码
+func decodeManifest(data []byte) ([]runtime.Object, error) {
+	decoder := yaml.NewYAMLOrJSONDecoder(bytes.NewReader(data), 4096)
+	deserializer := scheme.Codecs.UniversalDeserializer()
+
+	var objects []runtime.Object
+
+	for {
+		raw := runtime.RawExtension{}
+
+		if err := decoder.Decode(&raw); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		// 跳过 "---" 之间的空文档
+		raw.Raw = bytes.TrimSpace(raw.Raw)
+		if len(raw.Raw) == 0 || string(raw.Raw) == "null" {
+			continue
+		}
+
+		obj, gvk, err := deserializer.Decode(raw.Raw, nil, nil)
+
+		if err != nil {
+			return nil, err
+		}
+
+		// 解码后显式写回 GroupVersionKind，后面按 kind 排序和输出时都依赖它
+		obj.GetObjectKind().SetGroupVersionKind(*gvk)
+
+		if kindRank(gvk.Kind) < 0 {
+			return nil, fmt.Errorf("unsupported kind %s", gvk.Kind)
+		}
+
+		accessor, err := meta.Accessor(obj)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if gvk.Kind != "Namespace" && accessor.GetNamespace() == "" {
+			accessor.SetNamespace(stack.Namespace)
+		}
+
+		setOwnershipLabels(accessor)
+
+		objects = append(objects, obj)
+	}
+
+	return objects, nil
+}
+
+// createObject 根据对象的具体类型调用 clientset 中对应的 Create 方法
+func createObject(clientset kubernetes.Interface, obj runtime.Object) (metav1.Object, error) {
+	ctx := context.TODO()
+	options := createOptions()
+
+	switch o := obj.(type) {
+	case *apiv1.Namespace:
+		return clientset.CoreV1().Namespaces().Create(ctx, o, options)
+	case *apiv1.ResourceQuota:
+		return clientset.CoreV1().ResourceQuotas(o.Namespace).Create(ctx, o, options)
+	case *apiv1.LimitRange:
+		return clientset.CoreV1().LimitRanges(o.Namespace).Create(ctx, o, options)
+	case *apiv1.ServiceAccount:
+		return clientset.CoreV1().ServiceAccounts(o.Namespace).Create(ctx, o, options)
+	case *apiv1.Secret:
+		return clientset.CoreV1().Secrets(o.Namespace).Create(ctx, o, options)
+	case *apiv1.ConfigMap:
+		return clientset.CoreV1().ConfigMaps(o.Namespace).Create(ctx, o, options)
+	case *apiv1.PersistentVolumeClaim:
+		return clientset.CoreV1().PersistentVolumeClaims(o.Namespace).Create(ctx, o, options)
+	case *rbacv1.Role:
+		return clientset.RbacV1().Roles(o.Namespace).Create(ctx, o, options)
+	case *rbacv1.RoleBinding:
+		return clientset.RbacV1().RoleBindings(o.Namespace).Create(ctx, o, options)
+	case *apiv1.Service:
+		return clientset.CoreV1().Services(o.Namespace).Create(ctx, o, options)
+	case *appsv1.DaemonSet:
+		return clientset.AppsV1().DaemonSets(o.Namespace).Create(ctx, o, options)
+	case *appsv1.Deployment:
+		return clientset.AppsV1().Deployments(o.Namespace).Create(ctx, o, options)
+	case *appsv1.StatefulSet:
+		return clientset.AppsV1().StatefulSets(o.Namespace).Create(ctx, o, options)
+	case *batchv1.Job:
+		return clientset.BatchV1().Jobs(o.Namespace).Create(ctx, o, options)
+	case *networkingv1.Ingress:
+		return clientset.NetworkingV1().Ingresses(o.Namespace).Create(ctx, o, options)
+	case *autoscalingv2.HorizontalPodAutoscaler:
+		return clientset.AutoscalingV2().HorizontalPodAutoscalers(o.Namespace).Create(ctx, o, options)
+	case *policyv1.PodDisruptionBudget:
+		return clientset.PolicyV1().PodDisruptionBudgets(o.Namespace).Create(ctx, o, options)
+	}
+
+	return nil, fmt.Errorf("unsupported object type %T", obj)
+}
+
+// createManifests 按依赖顺序创建 -f 中的全部对象，遇到第一个错误就返回
+func createManifests(out io.Writer, clientset kubernetes.Interface, objects []runtime.Object) error {
+	for _, obj := range objects {
+		result, err := createObject(clientset, obj)
+
+		if err != nil {
+			return err
+		}
+
+		fmt.Fprintf(out, "Create %s %s%s \n", strings.ToLower(objectKind(obj)), result.GetName(), dryRunSuffix())
+	}
+
+	return nil
+}
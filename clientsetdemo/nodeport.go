@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+/*
+createService 之前写死了 NodePort 30080，集群中只要有其他 Service 占用了这个端口，create 就会在 Deployment 已经创建之后失败。
+现在 create 在创建任何对象之前列出集群中全部的 Service，检查两种冲突：
+  - 名字冲突：values.Namespace 中已经有名为 values.ServiceName 的 Service；
+  - NodePort 冲突：其他 Service 已经占用了 values.NodePort。ClusterIP 类型不使用 NodePort，NodePort 为 0 时由 API Server 分配，都不检查。
+
+NodePort 冲突时，-node-port-conflict=allocate 从 values.NodePortRange 中选一个空闲端口代替，默认的 fail 则与名字冲突一样拒绝创建，
+输出冲突报告并返回 serviceConflictError，进程以 EXIT_ALREADY_EXISTS 结束。
+*/
+
+const (
+	NODE_PORT_CONFLICT_FAIL     = "fail"
+	NODE_PORT_CONFLICT_ALLOCATE = "allocate"
+)
+
+// serviceTypes 是 -service-type 支持的 Service 类型
+var serviceTypes = map[string]bool{
+	string(apiv1.ServiceTypeClusterIP):    true,
+	string(apiv1.ServiceTypeNodePort):     true,
+	string(apiv1.ServiceTypeLoadBalancer): true,
+}
+
+// parseNodePortRange 解析 min-max 格式的端口范围，与 kube-apiserver 的 --service-node-port-range 相同
+func parseNodePortRange(value string) (int32, int32, error) {
+	first, last, ok := strings.Cut(value, "-")
+	if !ok {
+		return 0, 0, fmt.Errorf("%q is not in the form min-max", value)
+	}
+
+	low, err := strconv.ParseInt(strings.TrimSpace(first), 10, 32)
+	if err != nil {
+		return 0, 0, fmt.Errorf("%q: %w", value, err)
+	}
+
+	high, err := strconv.ParseInt(strings.TrimSpace(last), 10, 32)
+	if err != nil {
+		return 0, 0, fmt.Errorf("%q: %w", value, err)
+	}
+
+	if low < 1 || high > 65535 || low > high {
+		return 0, 0, fmt.Errorf("%q: must be a range of ports between 1 and 65535", value)
+	}
+
+	return int32(low), int32(high), nil
+}
+
+// usesNodePort 判断这种类型的 Service 是否在每个节点上占用 NodePort
+func usesNodePort(serviceType string) bool {
+	return serviceType == string(apiv1.ServiceTypeNodePort) || serviceType == string(apiv1.ServiceTypeLoadBalancer)
+}
+
+// serviceConflict 是一个冲突：existing 是已经存在的 Service（namespace/name），reason 说明冲突的内容
+type serviceConflict struct {
+	existing string
+	reason   string
+}
+
+// servicePreflight 在创建 Service 之前检查冲突。多个命名空间并发创建时共用一个 servicePreflight，
+// reserved 记录本次运行已经分配给其他命名空间、但可能还没有创建出来的 NodePort，避免两个命名空间拿到同一个端口
+type servicePreflight struct {
+	allocate bool
+
+	mu       sync.Mutex
+	reserved map[int32]string
+}
+
+func newServicePreflight(allocate bool) *servicePreflight {
+	return &servicePreflight{allocate: allocate, reserved: map[int32]string{}}
+}
+
+// check 检查 values 描述的 Service 是否与集群中已有的 Service 冲突，结果写到 out。
+// 返回的 values 中 NodePort 可能已经换成了新分配的端口；有不能解决的冲突时输出报告并返回 serviceConflictError
+func (p *servicePreflight) check(out io.Writer, clientset kubernetes.Interface, values stackValues) (stackValues, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	services, err := clientset.CoreV1().Services(metav1.NamespaceAll).List(context.TODO(), metav1.ListOptions{})
+
+	if err != nil {
+		return values, fmt.Errorf("list services: %w", err)
+	}
+
+	key := values.Namespace + "/" + values.ServiceName
+	used := map[int32]string{}
+	var conflicts []serviceConflict
+
+	for _, service := range services.Items {
+		if service.Namespace == values.Namespace && service.Name == values.ServiceName {
+			conflicts = append(conflicts, serviceConflict{existing: key, reason: "a service with this name already exists"})
+		}
+
+		for _, port := range service.Spec.Ports {
+			if port.NodePort != 0 {
+				used[port.NodePort] = service.Namespace + "/" + service.Name
+			}
+		}
+	}
+
+	for port, owner := range p.reserved {
+		if _, found := used[port]; !found {
+			used[port] = owner + " (being created)"
+		}
+	}
+
+	if usesNodePort(values.ServiceType) && values.NodePort != 0 {
+		if owner, found := used[values.NodePort]; found {
+			free := freeNodePort(values.NodePortRange, used)
+
+			switch {
+			case !p.allocate:
+				conflicts = append(conflicts, serviceConflict{existing: owner, reason: fmt.Sprintf("nodePort %d is already used", values.NodePort)})
+			case free == 0:
+				conflicts = append(conflicts, serviceConflict{existing: owner, reason: fmt.Sprintf("nodePort %d is already used and no port in %s is free", values.NodePort, values.NodePortRange)})
+			default:
+				fmt.Fprintf(out, "NodePort %d is used by %s, service %s gets %d instead\n", values.NodePort, owner, key, free)
+				values.NodePort = free
+			}
+		}
+	}
+
+	if len(conflicts) > 0 {
+		printServiceConflicts(out, key, conflicts)
+		return values, &serviceConflictError{message: fmt.Sprintf("service %s conflicts with %d existing service(s), nothing was changed", key, len(conflicts))}
+	}
+
+	if usesNodePort(values.ServiceType) && values.NodePort != 0 {
+		p.reserved[values.NodePort] = key
+	}
+
+	return values, nil
+}
+
+// freeNodePort 返回 portRange 中第一个没有被占用的端口，没有空闲端口时返回 0
+func freeNodePort(portRange string, used map[int32]string) int32 {
+	low, high, err := parseNodePortRange(portRange)
+
+	if err != nil {
+		return 0
+	}
+
+	for port := low; port <= high; port++ {
+		if _, found := used[port]; !found {
+			return port
+		}
+	}
+
+	return 0
+}
+
+// printServiceConflicts 以表格输出 service 的全部冲突
+func printServiceConflicts(out io.Writer, service string, conflicts []serviceConflict) {
+	fmt.Fprintf(out, "Service %s cannot be created:\n", service)
+
+	writer := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(writer, "CONFLICTS WITH\tREASON")
+
+	for _, conflict := range conflicts {
+		fmt.Fprintf(writer, "%s\t%s\n", conflict.existing, conflict.reason)
+	}
+
+	writer.Flush()
+}
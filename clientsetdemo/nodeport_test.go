@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// nodePortService 返回 namespace 中占用 nodePort 的 Service
+func nodePortService(namespace, name string, nodePort int32) *apiv1.Service {
+	return &apiv1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace},
+		Spec: apiv1.ServiceSpec{
+			Type:  apiv1.ServiceTypeNodePort,
+			Ports: []apiv1.ServicePort{{Port: 80, NodePort: nodePort}},
+		},
+	}
+}
+
+func TestServicePreflight(t *testing.T) {
+	clientset := fake.NewSimpleClientset(
+		nodePortService("other", "web", DEFAULT_NODE_PORT),
+		nodePortService("other", "api", 30000),
+	)
+
+	values := defaultStackValues()
+
+	var out bytes.Buffer
+	_, err := newServicePreflight(false).check(&out, clientset, values)
+
+	if code, _ := classifyError(err); code != EXIT_ALREADY_EXISTS {
+		t.Fatalf("check returned %v (exit code %d), want EXIT_ALREADY_EXISTS", err, code)
+	}
+
+	if !strings.Contains(out.String(), "other/web") {
+		t.Errorf("report does not name the service holding the port:\n%s", out.String())
+	}
+
+	// allocate 时每个命名空间分到不同的空闲端口，已经分配出去的端口不会再分配
+	services := newServicePreflight(true)
+
+	first, err := services.check(&bytes.Buffer{}, clientset, values)
+	if err != nil {
+		t.Fatalf("check: %v", err)
+	}
+
+	values.Namespace = "second"
+	second, err := services.check(&bytes.Buffer{}, clientset, values)
+	if err != nil {
+		t.Fatalf("check: %v", err)
+	}
+
+	if first.NodePort != 30001 || second.NodePort != 30002 {
+		t.Errorf("allocated node ports %d and %d, want 30001 and 30002", first.NodePort, second.NodePort)
+	}
+
+	// ClusterIP 不占用 NodePort，但名字冲突总是拒绝
+	values.Namespace = "other"
+	values.ServiceName = "web"
+	values.ServiceType = string(apiv1.ServiceTypeClusterIP)
+
+	out.Reset()
+	if _, err := services.check(&out, clientset, values); err == nil || strings.Contains(out.String(), "nodePort") {
+		t.Errorf("check returned %v with report:\n%s\nwant only the name conflict", err, out.String())
+	}
+}
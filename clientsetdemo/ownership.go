@@ -0,0 +1,423 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	appsv1 "k8s.io/api/apps/v1"
+	apiv1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	// MANAGED_BY_LABEL 和 INSTANCE_LABEL 是 Kubernetes 推荐的通用标签，本程序创建的每个对象都会带上这两个标签，
+	// clean 和 prune 只按标签查找对象，不再依赖写死的名字
+	MANAGED_BY_LABEL = "app.kubernetes.io/managed-by"
+	INSTANCE_LABEL   = "app.kubernetes.io/instance"
+	// MANAGED_BY 是 MANAGED_BY_LABEL 的取值
+	MANAGED_BY = "clientsetdemo"
+)
+
+// instance 是 INSTANCE_LABEL 的取值，由 -instance 参数指定，用来区分同一个集群中由本程序创建的多套对象
+var instance = "client-test"
+
+// ownershipLabels 返回本程序创建的对象都会带上的标签
+func ownershipLabels() map[string]string {
+	return map[string]string{
+		MANAGED_BY_LABEL: MANAGED_BY,
+		INSTANCE_LABEL:   instance,
+	}
+}
+
+// setOwnershipLabels 把 ownershipLabels 合并到对象已有的标签中
+func setOwnershipLabels(obj metav1.Object) {
+	objectLabels := obj.GetLabels()
+	if objectLabels == nil {
+		objectLabels = map[string]string{}
+	}
+
+	for key, value := range ownershipLabels() {
+		objectLabels[key] = value
+	}
+
+	obj.SetLabels(objectLabels)
+}
+
+// isOwned 判断对象是否带有 ownershipLabels
+func isOwned(obj metav1.Object) bool {
+	return labels.SelectorFromSet(ownershipLabels()).Matches(labels.Set(obj.GetLabels()))
+}
+
+// ownedObject 是通过标签找到的一个由本程序创建的对象
+type ownedObject struct {
+	gvr    schema.GroupVersionResource
+	object *unstructured.Unstructured
+}
+
+// ownedObjectKey 是对象在期望集合中的唯一标识，prune 用它判断线上对象是否还在期望状态中
+func ownedObjectKey(kind, namespace, name string) string {
+	return kind + "/" + namespace + "/" + name
+}
+
+// listOwnedObjects 用 dynamic client 按标签列出 namespace 中 ownedResources 的全部对象，即属于本程序的对象，
+// controller 根据这些对象生成的对象（见 isDerivedObject）不在其中
+func listOwnedObjects(clientset kubernetes.Interface, dynamicClient dynamic.Interface, namespace string) ([]ownedObject, error) {
+	resources, err := ownedResources(clientset)
+
+	if err != nil {
+		return nil, err
+	}
+
+	selector := labels.SelectorFromSet(ownershipLabels()).String()
+
+	var owned []ownedObject
+
+	for _, resource := range resources {
+		gvr := schema.GroupVersionResource{Group: resource.Group, Version: resource.Version, Resource: resource.Name}
+		list, err := dynamicClient.Resource(gvr).Namespace(namespace).List(context.TODO(), metav1.ListOptions{LabelSelector: selector})
+
+		if err != nil {
+			return nil, fmt.Errorf("list %s: %w", gvr.String(), err)
+		}
+
+		for i := range list.Items {
+			if !isDerivedObject(&list.Items[i]) {
+				owned = append(owned, ownedObject{gvr: gvr, object: &list.Items[i]})
+			}
+		}
+	}
+
+	return owned, nil
+}
+
+// ownedResources 通过 discovery 找出集群支持的、可以 list 和 delete 的全部命名空间级资源类型，返回的 APIResource 填好了 Group 和 Version。
+// clean 和 prune 在这些资源中查找本程序创建的对象，权限预检也按它们检查 list 和 delete 权限。
+// 部分 API 组不可用（例如 metrics-server 挂掉）时 discovery 会返回部分结果和错误，此时跳过不可用的组继续处理。
+// 这里使用包级函数 discovery.ServerPreferredNamespacedResources 而不是同名方法：两者对真实的 DiscoveryClient 完全相同，
+// 但 fake clientset 的同名方法总是返回空结果，包级函数则通过 ServerGroups 和 ServerResourcesForGroupVersion 读取 fake 中配置的资源。
+func ownedResources(clientset kubernetes.Interface) ([]metav1.APIResource, error) {
+	resourceLists, err := discovery.ServerPreferredNamespacedResources(clientset.Discovery())
+
+	if err != nil && !discovery.IsGroupDiscoveryFailedError(err) {
+		return nil, err
+	}
+
+	var resources []metav1.APIResource
+
+	for _, resourceList := range resourceLists {
+		gv, err := schema.ParseGroupVersion(resourceList.GroupVersion)
+
+		if err != nil {
+			return nil, err
+		}
+
+		for _, resource := range resourceList.APIResources {
+			// 跳过子资源（例如 deployments/scale）和不支持 list、delete 的资源
+			if strings.Contains(resource.Name, "/") || !hasVerbs(resource.Verbs, "list", "delete") {
+				continue
+			}
+
+			resource.Group, resource.Version = gv.Group, gv.Version
+			resources = append(resources, resource)
+		}
+	}
+
+	return resources, nil
+}
+
+// isDerivedObject 判断对象是否由 controller 根据本程序创建的对象生成。它们会从来源对象复制标签，因此同样带有 ownershipLabels，
+// 但应该由 controller 维护和回收，clean 和 prune 直接删除它们只会让 controller 马上重建，或者短暂地打断 Service 的流量：
+//   - 带有 controller ownerReference 的对象，例如 Deployment 的 ReplicaSet 和 Pod、Service 的 EndpointSlice；
+//   - endpoints controller 为每个 Service 维护的同名 Endpoints，它没有 ownerReference；
+//   - endpointslice.kubernetes.io/managed-by 不是本程序的 EndpointSlice，例如由 Endpoints 镜像出来的 EndpointSlice。
+func isDerivedObject(obj *unstructured.Unstructured) bool {
+	if metav1.GetControllerOf(obj) != nil {
+		return true
+	}
+
+	switch obj.GetKind() {
+	case "Endpoints":
+		return true
+	case "EndpointSlice":
+		managedBy, ok := obj.GetLabels()[discoveryv1.LabelManagedBy]
+		return ok && managedBy != MANAGED_BY
+	}
+
+	return false
+}
+
+// hasVerbs 判断资源是否支持全部的 verbs
+func hasVerbs(supported metav1.Verbs, verbs ...string) bool {
+	for _, verb := range verbs {
+		found := false
+
+		for _, s := range supported {
+			if s == verb {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			return false
+		}
+	}
+
+	return true
+}
+
+// deleteOwnedObjects 按照 kindOrder 的逆序删除对象：工作负载最先，被引用的配置和权限对象最后，不在 kindOrder 中的类型排在最前面。
+// 对象已经不存在时跳过，遇到其他错误立即返回。
+func deleteOwnedObjects(out io.Writer, dynamicClient dynamic.Interface, owned []ownedObject, options metav1.DeleteOptions) error {
+	sort.SliceStable(owned, func(i, j int) bool {
+		return kindRank(owned[i].object.GetKind()) > kindRank(owned[j].object.GetKind())
+	})
+
+	for _, o := range owned {
+		err := dynamicClient.Resource(o.gvr).Namespace(o.object.GetNamespace()).Delete(context.TODO(), o.object.GetName(), options)
+
+		if err := reportDelete(out, strings.ToLower(o.object.GetKind()), o.object.GetName(), err); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// podSelectorOf 返回工作负载的 spec.selector，不是工作负载的对象返回 nil
+func podSelectorOf(obj *unstructured.Unstructured) labels.Selector {
+	content, found, err := unstructured.NestedMap(obj.Object, "spec", "selector")
+
+	if err != nil || !found {
+		return nil
+	}
+
+	// Service 的 spec.selector 是一个简单的 map，不是 LabelSelector，这里只处理工作负载
+	switch obj.GetKind() {
+	case "Deployment", "StatefulSet", "DaemonSet", "ReplicaSet", "Job":
+	default:
+		return nil
+	}
+
+	labelSelector := &metav1.LabelSelector{}
+
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(content, labelSelector); err != nil {
+		return nil
+	}
+
+	selector, err := metav1.LabelSelectorAsSelector(labelSelector)
+
+	if err != nil {
+		return nil
+	}
+
+	return selector
+}
+
+// cleanOwned 删除 namespaces 中所有属于本程序的对象，然后删除其中属于本程序的命名空间本身，进度写到 out。
+// 不是由本程序创建的命名空间（没有 ownershipLabels）只清理其中的对象，不会被删除；
+// 按 options.pvcRetention 保留了 StatefulSet 的 PVC 的命名空间也不会被删除，否则 PVC 会随命名空间一起被删除。
+func cleanOwned(out io.Writer, clientset kubernetes.Interface, dynamicClient dynamic.Interface, namespaces []string, options cleanOptions) error {
+	deleteOptions := options.deleteOptions()
+	// dry run 时对象并没有真正被删除，不能等待
+	wait := options.wait && len(dryRun) == 0
+	// retained 记录每个命名空间中保留下来的 PVC 的数量
+	retained := map[string]int{}
+
+	for _, namespace := range namespaces {
+		owned, err := listOwnedObjects(clientset, dynamicClient, namespace)
+
+		if err != nil {
+			return err
+		}
+
+		// 删除之前先记下工作负载的 selector，-wait 时用它们找出还没终止的 Pod
+		selectors := map[string]labels.Selector{}
+		for _, o := range owned {
+			if selector := podSelectorOf(o.object); selector != nil {
+				selectors[strings.ToLower(o.object.GetKind())+" "+o.object.GetName()] = selector
+			}
+		}
+
+		// StatefulSet 的 PVC 不带 ownershipLabels，保留时要在删除 StatefulSet 之前处理，删除时在之后处理
+		statefulSets, err := ownedStatefulSets(owned)
+
+		if err != nil {
+			return err
+		}
+
+		deleteClaimsToo := options.pvcRetention == appsv1.DeletePersistentVolumeClaimRetentionPolicyType
+
+		if !deleteClaimsToo {
+			for _, statefulSet := range statefulSets {
+				count, err := retainClaims(out, clientset, statefulSet)
+
+				if err != nil {
+					return err
+				}
+
+				retained[namespace] += count
+			}
+		}
+
+		if err := deleteOwnedObjects(out, dynamicClient, owned, deleteOptions); err != nil {
+			return err
+		}
+
+		if deleteClaimsToo {
+			for _, statefulSet := range statefulSets {
+				if err := deleteClaims(out, clientset, statefulSet, deleteOptions); err != nil {
+					return err
+				}
+			}
+		}
+
+		// 使用 Orphan 策略时 ReplicaSet 和 Pod 会被保留下来，此时等待 Pod 终止没有意义
+		if wait && options.propagation != metav1.DeletePropagationOrphan {
+			for workload, selector := range selectors {
+				if err := waitForPodsGone(out, clientset, namespace, selector, workload, options.timeout); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	for _, namespace := range namespaces {
+		ns, err := clientset.CoreV1().Namespaces().Get(context.TODO(), namespace, metav1.GetOptions{})
+
+		if err != nil {
+			if err := reportDelete(out, "namespace", namespace, err); err != nil {
+				return err
+			}
+
+			continue
+		}
+
+		if !isOwned(ns) {
+			fmt.Fprintf(out, "namespace %s is not managed by %s instance %s, skip\n", namespace, MANAGED_BY, instance)
+			continue
+		}
+
+		if retained[namespace] > 0 {
+			fmt.Fprintf(out, "Keep namespace %s: deleting it would also delete the %d persistentvolumeclaim(s) kept by -pvc-retention=%s, delete them with -pvc-retention=%s\n",
+				namespace, retained[namespace], appsv1.RetainPersistentVolumeClaimRetentionPolicyType, appsv1.DeletePersistentVolumeClaimRetentionPolicyType)
+			continue
+		}
+
+		err = clientset.CoreV1().Namespaces().Delete(context.TODO(), namespace, deleteOptions)
+
+		if err := reportDelete(out, "namespace", namespace, err); err != nil {
+			return err
+		}
+
+		if wait {
+			if err := waitForNamespaceGone(out, clientset, namespace, options.timeout); err != nil {
+				return err
+			}
+
+			fmt.Fprintf(out, "Namespace %s is gone\n", namespace)
+		}
+	}
+
+	return nil
+}
+
+// objectNamespaces 返回对象所在的全部命名空间（去重并保持出现顺序），Namespace 对象本身也算在内
+func objectNamespaces(objects []runtime.Object) ([]string, error) {
+	var namespaces []string
+	seen := map[string]bool{}
+
+	for _, obj := range objects {
+		accessor, err := meta.Accessor(obj)
+
+		if err != nil {
+			return nil, err
+		}
+
+		namespace := accessor.GetNamespace()
+		if _, ok := obj.(*apiv1.Namespace); ok {
+			namespace = accessor.GetName()
+		}
+
+		if namespace != "" && !seen[namespace] {
+			seen[namespace] = true
+			namespaces = append(namespaces, namespace)
+		}
+	}
+
+	return namespaces, nil
+}
+
+// prune 删除 desired 所在的命名空间中带有 ownershipLabels、但已经不在 desired 中的对象，
+// 例如清单里删掉的 ConfigMap，或者改名之前的旧 Service。命名空间本身不会被 prune，其他不会出现在 desired 中的对象见 prunable。
+func prune(out io.Writer, clientset kubernetes.Interface, dynamicClient dynamic.Interface, desired []runtime.Object) error {
+	keys := map[string]bool{}
+
+	for _, obj := range desired {
+		accessor, err := meta.Accessor(obj)
+
+		if err != nil {
+			return err
+		}
+
+		keys[ownedObjectKey(objectKind(obj), accessor.GetNamespace(), accessor.GetName())] = true
+	}
+
+	background := metav1.DeletePropagationBackground
+	deleteOptions := metav1.DeleteOptions{PropagationPolicy: &background, DryRun: dryRun}
+
+	namespaces, err := objectNamespaces(desired)
+
+	if err != nil {
+		return err
+	}
+
+	for _, namespace := range namespaces {
+		owned, err := listOwnedObjects(clientset, dynamicClient, namespace)
+
+		if err != nil {
+			return err
+		}
+
+		var stale []ownedObject
+		for _, o := range owned {
+			if prunable(o.object) && !keys[ownedObjectKey(o.object.GetKind(), o.object.GetNamespace(), o.object.GetName())] {
+				stale = append(stale, o)
+			}
+		}
+
+		if len(stale) > 0 {
+			fmt.Fprintf(out, "Prune %d object(s) no longer in the desired set from namespace %s\n", len(stale), namespace)
+			if err := deleteOwnedObjects(out, dynamicClient, stale, deleteOptions); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// prunable 判断 prune 能否删除一个不在期望集合中的对象。只有 kindOrder 中 create 和 -f 会创建的类型才可能被 prune，
+// 下面这些对象本来就不会出现在期望集合中，由各自的操作清理：
+//   - 名字由 API Server 生成的对象，例如 run-job -keep 留下的 Job，由 gc-jobs 清理；
+//   - 带有 TRACK_LABEL 的 Deployment，即 release 创建的 <name>-<version>，由 promote 和 abort 处理。
+func prunable(obj *unstructured.Unstructured) bool {
+	if kindRank(obj.GetKind()) < 0 || obj.GetGenerateName() != "" {
+		return false
+	}
+
+	_, tracked := obj.GetLabels()[TRACK_LABEL]
+	return !tracked
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"os"
+	"reflect"
+	"sort"
+	"testing"
+
+	apiv1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/kubernetes/scheme"
+)
+
+// pruneResources 是 prune 测试中 discovery 声明的资源
+var pruneResources = []schema.GroupVersionResource{
+	servicesResource,
+	deploymentsResource,
+	{Version: "v1", Resource: "endpoints"},
+	{Group: "discovery.k8s.io", Version: "v1", Resource: "endpointslices"},
+	{Group: "batch", Version: "v1", Resource: "jobs"},
+}
+
+// newPruneClients 返回 prune 和 clean 测试使用的 fake clientset 和 fake dynamic client。
+// 除了 stack 的 Deployment 和 Service，命名空间中还有一个改名之前留下的旧 Service，
+// 以及同样带有 ownershipLabels 的 EndpointSlice、Endpoints、发布中的候选 Deployment 和 run-job -keep 留下的 Job
+func newPruneClients(t *testing.T) (*fake.Clientset, *dynamicfake.FakeDynamicClient) {
+	t.Helper()
+
+	clientset, _ := newFakeClients(t, false)
+	clientset.Resources = []*metav1.APIResourceList{
+		{
+			GroupVersion: "v1",
+			APIResources: []metav1.APIResource{
+				{Name: "services", Kind: "Service", Namespaced: true, Verbs: metav1.Verbs{"list", "delete"}},
+				{Name: "endpoints", Kind: "Endpoints", Namespaced: true, Verbs: metav1.Verbs{"list", "delete"}},
+			},
+		},
+		{
+			GroupVersion: "apps/v1",
+			APIResources: []metav1.APIResource{{Name: "deployments", Kind: "Deployment", Namespaced: true, Verbs: metav1.Verbs{"list", "delete"}}},
+		},
+		{
+			GroupVersion: "discovery.k8s.io/v1",
+			APIResources: []metav1.APIResource{{Name: "endpointslices", Kind: "EndpointSlice", Namespaced: true, Verbs: metav1.Verbs{"list", "delete"}}},
+		},
+		{
+			GroupVersion: "batch/v1",
+			APIResources: []metav1.APIResource{{Name: "jobs", Kind: "Job", Namespaced: true, Verbs: metav1.Verbs{"list", "delete"}}},
+		},
+	}
+
+	if err := createStack(os.Stdout, clientset, stack); err != nil {
+		t.Fatalf("createStack: %v", err)
+	}
+
+	deployment, err := clientset.AppsV1().Deployments(NAMESPACE).Get(context.TODO(), DEPLOYMENT_NAME, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("get deployment: %v", err)
+	}
+
+	service, err := clientset.CoreV1().Services(NAMESPACE).Get(context.TODO(), SERVICE_NAME, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("get service: %v", err)
+	}
+	service.UID = "service-uid"
+
+	oldService := service.DeepCopy()
+	oldService.Name = "old-service"
+
+	// endpointslice controller 复制 Service 的标签，并把 Service 设为 controller
+	endpointSlice := &discoveryv1.EndpointSlice{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            SERVICE_NAME + "-abcde",
+			Namespace:       NAMESPACE,
+			Labels:          map[string]string{discoveryv1.LabelManagedBy: "endpointslice-controller.k8s.io", discoveryv1.LabelServiceName: SERVICE_NAME},
+			OwnerReferences: []metav1.OwnerReference{*metav1.NewControllerRef(service, apiv1.SchemeGroupVersion.WithKind("Service"))},
+		},
+		AddressType: discoveryv1.AddressTypeIPv4,
+	}
+	setOwnershipLabels(endpointSlice)
+
+	// endpoints controller 同样复制 Service 的标签，但不设置 ownerReference
+	endpoints := &apiv1.Endpoints{ObjectMeta: metav1.ObjectMeta{Name: SERVICE_NAME, Namespace: NAMESPACE}}
+	setOwnershipLabels(endpoints)
+
+	candidate := deployment.DeepCopy()
+	candidate.Name = candidateName("v2")
+	candidate.Labels[TRACK_LABEL] = TRACK_CANDIDATE
+
+	job := newRunJob(runJobOptions{namespace: NAMESPACE, image: "busybox"})
+	job.Name = job.GenerateName + "x7k2p"
+
+	objects := []runtime.Object{deployment, service, oldService, endpointSlice, endpoints, candidate, job}
+
+	return clientset, dynamicfake.NewSimpleDynamicClient(scheme.Scheme, objects...)
+}
+
+// remainingObjects 返回 dynamic client 中 pruneResources 的全部对象，格式为 resource/name，按字母排序
+func remainingObjects(t *testing.T, dynamicClient *dynamicfake.FakeDynamicClient) []string {
+	t.Helper()
+
+	var remaining []string
+
+	for _, gvr := range pruneResources {
+		list, err := dynamicClient.Resource(gvr).Namespace(NAMESPACE).List(context.TODO(), metav1.ListOptions{})
+		if err != nil {
+			t.Fatalf("list %s: %v", gvr.Resource, err)
+		}
+
+		for _, item := range list.Items {
+			remaining = append(remaining, gvr.Resource+"/"+item.GetName())
+		}
+	}
+
+	sort.Strings(remaining)
+	return remaining
+}
+
+func TestPrune(t *testing.T) {
+	clientset, dynamicClient := newPruneClients(t)
+
+	if err := prune(os.Stdout, clientset, dynamicClient, stackObjects(stack)); err != nil {
+		t.Fatalf("prune: %v", err)
+	}
+
+	// 只有旧 Service 被删除；EndpointSlice 和 Endpoints 属于 controller，候选 Deployment 和 Job 不属于期望集合
+	want := []string{
+		"deployments/" + DEPLOYMENT_NAME,
+		"deployments/" + candidateName("v2"),
+		"endpoints/" + SERVICE_NAME,
+		"endpointslices/" + SERVICE_NAME + "-abcde",
+		"jobs/" + MANAGED_BY + "-run-x7k2p",
+		"services/" + SERVICE_NAME,
+	}
+
+	if got := remainingObjects(t, dynamicClient); !reflect.DeepEqual(got, want) {
+		t.Errorf("objects after prune = %v, want %v", got, want)
+	}
+}
+
+func TestCleanSkipsDerivedObjects(t *testing.T) {
+	clientset, dynamicClient := newPruneClients(t)
+
+	options := cleanOptions{propagation: metav1.DeletePropagationBackground, gracePeriod: -1}
+	if err := clean(os.Stdout, clientset, dynamicClient, options); err != nil {
+		t.Fatalf("clean: %v", err)
+	}
+
+	// clean 删除本程序创建的全部对象，包括候选 Deployment 和 Job；EndpointSlice 和 Endpoints 留给 controller 随 Service 回收
+	want := []string{
+		"endpoints/" + SERVICE_NAME,
+		"endpointslices/" + SERVICE_NAME + "-abcde",
+	}
+
+	if got := remainingObjects(t, dynamicClient); !reflect.DeepEqual(got, want) {
+		t.Errorf("objects after clean = %v, want %v", got, want)
+	}
+}
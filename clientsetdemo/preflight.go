@@ -0,0 +1,497 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+
+	appsv1 "k8s.io/api/apps/v1"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes"
+)
+
+/*
+create 和 clean 在修改任何对象之前先做权限预检。之前没有权限时要执行到一半（例如 createDeployment）才因为 Forbidden 失败，
+命名空间和前面的对象已经创建出来，只能手工清理。预检分两步：
+  - 为每个涉及的命名空间提交一个 SelfSubjectRulesReview，取得当前用户在其中的规则，规则已经允许的检查不再单独请求；
+  - 剩下的检查和集群级资源（例如命名空间本身）逐个提交 SelfSubjectAccessReview，由 API Server 给出结论。
+
+SelfSubjectRulesReview 的结果可能不完整（例如使用了 webhook 授权），所以只用来减少请求，不用来判定拒绝。
+有任何检查被拒绝时以矩阵输出缺少的权限，返回 permissionError，进程以 EXIT_FORBIDDEN 结束，集群中的对象没有任何改动。
+*/
+
+// accessCheck 是一次权限检查：当前用户能否在 namespace 中对 group/resource 执行 verb
+type accessCheck struct {
+	// namespace 为空表示集群级资源
+	namespace string
+	verb      string
+	group     string
+	resource  string
+	// escalation 不为空时，这是 Role 或 RoleBinding 授予出去的一项权限，当前用户自己没有它时，
+	// API Server 还接受 roles 上的 escalation 动词（escalate 或 bind）代替，见 rbacChecks
+	escalation string
+}
+
+// resourceName 返回 kubectl 风格的资源名，例如 deployments.apps
+func (c accessCheck) resourceName() string {
+	if c.group == "" {
+		return c.resource
+	}
+
+	return c.resource + "." + c.group
+}
+
+// operateChecks 返回 create 或 clean 将要用到的全部权限，每一项都对应这条路径实际发出的请求。
+// create 没有使用 -f 时 namespaces 中的每一个都会创建整套对象，waitRollout 为 true 时还需要等待 rollout 用到的权限，
+// prune 为 true 时还需要 prune 在 namespaces 中用到的权限
+func operateChecks(clientset kubernetes.Interface, operate string, namespaces []string, objects []runtime.Object, options cleanOptions, waitRollout, prune bool) ([]accessCheck, error) {
+	if operate == "clean" {
+		return cleanChecks(clientset, namespaces, options)
+	}
+
+	var checks []accessCheck
+
+	if objects != nil {
+		checks = createChecks(objects, waitRollout)
+	} else {
+		// servicePreflight 列出集群中全部的 Service 来检查冲突
+		checks = append(checks, accessCheck{verb: "list", resource: "services"})
+
+		for _, namespace := range namespaces {
+			values := stack
+			values.Namespace = namespace
+
+			checks = append(checks, createChecks(stackObjects(values), waitRollout)...)
+		}
+	}
+
+	if prune {
+		pruneChecks, err := pruneChecks(clientset, namespaces)
+
+		if err != nil {
+			return nil, err
+		}
+
+		checks = append(checks, pruneChecks...)
+	}
+
+	return checks, nil
+}
+
+// createChecks 返回创建 objects 需要的权限，资源名由 kind 推断。Namespace 和没有命名空间的对象按集群级资源检查
+func createChecks(objects []runtime.Object, waitRollout bool) []accessCheck {
+	var checks []accessCheck
+
+	for _, obj := range objects {
+		gvk := obj.GetObjectKind().GroupVersionKind()
+		gvr, _ := meta.UnsafeGuessKindToResource(gvk)
+
+		namespace := ""
+		if accessor, err := meta.Accessor(obj); err == nil && gvk.Kind != "Namespace" {
+			namespace = accessor.GetNamespace()
+		}
+
+		checks = append(checks, accessCheck{namespace: namespace, verb: "create", group: gvr.Group, resource: gvr.Resource})
+		checks = append(checks, rbacChecks(obj, objects)...)
+
+		if !waitRollout {
+			continue
+		}
+
+		switch gvk.Kind {
+		case "Deployment":
+			// waitForRollout 读取和监听 Deployment，同时监听 ReplicaSet、Pod 和 Event 来输出进度和失败原因
+			checks = append(checks,
+				accessCheck{namespace: namespace, verb: "get", group: "apps", resource: "deployments"},
+				accessCheck{namespace: namespace, verb: "watch", group: "apps", resource: "deployments"},
+				accessCheck{namespace: namespace, verb: "watch", group: "apps", resource: "replicasets"},
+				accessCheck{namespace: namespace, verb: "watch", resource: "pods"},
+				accessCheck{namespace: namespace, verb: "watch", resource: "events"},
+			)
+		case "StatefulSet", "DaemonSet":
+			// waitForWorkload 轮询工作负载的状态并列出它的 Pod
+			checks = append(checks,
+				accessCheck{namespace: namespace, verb: "get", group: "apps", resource: gvr.Resource},
+				accessCheck{namespace: namespace, verb: "list", resource: "pods"},
+			)
+		}
+	}
+
+	return checks
+}
+
+// rbacChecks 返回创建 Role 或 RoleBinding 时 RBAC 防止权限提升的检查。API Server 只在下面两种情况下接受它们：
+//   - Role 授予的每一项权限当前用户自己都有，否则要有 roles 上的 escalate；
+//   - RoleBinding 引用的 Role 授予的每一项权限当前用户自己都有，否则要有 roles 上的 bind。
+//
+// 引用的 Role 不在 objects 中时无法知道它授予了哪些权限，直接要求 bind
+func rbacChecks(obj runtime.Object, objects []runtime.Object) []accessCheck {
+	switch o := obj.(type) {
+	case *rbacv1.Role:
+		return grantedChecks(o.Namespace, o.Rules, "escalate")
+	case *rbacv1.RoleBinding:
+		for _, other := range objects {
+			if role, ok := other.(*rbacv1.Role); ok && o.RoleRef.Kind == "Role" && role.Namespace == o.Namespace && role.Name == o.RoleRef.Name {
+				return grantedChecks(o.Namespace, role.Rules, "bind")
+			}
+		}
+
+		resource := "roles"
+		if o.RoleRef.Kind == "ClusterRole" {
+			resource = "clusterroles"
+		}
+
+		return []accessCheck{{namespace: o.Namespace, verb: "bind", group: rbacv1.GroupName, resource: resource}}
+	}
+
+	return nil
+}
+
+// grantedChecks 把 rules 中的每一项权限展开成一个检查，当前用户没有时可以用 escalation 代替
+func grantedChecks(namespace string, rules []rbacv1.PolicyRule, escalation string) []accessCheck {
+	var checks []accessCheck
+
+	for _, rule := range rules {
+		for _, group := range rule.APIGroups {
+			for _, resource := range rule.Resources {
+				for _, verb := range rule.Verbs {
+					checks = append(checks, accessCheck{namespace: namespace, verb: verb, group: group, resource: resource, escalation: escalation})
+				}
+			}
+		}
+	}
+
+	return checks
+}
+
+// pruneChecks 返回 prune 需要的权限：listOwnedObjects 在每个命名空间中 list 全部 ownedResources，
+// 只有 prunable 的类型，即 kindOrder 中的类型，才可能被删除
+func pruneChecks(clientset kubernetes.Interface, namespaces []string) ([]accessCheck, error) {
+	resources, err := ownedResources(clientset)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var checks []accessCheck
+
+	for _, namespace := range namespaces {
+		for _, resource := range resources {
+			checks = append(checks, accessCheck{namespace: namespace, verb: "list", group: resource.Group, resource: resource.Name})
+
+			if kindRank(resource.Kind) >= 0 {
+				checks = append(checks, accessCheck{namespace: namespace, verb: "delete", group: resource.Group, resource: resource.Name})
+			}
+		}
+	}
+
+	return checks, nil
+}
+
+// cleanChecks 返回 cleanOwned 需要的权限：每一种 ownedResources 都要 list 和 delete，命名空间本身要 get 和 delete，
+// 等待删除完成时还要 list Pod 来等待它们终止，StatefulSet 的 PVC 需要的权限见 claimChecks
+func cleanChecks(clientset kubernetes.Interface, namespaces []string, options cleanOptions) ([]accessCheck, error) {
+	resources, err := ownedResources(clientset)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var checks []accessCheck
+
+	for _, namespace := range namespaces {
+		for _, resource := range resources {
+			for _, verb := range []string{"list", "delete"} {
+				checks = append(checks, accessCheck{namespace: namespace, verb: verb, group: resource.Group, resource: resource.Name})
+			}
+		}
+
+		// 与 cleanOwned 相同，dry run 时不会等待
+		if options.wait && len(dryRun) == 0 {
+			checks = append(checks, accessCheck{namespace: namespace, verb: "list", resource: "pods"})
+		}
+
+		claims, err := claimChecks(clientset, namespace, options.pvcRetention)
+
+		if err != nil {
+			return nil, err
+		}
+
+		checks = append(checks, claims...)
+	}
+
+	for _, verb := range []string{"get", "delete"} {
+		checks = append(checks, accessCheck{verb: verb, resource: "namespaces"})
+	}
+
+	return checks, nil
+}
+
+// claimChecks 返回 cleanOwned 处理 namespace 中 StatefulSet 的 PVC 需要的权限。有 volumeClaimTemplates 的 StatefulSet 都要 list PVC；
+// 保留 PVC 并且 StatefulSet 的 whenDeleted 为 Delete 时，retainClaims 还要 patch StatefulSet 和 update PVC；
+// 删除 PVC 时 deleteClaims 要 delete PVC。没有权限 list StatefulSet 时这里无从判断，list 本身已经作为 clean 的检查被拒绝
+func claimChecks(clientset kubernetes.Interface, namespace string, retention appsv1.PersistentVolumeClaimRetentionPolicyType) ([]accessCheck, error) {
+	selector := labels.SelectorFromSet(ownershipLabels()).String()
+	list, err := clientset.AppsV1().StatefulSets(namespace).List(context.TODO(), metav1.ListOptions{LabelSelector: selector})
+
+	if err != nil {
+		if apierrors.IsForbidden(err) || apierrors.IsNotFound(err) {
+			return nil, nil
+		}
+
+		return nil, fmt.Errorf("list statefulsets: %w", err)
+	}
+
+	var checks []accessCheck
+
+	for _, statefulSet := range list.Items {
+		if len(statefulSet.Spec.VolumeClaimTemplates) == 0 {
+			continue
+		}
+
+		checks = append(checks, accessCheck{namespace: namespace, verb: "list", resource: "persistentvolumeclaims"})
+
+		if retention == appsv1.DeletePersistentVolumeClaimRetentionPolicyType {
+			checks = append(checks, accessCheck{namespace: namespace, verb: "delete", resource: "persistentvolumeclaims"})
+			continue
+		}
+
+		if policy := statefulSet.Spec.PersistentVolumeClaimRetentionPolicy; policy != nil && policy.WhenDeleted == appsv1.DeletePersistentVolumeClaimRetentionPolicyType {
+			checks = append(checks,
+				accessCheck{namespace: namespace, verb: "patch", group: "apps", resource: "statefulsets"},
+				accessCheck{namespace: namespace, verb: "update", resource: "persistentvolumeclaims"},
+			)
+		}
+	}
+
+	return checks, nil
+}
+
+// preflight 检查当前用户是否拥有 checks 中的全部权限，结果写到 out，有缺少的权限时输出矩阵并返回 permissionError
+func preflight(out io.Writer, clientset kubernetes.Interface, checks []accessCheck) error {
+	var unique []accessCheck
+	seen := map[accessCheck]bool{}
+
+	for _, check := range checks {
+		if !seen[check] {
+			seen[check] = true
+			unique = append(unique, check)
+		}
+	}
+
+	rules := map[string][]authorizationv1.ResourceRule{}
+	// results 缓存每个检查的结论，escalation 不同的同一项权限只检查一次
+	results := map[accessCheck]bool{}
+	reviews := 0
+
+	allows := func(check accessCheck) (bool, error) {
+		check.escalation = ""
+
+		if allowed, found := results[check]; found {
+			return allowed, nil
+		}
+
+		// 命名空间中的规则也包含 ClusterRoleBinding 授予的部分，但对集群级资源不一定生效，集群级资源总是单独检查
+		if check.namespace != "" {
+			namespaceRules, found := rules[check.namespace]
+
+			if !found {
+				namespaceRules = rulesFor(clientset, check.namespace)
+				rules[check.namespace] = namespaceRules
+			}
+
+			if rulesAllow(namespaceRules, check) {
+				results[check] = true
+				return true, nil
+			}
+		}
+
+		allowed, err := accessAllowed(clientset, check)
+
+		if err != nil {
+			return false, fmt.Errorf("review %s %s: %w", check.verb, check.resourceName(), err)
+		}
+
+		reviews++
+		results[check] = allowed
+
+		return allowed, nil
+	}
+
+	denied := map[accessCheck]bool{}
+	// matrix 是输出矩阵时的检查，还包括被用来代替缺少的权限、但同样被拒绝的 escalate 和 bind
+	matrix := unique
+
+	for _, check := range unique {
+		allowed, err := allows(check)
+
+		if err != nil {
+			return err
+		}
+
+		if allowed {
+			continue
+		}
+
+		if check.escalation != "" {
+			escalation := accessCheck{namespace: check.namespace, verb: check.escalation, group: rbacv1.GroupName, resource: "roles"}
+
+			if allowed, err = allows(escalation); err != nil {
+				return err
+			}
+
+			if allowed {
+				continue
+			}
+
+			if !denied[escalation] {
+				denied[escalation] = true
+				matrix = append(matrix, escalation)
+			}
+		}
+
+		denied[check] = true
+	}
+
+	if len(denied) == 0 {
+		fmt.Fprintf(out, "Preflight: %d permission(s) granted, %d confirmed by access review\n", len(unique), reviews)
+		return nil
+	}
+
+	printPermissionMatrix(out, matrix, denied)
+	return &permissionError{message: fmt.Sprintf("missing %d of %d permission(s), nothing was changed", len(denied), len(matrix))}
+}
+
+// rulesFor 提交 SelfSubjectRulesReview 取得当前用户在 namespace 中的规则。请求失败时返回 nil，全部检查退回到 SelfSubjectAccessReview
+func rulesFor(clientset kubernetes.Interface, namespace string) []authorizationv1.ResourceRule {
+	review := &authorizationv1.SelfSubjectRulesReview{
+		Spec: authorizationv1.SelfSubjectRulesReviewSpec{Namespace: namespace},
+	}
+
+	result, err := clientset.AuthorizationV1().SelfSubjectRulesReviews().Create(context.TODO(), review, metav1.CreateOptions{})
+
+	if err != nil {
+		return nil
+	}
+
+	return result.Status.ResourceRules
+}
+
+// rulesAllow 判断 rules 中是否有规则允许 check。限定了 resourceNames 的规则只对特定对象生效，不能用来放行
+func rulesAllow(rules []authorizationv1.ResourceRule, check accessCheck) bool {
+	for _, rule := range rules {
+		if len(rule.ResourceNames) > 0 {
+			continue
+		}
+
+		if matchesRule(rule.Verbs, check.verb) && matchesRule(rule.APIGroups, check.group) && matchesRule(rule.Resources, check.resource) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// matchesRule 判断 values 中是否包含 value 或者通配符 *
+func matchesRule(values []string, value string) bool {
+	for _, v := range values {
+		if v == value || v == "*" {
+			return true
+		}
+	}
+
+	return false
+}
+
+// accessAllowed 提交一个 SelfSubjectAccessReview，返回 API Server 是否允许 check
+func accessAllowed(clientset kubernetes.Interface, check accessCheck) (bool, error) {
+	review := &authorizationv1.SelfSubjectAccessReview{
+		Spec: authorizationv1.SelfSubjectAccessReviewSpec{
+			ResourceAttributes: &authorizationv1.ResourceAttributes{
+				Namespace: check.namespace,
+				Verb:      check.verb,
+				Group:     check.group,
+				Resource:  check.resource,
+			},
+		},
+	}
+
+	result, err := clientset.AuthorizationV1().SelfSubjectAccessReviews().Create(context.TODO(), review, metav1.CreateOptions{})
+
+	if err != nil {
+		return false, err
+	}
+
+	return result.Status.Allowed, nil
+}
+
+// printPermissionMatrix 输出有拒绝项的资源，每行是一个命名空间中的一种资源，每列是一个 verb：
+// ok 表示允许，DENIED 表示缺少这个权限，- 表示本次操作不需要
+func printPermissionMatrix(out io.Writer, checks []accessCheck, denied map[accessCheck]bool) {
+	type row struct{ namespace, group, resource string }
+
+	var verbs []string
+	var rows []row
+	// cells 是每一行中每个 verb 的格子，被拒绝的检查记为 DENIED，同一项权限的其他检查不会把它改回 ok
+	cells := map[row]map[string]string{}
+	deniedRows := map[row]bool{}
+
+	for _, check := range checks {
+		r := row{namespace: check.namespace, group: check.group, resource: check.resource}
+
+		if cells[r] == nil {
+			cells[r] = map[string]string{}
+			rows = append(rows, r)
+		}
+
+		if !matchesRule(verbs, check.verb) {
+			verbs = append(verbs, check.verb)
+		}
+
+		if denied[check] {
+			cells[r][check.verb] = "DENIED"
+			deniedRows[r] = true
+		} else if cells[r][check.verb] == "" {
+			cells[r][check.verb] = "ok"
+		}
+	}
+
+	fmt.Fprintln(out, "Missing permissions:")
+
+	writer := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(writer, "NAMESPACE\tRESOURCE\t%s\n", strings.ToUpper(strings.Join(verbs, "\t")))
+
+	for _, r := range rows {
+		if !deniedRows[r] {
+			continue
+		}
+
+		namespace := r.namespace
+		if namespace == "" {
+			namespace = "(cluster)"
+		}
+
+		line := []string{namespace, accessCheck{group: r.group, resource: r.resource}.resourceName()}
+
+		for _, verb := range verbs {
+			cell := cells[r][verb]
+			if cell == "" {
+				cell = "-"
+			}
+
+			line = append(line, cell)
+		}
+
+		fmt.Fprintln(writer, strings.Join(line, "\t"))
+	}
+
+	writer.Flush()
+}
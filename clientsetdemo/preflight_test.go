@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+
+	appsv1 "k8s.io/api/apps/v1"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+// fakeAuthorizer 让 fake clientset 应答 SelfSubjectRulesReview 和 SelfSubjectAccessReview：
+// rules 是命名空间中的规则，allowed 中的 "verb resource" 由 SelfSubjectAccessReview 允许，返回的函数报告提交过的 access review 数量
+func fakeAuthorizer(clientset *fake.Clientset, rules []authorizationv1.ResourceRule, allowed ...string) func() int {
+	reviews := 0
+
+	clientset.PrependReactor("create", "selfsubjectrulesreviews", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		review := action.(k8stesting.CreateAction).GetObject().(*authorizationv1.SelfSubjectRulesReview)
+		review.Status.ResourceRules = rules
+		return true, review, nil
+	})
+
+	clientset.PrependReactor("create", "selfsubjectaccessreviews", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		review := action.(k8stesting.CreateAction).GetObject().(*authorizationv1.SelfSubjectAccessReview)
+		attributes := review.Spec.ResourceAttributes
+		reviews++
+
+		for _, a := range allowed {
+			if a == attributes.Verb+" "+attributes.Resource {
+				review.Status.Allowed = true
+			}
+		}
+
+		return true, review, nil
+	})
+
+	return func() int { return reviews }
+}
+
+func TestPreflightDenied(t *testing.T) {
+	clientset := fake.NewSimpleClientset()
+	reviews := fakeAuthorizer(clientset, []authorizationv1.ResourceRule{
+		{Verbs: []string{"create"}, APIGroups: []string{""}, Resources: []string{"services"}},
+	}, "create namespaces")
+
+	var out bytes.Buffer
+	err := preflight(&out, clientset, createChecks(stackObjects(stack), false))
+
+	if code, _ := classifyError(err); code != EXIT_FORBIDDEN {
+		t.Fatalf("preflight returned %v (exit code %d), want EXIT_FORBIDDEN", err, code)
+	}
+
+	// 命名空间和 Deployment 由 access review 确认，Service 已经被规则允许
+	if got := reviews(); got != 2 {
+		t.Errorf("submitted %d access review(s), want 2", got)
+	}
+
+	matrix := out.String()
+	if !strings.Contains(matrix, "deployments.apps") || !strings.Contains(matrix, "DENIED") {
+		t.Errorf("matrix does not report the deployment:\n%s", matrix)
+	}
+
+	if strings.Contains(matrix, "services") || strings.Contains(matrix, "namespaces") {
+		t.Errorf("matrix reports granted permissions:\n%s", matrix)
+	}
+}
+
+func TestPreflightCleanGranted(t *testing.T) {
+	clientset, _ := newFakeClients(t, false)
+
+	reviews := fakeAuthorizer(clientset, []authorizationv1.ResourceRule{
+		{Verbs: []string{"*"}, APIGroups: []string{"*"}, Resources: []string{"*"}},
+	}, "get namespaces", "delete namespaces")
+
+	checks, err := cleanChecks(clientset, []string{NAMESPACE}, cleanOptions{wait: true})
+	if err != nil {
+		t.Fatalf("cleanChecks: %v", err)
+	}
+
+	if err := preflight(&bytes.Buffer{}, clientset, checks); err != nil {
+		t.Fatalf("preflight: %v", err)
+	}
+
+	// 命名空间中的检查全部由规则放行，只有集群级的命名空间需要 access review
+	if got := reviews(); got != 2 {
+		t.Errorf("submitted %d access review(s), want 2", got)
+	}
+}
+
+// hasCheck 判断 checks 中是否有 namespace 中对 resource 执行 verb 的检查
+func hasCheck(checks []accessCheck, namespace, verb, resource string) bool {
+	for _, check := range checks {
+		if check.namespace == namespace && check.verb == verb && check.resourceName() == resource {
+			return true
+		}
+	}
+
+	return false
+}
+
+func TestPreflightCleanRetainedClaims(t *testing.T) {
+	tests := []struct {
+		retention appsv1.PersistentVolumeClaimRetentionPolicyType
+		// wantRetain 为 true 时 retainClaims 要 patch StatefulSet 和 update PVC
+		wantRetain bool
+		wantDelete bool
+	}{
+		{retention: appsv1.RetainPersistentVolumeClaimRetentionPolicyType, wantRetain: true},
+		{retention: appsv1.DeletePersistentVolumeClaimRetentionPolicyType, wantDelete: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(string(tt.retention), func(t *testing.T) {
+			// StatefulSet 以 whenDeleted=Delete 创建，clean 保留 PVC 时要先改掉这个策略
+			values := stack
+			values.Workload = WORKLOAD_STATEFULSET
+			values.StorageSize = "1Gi"
+			values.PVCRetention = string(appsv1.DeletePersistentVolumeClaimRetentionPolicyType)
+
+			clientset, _ := newFakeClients(t, false)
+			if err := createStack(io.Discard, clientset, values); err != nil {
+				t.Fatalf("createStack: %v", err)
+			}
+
+			checks, err := cleanChecks(clientset, []string{NAMESPACE}, cleanOptions{pvcRetention: tt.retention})
+			if err != nil {
+				t.Fatalf("cleanChecks: %v", err)
+			}
+
+			if !hasCheck(checks, NAMESPACE, "list", "persistentvolumeclaims") {
+				t.Errorf("no list persistentvolumeclaims check")
+			}
+
+			if got := hasCheck(checks, NAMESPACE, "patch", "statefulsets.apps") && hasCheck(checks, NAMESPACE, "update", "persistentvolumeclaims"); got != tt.wantRetain {
+				t.Errorf("patch statefulsets and update persistentvolumeclaims checked = %v, want %v", got, tt.wantRetain)
+			}
+
+			if got := hasCheck(checks, NAMESPACE, "delete", "persistentvolumeclaims"); got != tt.wantDelete {
+				t.Errorf("delete persistentvolumeclaims checked = %v, want %v", got, tt.wantDelete)
+			}
+
+			if !tt.wantRetain {
+				return
+			}
+
+			// 用户可以删除一切，但不能修改 StatefulSet 和 PVC：预检必须在删除任何对象之前拒绝
+			fakeAuthorizer(clientset, []authorizationv1.ResourceRule{
+				{Verbs: []string{"get", "list", "delete"}, APIGroups: []string{"*"}, Resources: []string{"*"}},
+			}, "get namespaces", "delete namespaces")
+
+			var out bytes.Buffer
+			if code, _ := classifyError(preflight(&out, clientset, checks)); code != EXIT_FORBIDDEN {
+				t.Fatalf("preflight exit code %d, want EXIT_FORBIDDEN", code)
+			}
+
+			if matrix := out.String(); !strings.Contains(matrix, "statefulsets.apps") || !strings.Contains(matrix, "persistentvolumeclaims") {
+				t.Errorf("matrix does not report the statefulset patch and claim update:\n%s", matrix)
+			}
+		})
+	}
+}
+
+func TestPreflightPrune(t *testing.T) {
+	clientset, _ := newPruneClients(t)
+
+	checks, err := operateChecks(clientset, "create", []string{NAMESPACE}, nil, cleanOptions{}, false, true)
+	if err != nil {
+		t.Fatalf("operateChecks: %v", err)
+	}
+
+	// prune 列出每一种发现的资源，但只删除 kindOrder 中的类型
+	for _, resource := range []string{"services", "deployments.apps", "endpoints", "endpointslices.discovery.k8s.io", "jobs.batch"} {
+		if !hasCheck(checks, NAMESPACE, "list", resource) {
+			t.Errorf("no list %s check", resource)
+		}
+	}
+
+	for resource, want := range map[string]bool{"services": true, "deployments.apps": true, "jobs.batch": true, "endpoints": false, "endpointslices.discovery.k8s.io": false} {
+		if got := hasCheck(checks, NAMESPACE, "delete", resource); got != want {
+			t.Errorf("delete %s checked = %v, want %v", resource, got, want)
+		}
+	}
+
+	// 用户可以创建 stack，但不能删除：没有 -prune 时预检通过，有 -prune 时被拒绝
+	fakeAuthorizer(clientset, []authorizationv1.ResourceRule{
+		{Verbs: []string{"create", "list"}, APIGroups: []string{"*"}, Resources: []string{"*"}},
+	}, "create namespaces", "list services")
+
+	withoutPrune, err := operateChecks(clientset, "create", []string{NAMESPACE}, nil, cleanOptions{}, false, false)
+	if err != nil {
+		t.Fatalf("operateChecks: %v", err)
+	}
+
+	if err := preflight(io.Discard, clientset, withoutPrune); err != nil {
+		t.Errorf("preflight without -prune: %v", err)
+	}
+
+	var out bytes.Buffer
+	if code, _ := classifyError(preflight(&out, clientset, checks)); code != EXIT_FORBIDDEN {
+		t.Fatalf("preflight with -prune: exit code %d, want EXIT_FORBIDDEN", code)
+	}
+
+	if matrix := out.String(); !strings.Contains(matrix, "DELETE") || strings.Contains(matrix, "endpointslices") {
+		t.Errorf("matrix does not report exactly the missing delete permissions:\n%s", matrix)
+	}
+}
+
+func TestPreflightRoleEscalation(t *testing.T) {
+	values := stack
+	values.Provision = true
+	values.RoleVerbs = defaultRoleVerbs
+
+	// 用户可以创建任何对象，但不一定拥有 Role 授予出去的权限
+	createAll := authorizationv1.ResourceRule{Verbs: []string{"create"}, APIGroups: []string{"*"}, Resources: []string{"*"}}
+	granted := authorizationv1.ResourceRule{Verbs: defaultRoleVerbs, APIGroups: []string{""}, Resources: roleResources}
+
+	tests := []struct {
+		name    string
+		rules   []authorizationv1.ResourceRule
+		allowed []string
+		// wantDenied 是矩阵中期望出现的 DENIED 行，为空表示期望预检通过
+		wantDenied []string
+	}{
+		{name: "user holds the granted permissions", rules: []authorizationv1.ResourceRule{createAll, granted}},
+		{name: "escalate and bind", rules: []authorizationv1.ResourceRule{createAll}, allowed: []string{"escalate roles", "bind roles"}},
+		{name: "escalate without bind", rules: []authorizationv1.ResourceRule{createAll}, allowed: []string{"escalate roles"}, wantDenied: []string{"roles.rbac.authorization.k8s.io", "pods"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clientset := fake.NewSimpleClientset()
+			fakeAuthorizer(clientset, tt.rules, tt.allowed...)
+
+			var out bytes.Buffer
+			err := preflight(&out, clientset, createChecks(newProvisionObjects(values), false))
+
+			if len(tt.wantDenied) == 0 {
+				if err != nil {
+					t.Fatalf("preflight: %v\n%s", err, out.String())
+				}
+				return
+			}
+
+			if code, _ := classifyError(err); code != EXIT_FORBIDDEN {
+				t.Fatalf("preflight returned %v (exit code %d), want EXIT_FORBIDDEN", err, code)
+			}
+
+			for _, resource := range tt.wantDenied {
+				if !strings.Contains(out.String(), resource) {
+					t.Errorf("matrix does not report %s:\n%s", resource, out.String())
+				}
+			}
+		})
+	}
+}
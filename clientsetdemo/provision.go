@@ -0,0 +1,248 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	apiv1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+/*
+stackValues.Provision 为 true 时，create 把命名空间配置成可以交给其他团队使用的沙箱：
+  - 命名空间带上 Pod Security Admission 的 enforce、audit 和 warn 标签，级别由 podSecurity 决定；
+  - ServiceAccount <deploymentName>，tomcat 的 Pod 以它的身份运行，不再使用 default；
+  - Role 和 RoleBinding <deploymentName>，只授予这个 ServiceAccount 对 roleResources 的 roleVerbs 权限；
+  - ResourceQuota <namespace>-quota，限制命名空间中 CPU、内存的 request 和 limit 总量以及 Pod 数量；
+  - LimitRange <namespace>-limits，为没有写 resources 的容器填充默认的 request 和 limit，否则有 ResourceQuota 时这样的 Pod 会被拒绝。
+*/
+
+const (
+	// POD_SECURITY_LABEL_PREFIX 后面接 enforce、audit 或 warn，取值是 privileged、baseline 或 restricted
+	POD_SECURITY_LABEL_PREFIX = "pod-security.kubernetes.io/"
+
+	DEFAULT_POD_SECURITY   = "baseline"
+	DEFAULT_QUOTA_CPU      = "4"
+	DEFAULT_QUOTA_MEMORY   = "8Gi"
+	DEFAULT_QUOTA_PODS     = 20
+	DEFAULT_REQUEST_CPU    = "100m"
+	DEFAULT_LIMIT_CPU      = "500m"
+	DEFAULT_REQUEST_MEMORY = "256Mi"
+	DEFAULT_LIMIT_MEMORY   = "512Mi"
+)
+
+// roleResources 是 Role 授权的核心组资源
+var roleResources = []string{"pods", "services", "configmaps", "endpoints"}
+
+// defaultRoleVerbs 是只读的权限
+var defaultRoleVerbs = []string{"get", "list", "watch"}
+
+// podSecurityLevels 是 Pod Security Admission 支持的级别。restricted 要求容器以非 root 用户运行，默认的 tomcat 镜像不满足
+var podSecurityLevels = map[string]bool{"privileged": true, "baseline": true, "restricted": true}
+
+// knownRoleVerbs 是 Role 中可以使用的动词
+var knownRoleVerbs = map[string]bool{
+	"get": true, "list": true, "watch": true, "create": true, "update": true,
+	"patch": true, "delete": true, "deletecollection": true, "*": true,
+}
+
+func serviceAccountName(values stackValues) string {
+	return values.DeploymentName
+}
+
+// podSecurityLabels 返回命名空间上的 Pod Security Admission 标签，enforce 拒绝违规的 Pod，audit 和 warn 只记录和提示
+func podSecurityLabels(level string) map[string]string {
+	labels := map[string]string{}
+
+	for _, mode := range []string{"enforce", "audit", "warn"} {
+		labels[POD_SECURITY_LABEL_PREFIX+mode] = level
+	}
+
+	return labels
+}
+
+// newProvisionObjects 返回 Provision 开启时在命名空间中创建的 ResourceQuota、LimitRange、ServiceAccount、Role 和 RoleBinding，
+// 顺序与 kindOrder 相同，它们都要在 Deployment 之前创建
+func newProvisionObjects(values stackValues) []runtime.Object {
+	if !values.Provision {
+		return nil
+	}
+
+	quota := &apiv1.ResourceQuota{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      values.Namespace + "-quota",
+			Namespace: values.Namespace,
+			Labels:    ownershipLabels(),
+		},
+		Spec: apiv1.ResourceQuotaSpec{
+			Hard: apiv1.ResourceList{
+				apiv1.ResourceRequestsCPU:    resource.MustParse(values.QuotaCPU),
+				apiv1.ResourceLimitsCPU:      resource.MustParse(values.QuotaCPU),
+				apiv1.ResourceRequestsMemory: resource.MustParse(values.QuotaMemory),
+				apiv1.ResourceLimitsMemory:   resource.MustParse(values.QuotaMemory),
+				apiv1.ResourcePods:           *resource.NewQuantity(int64(values.QuotaPods), resource.DecimalSI),
+			},
+		},
+	}
+	quota.SetGroupVersionKind(apiv1.SchemeGroupVersion.WithKind("ResourceQuota"))
+
+	limitRange := &apiv1.LimitRange{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      values.Namespace + "-limits",
+			Namespace: values.Namespace,
+			Labels:    ownershipLabels(),
+		},
+		Spec: apiv1.LimitRangeSpec{
+			Limits: []apiv1.LimitRangeItem{{
+				Type: apiv1.LimitTypeContainer,
+				DefaultRequest: apiv1.ResourceList{
+					apiv1.ResourceCPU:    resource.MustParse(values.RequestCPU),
+					apiv1.ResourceMemory: resource.MustParse(values.RequestMemory),
+				},
+				Default: apiv1.ResourceList{
+					apiv1.ResourceCPU:    resource.MustParse(values.LimitCPU),
+					apiv1.ResourceMemory: resource.MustParse(values.LimitMemory),
+				},
+			}},
+		},
+	}
+	limitRange.SetGroupVersionKind(apiv1.SchemeGroupVersion.WithKind("LimitRange"))
+
+	serviceAccount := &apiv1.ServiceAccount{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      serviceAccountName(values),
+			Namespace: values.Namespace,
+			Labels:    ownershipLabels(),
+		},
+	}
+	serviceAccount.SetGroupVersionKind(apiv1.SchemeGroupVersion.WithKind("ServiceAccount"))
+
+	role := &rbacv1.Role{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      values.DeploymentName,
+			Namespace: values.Namespace,
+			Labels:    ownershipLabels(),
+		},
+		Rules: []rbacv1.PolicyRule{{
+			APIGroups: []string{""},
+			Resources: roleResources,
+			Verbs:     values.RoleVerbs,
+		}},
+	}
+	role.SetGroupVersionKind(rbacv1.SchemeGroupVersion.WithKind("Role"))
+
+	roleBinding := &rbacv1.RoleBinding{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      values.DeploymentName,
+			Namespace: values.Namespace,
+			Labels:    ownershipLabels(),
+		},
+		Subjects: []rbacv1.Subject{{
+			Kind:      rbacv1.ServiceAccountKind,
+			Name:      serviceAccount.Name,
+			Namespace: values.Namespace,
+		}},
+		RoleRef: rbacv1.RoleRef{
+			APIGroup: rbacv1.GroupName,
+			Kind:     "Role",
+			Name:     role.Name,
+		},
+	}
+	roleBinding.SetGroupVersionKind(rbacv1.SchemeGroupVersion.WithKind("RoleBinding"))
+
+	return []runtime.Object{quota, limitRange, serviceAccount, role, roleBinding}
+}
+
+// validateProvision 检查 Provision 开启时的参数。ResourceQuota 要能容纳全部副本按默认 limit 运行，否则 Pod 会被配额拒绝
+func (v stackValues) validateProvision() []string {
+	if !v.Provision {
+		return nil
+	}
+
+	var problems []string
+
+	if !podSecurityLevels[v.PodSecurity] {
+		problems = append(problems, fmt.Sprintf("podSecurity %q: must be privileged, baseline or restricted", v.PodSecurity))
+	}
+
+	if len(v.RoleVerbs) == 0 {
+		problems = append(problems, "roleVerbs: must not be empty")
+	}
+
+	for _, verb := range v.RoleVerbs {
+		if !knownRoleVerbs[verb] {
+			problems = append(problems, fmt.Sprintf("roleVerbs %q: unknown verb", verb))
+		}
+	}
+
+	quantities := map[string]resource.Quantity{}
+	for _, q := range []struct{ field, value string }{
+		{"quotaCPU", v.QuotaCPU},
+		{"quotaMemory", v.QuotaMemory},
+		{"requestCPU", v.RequestCPU},
+		{"limitCPU", v.LimitCPU},
+		{"requestMemory", v.RequestMemory},
+		{"limitMemory", v.LimitMemory},
+	} {
+		quantity, err := resource.ParseQuantity(q.value)
+
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%s %q: %v", q.field, q.value, err))
+			continue
+		}
+
+		quantities[q.field] = quantity
+	}
+
+	// 有解析失败的值时不再比较大小
+	if len(quantities) < 6 {
+		return problems
+	}
+
+	for _, pair := range [][2]string{{"requestCPU", "limitCPU"}, {"requestMemory", "limitMemory"}} {
+		request, limit := quantities[pair[0]], quantities[pair[1]]
+
+		if request.Cmp(limit) > 0 {
+			problems = append(problems, fmt.Sprintf("%s %s: must not exceed %s %s", pair[0], request.String(), pair[1], limit.String()))
+		}
+	}
+
+	// 开启 HPA 时按最多的副本数计算
+	replicas := v.Replicas
+	if v.HPA && v.HPAMaxReplicas > replicas {
+		replicas = v.HPAMaxReplicas
+	}
+
+	if v.QuotaPods < replicas {
+		problems = append(problems, fmt.Sprintf("quotaPods %d: must be at least %d replicas", v.QuotaPods, replicas))
+	}
+
+	for _, pair := range [][2]string{{"limitCPU", "quotaCPU"}, {"limitMemory", "quotaMemory"}} {
+		limit, quota := quantities[pair[0]], quantities[pair[1]]
+
+		total := limit.DeepCopy()
+		total.Mul(int64(replicas))
+
+		if total.Cmp(quota) > 0 {
+			problems = append(problems, fmt.Sprintf("%s %s: %d replicas need %s, which exceeds %s %s", pair[0], limit.String(), replicas, total.String(), pair[1], quota.String()))
+		}
+	}
+
+	return problems
+}
+
+// roleVerbList 把 -role-verbs 的逗号分隔列表拆开
+func roleVerbList(value string) []string {
+	var verbs []string
+
+	for _, verb := range strings.Split(value, ",") {
+		if verb = strings.TrimSpace(verb); verb != "" {
+			verbs = append(verbs, verb)
+		}
+	}
+
+	return verbs
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"os"
+	"strings"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestCreateStackWithProvision(t *testing.T) {
+	values := defaultStackValues()
+	values.Provision = true
+	values.PodSecurity = "restricted"
+	values.RoleVerbs = []string{"get", "list"}
+
+	clientset := fake.NewSimpleClientset()
+	if err := createStack(os.Stdout, clientset, values); err != nil {
+		t.Fatalf("createStack: %v", err)
+	}
+
+	ctx := context.TODO()
+
+	namespace, err := clientset.CoreV1().Namespaces().Get(ctx, NAMESPACE, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("get namespace: %v", err)
+	}
+
+	if level := namespace.Labels[POD_SECURITY_LABEL_PREFIX+"enforce"]; level != "restricted" || !isOwned(namespace) {
+		t.Errorf("namespace labels %v, want pod security restricted and the ownership labels", namespace.Labels)
+	}
+
+	if _, err := clientset.CoreV1().ServiceAccounts(NAMESPACE).Get(ctx, serviceAccountName(values), metav1.GetOptions{}); err != nil {
+		t.Errorf("get service account: %v", err)
+	}
+
+	role, err := clientset.RbacV1().Roles(NAMESPACE).Get(ctx, DEPLOYMENT_NAME, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("get role: %v", err)
+	}
+
+	if verbs := strings.Join(role.Rules[0].Verbs, ","); verbs != "get,list" {
+		t.Errorf("role verbs %s, want get,list", verbs)
+	}
+
+	binding, err := clientset.RbacV1().RoleBindings(NAMESPACE).Get(ctx, DEPLOYMENT_NAME, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("get role binding: %v", err)
+	}
+
+	if subject := binding.Subjects[0]; subject.Name != serviceAccountName(values) || subject.Namespace != NAMESPACE {
+		t.Errorf("role binding subject %+v, want the stack's service account", subject)
+	}
+
+	quotas, _ := clientset.CoreV1().ResourceQuotas(NAMESPACE).List(ctx, metav1.ListOptions{})
+	limitRanges, _ := clientset.CoreV1().LimitRanges(NAMESPACE).List(ctx, metav1.ListOptions{})
+	if len(quotas.Items) != 1 || len(limitRanges.Items) != 1 {
+		t.Errorf("got %d resource quota(s) and %d limit range(s), want one of each", len(quotas.Items), len(limitRanges.Items))
+	}
+
+	deployment, err := clientset.AppsV1().Deployments(NAMESPACE).Get(ctx, DEPLOYMENT_NAME, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("get deployment: %v", err)
+	}
+
+	if name := deployment.Spec.Template.Spec.ServiceAccountName; name != serviceAccountName(values) {
+		t.Errorf("deployment runs as service account %q, want %q", name, serviceAccountName(values))
+	}
+}
+
+func TestValidateProvision(t *testing.T) {
+	values := defaultStackValues()
+	values.Provision = true
+	values.HPA = true
+	values.HPAMaxReplicas = 10
+	values.QuotaCPU = "2"
+	values.RequestMemory = "1Gi"
+
+	err := values.validate()
+	if err == nil {
+		t.Fatalf("validate: expected an error")
+	}
+
+	// 10 个副本按默认 limit 500m 需要 5 个 CPU，超过了配额
+	for _, want := range []string{"limitCPU 500m: 10 replicas need 5", "requestMemory 1Gi: must not exceed limitMemory 512Mi"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("validate: error %q does not mention %q", err, want)
+		}
+	}
+}
@@ -0,0 +1,408 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/util/retry"
+)
+
+/*
+release、promote 和 abort 三个操作以 blue/green 或 canary 的方式发布 tomcat 的新版本。
+
+-operate=release -strategy=bluegreen -version=v2 创建第二个 Deployment（candidate），它的选择器和 Pod 模板比 stable 多一个 VERSION_LABEL。
+candidate 的 rollout 完成之后，把 Service 的选择器改为只匹配新版本，流量一次性切换过去；旧版本保持原来的副本数继续运行，abort 可以立即切回。
+
+-operate=release -strategy=canary -version=v2 同样创建 candidate，但只给它总副本数的 -canary-percent，stable 缩容相同的数量。
+Service 的选择器只有 app=tomcat，两个版本的 Pod 都匹配，流量大致按副本数的比例分配。
+
+-operate=promote 完成发布：Service 只选择新版本，删除旧的 Deployment，candidate 成为新的 stable（canary 发布时先扩容到总副本数）。
+-operate=abort 撤销发布：恢复 Service 原来的选择器和 stable 的副本数，删除 candidate。
+
+发布的状态都保存在集群中的标签和注解上，promote 和 abort 不需要再次指定 -strategy 或 -version。
+*/
+
+const (
+	// VERSION_LABEL 是 Kubernetes 推荐的版本标签，candidate 的选择器和 Pod 模板都带有它，blue/green 切换时 Service 按它选择 Pod
+	VERSION_LABEL = "app.kubernetes.io/version"
+	// TRACK_LABEL 标记 Deployment 在发布中的角色。没有这个标签的 Deployment（例如 create 创建的 stack.DeploymentName）视为 stable
+	TRACK_LABEL     = "clientsetdemo/track"
+	TRACK_STABLE    = "stable"
+	TRACK_CANDIDATE = "candidate"
+
+	// 以下注解写在 candidate 上，记录发布开始时的状态
+	STRATEGY_ANNOTATION = "clientsetdemo/strategy"
+	// TOTAL_REPLICAS_ANNOTATION 是发布开始时 stable 的副本数，发布结束后留下的那个版本恢复到这个副本数
+	TOTAL_REPLICAS_ANNOTATION = "clientsetdemo/total-replicas"
+	STABLE_ANNOTATION         = "clientsetdemo/stable"
+	// PREVIOUS_SELECTOR_ANNOTATION 写在 Service 上，是发布修改选择器之前的值（JSON），abort 用它恢复
+	PREVIOUS_SELECTOR_ANNOTATION = "clientsetdemo/previous-selector"
+
+	STRATEGY_BLUEGREEN = "bluegreen"
+	STRATEGY_CANARY    = "canary"
+)
+
+// releaseOptions 保存 release、promote 和 abort 操作的命令行参数
+type releaseOptions struct {
+	strategy string
+	version  string
+	// canaryPercent 是 canary 发布时 candidate 占总副本数的百分比
+	canaryPercent int
+	// timeout 是等待 candidate rollout 的最长时间
+	timeout time.Duration
+	// clean 决定删除 Deployment 时使用的 DeleteOptions
+	clean cleanOptions
+}
+
+// candidateName 返回版本 version 的 Deployment 名字
+func candidateName(version string) string {
+	return stack.DeploymentName + "-" + version
+}
+
+// findRelease 返回 stack.Namespace 中的 stable Deployment 和正在发布的 candidate，没有正在进行的发布时 candidate 为 nil。
+// 有 candidate 时 stable 是它的 STABLE_ANNOTATION，promote 中途失败后 stable 可能已经被删除，这时 stable 为 nil。
+func findRelease(clientset kubernetes.Interface) (stable, candidate *appsv1.Deployment, err error) {
+	deploymentClient := clientset.AppsV1().Deployments(stack.Namespace)
+
+	list, err := deploymentClient.List(context.TODO(), metav1.ListOptions{LabelSelector: labels.SelectorFromSet(ownershipLabels()).String()})
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for i := range list.Items {
+		deployment := &list.Items[i]
+
+		switch deployment.Labels[TRACK_LABEL] {
+		case TRACK_CANDIDATE:
+			if candidate != nil {
+				return nil, nil, fmt.Errorf("found two candidate deployments %s and %s, delete one of them", candidate.Name, deployment.Name)
+			}
+			candidate = deployment
+		case TRACK_STABLE:
+			stable = deployment
+		}
+	}
+
+	name := stack.DeploymentName
+	switch {
+	case candidate != nil:
+		name = candidate.Annotations[STABLE_ANNOTATION]
+	case stable != nil:
+		return stable, nil, nil
+	}
+
+	stable, err = deploymentClient.Get(context.TODO(), name, metav1.GetOptions{})
+
+	if apierrors.IsNotFound(err) && candidate != nil {
+		return nil, candidate, nil
+	}
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return stable, candidate, nil
+}
+
+// canaryReplicas 按百分比计算 candidate 的副本数，向上取整，并且两个版本都至少保留一个副本
+func canaryReplicas(total int32, percent int) int32 {
+	replicas := (total*int32(percent) + 99) / 100
+
+	if replicas < 1 {
+		replicas = 1
+	}
+
+	if replicas > total-1 {
+		replicas = total - 1
+	}
+
+	return replicas
+}
+
+// newCandidate 以 newDeployment 为基础构造 candidate：名字带上版本，选择器和 Pod 模板多一个 VERSION_LABEL，
+// 注解中记录发布的方式、总副本数和 stable 的名字
+func newCandidate(options releaseOptions, stable *appsv1.Deployment, total, replicas int32) *appsv1.Deployment {
+	values := stack
+	values.DeploymentName = candidateName(options.version)
+	values.Replicas = replicas
+
+	deployment := newDeployment(values)
+	deployment.Labels[TRACK_LABEL] = TRACK_CANDIDATE
+	deployment.Labels[VERSION_LABEL] = options.version
+	deployment.Annotations = map[string]string{
+		STRATEGY_ANNOTATION:       options.strategy,
+		TOTAL_REPLICAS_ANNOTATION: strconv.Itoa(int(total)),
+		STABLE_ANNOTATION:         stable.Name,
+	}
+	deployment.Spec.Selector.MatchLabels[VERSION_LABEL] = options.version
+	deployment.Spec.Template.Labels[VERSION_LABEL] = options.version
+
+	return deployment
+}
+
+// releaseStack 开始一次 blue/green 或 canary 发布，同一时间只能有一个 candidate
+func releaseStack(out io.Writer, clientset kubernetes.Interface, options releaseOptions) error {
+	stable, candidate, err := findRelease(clientset)
+
+	if err != nil {
+		return err
+	}
+
+	if candidate != nil {
+		return fmt.Errorf("version %s is already being released as deployment %s, promote or abort it first", candidate.Labels[VERSION_LABEL], candidate.Name)
+	}
+
+	if stable.Name == candidateName(options.version) {
+		return fmt.Errorf("version %s is already the stable version", options.version)
+	}
+
+	total := replicasOf(stable)
+	replicas := total
+
+	if options.strategy == STRATEGY_CANARY {
+		if total < 2 {
+			return fmt.Errorf("deployment %s has %d replica(s), a canary release needs at least 2", stable.Name, total)
+		}
+
+		replicas = canaryReplicas(total, options.canaryPercent)
+	}
+
+	candidate = newCandidate(options, stable, total, replicas)
+
+	result, err := clientset.AppsV1().Deployments(stack.Namespace).Create(context.TODO(), candidate, metav1.CreateOptions{})
+
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(out, "Create %s candidate deployment %s for version %s with %d replicas \n", options.strategy, result.Name, options.version, replicas)
+
+	if err := waitForRollout(out, clientset, stack.Namespace, candidate.Name, options.timeout); err != nil {
+		return fmt.Errorf("version %s did not become available, the service still routes to %s, run abort to remove it: %w", options.version, stable.Name, err)
+	}
+
+	if options.strategy == STRATEGY_CANARY {
+		// 两个版本都要接收流量，选择器中不能带有版本标签。先扩出 candidate 再缩容 stable，总的可用副本数不会减少
+		selector := map[string]string{"app": "tomcat"}
+
+		if err := setServiceSelector(out, clientset, selector, true); err != nil {
+			return err
+		}
+
+		if err := scaleTo(out, clientset, stable.Name, total-replicas); err != nil {
+			return err
+		}
+
+		fmt.Fprintf(out, "Canary %s serves %d of %d replicas, run promote or abort to finish the release \n", options.version, replicas, total)
+		return nil
+	}
+
+	if err := setServiceSelector(out, clientset, candidate.Spec.Template.Labels, true); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(out, "Service %s switched from %s to %s, run promote to delete %s or abort to switch back \n", stack.ServiceName, stable.Name, candidate.Name, stable.Name)
+	return nil
+}
+
+// promoteRelease 完成发布：Service 只选择新版本，删除旧版本，candidate 改为 stable
+func promoteRelease(out io.Writer, clientset kubernetes.Interface, options releaseOptions) error {
+	stable, candidate, err := findRelease(clientset)
+
+	if err != nil {
+		return err
+	}
+
+	if candidate == nil {
+		return fmt.Errorf("no release in progress in namespace %s", stack.Namespace)
+	}
+
+	if candidate.Annotations[STRATEGY_ANNOTATION] == STRATEGY_CANARY {
+		total, err := strconv.Atoi(candidate.Annotations[TOTAL_REPLICAS_ANNOTATION])
+
+		if err != nil {
+			return fmt.Errorf("deployment %s has an invalid %s annotation: %w", candidate.Name, TOTAL_REPLICAS_ANNOTATION, err)
+		}
+
+		if err := scaleTo(out, clientset, candidate.Name, int32(total)); err != nil {
+			return err
+		}
+
+		if err := waitForRollout(out, clientset, stack.Namespace, candidate.Name, options.timeout); err != nil {
+			return err
+		}
+	}
+
+	if err := setServiceSelector(out, clientset, candidate.Spec.Template.Labels, false); err != nil {
+		return err
+	}
+
+	if stable != nil {
+		err := clientset.AppsV1().Deployments(stack.Namespace).Delete(context.TODO(), stable.Name, options.clean.deleteOptions())
+
+		if err := reportDelete(out, "deployment", stable.Name, err); err != nil {
+			return err
+		}
+	}
+
+	// 去掉发布过程中的注解，TRACK_LABEL 改为 stable，下一次发布以它为基础
+	err = patchDeployment(clientset, candidate.Name, func(deployment *appsv1.Deployment) (map[string]interface{}, error) {
+		return map[string]interface{}{
+			"metadata": map[string]interface{}{
+				"labels": map[string]interface{}{TRACK_LABEL: TRACK_STABLE},
+				"annotations": map[string]interface{}{
+					STRATEGY_ANNOTATION:       nil,
+					TOTAL_REPLICAS_ANNOTATION: nil,
+					STABLE_ANNOTATION:         nil,
+				},
+			},
+		}, nil
+	})
+
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(out, "Promote deployment %s to stable, use -name=%s for scale, set-image, restart and rollback \n", candidate.Name, candidate.Name)
+	return nil
+}
+
+// abortRelease 撤销发布：恢复 Service 的选择器和 stable 的副本数，再删除 candidate。
+// stable 是 create 创建的没有版本标签的 Deployment 时，恢复后的选择器 app=tomcat 也匹配 candidate 的 Pod，直到 candidate 被删除。
+func abortRelease(out io.Writer, clientset kubernetes.Interface, options releaseOptions) error {
+	stable, candidate, err := findRelease(clientset)
+
+	if err != nil {
+		return err
+	}
+
+	if candidate == nil {
+		return fmt.Errorf("no release in progress in namespace %s", stack.Namespace)
+	}
+
+	if stable == nil {
+		return fmt.Errorf("deployment %s no longer exists, the release of %s can only be promoted", candidate.Annotations[STABLE_ANNOTATION], candidate.Name)
+	}
+
+	if err := restoreServiceSelector(out, clientset); err != nil {
+		return err
+	}
+
+	if candidate.Annotations[STRATEGY_ANNOTATION] == STRATEGY_CANARY {
+		total, err := strconv.Atoi(candidate.Annotations[TOTAL_REPLICAS_ANNOTATION])
+
+		if err != nil {
+			return fmt.Errorf("deployment %s has an invalid %s annotation: %w", candidate.Name, TOTAL_REPLICAS_ANNOTATION, err)
+		}
+
+		if err := scaleTo(out, clientset, stable.Name, int32(total)); err != nil {
+			return err
+		}
+	}
+
+	err = clientset.AppsV1().Deployments(stack.Namespace).Delete(context.TODO(), candidate.Name, options.clean.deleteOptions())
+
+	return reportDelete(out, "deployment", candidate.Name, err)
+}
+
+// scaleTo 通过 patch 修改 Deployment 的 spec.replicas
+func scaleTo(out io.Writer, clientset kubernetes.Interface, name string, replicas int32) error {
+	var from int32
+
+	err := patchDeployment(clientset, name, func(deployment *appsv1.Deployment) (map[string]interface{}, error) {
+		from = replicasOf(deployment)
+
+		return map[string]interface{}{
+			"spec": map[string]interface{}{"replicas": replicas},
+		}, nil
+	})
+
+	if err != nil {
+		return err
+	}
+
+	// Conflict 时 patch 会重新生成，结果只在成功之后输出一次
+	fmt.Fprintf(out, "Scale deployment %s from %d to %d \n", name, from, replicas)
+	return nil
+}
+
+// replicasOf 返回 Deployment 的期望副本数，没有设置时与 API Server 的默认值相同为 1
+func replicasOf(deployment *appsv1.Deployment) int32 {
+	if deployment.Spec.Replicas == nil {
+		return 1
+	}
+
+	return *deployment.Spec.Replicas
+}
+
+// setServiceSelector 把 Service 的选择器整体替换为 selector。record 为 true 时把原来的选择器记到 PREVIOUS_SELECTOR_ANNOTATION，
+// 已经有记录时保留最早的那个；record 为 false 时删除这个注解。
+func setServiceSelector(out io.Writer, clientset kubernetes.Interface, selector map[string]string, record bool) error {
+	serviceClient := clientset.CoreV1().Services(stack.Namespace)
+
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		service, err := serviceClient.Get(context.TODO(), stack.ServiceName, metav1.GetOptions{})
+
+		if err != nil {
+			return err
+		}
+
+		if service.Annotations == nil {
+			service.Annotations = map[string]string{}
+		}
+
+		if _, recorded := service.Annotations[PREVIOUS_SELECTOR_ANNOTATION]; record && !recorded {
+			data, err := json.Marshal(service.Spec.Selector)
+
+			if err != nil {
+				return err
+			}
+
+			service.Annotations[PREVIOUS_SELECTOR_ANNOTATION] = string(data)
+		}
+
+		if !record {
+			delete(service.Annotations, PREVIOUS_SELECTOR_ANNOTATION)
+		}
+
+		service.Spec.Selector = selector
+
+		if _, err := serviceClient.Update(context.TODO(), service, metav1.UpdateOptions{}); err != nil {
+			return err
+		}
+
+		fmt.Fprintf(out, "Set service %s selector to %s \n", stack.ServiceName, labels.Set(selector))
+		return nil
+	})
+}
+
+// restoreServiceSelector 把 Service 的选择器恢复为 PREVIOUS_SELECTOR_ANNOTATION 中记录的值，没有记录时不做修改
+func restoreServiceSelector(out io.Writer, clientset kubernetes.Interface) error {
+	service, err := clientset.CoreV1().Services(stack.Namespace).Get(context.TODO(), stack.ServiceName, metav1.GetOptions{})
+
+	if err != nil {
+		return err
+	}
+
+	previous, ok := service.Annotations[PREVIOUS_SELECTOR_ANNOTATION]
+	if !ok {
+		return nil
+	}
+
+	var selector map[string]string
+	if err := json.Unmarshal([]byte(previous), &selector); err != nil {
+		return fmt.Errorf("service %s has an invalid %s annotation: %w", stack.ServiceName, PREVIOUS_SELECTOR_ANNOTATION, err)
+	}
+
+	return setServiceSelector(out, clientset, selector, false)
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+// rolloutCompletes 让 fake clientset 对单个 Deployment 的 watch 立即返回一个 rollout 已经完成的状态。
+// fake clientset 既没有 Deployment controller 更新 status，watch 也不会为已有对象发送 ADDED 事件。
+// reactor 中不能再调用 clientset（它在执行 reactor 时持有锁），所以直接从 tracker 中读取。
+func rolloutCompletes(clientset *fake.Clientset) {
+	clientset.PrependWatchReactor("deployments", func(action k8stesting.Action) (bool, watch.Interface, error) {
+		name, _ := action.(k8stesting.WatchAction).GetWatchRestrictions().Fields.RequiresExactMatch("metadata.name")
+
+		obj, err := clientset.Tracker().Get(deploymentsResource, action.GetNamespace(), name)
+		if err != nil {
+			return true, nil, err
+		}
+
+		deployment := obj.(*appsv1.Deployment).DeepCopy()
+		replicas := replicasOf(deployment)
+		deployment.Status = appsv1.DeploymentStatus{Replicas: replicas, UpdatedReplicas: replicas, AvailableReplicas: replicas}
+
+		watcher := watch.NewFakeWithChanSize(1, false)
+		watcher.Modify(deployment)
+
+		return true, watcher, nil
+	})
+}
+
+func newReleaseClientset(t *testing.T) *fake.Clientset {
+	t.Helper()
+
+	clientset := fake.NewSimpleClientset()
+	if err := createStack(os.Stdout, clientset, stack); err != nil {
+		t.Fatalf("createStack: %v", err)
+	}
+
+	rolloutCompletes(clientset)
+
+	return clientset
+}
+
+func getDeployment(t *testing.T, clientset *fake.Clientset, name string) *appsv1.Deployment {
+	t.Helper()
+
+	deployment, err := clientset.AppsV1().Deployments(NAMESPACE).Get(context.TODO(), name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("get deployment %s: %v", name, err)
+	}
+
+	return deployment
+}
+
+func serviceSelector(t *testing.T, clientset *fake.Clientset) (map[string]string, bool) {
+	t.Helper()
+
+	service, err := clientset.CoreV1().Services(NAMESPACE).Get(context.TODO(), SERVICE_NAME, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("get service: %v", err)
+	}
+
+	_, recorded := service.Annotations[PREVIOUS_SELECTOR_ANNOTATION]
+
+	return service.Spec.Selector, recorded
+}
+
+func TestBlueGreenPromote(t *testing.T) {
+	clientset := newReleaseClientset(t)
+	options := releaseOptions{strategy: STRATEGY_BLUEGREEN, version: "v2", timeout: time.Second, clean: cleanOptions{propagation: metav1.DeletePropagationBackground, gracePeriod: -1}}
+
+	if err := releaseStack(os.Stdout, clientset, options); err != nil {
+		t.Fatalf("release: %v", err)
+	}
+
+	green := getDeployment(t, clientset, candidateName("v2"))
+	if replicasOf(green) != DEFAULT_REPLICAS {
+		t.Errorf("green has %d replicas, want %d", replicasOf(green), DEFAULT_REPLICAS)
+	}
+
+	if replicasOf(getDeployment(t, clientset, DEPLOYMENT_NAME)) != DEFAULT_REPLICAS {
+		t.Errorf("blue was scaled during a blue/green release")
+	}
+
+	selector, recorded := serviceSelector(t, clientset)
+	if selector[VERSION_LABEL] != "v2" || !recorded {
+		t.Errorf("service selector %v, recorded %v, want version v2 with the previous selector recorded", selector, recorded)
+	}
+
+	if err := releaseStack(os.Stdout, clientset, releaseOptions{strategy: STRATEGY_CANARY, version: "v3", canaryPercent: 10}); err == nil || !strings.Contains(err.Error(), "promote or abort") {
+		t.Errorf("a second release: got error %v, want one asking to promote or abort first", err)
+	}
+
+	if err := promoteRelease(os.Stdout, clientset, options); err != nil {
+		t.Fatalf("promote: %v", err)
+	}
+
+	if _, err := clientset.AppsV1().Deployments(NAMESPACE).Get(context.TODO(), DEPLOYMENT_NAME, metav1.GetOptions{}); !apierrors.IsNotFound(err) {
+		t.Errorf("blue still exists after promote: %v", err)
+	}
+
+	green = getDeployment(t, clientset, candidateName("v2"))
+	if green.Labels[TRACK_LABEL] != TRACK_STABLE || green.Annotations[STABLE_ANNOTATION] != "" {
+		t.Errorf("green labels %v annotations %v, want it to be the stable deployment", green.Labels, green.Annotations)
+	}
+
+	if _, recorded := serviceSelector(t, clientset); recorded {
+		t.Errorf("the previous selector is still recorded after promote")
+	}
+}
+
+func TestCanaryAbort(t *testing.T) {
+	clientset := newReleaseClientset(t)
+	options := releaseOptions{strategy: STRATEGY_CANARY, version: "v2", canaryPercent: 25, timeout: time.Second, clean: cleanOptions{propagation: metav1.DeletePropagationBackground, gracePeriod: -1}}
+
+	if err := releaseStack(os.Stdout, clientset, options); err != nil {
+		t.Fatalf("release: %v", err)
+	}
+
+	// 2 个副本的 25% 向上取整是 1 个
+	if replicas := replicasOf(getDeployment(t, clientset, candidateName("v2"))); replicas != 1 {
+		t.Errorf("canary has %d replicas, want 1", replicas)
+	}
+
+	if replicas := replicasOf(getDeployment(t, clientset, DEPLOYMENT_NAME)); replicas != 1 {
+		t.Errorf("stable has %d replicas, want 1", replicas)
+	}
+
+	if selector, _ := serviceSelector(t, clientset); selector[VERSION_LABEL] != "" {
+		t.Errorf("service selector %v selects a single version during a canary release", selector)
+	}
+
+	if err := abortRelease(os.Stdout, clientset, releaseOptions{clean: options.clean}); err != nil {
+		t.Fatalf("abort: %v", err)
+	}
+
+	if _, err := clientset.AppsV1().Deployments(NAMESPACE).Get(context.TODO(), candidateName("v2"), metav1.GetOptions{}); !apierrors.IsNotFound(err) {
+		t.Errorf("canary still exists after abort: %v", err)
+	}
+
+	if replicas := replicasOf(getDeployment(t, clientset, DEPLOYMENT_NAME)); replicas != DEFAULT_REPLICAS {
+		t.Errorf("stable has %d replicas after abort, want %d", replicas, DEFAULT_REPLICAS)
+	}
+
+	if selector, recorded := serviceSelector(t, clientset); selector["app"] != "tomcat" || len(selector) != 1 || recorded {
+		t.Errorf("service selector %v, recorded %v after abort, want app=tomcat", selector, recorded)
+	}
+
+	if err := abortRelease(os.Stdout, clientset, options); err == nil {
+		t.Errorf("abort without a release in progress: expected an error")
+	}
+}
+
+func TestCanaryReplicas(t *testing.T) {
+	tests := []struct {
+		total   int32
+		percent int
+		want    int32
+	}{
+		{total: 10, percent: 10, want: 1},
+		{total: 10, percent: 25, want: 3},
+		{total: 2, percent: 1, want: 1},
+		{total: 4, percent: 99, want: 3},
+	}
+
+	for _, tt := range tests {
+		if got := canaryReplicas(tt.total, tt.percent); got != tt.want {
+			t.Errorf("canaryReplicas(%d, %d) = %d, want %d", tt.total, tt.percent, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,347 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes"
+)
+
+// fatalWaitingReasons 是容器处于 Waiting 状态时，表示 rollout 不可能自行恢复的原因。
+// ErrImagePull 不在其中，它通常会在几次重试后变成 ImagePullBackOff，第一次拉取失败时只打印出来，不判定失败。
+var fatalWaitingReasons = map[string]bool{
+	"ImagePullBackOff":           true,
+	"InvalidImageName":           true,
+	"CrashLoopBackOff":           true,
+	"CreateContainerConfigError": true,
+}
+
+// rolloutWatcher 同时 watch Deployment、它的 ReplicaSet、Pod 以及命名空间中的事件，
+// 任何一个 watch 被 API Server 关闭后都会重新建立，直到 rollout 完成、失败或者超时。
+type rolloutWatcher struct {
+	// out 是进度信息的输出
+	out  io.Writer
+	name string
+
+	// lastStatus 和 lastConditions 用于去重，状态没有变化时不重复打印进度
+	lastStatus     string
+	lastConditions map[appsv1.DeploymentConditionType]string
+	// since 是开始等待的时间，watch 建立时会收到命名空间中以前的事件，早于这个时间的事件不再打印
+	since time.Time
+	// reported 记录已经打印过的 Pod 状态和事件，避免同一条信息在每次 watch 事件中重复出现
+	reported map[string]bool
+
+	// deployment、replicaSets 和 pods 是 watch 最近一次收到的对象，用于找出这次 rollout 的新 ReplicaSet 和它的 Pod
+	deployment  *appsv1.Deployment
+	replicaSets map[string]*appsv1.ReplicaSet
+	pods        map[string]*apiv1.Pod
+	// newHash 是新 ReplicaSet 的 pod-template-hash 标签，还没有找到新 ReplicaSet 时为空
+	newHash string
+}
+
+// waitForRollout 阻塞到 Deployment 的 status.updatedReplicas 和 status.availableReplicas 都达到 spec.replicas，
+// 期间持续把进度写到 out。遇到 ProgressDeadlineExceeded、新 ReplicaSet 的 Pod 镜像拉取失败或者容器 CrashLoopBackOff 时立即返回错误。
+// 旧 ReplicaSet 的 Pod 不判定失败：set-image 或 restart 常常正是为了替换掉正在 CrashLoopBackOff 的旧 Pod。
+func waitForRollout(out io.Writer, clientset kubernetes.Interface, namespace, name string, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.TODO(), timeout)
+	defer cancel()
+
+	w := &rolloutWatcher{
+		out:            out,
+		name:           name,
+		lastConditions: map[appsv1.DeploymentConditionType]string{},
+		reported:       map[string]bool{},
+		since:          time.Now(),
+		replicaSets:    map[string]*appsv1.ReplicaSet{},
+		pods:           map[string]*apiv1.Pod{},
+	}
+
+	deployment, err := clientset.AppsV1().Deployments(namespace).Get(ctx, name, metav1.GetOptions{})
+
+	if err != nil {
+		return err
+	}
+
+	selector, err := metav1.LabelSelectorAsSelector(deployment.Spec.Selector)
+
+	if err != nil {
+		return err
+	}
+
+	deploymentOptions := metav1.ListOptions{FieldSelector: fields.OneTermEqualSelector("metadata.name", name).String()}
+	// ReplicaSet 和 Pod 都带着 Deployment 的 selector 中的标签
+	podOptions := metav1.ListOptions{LabelSelector: selector.String()}
+
+	deploymentWatch, err := clientset.AppsV1().Deployments(namespace).Watch(ctx, deploymentOptions)
+	if err != nil {
+		return err
+	}
+	defer func() { deploymentWatch.Stop() }()
+
+	replicaSetWatch, err := clientset.AppsV1().ReplicaSets(namespace).Watch(ctx, podOptions)
+	if err != nil {
+		return err
+	}
+	defer func() { replicaSetWatch.Stop() }()
+
+	podWatch, err := clientset.CoreV1().Pods(namespace).Watch(ctx, podOptions)
+	if err != nil {
+		return err
+	}
+	defer func() { podWatch.Stop() }()
+
+	eventWatch, err := clientset.CoreV1().Events(namespace).Watch(ctx, metav1.ListOptions{})
+	if err != nil {
+		return err
+	}
+	defer func() { eventWatch.Stop() }()
+
+	// 不带 resourceVersion 的 watch 会先为已经存在的对象发送 ADDED 事件，所以这里不需要额外 List 一次
+	for {
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("timed out after %v waiting for deployment %s rollout: %s: %w", timeout, name, w.lastStatus, ctx.Err())
+
+		case event, ok := <-deploymentWatch.ResultChan():
+			if !ok {
+				if deploymentWatch, err = clientset.AppsV1().Deployments(namespace).Watch(ctx, deploymentOptions); err != nil {
+					return err
+				}
+				continue
+			}
+
+			deployment, ok := event.Object.(*appsv1.Deployment)
+			if !ok {
+				continue
+			}
+
+			if event.Type == watch.Deleted {
+				return &rolloutError{fmt.Sprintf("deployment %s was deleted during rollout", name)}
+			}
+
+			w.deployment = deployment
+			if err := w.resolveNewReplicaSet(); err != nil {
+				return err
+			}
+
+			done, err := w.checkDeployment(deployment)
+			if err != nil || done {
+				return err
+			}
+
+		case event, ok := <-replicaSetWatch.ResultChan():
+			if !ok {
+				if replicaSetWatch, err = clientset.AppsV1().ReplicaSets(namespace).Watch(ctx, podOptions); err != nil {
+					return err
+				}
+				continue
+			}
+
+			replicaSet, ok := event.Object.(*appsv1.ReplicaSet)
+			if !ok {
+				continue
+			}
+
+			if event.Type == watch.Deleted {
+				delete(w.replicaSets, replicaSet.Name)
+				continue
+			}
+
+			w.replicaSets[replicaSet.Name] = replicaSet
+			if err := w.resolveNewReplicaSet(); err != nil {
+				return err
+			}
+
+		case event, ok := <-podWatch.ResultChan():
+			if !ok {
+				if podWatch, err = clientset.CoreV1().Pods(namespace).Watch(ctx, podOptions); err != nil {
+					return err
+				}
+				continue
+			}
+
+			pod, ok := event.Object.(*apiv1.Pod)
+			if !ok {
+				continue
+			}
+
+			if event.Type == watch.Deleted {
+				delete(w.pods, pod.Name)
+				continue
+			}
+
+			w.pods[pod.Name] = pod
+			if err := w.checkNewPod(pod); err != nil {
+				return err
+			}
+
+		case event, ok := <-eventWatch.ResultChan():
+			if !ok {
+				if eventWatch, err = clientset.CoreV1().Events(namespace).Watch(ctx, metav1.ListOptions{}); err != nil {
+					return err
+				}
+				continue
+			}
+
+			if e, ok := event.Object.(*apiv1.Event); ok {
+				w.checkEvent(e)
+			}
+		}
+	}
+}
+
+// checkDeployment 参照 kubectl rollout status 的判断逻辑，根据 Deployment 的状态输出进度并判断 rollout 是否结束
+func (w *rolloutWatcher) checkDeployment(deployment *appsv1.Deployment) (bool, error) {
+	// 条件的 message 中会带上新 ReplicaSet 的名字，变化时打印出来
+	for _, condition := range deployment.Status.Conditions {
+		if w.lastConditions[condition.Type] != condition.Message {
+			w.lastConditions[condition.Type] = condition.Message
+			fmt.Fprintf(w.out, "deployment %s condition %s=%s: %s\n", w.name, condition.Type, condition.Status, condition.Message)
+		}
+
+		if condition.Type == appsv1.DeploymentProgressing && condition.Reason == "ProgressDeadlineExceeded" {
+			return false, &rolloutError{fmt.Sprintf("deployment %s exceeded its progress deadline: %s", w.name, condition.Message)}
+		}
+	}
+
+	// Deployment controller 还没有处理最新的 spec
+	if deployment.Generation > deployment.Status.ObservedGeneration {
+		w.progress("Waiting for deployment spec update to be observed...")
+		return false, nil
+	}
+
+	replicas := int32(1)
+	if deployment.Spec.Replicas != nil {
+		replicas = *deployment.Spec.Replicas
+	}
+
+	status := deployment.Status
+
+	switch {
+	case status.UpdatedReplicas < replicas:
+		w.progress(fmt.Sprintf("Waiting for deployment %q rollout to finish: %d out of %d new replicas have been updated...", w.name, status.UpdatedReplicas, replicas))
+	case status.Replicas > status.UpdatedReplicas:
+		w.progress(fmt.Sprintf("Waiting for deployment %q rollout to finish: %d old replicas are pending termination...", w.name, status.Replicas-status.UpdatedReplicas))
+	case status.AvailableReplicas < status.UpdatedReplicas:
+		w.progress(fmt.Sprintf("Waiting for deployment %q rollout to finish: %d of %d updated replicas are available...", w.name, status.AvailableReplicas, status.UpdatedReplicas))
+	default:
+		fmt.Fprintf(w.out, "deployment %q successfully rolled out\n", w.name)
+		return true, nil
+	}
+
+	return false, nil
+}
+
+// resolveNewReplicaSet 找出这次 rollout 的新 ReplicaSet：由 Deployment 控制、修订号与 Deployment 的 REVISION_ANNOTATION 相同的那个，
+// 与 kubectl rollout status 相同。Deployment controller 还没有处理最新的 spec 时，Deployment 上的修订号还是旧的，这时不做判断。
+// 新 ReplicaSet 变化时，用 checkNewPod 重新检查之前收到的 Pod，它们可能在找到新 ReplicaSet 之前就已经到达了
+func (w *rolloutWatcher) resolveNewReplicaSet() error {
+	if w.deployment == nil || w.deployment.Generation > w.deployment.Status.ObservedGeneration {
+		return nil
+	}
+
+	revision := w.deployment.Annotations[REVISION_ANNOTATION]
+
+	if revision == "" {
+		return nil
+	}
+
+	for _, replicaSet := range w.replicaSets {
+		if !metav1.IsControlledBy(replicaSet, w.deployment) || replicaSet.Annotations[REVISION_ANNOTATION] != revision {
+			continue
+		}
+
+		hash := replicaSet.Labels[appsv1.DefaultDeploymentUniqueLabelKey]
+
+		if hash == "" || hash == w.newHash {
+			return nil
+		}
+
+		w.newHash = hash
+		fmt.Fprintf(w.out, "deployment %s revision %s: new replicaset %s\n", w.name, revision, replicaSet.Name)
+
+		for _, pod := range w.pods {
+			if err := w.checkNewPod(pod); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	return nil
+}
+
+// checkNewPod 只用 checkPod 检查新 ReplicaSet 的 Pod，旧 ReplicaSet 的 Pod 即使 CrashLoopBackOff 也会被 rollout 替换掉，不影响结果
+func (w *rolloutWatcher) checkNewPod(pod *apiv1.Pod) error {
+	if w.newHash == "" || pod.Labels[appsv1.DefaultDeploymentUniqueLabelKey] != w.newHash {
+		return nil
+	}
+
+	return w.checkPod(pod)
+}
+
+// checkPod 检查 Pod 中容器的 Waiting 原因，镜像拉取失败或者 CrashLoopBackOff 时返回错误
+func (w *rolloutWatcher) checkPod(pod *apiv1.Pod) error {
+	statuses := append(append([]apiv1.ContainerStatus{}, pod.Status.InitContainerStatuses...), pod.Status.ContainerStatuses...)
+
+	for _, status := range statuses {
+		waiting := status.State.Waiting
+		if waiting == nil || waiting.Reason == "" || waiting.Reason == "ContainerCreating" || waiting.Reason == "PodInitializing" {
+			continue
+		}
+
+		key := fmt.Sprintf("pod/%s/%s/%s", pod.Name, status.Name, waiting.Reason)
+		if !w.reported[key] {
+			w.reported[key] = true
+			fmt.Fprintf(w.out, "pod %s container %s is waiting: %s %s\n", pod.Name, status.Name, waiting.Reason, waiting.Message)
+		}
+
+		if fatalWaitingReasons[waiting.Reason] {
+			return &rolloutError{fmt.Sprintf("pod %s container %s: %s: %s", pod.Name, status.Name, waiting.Reason, waiting.Message)}
+		}
+	}
+
+	return nil
+}
+
+// checkEvent 打印与这个 Deployment、它的 ReplicaSet 和 Pod 有关的 Warning 事件。
+// ReplicaSet 和 Pod 的名字都以 Deployment 的名字为前缀，据此过滤掉命名空间中其他对象的事件。
+func (w *rolloutWatcher) checkEvent(event *apiv1.Event) {
+	if event.Type != apiv1.EventTypeWarning || !strings.HasPrefix(event.InvolvedObject.Name, w.name) {
+		return
+	}
+
+	last := event.LastTimestamp.Time
+	if last.IsZero() {
+		last = event.EventTime.Time
+	}
+
+	if last.Before(w.since.Truncate(time.Second)) {
+		return
+	}
+
+	key := fmt.Sprintf("event/%s/%d", event.UID, event.Count)
+	if w.reported[key] {
+		return
+	}
+	w.reported[key] = true
+
+	fmt.Fprintf(w.out, "warning event on %s %s: %s: %s\n", strings.ToLower(event.InvolvedObject.Kind), event.InvolvedObject.Name, event.Reason, event.Message)
+}
+
+// progress 只在进度信息发生变化时打印
+func (w *rolloutWatcher) progress(message string) {
+	if message != w.lastStatus {
+		w.lastStatus = message
+		fmt.Fprintln(w.out, message)
+	}
+}
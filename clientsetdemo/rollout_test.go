@@ -0,0 +1,109 @@
+package main
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+	"k8s.io/utils/pointer"
+)
+
+// fakeWatches 让 fake clientset 的 watch 像 API Server 一样，先为已经存在的对象发送 ADDED 事件
+func fakeWatches(clientset *fake.Clientset, objects map[string][]runtime.Object) {
+	clientset.PrependWatchReactor("*", func(action k8stesting.Action) (bool, watch.Interface, error) {
+		existing := objects[action.GetResource().Resource]
+		watcher := watch.NewFakeWithChanSize(len(existing), false)
+
+		for _, obj := range existing {
+			watcher.Add(obj)
+		}
+
+		return true, watcher, nil
+	})
+}
+
+func TestWaitForRolloutChecksNewReplicaSetPods(t *testing.T) {
+	deployment := newDeployment(stack)
+	deployment.Namespace = NAMESPACE
+	deployment.UID = types.UID("deployment-uid")
+	deployment.Generation = 2
+	deployment.Annotations = map[string]string{REVISION_ANNOTATION: "2"}
+
+	owner := metav1.OwnerReference{APIVersion: "apps/v1", Kind: "Deployment", Name: deployment.Name, UID: deployment.UID, Controller: pointer.Bool(true)}
+
+	replicaSet := func(revision, hash string) *appsv1.ReplicaSet {
+		return &appsv1.ReplicaSet{ObjectMeta: metav1.ObjectMeta{
+			Name:            deployment.Name + "-" + hash,
+			Namespace:       NAMESPACE,
+			Labels:          map[string]string{appsv1.DefaultDeploymentUniqueLabelKey: hash},
+			Annotations:     map[string]string{REVISION_ANNOTATION: revision},
+			OwnerReferences: []metav1.OwnerReference{owner},
+		}}
+	}
+
+	pod := func(hash, reason string) *apiv1.Pod {
+		return &apiv1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: deployment.Name + "-" + hash + "-x1", Namespace: NAMESPACE, Labels: map[string]string{appsv1.DefaultDeploymentUniqueLabelKey: hash}},
+			Status: apiv1.PodStatus{ContainerStatuses: []apiv1.ContainerStatus{{
+				Name:  "web",
+				State: apiv1.ContainerState{Waiting: &apiv1.ContainerStateWaiting{Reason: reason}},
+			}}},
+		}
+	}
+
+	tests := []struct {
+		name string
+		// rolledOut 为 true 时 Deployment 的状态表示 rollout 已经完成
+		rolledOut bool
+		pods      []runtime.Object
+		wantExit  int
+	}{
+		{
+			name:      "crashing old pods do not fail the rollout that replaces them",
+			rolledOut: true,
+			pods:      []runtime.Object{pod("old", "CrashLoopBackOff")},
+		},
+		{
+			name:     "image pull failure of a new pod fails the rollout",
+			pods:     []runtime.Object{pod("old", "CrashLoopBackOff"), pod("new", "ImagePullBackOff")},
+			wantExit: EXIT_ROLLOUT_FAILED,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			current := deployment.DeepCopy()
+			current.Status = appsv1.DeploymentStatus{ObservedGeneration: 2, Replicas: 2, UpdatedReplicas: 1, AvailableReplicas: 1}
+			if tt.rolledOut {
+				current.Status = appsv1.DeploymentStatus{ObservedGeneration: 2, Replicas: 1, UpdatedReplicas: 1, AvailableReplicas: 1}
+				current.Spec.Replicas = pointer.Int32(1)
+			}
+
+			clientset := fake.NewSimpleClientset(current)
+			fakeWatches(clientset, map[string][]runtime.Object{
+				"deployments": {current},
+				"replicasets": {replicaSet("1", "old"), replicaSet("2", "new")},
+				"pods":        tt.pods,
+			})
+
+			err := waitForRollout(os.Stdout, clientset, NAMESPACE, deployment.Name, 5*time.Second)
+
+			exit := EXIT_OK
+			if err != nil {
+				exit, _ = classifyError(err)
+			}
+
+			if exit != tt.wantExit {
+				t.Errorf("waitForRollout returned %v (exit code %d), want exit code %d", err, exit, tt.wantExit)
+			}
+		})
+	}
+}
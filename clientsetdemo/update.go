@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/util/retry"
+)
+
+// RESTARTED_AT_ANNOTATION 与 kubectl rollout restart 使用的注解相同，修改它会让 Pod 模板发生变化，从而触发一次滚动更新
+const RESTARTED_AT_ANNOTATION = "kubectl.kubernetes.io/restartedAt"
+
+// scaleDeployment 通过 scale 子资源修改 Deployment 的副本数。
+// 先读取当前的 Scale 对象再更新，其中带有 resourceVersion，期间如果 Deployment 被其他人修改会返回 Conflict，由 RetryOnConflict 重新读取后再试。
+// 结果在重试成功之后写到 out，发生 Conflict 时也只输出一次。
+func scaleDeployment(out io.Writer, clientset kubernetes.Interface, name string, replicas int32) error {
+	deploymentClient := clientset.AppsV1().Deployments(stack.Namespace)
+	var from int32
+
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		scale, err := deploymentClient.GetScale(context.TODO(), name, metav1.GetOptions{})
+
+		if err != nil {
+			return err
+		}
+
+		from = scale.Spec.Replicas
+		scale.Spec.Replicas = replicas
+		_, err = deploymentClient.UpdateScale(context.TODO(), name, scale, metav1.UpdateOptions{DryRun: dryRun})
+
+		return err
+	})
+
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(out, "Scale deployment %s from %d to %d%s \n", name, from, replicas, dryRunSuffix())
+	return nil
+}
+
+// setImage 把 Deployment 中名为 container 的容器镜像修改为 image。container 为空并且只有一个容器时，修改这唯一的容器。
+// 结果在修改成功之后写到 out。
+func setImage(out io.Writer, clientset kubernetes.Interface, name, container, image string) error {
+	var from string
+
+	err := patchDeployment(clientset, name, func(deployment *appsv1.Deployment) (map[string]interface{}, error) {
+		containers := deployment.Spec.Template.Spec.Containers
+
+		if container == "" {
+			if len(containers) != 1 {
+				return nil, fmt.Errorf("deployment %s has %d containers, use -container to choose one", name, len(containers))
+			}
+
+			container = containers[0].Name
+		}
+
+		for _, c := range containers {
+			if c.Name == container {
+				from = c.Image
+
+				// 容器列表在 strategic merge patch 中以 name 为合并键，只需要写出要修改的容器和字段
+				return map[string]interface{}{
+					"spec": map[string]interface{}{
+						"template": map[string]interface{}{
+							"spec": map[string]interface{}{
+								"containers": []map[string]interface{}{{"name": container, "image": image}},
+							},
+						},
+					},
+				}, nil
+			}
+		}
+
+		return nil, fmt.Errorf("deployment %s has no container named %s", name, container)
+	})
+
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(out, "Set deployment %s container %s image from %s to %s%s \n", name, container, from, image, dryRunSuffix())
+	return nil
+}
+
+// restartDeployment 在 Pod 模板上写入当前时间的 restartedAt 注解，效果与 kubectl rollout restart 相同，结果在修改成功之后写到 out
+func restartDeployment(out io.Writer, clientset kubernetes.Interface, name string) error {
+	restartedAt := time.Now().Format(time.RFC3339)
+
+	err := patchDeployment(clientset, name, func(deployment *appsv1.Deployment) (map[string]interface{}, error) {
+		return map[string]interface{}{
+			"spec": map[string]interface{}{
+				"template": map[string]interface{}{
+					"metadata": map[string]interface{}{
+						"annotations": map[string]string{RESTARTED_AT_ANNOTATION: restartedAt},
+					},
+				},
+			},
+		}, nil
+	})
+
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(out, "Restart deployment %s at %s%s \n", name, restartedAt, dryRunSuffix())
+	return nil
+}
+
+// patchDeployment 读取 Deployment，由 build 根据当前状态生成 strategic merge patch，再提交修改。
+// patch 中带上读取到的 resourceVersion 作为前置条件，Deployment 在此期间被修改时 API Server 返回 Conflict，
+// RetryOnConflict 会重新读取并重新生成 patch，保证修改是基于最新的状态做出的。-dry-run=server 时 API Server 只校验，不保存修改。
+func patchDeployment(clientset kubernetes.Interface, name string, build func(*appsv1.Deployment) (map[string]interface{}, error)) error {
+	deploymentClient := clientset.AppsV1().Deployments(stack.Namespace)
+
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		deployment, err := deploymentClient.Get(context.TODO(), name, metav1.GetOptions{})
+
+		if err != nil {
+			return err
+		}
+
+		patch, err := build(deployment)
+
+		if err != nil {
+			return err
+		}
+
+		// build 生成的 patch 中可能已经有 metadata（例如修改标签），resourceVersion 合并进去而不是覆盖
+		metadata, _ := patch["metadata"].(map[string]interface{})
+		if metadata == nil {
+			metadata = map[string]interface{}{}
+		}
+
+		metadata["resourceVersion"] = deployment.ResourceVersion
+		patch["metadata"] = metadata
+
+		data, err := json.Marshal(patch)
+
+		if err != nil {
+			return err
+		}
+
+		_, err = deploymentClient.Patch(context.TODO(), name, types.StrategicMergePatchType, data, metav1.PatchOptions{DryRun: dryRun})
+
+		return err
+	})
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	appsv1 "k8s.io/api/apps/v1"
+	autoscalingv1 "k8s.io/api/autoscaling/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
+	appsv1client "k8s.io/client-go/kubernetes/typed/apps/v1"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+// newUpdateClientset 返回一个带有 stack Deployment 的 fake clientset。
+// fake 的 object tracker 不能处理 scale 子资源，这里在 Deployment 和 Scale 之间转换
+func newUpdateClientset() *fake.Clientset {
+	deployment := newDeployment(stack)
+	deployment.Namespace = stack.Namespace
+	clientset := fake.NewSimpleClientset(deployment)
+
+	clientset.PrependReactor("*", "deployments", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if action.GetSubresource() != "scale" {
+			return false, nil, nil
+		}
+
+		// reactor 在 fake clientset 的锁中执行，直接读写 tracker
+		gvr := appsv1.SchemeGroupVersion.WithResource("deployments")
+		obj, err := clientset.Tracker().Get(gvr, stack.Namespace, stack.DeploymentName)
+
+		if err != nil {
+			return true, nil, err
+		}
+
+		deployment := obj.(*appsv1.Deployment)
+
+		if update, ok := action.(k8stesting.UpdateAction); ok {
+			deployment.Spec.Replicas = &update.GetObject().(*autoscalingv1.Scale).Spec.Replicas
+
+			if err := clientset.Tracker().Update(gvr, deployment, stack.Namespace); err != nil {
+				return true, nil, err
+			}
+		}
+
+		scale := &autoscalingv1.Scale{
+			ObjectMeta: metav1.ObjectMeta{Name: deployment.Name, Namespace: deployment.Namespace},
+			Spec:       autoscalingv1.ScaleSpec{Replicas: replicasOf(deployment)},
+		}
+
+		return true, scale, nil
+	})
+
+	return clientset
+}
+
+// getStackDeployment 读取 fake clientset 中的 stack Deployment
+func getStackDeployment(t *testing.T, clientset kubernetes.Interface) *appsv1.Deployment {
+	t.Helper()
+
+	deployment, err := clientset.AppsV1().Deployments(stack.Namespace).Get(context.TODO(), stack.DeploymentName, metav1.GetOptions{})
+
+	if err != nil {
+		t.Fatalf("get deployment: %v", err)
+	}
+
+	return deployment
+}
+
+func TestScaleDeployment(t *testing.T) {
+	clientset := newUpdateClientset()
+
+	var out bytes.Buffer
+	if err := scaleDeployment(&out, clientset, stack.DeploymentName, 5); err != nil {
+		t.Fatalf("scaleDeployment: %v", err)
+	}
+
+	if replicas := replicasOf(getStackDeployment(t, clientset)); replicas != 5 {
+		t.Errorf("replicas = %d, want 5", replicas)
+	}
+
+	if want := "Scale deployment " + stack.DeploymentName; !strings.Contains(out.String(), want) {
+		t.Errorf("output %q does not contain %q", out.String(), want)
+	}
+}
+
+func TestSetImage(t *testing.T) {
+	tests := []struct {
+		name      string
+		container string
+		wantErr   bool
+	}{
+		{name: "the only container by default"},
+		{name: "container by name", container: "tomcat"},
+		{name: "unknown container", container: "sidecar", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clientset := newUpdateClientset()
+
+			var out bytes.Buffer
+			err := setImage(&out, clientset, stack.DeploymentName, tt.container, "tomcat:9")
+
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("setImage: expected an error for container %q", tt.container)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("setImage: %v", err)
+			}
+
+			if image := getStackDeployment(t, clientset).Spec.Template.Spec.Containers[0].Image; image != "tomcat:9" {
+				t.Errorf("image = %s, want tomcat:9", image)
+			}
+		})
+	}
+}
+
+func TestRestartDeployment(t *testing.T) {
+	clientset := newUpdateClientset()
+
+	var out bytes.Buffer
+	if err := restartDeployment(&out, clientset, stack.DeploymentName); err != nil {
+		t.Fatalf("restartDeployment: %v", err)
+	}
+
+	if _, ok := getStackDeployment(t, clientset).Spec.Template.Annotations[RESTARTED_AT_ANNOTATION]; !ok {
+		t.Errorf("pod template has no %s annotation", RESTARTED_AT_ANNOTATION)
+	}
+}
+
+func TestUpdateRetriesOnConflict(t *testing.T) {
+	clientset := newUpdateClientset()
+
+	// 第一次 patch 返回 Conflict，模拟读取之后 Deployment 被其他人修改
+	conflicts := 0
+	clientset.PrependReactor("patch", "deployments", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if conflicts > 0 {
+			return false, nil, nil
+		}
+
+		conflicts++
+		return true, nil, apierrors.NewConflict(appsv1.Resource("deployments"), stack.DeploymentName, nil)
+	})
+
+	var out bytes.Buffer
+	if err := setImage(&out, clientset, stack.DeploymentName, "", "tomcat:9"); err != nil {
+		t.Fatalf("setImage: %v", err)
+	}
+
+	if image := getStackDeployment(t, clientset).Spec.Template.Spec.Containers[0].Image; image != "tomcat:9" {
+		t.Errorf("image = %s, want tomcat:9", image)
+	}
+
+	if lines := strings.Count(out.String(), "Set deployment"); lines != 1 {
+		t.Errorf("output reports the change %d times, want once:\n%s", lines, out.String())
+	}
+}
+
+// dryRunClientset 像 API Server 一样处理 Deployment 写请求中的 DryRun：只返回当前对象，不保存修改。
+// fake clientset 本身不理会 DryRun，也不在 patch 和 update 的 action 中记录它
+type dryRunClientset struct {
+	*fake.Clientset
+	// dryRunWrites 是带着 DryRun 的写请求的个数
+	dryRunWrites int
+}
+
+func (c *dryRunClientset) AppsV1() appsv1client.AppsV1Interface {
+	return dryRunApps{c.Clientset.AppsV1(), c}
+}
+
+type dryRunApps struct {
+	appsv1client.AppsV1Interface
+	clientset *dryRunClientset
+}
+
+func (a dryRunApps) Deployments(namespace string) appsv1client.DeploymentInterface {
+	return dryRunDeployments{a.AppsV1Interface.Deployments(namespace), a.clientset}
+}
+
+type dryRunDeployments struct {
+	appsv1client.DeploymentInterface
+	clientset *dryRunClientset
+}
+
+func (d dryRunDeployments) Patch(ctx context.Context, name string, pt types.PatchType, data []byte, opts metav1.PatchOptions, subresources ...string) (*appsv1.Deployment, error) {
+	if len(opts.DryRun) == 0 {
+		return d.DeploymentInterface.Patch(ctx, name, pt, data, opts, subresources...)
+	}
+
+	d.clientset.dryRunWrites++
+	return d.Get(ctx, name, metav1.GetOptions{})
+}
+
+func (d dryRunDeployments) UpdateScale(ctx context.Context, name string, scale *autoscalingv1.Scale, opts metav1.UpdateOptions) (*autoscalingv1.Scale, error) {
+	if len(opts.DryRun) == 0 {
+		return d.DeploymentInterface.UpdateScale(ctx, name, scale, opts)
+	}
+
+	d.clientset.dryRunWrites++
+	return d.GetScale(ctx, name, metav1.GetOptions{})
+}
+
+func TestUpdateOperationsDryRun(t *testing.T) {
+	dryRun = []string{metav1.DryRunAll}
+	defer func() { dryRun = nil }()
+
+	clientset := &dryRunClientset{Clientset: newUpdateClientset()}
+	before := getStackDeployment(t, clientset)
+
+	var out bytes.Buffer
+	if err := scaleDeployment(&out, clientset, stack.DeploymentName, 5); err != nil {
+		t.Fatalf("scaleDeployment: %v", err)
+	}
+
+	if err := setImage(&out, clientset, stack.DeploymentName, "", "tomcat:9"); err != nil {
+		t.Fatalf("setImage: %v", err)
+	}
+
+	if err := restartDeployment(&out, clientset, stack.DeploymentName); err != nil {
+		t.Fatalf("restartDeployment: %v", err)
+	}
+
+	if clientset.dryRunWrites != 3 {
+		t.Errorf("%d write request(s) with dryRun, want 3 for scale, set-image and restart", clientset.dryRunWrites)
+	}
+
+	if after := getStackDeployment(t, clientset); replicasOf(after) != replicasOf(before) ||
+		after.Spec.Template.Spec.Containers[0].Image != before.Spec.Template.Spec.Containers[0].Image ||
+		after.Spec.Template.Annotations[RESTARTED_AT_ANNOTATION] != "" {
+		t.Errorf("dry run changed the deployment: %+v", after.Spec)
+	}
+
+	if lines := strings.Count(out.String(), dryRunSuffix()); lines != 3 {
+		t.Errorf("output marks %d line(s) as dry run, want 3:\n%s", lines, out.String())
+	}
+}
@@ -0,0 +1,446 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	apiv1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+)
+
+// finding 是 validate 发现的一个问题。warning 为 true 的问题不一定会被 API Server 拒绝，但多半是写错了，
+// 例如 Service 的 selector 没有选中任何工作负载。
+type finding struct {
+	warning bool
+	// object 是 "Kind namespace/name" 形式的对象标识
+	object string
+	err    *field.Error
+}
+
+func (f finding) String() string {
+	severity := "error"
+	if f.warning {
+		severity = "warning"
+	}
+
+	return fmt.Sprintf("%-7s %s: %s", severity, f.object, f.err.Error())
+}
+
+// workload 是带有 Pod 模板的对象，validate 用它检查 selector 和容器端口
+type workload struct {
+	kind      string
+	object    string
+	namespace string
+	selector  *metav1.LabelSelector
+	template  *apiv1.PodTemplateSpec
+	// path 是 Pod 模板在对象中的路径，Deployment、StatefulSet、DaemonSet 和 Job 都是 spec.template
+	path *field.Path
+}
+
+// workloadOf 返回对象的 Pod 模板，不是工作负载时返回 false
+func workloadOf(obj runtime.Object, object, namespace string) (workload, bool) {
+	w := workload{kind: objectKind(obj), object: object, namespace: namespace, path: field.NewPath("spec", "template")}
+
+	switch o := obj.(type) {
+	case *appsv1.Deployment:
+		w.selector, w.template = o.Spec.Selector, &o.Spec.Template
+	case *appsv1.StatefulSet:
+		w.selector, w.template = o.Spec.Selector, &o.Spec.Template
+	case *appsv1.DaemonSet:
+		w.selector, w.template = o.Spec.Selector, &o.Spec.Template
+	case *batchv1.Job:
+		w.selector, w.template = o.Spec.Selector, &o.Spec.Template
+	default:
+		return workload{}, false
+	}
+
+	return w, true
+}
+
+// validateObjects 对将要创建的对象做结构和语义检查，完全在本地完成，不访问 API Server。
+// 检查的内容：
+//   - 名字、命名空间和标签的格式，规则与 API Server 相同
+//   - 工作负载的 selector 能否选中自己的 Pod 模板
+//   - 容器端口和 Service 端口是否重复，端口名是否合法
+//   - Service 的 targetPort 能否在被选中的工作负载中找到名字和协议都一致的容器端口
+//   - NodePort 是否在 -node-port-range（stack.NodePortRange）之内，是否有两个 Service 使用同一个 NodePort
+func validateObjects(objects []runtime.Object) []finding {
+	// stack.validate 在连接集群之前已经检查过 stack.NodePortRange 的格式
+	nodePortMin, nodePortMax, _ := parseNodePortRange(stack.NodePortRange)
+
+	var findings []finding
+	var workloads []workload
+	var services []*apiv1.Service
+	serviceObjects := map[*apiv1.Service]string{}
+
+	for _, obj := range objects {
+		accessor, err := meta.Accessor(obj)
+
+		if err != nil {
+			exitOnError(err)
+		}
+
+		kind := objectKind(obj)
+		object := kind + " " + accessor.GetName()
+		if accessor.GetNamespace() != "" {
+			object = kind + " " + accessor.GetNamespace() + "/" + accessor.GetName()
+		}
+
+		report := func(warning bool, errs ...*field.Error) {
+			for _, err := range errs {
+				findings = append(findings, finding{warning: warning, object: object, err: err})
+			}
+		}
+
+		report(false, validateObjectMeta(kind, accessor)...)
+
+		if w, ok := workloadOf(obj, object, accessor.GetNamespace()); ok {
+			report(false, validateWorkload(w)...)
+			workloads = append(workloads, w)
+		}
+
+		if service, ok := obj.(*apiv1.Service); ok {
+			report(false, validateServicePorts(service, nodePortMin, nodePortMax)...)
+			services = append(services, service)
+			serviceObjects[service] = object
+		}
+	}
+
+	// NodePort 在整个集群中唯一，同一组对象里的两个 Service 不能使用同一个
+	nodePorts := map[int32]string{}
+
+	for _, service := range services {
+		object := serviceObjects[service]
+		warnings, errs := validateServiceTargets(service, workloads)
+
+		for _, err := range errs {
+			findings = append(findings, finding{object: object, err: err})
+		}
+
+		for _, err := range warnings {
+			findings = append(findings, finding{warning: true, object: object, err: err})
+		}
+
+		for i, port := range service.Spec.Ports {
+			if port.NodePort == 0 {
+				continue
+			}
+
+			if other, ok := nodePorts[port.NodePort]; ok {
+				path := field.NewPath("spec", "ports").Index(i).Child("nodePort")
+				findings = append(findings, finding{object: object, err: field.Duplicate(path, fmt.Sprintf("%d (also used by %s)", port.NodePort, other))})
+				continue
+			}
+
+			nodePorts[port.NodePort] = object
+		}
+	}
+
+	return findings
+}
+
+// validateObjectMeta 检查名字、命名空间和标签的格式。
+// 命名空间名必须是 RFC 1123 label，Service 名必须是 RFC 1035 label，其他对象的名字是 RFC 1123 subdomain。
+func validateObjectMeta(kind string, accessor metav1.Object) field.ErrorList {
+	var errs field.ErrorList
+	path := field.NewPath("metadata")
+
+	nameRule := validation.IsDNS1123Subdomain
+	switch kind {
+	case "Namespace":
+		nameRule = validation.IsDNS1123Label
+	case "Service":
+		nameRule = validation.IsDNS1035Label
+	}
+
+	for _, message := range nameRule(accessor.GetName()) {
+		errs = append(errs, field.Invalid(path.Child("name"), accessor.GetName(), message))
+	}
+
+	if namespace := accessor.GetNamespace(); namespace != "" {
+		for _, message := range validation.IsDNS1123Label(namespace) {
+			errs = append(errs, field.Invalid(path.Child("namespace"), namespace, message))
+		}
+	}
+
+	errs = append(errs, validateLabels(accessor.GetLabels(), path.Child("labels"))...)
+
+	return errs
+}
+
+// validateLabels 检查标签的键是否是合法的 qualified name，值是否是合法的标签值
+func validateLabels(objectLabels map[string]string, path *field.Path) field.ErrorList {
+	var errs field.ErrorList
+
+	// 按键排序，输出的顺序是确定的
+	keys := make([]string, 0, len(objectLabels))
+	for key := range objectLabels {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		value := objectLabels[key]
+
+		for _, message := range validation.IsQualifiedName(key) {
+			errs = append(errs, field.Invalid(path, key, message))
+		}
+
+		for _, message := range validation.IsValidLabelValue(value) {
+			errs = append(errs, field.Invalid(path.Key(key), value, message))
+		}
+	}
+
+	return errs
+}
+
+// validateWorkload 检查 selector 与 Pod 模板的标签，以及容器名和容器端口。
+// Job 的 selector 通常由 API Server 自动生成，没有写 selector 时不检查。
+func validateWorkload(w workload) field.ErrorList {
+	var errs field.ErrorList
+
+	errs = append(errs, validateLabels(w.template.Labels, w.path.Child("metadata", "labels"))...)
+
+	if w.selector == nil {
+		if w.kind != "Job" {
+			errs = append(errs, field.Required(field.NewPath("spec", "selector"), ""))
+		}
+	} else {
+		selector, err := metav1.LabelSelectorAsSelector(w.selector)
+
+		switch {
+		case err != nil:
+			errs = append(errs, field.Invalid(field.NewPath("spec", "selector"), w.selector, err.Error()))
+		case selector.Empty():
+			errs = append(errs, field.Invalid(field.NewPath("spec", "selector"), w.selector, "empty selector is invalid for this workload"))
+		case !selector.Matches(labels.Set(w.template.Labels)):
+			errs = append(errs, field.Invalid(w.path.Child("metadata", "labels"), w.template.Labels, "`selector` does not match template `labels`"))
+		}
+	}
+
+	containersPath := w.path.Child("spec", "containers")
+	names := map[string]bool{}
+	// Pod 中的容器共享网络命名空间，端口号和端口名在整个 Pod 内都必须唯一
+	portNames := map[string]bool{}
+	ports := map[string]bool{}
+
+	for i, container := range w.template.Spec.Containers {
+		containerPath := containersPath.Index(i)
+
+		for _, message := range validation.IsDNS1123Label(container.Name) {
+			errs = append(errs, field.Invalid(containerPath.Child("name"), container.Name, message))
+		}
+
+		if names[container.Name] {
+			errs = append(errs, field.Duplicate(containerPath.Child("name"), container.Name))
+		}
+		names[container.Name] = true
+
+		for j, port := range container.Ports {
+			portPath := containerPath.Child("ports").Index(j)
+
+			if port.Name != "" {
+				for _, message := range validation.IsValidPortName(port.Name) {
+					errs = append(errs, field.Invalid(portPath.Child("name"), port.Name, message))
+				}
+
+				if portNames[port.Name] {
+					errs = append(errs, field.Duplicate(portPath.Child("name"), port.Name))
+				}
+				portNames[port.Name] = true
+			}
+
+			for _, message := range validation.IsValidPortNum(int(port.ContainerPort)) {
+				errs = append(errs, field.Invalid(portPath.Child("containerPort"), port.ContainerPort, message))
+			}
+
+			key := fmt.Sprintf("%d/%s", port.ContainerPort, protocolOf(port.Protocol))
+			if ports[key] {
+				errs = append(errs, field.Duplicate(portPath, key))
+			}
+			ports[key] = true
+		}
+	}
+
+	return errs
+}
+
+// validateServicePorts 检查 Service 自身的端口：端口名、端口号、NodePort 是否在 nodePortMin 到 nodePortMax 之间，以及是否有重复的端口
+func validateServicePorts(service *apiv1.Service, nodePortMin, nodePortMax int32) field.ErrorList {
+	var errs field.ErrorList
+	portsPath := field.NewPath("spec", "ports")
+	names := map[string]bool{}
+	ports := map[string]bool{}
+	exposesNodePort := service.Spec.Type == apiv1.ServiceTypeNodePort || service.Spec.Type == apiv1.ServiceTypeLoadBalancer
+
+	for i, port := range service.Spec.Ports {
+		portPath := portsPath.Index(i)
+
+		// 有多个端口时每个端口都必须有名字
+		if port.Name == "" && len(service.Spec.Ports) > 1 {
+			errs = append(errs, field.Required(portPath.Child("name"), "required when the service has more than one port"))
+		}
+
+		if port.Name != "" {
+			for _, message := range validation.IsDNS1123Label(port.Name) {
+				errs = append(errs, field.Invalid(portPath.Child("name"), port.Name, message))
+			}
+
+			if names[port.Name] {
+				errs = append(errs, field.Duplicate(portPath.Child("name"), port.Name))
+			}
+			names[port.Name] = true
+		}
+
+		for _, message := range validation.IsValidPortNum(int(port.Port)) {
+			errs = append(errs, field.Invalid(portPath.Child("port"), port.Port, message))
+		}
+
+		key := fmt.Sprintf("%d/%s", port.Port, protocolOf(port.Protocol))
+		if ports[key] {
+			errs = append(errs, field.Duplicate(portPath, key))
+		}
+		ports[key] = true
+
+		if port.NodePort == 0 {
+			continue
+		}
+
+		nodePortPath := portPath.Child("nodePort")
+
+		if !exposesNodePort {
+			errs = append(errs, field.Forbidden(nodePortPath, fmt.Sprintf("may not be used when `type` is '%s'", serviceTypeOf(service))))
+		} else if port.NodePort < nodePortMin || port.NodePort > nodePortMax {
+			errs = append(errs, field.Invalid(nodePortPath, port.NodePort, fmt.Sprintf("must be in the range %d-%d", nodePortMin, nodePortMax)))
+		}
+	}
+
+	return errs
+}
+
+// validateServiceTargets 检查 Service 的每个端口能否转发到被它的 selector 选中的工作负载：
+// targetPort 是名字时，容器中必须有同名端口；两种写法都要求容器端口的协议与 Service 端口相同。
+// 第一个返回值是警告，例如 selector 没有选中任何工作负载，或者数字 targetPort 没有在容器中声明（声明只是说明性的，不影响转发）。
+func validateServiceTargets(service *apiv1.Service, workloads []workload) (field.ErrorList, field.ErrorList) {
+	var warnings, errs field.ErrorList
+
+	// 没有 selector 的 Service 由用户自己维护 Endpoints，无从检查
+	if len(service.Spec.Selector) == 0 {
+		return nil, nil
+	}
+
+	selector := labels.SelectorFromSet(service.Spec.Selector)
+
+	var selected []workload
+	for _, w := range workloads {
+		if w.namespace == service.Namespace && selector.Matches(labels.Set(w.template.Labels)) {
+			selected = append(selected, w)
+		}
+	}
+
+	if len(selected) == 0 {
+		warnings = append(warnings, field.NotFound(field.NewPath("spec", "selector"), service.Spec.Selector))
+		return warnings, nil
+	}
+
+	for i, port := range service.Spec.Ports {
+		targetPath := field.NewPath("spec", "ports").Index(i).Child("targetPort")
+		protocol := protocolOf(port.Protocol)
+
+		// 没有写 targetPort 时 API Server 使用 port 作为 targetPort
+		target := port.TargetPort
+		if target.Type == intstr.Int && target.IntVal == 0 {
+			target = intstr.FromInt32(port.Port)
+		}
+
+		for _, w := range selected {
+			containerPort, found := findContainerPort(w.template, target)
+
+			switch {
+			case !found && target.Type == intstr.String:
+				errs = append(errs, field.NotFound(targetPath, fmt.Sprintf("%s (no container port with this name in %s)", target.String(), w.object)))
+			case !found:
+				warnings = append(warnings, field.NotFound(targetPath, fmt.Sprintf("%s (not declared by any container of %s)", target.String(), w.object)))
+			case protocolOf(containerPort.Protocol) != protocol:
+				errs = append(errs, field.Invalid(targetPath, target.String(),
+					fmt.Sprintf("service port protocol is %s but container port %s of %s uses %s", protocol, portDescription(containerPort), w.object, protocolOf(containerPort.Protocol))))
+			}
+		}
+	}
+
+	return warnings, errs
+}
+
+// findContainerPort 在 Pod 模板的所有容器中按名字或端口号查找容器端口
+func findContainerPort(template *apiv1.PodTemplateSpec, target intstr.IntOrString) (apiv1.ContainerPort, bool) {
+	for _, container := range template.Spec.Containers {
+		for _, port := range container.Ports {
+			if target.Type == intstr.String && port.Name == target.StrVal {
+				return port, true
+			}
+
+			if target.Type == intstr.Int && port.ContainerPort == target.IntVal {
+				return port, true
+			}
+		}
+	}
+
+	return apiv1.ContainerPort{}, false
+}
+
+// protocolOf 返回端口的协议，没有写协议时 API Server 默认使用 TCP
+func protocolOf(protocol apiv1.Protocol) apiv1.Protocol {
+	if protocol == "" {
+		return apiv1.ProtocolTCP
+	}
+
+	return protocol
+}
+
+// serviceTypeOf 返回 Service 的类型，没有写类型时 API Server 默认使用 ClusterIP
+func serviceTypeOf(service *apiv1.Service) apiv1.ServiceType {
+	if service.Spec.Type == "" {
+		return apiv1.ServiceTypeClusterIP
+	}
+
+	return service.Spec.Type
+}
+
+// portDescription 返回 "http (8080)" 形式的容器端口描述
+func portDescription(port apiv1.ContainerPort) string {
+	if port.Name == "" {
+		return fmt.Sprintf("%d", port.ContainerPort)
+	}
+
+	return fmt.Sprintf("%s (%d)", port.Name, port.ContainerPort)
+}
+
+// validate 输出 validateObjects 发现的全部问题，有错误时返回 error，只有警告时返回 nil
+func validate(objects []runtime.Object) error {
+	findings := validateObjects(objects)
+	errorCount := 0
+
+	for _, f := range findings {
+		fmt.Println(f.String())
+
+		if !f.warning {
+			errorCount++
+		}
+	}
+
+	fmt.Printf("Validated %d object(s): %d error(s), %d warning(s)\n", len(objects), errorCount, len(findings)-errorCount)
+
+	if errorCount > 0 {
+		return &invalidError{message: fmt.Sprintf("%d object validation error(s)", errorCount)}
+	}
+
+	return nil
+}
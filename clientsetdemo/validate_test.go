@@ -0,0 +1,184 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	appsv1 "k8s.io/api/apps/v1"
+	apiv1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+func TestValidateObjects(t *testing.T) {
+	tests := []struct {
+		name string
+		// modify 修改 stackObjects 返回的命名空间、Deployment 和 Service，返回值追加到对象列表中
+		modify func(*apiv1.Namespace, *appsv1.Deployment, *apiv1.Service) []runtime.Object
+		// wantErrors 和 wantWarnings 是应该出现在对应级别的问题中的字段路径
+		wantErrors   []string
+		wantWarnings []string
+	}{
+		{
+			name: "consistent stack",
+			modify: func(_ *apiv1.Namespace, d *appsv1.Deployment, _ *apiv1.Service) []runtime.Object {
+				d.Spec.Template.Spec.Containers[0].Ports[0].Protocol = apiv1.ProtocolTCP
+				return nil
+			},
+		},
+		{
+			name: "SCTP container port behind a TCP service",
+			modify: func(_ *apiv1.Namespace, d *appsv1.Deployment, _ *apiv1.Service) []runtime.Object {
+				d.Spec.Template.Spec.Containers[0].Ports[0].Protocol = apiv1.ProtocolSCTP
+				return nil
+			},
+			wantErrors: []string{"spec.ports[0].targetPort"},
+		},
+		{
+			name: "invalid names",
+			modify: func(n *apiv1.Namespace, d *appsv1.Deployment, s *apiv1.Service) []runtime.Object {
+				d.Spec.Template.Spec.Containers[0].Ports[0].Protocol = apiv1.ProtocolTCP
+				n.Name = "test_clientset"
+				d.Name = "Tomcat"
+				s.Name = "8080-service"
+				return nil
+			},
+			wantErrors: []string{"Namespace test_clientset: metadata.name", "Deployment test-clientset/Tomcat: metadata.name", "Service test-clientset/8080-service: metadata.name"},
+		},
+		{
+			name: "selector does not match the template",
+			modify: func(_ *apiv1.Namespace, d *appsv1.Deployment, _ *apiv1.Service) []runtime.Object {
+				d.Spec.Template.Spec.Containers[0].Ports[0].Protocol = apiv1.ProtocolTCP
+				d.Spec.Template.Labels = map[string]string{"app": "tomcat8"}
+				return nil
+			},
+			wantErrors:   []string{"spec.template.metadata.labels"},
+			wantWarnings: []string{"spec.selector"},
+		},
+		{
+			name: "named target port that no container declares",
+			modify: func(_ *apiv1.Namespace, d *appsv1.Deployment, s *apiv1.Service) []runtime.Object {
+				d.Spec.Template.Spec.Containers[0].Ports[0].Protocol = apiv1.ProtocolTCP
+				s.Spec.Ports[0].TargetPort = intstr.FromString("web")
+				return nil
+			},
+			wantErrors: []string{"spec.ports[0].targetPort: Not found"},
+		},
+		{
+			name: "numeric target port that no container declares",
+			modify: func(_ *apiv1.Namespace, d *appsv1.Deployment, s *apiv1.Service) []runtime.Object {
+				d.Spec.Template.Spec.Containers[0].Ports[0].Protocol = apiv1.ProtocolTCP
+				s.Spec.Ports[0].TargetPort = intstr.FromInt32(9090)
+				return nil
+			},
+			wantWarnings: []string{"spec.ports[0].targetPort"},
+		},
+		{
+			name: "node port outside the range and on a ClusterIP service",
+			modify: func(n *apiv1.Namespace, d *appsv1.Deployment, s *apiv1.Service) []runtime.Object {
+				d.Spec.Template.Spec.Containers[0].Ports[0].Protocol = apiv1.ProtocolTCP
+				s.Spec.Ports[0].NodePort = 8080
+
+				other := s.DeepCopy()
+				other.Name = "cluster-ip"
+				other.Spec.Type = apiv1.ServiceTypeClusterIP
+				other.Spec.Ports[0].NodePort = 30081
+				return []runtime.Object{other}
+			},
+			wantErrors: []string{"spec.ports[0].nodePort: Invalid value", "spec.ports[0].nodePort: Forbidden"},
+		},
+		{
+			name: "duplicate ports",
+			modify: func(_ *apiv1.Namespace, d *appsv1.Deployment, s *apiv1.Service) []runtime.Object {
+				container := &d.Spec.Template.Spec.Containers[0]
+				container.Ports[0].Protocol = apiv1.ProtocolTCP
+				container.Ports = append(container.Ports, apiv1.ContainerPort{Name: "http", ContainerPort: 8080})
+				s.Spec.Ports = append(s.Spec.Ports, apiv1.ServicePort{Name: "http", Port: 8080})
+
+				other := s.DeepCopy()
+				other.Name = "other-service"
+				other.Spec.Ports = other.Spec.Ports[:1]
+				return []runtime.Object{other}
+			},
+			wantErrors: []string{
+				"spec.template.spec.containers[0].ports[1].name: Duplicate",
+				"spec.template.spec.containers[0].ports[1]: Duplicate",
+				"spec.ports[1].name: Duplicate",
+				"spec.ports[1]: Duplicate",
+				"other-service: spec.ports[0].nodePort: Duplicate",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			objects := stackObjects(stack)
+			objects = append(objects, tt.modify(objects[0].(*apiv1.Namespace), objects[1].(*appsv1.Deployment), objects[2].(*apiv1.Service))...)
+
+			var errors, warnings []string
+			for _, f := range validateObjects(objects) {
+				if f.warning {
+					warnings = append(warnings, f.String())
+				} else {
+					errors = append(errors, f.String())
+				}
+			}
+
+			checkFindings(t, "error", errors, tt.wantErrors)
+			checkFindings(t, "warning", warnings, tt.wantWarnings)
+		})
+	}
+}
+
+func TestValidateNodePortRange(t *testing.T) {
+	// 集群的 --service-node-port-range 不是默认值时，按 -node-port-range 检查 NodePort
+	defer func(portRange string) { stack.NodePortRange = portRange }(stack.NodePortRange)
+	stack.NodePortRange = "31000-31999"
+
+	tests := []struct {
+		nodePort   int32
+		wantErrors []string
+	}{
+		{nodePort: 31500},
+		{nodePort: DEFAULT_NODE_PORT, wantErrors: []string{"spec.ports[0].nodePort: Invalid value: 30080: must be in the range 31000-31999"}},
+	}
+
+	for _, tt := range tests {
+		objects := stackObjects(stack)
+		objects[1].(*appsv1.Deployment).Spec.Template.Spec.Containers[0].Ports[0].Protocol = apiv1.ProtocolTCP
+		objects[2].(*apiv1.Service).Spec.Ports[0].NodePort = tt.nodePort
+
+		var errors []string
+		for _, f := range validateObjects(objects) {
+			if !f.warning {
+				errors = append(errors, f.String())
+			}
+		}
+
+		checkFindings(t, "error", errors, tt.wantErrors)
+	}
+}
+
+// checkFindings 检查 got 与 want 的数量相同，并且 want 中的每一项都出现在某个问题中
+func checkFindings(t *testing.T, severity string, got, want []string) {
+	t.Helper()
+
+	if len(got) != len(want) {
+		t.Errorf("got %d %s(s), want %d:\n%s", len(got), severity, len(want), strings.Join(got, "\n"))
+		return
+	}
+
+	for _, w := range want {
+		found := false
+		for _, g := range got {
+			if strings.Contains(g, w) {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			t.Errorf("no %s mentions %q:\n%s", severity, w, strings.Join(got, "\n"))
+		}
+	}
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	appsv1 "k8s.io/api/apps/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	// DEFAULT_IMAGE、DEFAULT_REPLICAS 和 DEFAULT_PORT 是没有指定 -values 和对应参数时使用的值，与之前写死在代码里的相同
+	DEFAULT_IMAGE     = "tomcat:8.0.18-jre8"
+	DEFAULT_REPLICAS  = 2
+	DEFAULT_PORT      = 8080
+	DEFAULT_NODE_PORT = 30080
+
+	// DEFAULT_NODE_PORT_RANGE 是 kube-apiserver --service-node-port-range 的默认范围
+	DEFAULT_NODE_PORT_RANGE = "30000-32767"
+
+	DEFAULT_SERVICE_TYPE = "NodePort"
+)
+
+// stackValues 是 create、apply、diff 和 clean 操作的那一组对象（命名空间、Deployment 和 Service）的参数。
+// 同一个集群中的多个人各自指定不同的命名空间、名字和 NodePort，就可以互不冲突地运行各自的一套对象。
+// 字段可以写在 -values 指定的 YAML 文件中，命令行参数的优先级高于文件。
+type stackValues struct {
+	Namespace      string `json:"namespace"`
+	DeploymentName string `json:"deploymentName"`
+	ServiceName    string `json:"serviceName"`
+	Image          string `json:"image"`
+	Replicas       int32  `json:"replicas"`
+	// Port 同时是容器端口和 Service 端口
+	Port int32 `json:"port"`
+	// ServiceType 是 ClusterIP、NodePort 或 LoadBalancer，ClusterIP 时忽略 NodePort
+	ServiceType string `json:"serviceType"`
+	// NodePort 为 0 表示由 API Server 自动分配
+	NodePort int32 `json:"nodePort"`
+	// NodePortRange 是集群的 --service-node-port-range，NodePort 冲突时从中分配空闲端口，见 nodeport.go
+	NodePortRange string `json:"nodePortRange"`
+	// Workload 是 deployment、statefulset 或 daemonset，三种工作负载的名字都是 DeploymentName，见 workload.go
+	Workload string `json:"workload"`
+	// StorageSize 和 StorageClass 是 statefulset 为每个 Pod 创建的 PVC 的容量和 StorageClass，StorageClass 为空时使用集群的默认值
+	StorageSize  string `json:"storageSize"`
+	StorageClass string `json:"storageClass,omitempty"`
+	// PVCRetention 是 Retain 或 Delete，决定删除 StatefulSet（包括 clean）时是否同时删除它的 PVC
+	PVCRetention string `json:"pvcRetention"`
+
+	// 以下是可选的配套对象，见 companions.go。ConfigData 和 SecretData 的 key 分别是挂载的文件名和环境变量名
+	ConfigMap    bool              `json:"configMap"`
+	ConfigData   map[string]string `json:"configData,omitempty"`
+	Secret       bool              `json:"secret"`
+	SecretData   map[string]string `json:"secretData,omitempty"`
+	Ingress      bool              `json:"ingress"`
+	IngressHost  string            `json:"ingressHost,omitempty"`
+	IngressClass string            `json:"ingressClass,omitempty"`
+	HPA          bool              `json:"hpa"`
+	// HPA 在 Replicas 和 HPAMaxReplicas 之间伸缩，目标是 Pod 的平均 CPU 使用率达到 HPACPUPercent
+	HPAMaxReplicas  int32 `json:"hpaMaxReplicas"`
+	HPACPUPercent   int32 `json:"hpaCPUPercent"`
+	PDB             bool  `json:"pdb"`
+	PDBMinAvailable int32 `json:"pdbMinAvailable"`
+
+	// 以下是 Provision 开启时为命名空间配置的 Pod Security 级别、权限和配额，见 provision.go
+	Provision   bool     `json:"provision"`
+	PodSecurity string   `json:"podSecurity"`
+	RoleVerbs   []string `json:"roleVerbs"`
+	QuotaCPU    string   `json:"quotaCPU"`
+	QuotaMemory string   `json:"quotaMemory"`
+	QuotaPods   int32    `json:"quotaPods"`
+	// RequestCPU、LimitCPU、RequestMemory 和 LimitMemory 是 LimitRange 为容器填充的默认值
+	RequestCPU    string `json:"requestCPU"`
+	LimitCPU      string `json:"limitCPU"`
+	RequestMemory string `json:"requestMemory"`
+	LimitMemory   string `json:"limitMemory"`
+}
+
+// stack 是本次运行使用的参数，main 在解析完 -values 和命令行参数之后设置它
+var stack = defaultStackValues()
+
+// defaultStackValues 返回默认参数
+func defaultStackValues() stackValues {
+	return stackValues{
+		Namespace:      NAMESPACE,
+		DeploymentName: DEPLOYMENT_NAME,
+		ServiceName:    SERVICE_NAME,
+		Image:          DEFAULT_IMAGE,
+		Replicas:       DEFAULT_REPLICAS,
+		Port:           DEFAULT_PORT,
+		ServiceType:    DEFAULT_SERVICE_TYPE,
+		NodePort:       DEFAULT_NODE_PORT,
+		NodePortRange:  DEFAULT_NODE_PORT_RANGE,
+		Workload:       WORKLOAD_DEPLOYMENT,
+		StorageSize:    DEFAULT_STORAGE_SIZE,
+		PVCRetention:   string(appsv1.RetainPersistentVolumeClaimRetentionPolicyType),
+
+		HPAMaxReplicas:  DEFAULT_HPA_MAX_REPLICAS,
+		HPACPUPercent:   DEFAULT_HPA_CPU_PERCENT,
+		PDBMinAvailable: DEFAULT_PDB_MIN_AVAILABLE,
+
+		PodSecurity:   DEFAULT_POD_SECURITY,
+		RoleVerbs:     defaultRoleVerbs,
+		QuotaCPU:      DEFAULT_QUOTA_CPU,
+		QuotaMemory:   DEFAULT_QUOTA_MEMORY,
+		QuotaPods:     DEFAULT_QUOTA_PODS,
+		RequestCPU:    DEFAULT_REQUEST_CPU,
+		LimitCPU:      DEFAULT_LIMIT_CPU,
+		RequestMemory: DEFAULT_REQUEST_MEMORY,
+		LimitMemory:   DEFAULT_LIMIT_MEMORY,
+	}
+}
+
+// loadValuesFile 读取 YAML 格式的 values 文件，覆盖 values 中对应的字段，文件中没有写的字段保持不变。
+// 文件中出现未知字段（例如拼错的 nodePorts）时返回错误，而不是悄悄忽略。
+func loadValuesFile(path string, values *stackValues) error {
+	data, err := os.ReadFile(path)
+
+	if err != nil {
+		return err
+	}
+
+	if err := yaml.UnmarshalStrict(data, values); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+
+	return nil
+}
+
+// validate 在发出任何请求之前检查参数，一次返回全部问题。
+// 命名空间必须是 RFC 1123 label，Deployment 名字必须是 RFC 1123 subdomain，
+// Service 名字必须是 RFC 1035 label（与 RFC 1123 label 相同，只是不能以数字开头），这些都是 API Server 的校验规则。
+func (v stackValues) validate() error {
+	var problems []string
+
+	check := func(field string, messages []string) {
+		for _, message := range messages {
+			problems = append(problems, field+": "+message)
+		}
+	}
+
+	check(fmt.Sprintf("namespace %q", v.Namespace), validation.IsDNS1123Label(v.Namespace))
+	check(fmt.Sprintf("deploymentName %q", v.DeploymentName), validation.IsDNS1123Subdomain(v.DeploymentName))
+	check(fmt.Sprintf("serviceName %q", v.ServiceName), validation.IsDNS1035Label(v.ServiceName))
+
+	if strings.TrimSpace(v.Image) == "" {
+		problems = append(problems, "image: must not be empty")
+	}
+
+	if v.Replicas < 0 {
+		problems = append(problems, fmt.Sprintf("replicas %d: must be greater than or equal to 0", v.Replicas))
+	}
+
+	check(fmt.Sprintf("port %d", v.Port), validation.IsValidPortNum(int(v.Port)))
+
+	if !serviceTypes[v.ServiceType] {
+		problems = append(problems, fmt.Sprintf("serviceType %q: must be ClusterIP, NodePort or LoadBalancer", v.ServiceType))
+	}
+
+	// ClusterIP 类型的 Service 不使用 NodePort，nodePort 的值会被忽略
+	if low, high, err := parseNodePortRange(v.NodePortRange); err != nil {
+		problems = append(problems, fmt.Sprintf("nodePortRange: %v", err))
+	} else if usesNodePort(v.ServiceType) && v.NodePort != 0 && (v.NodePort < low || v.NodePort > high) {
+		problems = append(problems, fmt.Sprintf("nodePort %d: must be 0 (allocated by the API server) or in the range %d-%d", v.NodePort, low, high))
+	}
+
+	problems = append(problems, v.validateWorkload()...)
+	problems = append(problems, v.validateCompanions()...)
+	problems = append(problems, v.validateProvision()...)
+
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid values: %s", strings.Join(problems, "; "))
+	}
+
+	return nil
+}
+
+// validateCompanions 检查开启了的配套对象的参数，关闭的配套对象不检查
+func (v stackValues) validateCompanions() []string {
+	var problems []string
+
+	check := func(field string, messages []string) {
+		for _, message := range messages {
+			problems = append(problems, field+": "+message)
+		}
+	}
+
+	if v.ConfigMap {
+		if len(v.ConfigData) == 0 {
+			problems = append(problems, "configData: must not be empty when configMap is enabled")
+		}
+
+		for _, key := range sortedKeys(v.ConfigData) {
+			check(fmt.Sprintf("configData key %q", key), validation.IsConfigMapKey(key))
+		}
+	}
+
+	// Secret 通过 envFrom 注入，key 必须是合法的环境变量名
+	if v.Secret {
+		if len(v.SecretData) == 0 {
+			problems = append(problems, "secretData: must not be empty when secret is enabled")
+		}
+
+		for _, key := range sortedKeys(v.SecretData) {
+			check(fmt.Sprintf("secretData key %q", key), validation.IsEnvVarName(key))
+		}
+	}
+
+	if v.Ingress {
+		if strings.HasPrefix(v.IngressHost, "*.") {
+			check(fmt.Sprintf("ingressHost %q", v.IngressHost), validation.IsWildcardDNS1123Subdomain(v.IngressHost))
+		} else if v.IngressHost != "" {
+			check(fmt.Sprintf("ingressHost %q", v.IngressHost), validation.IsDNS1123Subdomain(v.IngressHost))
+		}
+
+		if v.IngressClass != "" {
+			check(fmt.Sprintf("ingressClass %q", v.IngressClass), validation.IsDNS1123Subdomain(v.IngressClass))
+		}
+	}
+
+	if v.HPA {
+		if v.HPAMaxReplicas < 1 || v.HPAMaxReplicas < v.Replicas {
+			problems = append(problems, fmt.Sprintf("hpaMaxReplicas %d: must be at least 1 and at least replicas (%d)", v.HPAMaxReplicas, v.Replicas))
+		}
+
+		if v.HPACPUPercent < 1 {
+			problems = append(problems, fmt.Sprintf("hpaCPUPercent %d: must be greater than 0", v.HPACPUPercent))
+		}
+	}
+
+	// minAvailable 不小于副本数时任何 Pod 都不能被驱逐，节点维护会一直卡住
+	if v.PDB && (v.PDBMinAvailable < 0 || v.PDBMinAvailable >= v.Replicas) {
+		problems = append(problems, fmt.Sprintf("pdbMinAvailable %d: must be at least 0 and less than replicas (%d), otherwise no pod can ever be evicted", v.PDBMinAvailable, v.Replicas))
+	}
+
+	return problems
+}
+
+// sortedKeys 返回排好序的 key，让错误信息的顺序固定
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestStackValuesValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(*stackValues)
+		// wantErr 是错误信息中应该出现的内容，为空表示期望校验通过
+		wantErr []string
+	}{
+		{
+			name:   "defaults are valid",
+			modify: func(v *stackValues) {},
+		},
+		{
+			name:   "node port allocated by the API server",
+			modify: func(v *stackValues) { v.NodePort = 0 },
+		},
+		{
+			name:   "cluster IP service ignores the node port",
+			modify: func(v *stackValues) { v.ServiceType, v.NodePort = "ClusterIP", 8080 },
+		},
+		{
+			name:    "unknown service type",
+			modify:  func(v *stackValues) { v.ServiceType = "ExternalName" },
+			wantErr: []string{`serviceType "ExternalName"`},
+		},
+		{
+			name:    "node port outside a custom range",
+			modify:  func(v *stackValues) { v.NodePortRange = "31000-31999" },
+			wantErr: []string{"nodePort 30080"},
+		},
+		{
+			name:    "namespace with underscore",
+			modify:  func(v *stackValues) { v.Namespace = "test_clientset" },
+			wantErr: []string{`namespace "test_clientset"`},
+		},
+		{
+			name:    "service name starting with a digit",
+			modify:  func(v *stackValues) { v.ServiceName = "1-service" },
+			wantErr: []string{`serviceName "1-service"`},
+		},
+		{
+			name:    "upper case deployment name",
+			modify:  func(v *stackValues) { v.DeploymentName = "Tomcat" },
+			wantErr: []string{`deploymentName "Tomcat"`},
+		},
+		{
+			name:    "node port outside the range",
+			modify:  func(v *stackValues) { v.NodePort = 8080 },
+			wantErr: []string{"nodePort 8080"},
+		},
+		{
+			name: "statefulset with storage settings",
+			modify: func(v *stackValues) {
+				v.Workload, v.StorageSize, v.StorageClass, v.PVCRetention = "statefulset", "10Gi", "fast-ssd", "Delete"
+			},
+		},
+		{
+			name: "invalid workload settings",
+			modify: func(v *stackValues) {
+				v.Workload, v.HPA, v.PVCRetention = "daemonset", true, "Keep"
+			},
+			wantErr: []string{`pvcRetention "Keep"`, "hpa: a daemonset"},
+		},
+		{
+			name:    "statefulset with an invalid storage size",
+			modify:  func(v *stackValues) { v.Workload, v.StorageSize = "statefulset", "lots" },
+			wantErr: []string{`storageSize "lots"`},
+		},
+		{
+			name: "companions with their settings",
+			modify: func(v *stackValues) {
+				v.ConfigMap, v.ConfigData = true, map[string]string{"app.properties": "greeting=hello"}
+				v.Secret, v.SecretData = true, map[string]string{"DB_PASSWORD": "secret"}
+				v.Ingress, v.IngressHost = true, "*.example.com"
+				v.HPA, v.PDB = true, true
+			},
+		},
+		{
+			name: "companions with invalid settings",
+			modify: func(v *stackValues) {
+				v.ConfigMap = true
+				v.Secret, v.SecretData = true, map[string]string{"1PASSWORD": "secret"}
+				v.HPA, v.HPAMaxReplicas = true, 1
+				v.PDB, v.PDBMinAvailable = true, 2
+			},
+			wantErr: []string{"configData", `secretData key "1PASSWORD"`, "hpaMaxReplicas 1", "pdbMinAvailable 2"},
+		},
+		{
+			name: "every problem is reported at once",
+			modify: func(v *stackValues) {
+				v.Image = ""
+				v.Replicas = -1
+				v.Port = 70000
+			},
+			wantErr: []string{"image", "replicas -1", "port 70000"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			values := defaultStackValues()
+			tt.modify(&values)
+
+			err := values.validate()
+
+			if len(tt.wantErr) == 0 {
+				if err != nil {
+					t.Fatalf("validate: unexpected error %v", err)
+				}
+				return
+			}
+
+			if err == nil {
+				t.Fatalf("validate: expected an error mentioning %v", tt.wantErr)
+			}
+
+			for _, want := range tt.wantErr {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("validate: error %q does not mention %q", err, want)
+				}
+			}
+		})
+	}
+}
+
+func TestLoadValuesFile(t *testing.T) {
+	dir := t.TempDir()
+
+	path := filepath.Join(dir, "values.yaml")
+	if err := os.WriteFile(path, []byte("namespace: alice\nimage: tomcat:9\nnodePort: 30081\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	values := defaultStackValues()
+	if err := loadValuesFile(path, &values); err != nil {
+		t.Fatalf("loadValuesFile: %v", err)
+	}
+
+	want := defaultStackValues()
+	want.Namespace = "alice"
+	want.Image = "tomcat:9"
+	want.NodePort = 30081
+
+	if !reflect.DeepEqual(values, want) {
+		t.Errorf("got %+v, want %+v", values, want)
+	}
+
+	typo := filepath.Join(dir, "typo.yaml")
+	if err := os.WriteFile(typo, []byte("nodePorts: 30081\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := loadValuesFile(typo, &values); err == nil {
+		t.Errorf("loadValuesFile: expected an error for the unknown field nodePorts")
+	}
+}
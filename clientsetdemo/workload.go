@@ -0,0 +1,499 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	apiv1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/utils/pointer"
+)
+
+/*
+-workload 决定 create 为 tomcat 创建哪一种工作负载，三种都使用 newPodTemplate 返回的 Pod 模板，名字都是 values.DeploymentName：
+  - deployment（默认）：与之前相同，见 newDeployment；
+  - statefulset：通过 volumeClaimTemplates 为每个 Pod 创建自己的 PVC <DATA_VOLUME>-<名字>-<序号>，挂载到 DATA_MOUNT_PATH。
+    StatefulSet 需要一个 headless Service（<serviceName>-headless）为每个 Pod 提供稳定的 DNS 名字，对外访问仍然使用 values.ServiceName；
+  - daemonset：每个节点运行一个 Pod，忽略 replicas，更新时一次只替换一个节点上的 Pod。
+
+-wait-rollout 按各自的 status 判断 rollout 是否完成，见 waitForWorkload。
+values.PVCRetention 写入 StatefulSet 的 persistentVolumeClaimRetentionPolicy.whenDeleted，clean 也按它处理 StatefulSet 的 PVC：
+Retain 保留 PVC，Delete 删除 PVC。PVC 不带 ownershipLabels，不会被 clean 按标签找到，所以由 retainClaims 和 deleteClaims 单独处理。
+删除命名空间会删除其中全部的 PVC，所以 Retain 保留了 PVC 时，clean 也保留它们所在的命名空间，并输出原因。
+*/
+
+const (
+	WORKLOAD_DEPLOYMENT  = "deployment"
+	WORKLOAD_STATEFULSET = "statefulset"
+	WORKLOAD_DAEMONSET   = "daemonset"
+
+	// DATA_VOLUME 是 StatefulSet volumeClaimTemplates 的名字，DATA_MOUNT_PATH 是它在 tomcat 容器中的挂载路径
+	DATA_VOLUME     = "data"
+	DATA_MOUNT_PATH = "/usr/local/tomcat/data"
+
+	DEFAULT_STORAGE_SIZE = "1Gi"
+)
+
+// workloadKinds 是 -workload 支持的取值和对应的 kind
+var workloadKinds = map[string]string{
+	WORKLOAD_DEPLOYMENT:  "Deployment",
+	WORKLOAD_STATEFULSET: "StatefulSet",
+	WORKLOAD_DAEMONSET:   "DaemonSet",
+}
+
+// validateWorkload 检查工作负载的参数，PVC 的参数只在 statefulset 时检查
+func (v stackValues) validateWorkload() []string {
+	var problems []string
+
+	if _, found := workloadKinds[v.Workload]; !found {
+		problems = append(problems, fmt.Sprintf("workload %q: must be deployment, statefulset or daemonset", v.Workload))
+	}
+
+	switch appsv1.PersistentVolumeClaimRetentionPolicyType(v.PVCRetention) {
+	case appsv1.RetainPersistentVolumeClaimRetentionPolicyType, appsv1.DeletePersistentVolumeClaimRetentionPolicyType:
+	default:
+		problems = append(problems, fmt.Sprintf("pvcRetention %q: must be Retain or Delete", v.PVCRetention))
+	}
+
+	if v.Workload == WORKLOAD_STATEFULSET {
+		for _, message := range validation.IsDNS1035Label(headlessServiceName(v)) {
+			problems = append(problems, fmt.Sprintf("headless service name %q: %s", headlessServiceName(v), message))
+		}
+
+		if size, err := resource.ParseQuantity(v.StorageSize); err != nil {
+			problems = append(problems, fmt.Sprintf("storageSize %q: %v", v.StorageSize, err))
+		} else if size.Sign() <= 0 {
+			problems = append(problems, fmt.Sprintf("storageSize %q: must be greater than 0", v.StorageSize))
+		}
+
+		if v.StorageClass != "" {
+			for _, message := range validation.IsDNS1123Subdomain(v.StorageClass) {
+				problems = append(problems, fmt.Sprintf("storageClass %q: %s", v.StorageClass, message))
+			}
+		}
+	}
+
+	// DaemonSet 的 Pod 数由节点数决定，HPA 无法伸缩它
+	if v.Workload == WORKLOAD_DAEMONSET && v.HPA {
+		problems = append(problems, "hpa: a daemonset runs one pod per node and cannot be autoscaled")
+	}
+
+	return problems
+}
+
+// headlessServiceName 返回 StatefulSet 的 headless Service 的名字
+func headlessServiceName(values stackValues) string {
+	return values.ServiceName + "-headless"
+}
+
+// newWorkloadObjects 返回 values.Workload 对应的工作负载，statefulset 时 headless Service 排在 StatefulSet 之前。
+// 与 stackObjects 中的其他对象一样设置好 GroupVersionKind 和命名空间
+func newWorkloadObjects(values stackValues) []runtime.Object {
+	switch values.Workload {
+	case WORKLOAD_STATEFULSET:
+		service := newHeadlessService(values)
+		service.Namespace = values.Namespace
+		service.SetGroupVersionKind(apiv1.SchemeGroupVersion.WithKind("Service"))
+
+		statefulSet := newStatefulSet(values)
+		statefulSet.Namespace = values.Namespace
+		statefulSet.SetGroupVersionKind(appsv1.SchemeGroupVersion.WithKind("StatefulSet"))
+
+		return []runtime.Object{service, statefulSet}
+	case WORKLOAD_DAEMONSET:
+		daemonSet := newDaemonSet(values)
+		daemonSet.Namespace = values.Namespace
+		daemonSet.SetGroupVersionKind(appsv1.SchemeGroupVersion.WithKind("DaemonSet"))
+
+		return []runtime.Object{daemonSet}
+	}
+
+	deployment := newDeployment(values)
+	deployment.Namespace = values.Namespace
+	deployment.SetGroupVersionKind(appsv1.SchemeGroupVersion.WithKind("Deployment"))
+
+	return []runtime.Object{deployment}
+}
+
+// createWorkload 在 values.Namespace 中创建 values.Workload 对应的工作负载
+func createWorkload(out io.Writer, clientset kubernetes.Interface, values stackValues) error {
+	if values.Workload == WORKLOAD_DEPLOYMENT {
+		return createDeployment(out, clientset, values)
+	}
+
+	return createCompanions(out, clientset, newWorkloadObjects(values))
+}
+
+// newHeadlessService 返回 StatefulSet 使用的 headless Service：clusterIP 为 None，DNS 直接解析到每个 Pod
+func newHeadlessService(values stackValues) *apiv1.Service {
+	return &apiv1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   headlessServiceName(values),
+			Labels: ownershipLabels(),
+		},
+		Spec: apiv1.ServiceSpec{
+			ClusterIP: apiv1.ClusterIPNone,
+			Ports: []apiv1.ServicePort{{
+				Name: "http",
+				Port: values.Port,
+			}},
+			Selector: map[string]string{
+				"app": "tomcat",
+			},
+		},
+	}
+}
+
+// newStatefulSet 返回 tomcat StatefulSet，每个 Pod 挂载自己的 PVC。
+// volumeClaimTemplates 只带 app 标签：PVC 由 StatefulSet controller 创建，是否删除由 PVCRetention 决定，不能被 clean 和 prune 按标签删除
+func newStatefulSet(values stackValues) *appsv1.StatefulSet {
+	template := newPodTemplate(values)
+	container := &template.Spec.Containers[0]
+	container.VolumeMounts = append(container.VolumeMounts, apiv1.VolumeMount{Name: DATA_VOLUME, MountPath: DATA_MOUNT_PATH})
+
+	claim := apiv1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: DATA_VOLUME,
+			Labels: map[string]string{
+				"app": "tomcat",
+			},
+		},
+		Spec: apiv1.PersistentVolumeClaimSpec{
+			AccessModes: []apiv1.PersistentVolumeAccessMode{apiv1.ReadWriteOnce},
+			Resources: apiv1.VolumeResourceRequirements{
+				Requests: apiv1.ResourceList{
+					apiv1.ResourceStorage: resource.MustParse(values.StorageSize),
+				},
+			},
+		},
+	}
+
+	if values.StorageClass != "" {
+		claim.Spec.StorageClassName = pointer.String(values.StorageClass)
+	}
+
+	return &appsv1.StatefulSet{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   values.DeploymentName,
+			Labels: ownershipLabels(),
+		},
+		Spec: appsv1.StatefulSetSpec{
+			Replicas:    pointer.Int32(values.Replicas),
+			ServiceName: headlessServiceName(values),
+			Selector: &metav1.LabelSelector{
+				MatchLabels: map[string]string{
+					"app": "tomcat",
+				},
+			},
+			Template:             template,
+			VolumeClaimTemplates: []apiv1.PersistentVolumeClaim{claim},
+			// 缩容时总是保留 PVC，再扩容时 Pod 可以拿回原来的数据
+			PersistentVolumeClaimRetentionPolicy: &appsv1.StatefulSetPersistentVolumeClaimRetentionPolicy{
+				WhenDeleted: appsv1.PersistentVolumeClaimRetentionPolicyType(values.PVCRetention),
+				WhenScaled:  appsv1.RetainPersistentVolumeClaimRetentionPolicyType,
+			},
+		},
+	}
+}
+
+// newDaemonSet 返回 tomcat DaemonSet，每个节点一个 Pod，滚动更新时一次只替换一个节点上的 Pod
+func newDaemonSet(values stackValues) *appsv1.DaemonSet {
+	maxUnavailable := intstr.FromInt32(1)
+
+	return &appsv1.DaemonSet{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   values.DeploymentName,
+			Labels: ownershipLabels(),
+		},
+		Spec: appsv1.DaemonSetSpec{
+			Selector: &metav1.LabelSelector{
+				MatchLabels: map[string]string{
+					"app": "tomcat",
+				},
+			},
+			Template: newPodTemplate(values),
+			UpdateStrategy: appsv1.DaemonSetUpdateStrategy{
+				Type:          appsv1.RollingUpdateDaemonSetStrategyType,
+				RollingUpdate: &appsv1.RollingUpdateDaemonSet{MaxUnavailable: &maxUnavailable},
+			},
+		},
+	}
+}
+
+// waitForWorkload 等待一个工作负载完成 rollout，进度写到 out。Deployment 使用 waitForRollout；
+// StatefulSet 和 DaemonSet 每秒读取一次状态，同时像 waitForRollout 一样检查 Pod，镜像拉取失败或者 CrashLoopBackOff 时立即返回错误
+func waitForWorkload(out io.Writer, clientset kubernetes.Interface, kind, namespace, name string, timeout time.Duration) error {
+	if kind == "Deployment" {
+		return waitForRollout(out, clientset, namespace, name, timeout)
+	}
+
+	w := &rolloutWatcher{
+		out:      out,
+		name:     name,
+		reported: map[string]bool{},
+		since:    time.Now(),
+	}
+
+	err := wait.PollUntilContextTimeout(context.TODO(), time.Second, timeout, true, func(ctx context.Context) (bool, error) {
+		var selector *metav1.LabelSelector
+		var done bool
+
+		switch kind {
+		case "StatefulSet":
+			statefulSet, err := clientset.AppsV1().StatefulSets(namespace).Get(ctx, name, metav1.GetOptions{})
+
+			if err != nil {
+				return false, err
+			}
+
+			selector, done = statefulSet.Spec.Selector, w.checkStatefulSet(statefulSet)
+		case "DaemonSet":
+			daemonSet, err := clientset.AppsV1().DaemonSets(namespace).Get(ctx, name, metav1.GetOptions{})
+
+			if err != nil {
+				return false, err
+			}
+
+			selector, done = daemonSet.Spec.Selector, w.checkDaemonSet(daemonSet)
+		default:
+			return false, fmt.Errorf("cannot wait for the rollout of %s %s", strings.ToLower(kind), name)
+		}
+
+		if done {
+			return true, nil
+		}
+
+		return false, w.checkWorkloadPods(ctx, clientset, namespace, selector, kind == "DaemonSet")
+	})
+
+	if wait.Interrupted(err) {
+		return fmt.Errorf("timed out after %v waiting for %s %s rollout: %s: %w", timeout, strings.ToLower(kind), name, w.lastStatus, err)
+	}
+
+	return err
+}
+
+// checkStatefulSet 参照 kubectl rollout status，根据 StatefulSet 的状态输出进度并判断 rollout 是否结束。
+// 设置了 partition 时只等待序号不小于 partition 的 Pod 更新
+func (w *rolloutWatcher) checkStatefulSet(statefulSet *appsv1.StatefulSet) bool {
+	status := statefulSet.Status
+
+	if statefulSet.Generation > status.ObservedGeneration {
+		w.progress("Waiting for statefulset spec update to be observed...")
+		return false
+	}
+
+	replicas := int32(1)
+	if statefulSet.Spec.Replicas != nil {
+		replicas = *statefulSet.Spec.Replicas
+	}
+
+	partition := int32(0)
+	if update := statefulSet.Spec.UpdateStrategy.RollingUpdate; update != nil && update.Partition != nil {
+		partition = *update.Partition
+	}
+
+	switch {
+	case status.ReadyReplicas < replicas:
+		w.progress(fmt.Sprintf("Waiting for statefulset %q: %d of %d pods are ready...", w.name, status.ReadyReplicas, replicas))
+	case partition > 0 && status.UpdatedReplicas < replicas-partition:
+		w.progress(fmt.Sprintf("Waiting for statefulset %q partitioned rollout to finish: %d out of %d new pods have been updated...", w.name, status.UpdatedReplicas, replicas-partition))
+	case partition == 0 && status.UpdateRevision != status.CurrentRevision:
+		w.progress(fmt.Sprintf("Waiting for statefulset %q rolling update to complete %d pods at revision %s...", w.name, status.UpdatedReplicas, status.UpdateRevision))
+	default:
+		fmt.Fprintf(w.out, "statefulset %q successfully rolled out %d pods at revision %s\n", w.name, replicas, status.UpdateRevision)
+		return true
+	}
+
+	return false
+}
+
+// checkDaemonSet 参照 kubectl rollout status，根据 DaemonSet 的状态输出进度并判断 rollout 是否结束
+func (w *rolloutWatcher) checkDaemonSet(daemonSet *appsv1.DaemonSet) bool {
+	status := daemonSet.Status
+
+	if daemonSet.Generation > status.ObservedGeneration {
+		w.progress("Waiting for daemon set spec update to be observed...")
+		return false
+	}
+
+	switch {
+	case status.UpdatedNumberScheduled < status.DesiredNumberScheduled:
+		w.progress(fmt.Sprintf("Waiting for daemon set %q rollout to finish: %d out of %d new pods have been updated...", w.name, status.UpdatedNumberScheduled, status.DesiredNumberScheduled))
+	case status.NumberAvailable < status.DesiredNumberScheduled:
+		w.progress(fmt.Sprintf("Waiting for daemon set %q rollout to finish: %d of %d updated pods are available...", w.name, status.NumberAvailable, status.DesiredNumberScheduled))
+	default:
+		fmt.Fprintf(w.out, "daemon set %q successfully rolled out on %d node(s)\n", w.name, status.DesiredNumberScheduled)
+		return true
+	}
+
+	return false
+}
+
+// checkWorkloadPods 用 checkPod 检查工作负载的每个 Pod。perNode 为 true 时（DaemonSet）还会在每个节点上的 Pod 就绪时打印一次
+func (w *rolloutWatcher) checkWorkloadPods(ctx context.Context, clientset kubernetes.Interface, namespace string, selector *metav1.LabelSelector, perNode bool) error {
+	podSelector, err := metav1.LabelSelectorAsSelector(selector)
+
+	if err != nil {
+		return err
+	}
+
+	pods, err := clientset.CoreV1().Pods(namespace).List(ctx, metav1.ListOptions{LabelSelector: podSelector.String()})
+
+	if err != nil {
+		return err
+	}
+
+	for i := range pods.Items {
+		pod := &pods.Items[i]
+
+		if err := w.checkPod(pod); err != nil {
+			return err
+		}
+
+		key := "ready/" + pod.Name
+		if perNode && pod.Spec.NodeName != "" && isPodReady(pod) && !w.reported[key] {
+			w.reported[key] = true
+			fmt.Fprintf(w.out, "pod %s on node %s is ready\n", pod.Name, pod.Spec.NodeName)
+		}
+	}
+
+	return nil
+}
+
+// isPodReady 判断 Pod 的 Ready 条件是否为 True
+func isPodReady(pod *apiv1.Pod) bool {
+	for _, condition := range pod.Status.Conditions {
+		if condition.Type == apiv1.PodReady {
+			return condition.Status == apiv1.ConditionTrue
+		}
+	}
+
+	return false
+}
+
+// ownedStatefulSets 返回 owned 中的 StatefulSet
+func ownedStatefulSets(owned []ownedObject) ([]*appsv1.StatefulSet, error) {
+	var statefulSets []*appsv1.StatefulSet
+
+	for _, o := range owned {
+		if o.object.GetKind() != "StatefulSet" {
+			continue
+		}
+
+		statefulSet := &appsv1.StatefulSet{}
+
+		if err := runtime.DefaultUnstructuredConverter.FromUnstructured(o.object.Object, statefulSet); err != nil {
+			return nil, fmt.Errorf("statefulset %s: %w", o.object.GetName(), err)
+		}
+
+		statefulSets = append(statefulSets, statefulSet)
+	}
+
+	return statefulSets, nil
+}
+
+// statefulSetClaims 返回 StatefulSet 的 volumeClaimTemplates 创建的 PVC，它们的名字是 <模板名>-<StatefulSet 名>-<序号>
+func statefulSetClaims(clientset kubernetes.Interface, statefulSet *appsv1.StatefulSet) ([]apiv1.PersistentVolumeClaim, error) {
+	list, err := clientset.CoreV1().PersistentVolumeClaims(statefulSet.Namespace).List(context.TODO(), metav1.ListOptions{})
+
+	if err != nil {
+		return nil, fmt.Errorf("list persistentvolumeclaims: %w", err)
+	}
+
+	var claims []apiv1.PersistentVolumeClaim
+
+	for _, claim := range list.Items {
+		for _, template := range statefulSet.Spec.VolumeClaimTemplates {
+			ordinal, found := strings.CutPrefix(claim.Name, template.Name+"-"+statefulSet.Name+"-")
+
+			if _, err := strconv.ParseUint(ordinal, 10, 32); found && err == nil {
+				claims = append(claims, claim)
+				break
+			}
+		}
+	}
+
+	return claims, nil
+}
+
+// retainClaims 在删除 StatefulSet 之前保证它的 PVC 被保留下来。whenDeleted 为 Delete 时 StatefulSet controller 给 PVC 加上了指向
+// StatefulSet 的 ownerReference，先把策略改成 Retain（controller 不会再加回来），再去掉这些 ownerReference，垃圾回收就不会删除 PVC。
+// 返回保留下来的 PVC 的数量
+func retainClaims(out io.Writer, clientset kubernetes.Interface, statefulSet *appsv1.StatefulSet) (int, error) {
+	claims, err := statefulSetClaims(clientset, statefulSet)
+
+	if err != nil {
+		return 0, err
+	}
+
+	policy := statefulSet.Spec.PersistentVolumeClaimRetentionPolicy
+
+	if policy != nil && policy.WhenDeleted == appsv1.DeletePersistentVolumeClaimRetentionPolicyType {
+		patch := []byte(`{"spec":{"persistentVolumeClaimRetentionPolicy":{"whenDeleted":"Retain"}}}`)
+		_, err := clientset.AppsV1().StatefulSets(statefulSet.Namespace).Patch(context.TODO(), statefulSet.Name, types.MergePatchType, patch, metav1.PatchOptions{DryRun: dryRun})
+
+		if err != nil {
+			return 0, fmt.Errorf("retain persistentvolumeclaims of statefulset %s: %w", statefulSet.Name, err)
+		}
+
+		for i := range claims {
+			claim := &claims[i]
+			var references []metav1.OwnerReference
+
+			for _, reference := range claim.OwnerReferences {
+				if reference.UID != statefulSet.UID {
+					references = append(references, reference)
+				}
+			}
+
+			if len(references) == len(claim.OwnerReferences) {
+				continue
+			}
+
+			claim.OwnerReferences = references
+
+			if _, err := clientset.CoreV1().PersistentVolumeClaims(claim.Namespace).Update(context.TODO(), claim, metav1.UpdateOptions{DryRun: dryRun}); err != nil {
+				return 0, fmt.Errorf("retain persistentvolumeclaim %s: %w", claim.Name, err)
+			}
+		}
+	}
+
+	for _, claim := range claims {
+		fmt.Fprintf(out, "Keep persistentvolumeclaim %s of statefulset %s%s \n", claim.Name, statefulSet.Name, dryRunSuffix())
+	}
+
+	return len(claims), nil
+}
+
+// deleteClaims 删除 StatefulSet 的 PVC。whenDeleted 为 Retain 或者集群不支持 persistentVolumeClaimRetentionPolicy 时 PVC 不会被自动删除，
+// 这里统一显式删除；仍被 Pod 使用的 PVC 会等 Pod 终止之后才真正消失
+func deleteClaims(out io.Writer, clientset kubernetes.Interface, statefulSet *appsv1.StatefulSet, options metav1.DeleteOptions) error {
+	claims, err := statefulSetClaims(clientset, statefulSet)
+
+	if err != nil {
+		return err
+	}
+
+	for _, claim := range claims {
+		err := clientset.CoreV1().PersistentVolumeClaims(claim.Namespace).Delete(context.TODO(), claim.Name, options)
+
+		if err := reportDelete(out, "persistentvolumeclaim", claim.Name, err); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
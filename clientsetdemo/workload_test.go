@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	apiv1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/utils/pointer"
+)
+
+func TestCreateStatefulSetStack(t *testing.T) {
+	values := stack
+	values.Workload = WORKLOAD_STATEFULSET
+	values.StorageSize = "5Gi"
+	values.PVCRetention = string(appsv1.DeletePersistentVolumeClaimRetentionPolicyType)
+
+	clientset := fake.NewSimpleClientset()
+
+	if err := createStack(os.Stdout, clientset, values); err != nil {
+		t.Fatalf("createStack: %v", err)
+	}
+
+	statefulSet, err := clientset.AppsV1().StatefulSets(NAMESPACE).Get(context.TODO(), DEPLOYMENT_NAME, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("get statefulset: %v", err)
+	}
+
+	if statefulSet.Spec.ServiceName != headlessServiceName(values) {
+		t.Errorf("serviceName = %q, want %q", statefulSet.Spec.ServiceName, headlessServiceName(values))
+	}
+
+	if policy := statefulSet.Spec.PersistentVolumeClaimRetentionPolicy; policy == nil || policy.WhenDeleted != appsv1.DeletePersistentVolumeClaimRetentionPolicyType {
+		t.Errorf("persistentVolumeClaimRetentionPolicy = %+v, want whenDeleted Delete", policy)
+	}
+
+	claims := statefulSet.Spec.VolumeClaimTemplates
+	if len(claims) != 1 || claims[0].Spec.Resources.Requests.Storage().String() != "5Gi" {
+		t.Errorf("volumeClaimTemplates = %+v, want one 5Gi claim", claims)
+	}
+
+	headless, err := clientset.CoreV1().Services(NAMESPACE).Get(context.TODO(), headlessServiceName(values), metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("get headless service: %v", err)
+	}
+
+	if headless.Spec.ClusterIP != apiv1.ClusterIPNone {
+		t.Errorf("headless service clusterIP = %q, want None", headless.Spec.ClusterIP)
+	}
+
+	if _, err := clientset.AppsV1().Deployments(NAMESPACE).Get(context.TODO(), DEPLOYMENT_NAME, metav1.GetOptions{}); !apierrors.IsNotFound(err) {
+		t.Errorf("get deployment returned %v, want NotFound", err)
+	}
+}
+
+func TestCleanStatefulSetClaims(t *testing.T) {
+	tests := []struct {
+		retention appsv1.PersistentVolumeClaimRetentionPolicyType
+		// wantClaims 是 clean 之后应该还存在的 PVC
+		wantClaims []string
+		// wantNamespace 为 true 时命名空间应该被保留下来，删除它会删掉保留的 PVC
+		wantNamespace bool
+	}{
+		{retention: appsv1.RetainPersistentVolumeClaimRetentionPolicyType, wantClaims: []string{"data-" + DEPLOYMENT_NAME + "-0", "data-" + DEPLOYMENT_NAME + "-1", "unrelated"}, wantNamespace: true},
+		{retention: appsv1.DeletePersistentVolumeClaimRetentionPolicyType, wantClaims: []string{"unrelated"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(string(tt.retention), func(t *testing.T) {
+			values := stack
+			values.Workload = WORKLOAD_STATEFULSET
+			values.PVCRetention = string(appsv1.DeletePersistentVolumeClaimRetentionPolicyType)
+
+			statefulSet := newWorkloadObjects(values)[1].(*appsv1.StatefulSet)
+			statefulSet.UID = types.UID("statefulset-uid")
+
+			// StatefulSet controller 按 whenDeleted=Delete 给 PVC 加上的 ownerReference
+			owner := metav1.OwnerReference{APIVersion: "apps/v1", Kind: "StatefulSet", Name: statefulSet.Name, UID: statefulSet.UID}
+			claim := func(name string) *apiv1.PersistentVolumeClaim {
+				return &apiv1.PersistentVolumeClaim{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: NAMESPACE, OwnerReferences: []metav1.OwnerReference{owner}}}
+			}
+
+			clientset := fake.NewSimpleClientset(newNamespace(values), statefulSet, claim("data-"+DEPLOYMENT_NAME+"-0"), claim("data-"+DEPLOYMENT_NAME+"-1"), claim("unrelated"))
+			clientset.Resources = []*metav1.APIResourceList{{
+				GroupVersion: "apps/v1",
+				APIResources: []metav1.APIResource{{Name: "statefulsets", Kind: "StatefulSet", Namespaced: true, Verbs: metav1.Verbs{"create", "list", "delete"}}},
+			}}
+			dynamicClient := dynamicfake.NewSimpleDynamicClient(scheme.Scheme, statefulSet.DeepCopy())
+
+			options := cleanOptions{propagation: metav1.DeletePropagationBackground, gracePeriod: -1, pvcRetention: tt.retention}
+			if err := cleanOwned(os.Stdout, clientset, dynamicClient, []string{NAMESPACE}, options); err != nil {
+				t.Fatalf("cleanOwned: %v", err)
+			}
+
+			claims, err := clientset.CoreV1().PersistentVolumeClaims(NAMESPACE).List(context.TODO(), metav1.ListOptions{})
+			if err != nil {
+				t.Fatalf("list persistentvolumeclaims: %v", err)
+			}
+
+			var names []string
+			for _, claim := range claims.Items {
+				names = append(names, claim.Name)
+
+				// 保留下来的 PVC 不能再指向被删除的 StatefulSet，否则垃圾回收仍然会删除它们
+				if tt.retention == appsv1.RetainPersistentVolumeClaimRetentionPolicyType && claim.Name != "unrelated" && len(claim.OwnerReferences) > 0 {
+					t.Errorf("retained claim %s still has owner references %+v", claim.Name, claim.OwnerReferences)
+				}
+			}
+
+			if len(names) != len(tt.wantClaims) {
+				t.Fatalf("claims after clean = %v, want %v", names, tt.wantClaims)
+			}
+
+			for i := range names {
+				if names[i] != tt.wantClaims[i] {
+					t.Errorf("claims after clean = %v, want %v", names, tt.wantClaims)
+				}
+			}
+
+			_, err = clientset.CoreV1().Namespaces().Get(context.TODO(), NAMESPACE, metav1.GetOptions{})
+			if tt.wantNamespace && err != nil {
+				t.Errorf("get namespace after clean: %v, want it kept for the retained claims", err)
+			}
+
+			if !tt.wantNamespace && !apierrors.IsNotFound(err) {
+				t.Errorf("get namespace after clean returned %v, want NotFound", err)
+			}
+		})
+	}
+}
+
+func TestWaitForWorkload(t *testing.T) {
+	statefulSet := &appsv1.StatefulSet{
+		ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: NAMESPACE, Generation: 2},
+		Spec: appsv1.StatefulSetSpec{
+			Replicas: pointer.Int32(2),
+			Selector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "web"}},
+		},
+		Status: appsv1.StatefulSetStatus{ObservedGeneration: 2, ReadyReplicas: 2, UpdatedReplicas: 2, CurrentRevision: "web-1", UpdateRevision: "web-1"},
+	}
+
+	daemonSet := &appsv1.DaemonSet{
+		ObjectMeta: metav1.ObjectMeta{Name: "agent", Namespace: NAMESPACE, Generation: 1},
+		Spec: appsv1.DaemonSetSpec{
+			Selector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "agent"}},
+		},
+		Status: appsv1.DaemonSetStatus{ObservedGeneration: 1, DesiredNumberScheduled: 3, UpdatedNumberScheduled: 1},
+	}
+
+	stuck := &apiv1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "agent-x1", Namespace: NAMESPACE, Labels: map[string]string{"app": "agent"}},
+		Spec:       apiv1.PodSpec{NodeName: "node-1"},
+		Status: apiv1.PodStatus{ContainerStatuses: []apiv1.ContainerStatus{{
+			Name:  "agent",
+			State: apiv1.ContainerState{Waiting: &apiv1.ContainerStateWaiting{Reason: "ImagePullBackOff"}},
+		}}},
+	}
+
+	clientset := fake.NewSimpleClientset(statefulSet, daemonSet, stuck)
+
+	if err := waitForWorkload(os.Stdout, clientset, "StatefulSet", NAMESPACE, "web", time.Minute); err != nil {
+		t.Errorf("wait for rolled out statefulset: %v", err)
+	}
+
+	err := waitForWorkload(os.Stdout, clientset, "DaemonSet", NAMESPACE, "agent", time.Minute)
+	if code, _ := classifyError(err); code != EXIT_ROLLOUT_FAILED {
+		t.Errorf("wait for daemonset with a stuck pod returned %v (exit code %d), want EXIT_ROLLOUT_FAILED", err, code)
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+)
+
+// 退出码：
+//
+//	0 成功，1 其他错误，2 命令行参数错误，3 NotFound，4 AlreadyExists，
+//	5 Forbidden，6 Conflict，7 Timeout，8 Unauthorized
+//
+// discovery 只有读操作，实际可能出现的主要是 Forbidden、Unauthorized 和 Timeout。
+const (
+	EXIT_OK             = 0
+	EXIT_ERROR          = 1
+	EXIT_USAGE          = 2
+	EXIT_NOT_FOUND      = 3
+	EXIT_ALREADY_EXISTS = 4
+	EXIT_FORBIDDEN      = 5
+	EXIT_CONFLICT       = 6
+	EXIT_TIMEOUT        = 7
+	EXIT_UNAUTHORIZED   = 8
+)
+
+// errorFormat 由 -error-format 参数指定，text 或 json
+var errorFormat = "text"
+
+// usageError 表示命令行参数错误
+type usageError struct {
+	message string
+}
+
+func (e *usageError) Error() string {
+	return e.message
+}
+
+// exitUsage 以 EXIT_USAGE 结束进程
+func exitUsage(format string, args ...interface{}) {
+	exitOnError(&usageError{message: fmt.Sprintf(format, args...)})
+}
+
+// classifyError 用 apierrors 判断错误类别，返回退出码和类别名称
+func classifyError(err error) (int, string) {
+	switch {
+	case errors.As(err, new(*usageError)):
+		return EXIT_USAGE, "Usage"
+	case apierrors.IsNotFound(err):
+		return EXIT_NOT_FOUND, "NotFound"
+	case apierrors.IsAlreadyExists(err):
+		return EXIT_ALREADY_EXISTS, "AlreadyExists"
+	case apierrors.IsForbidden(err):
+		return EXIT_FORBIDDEN, "Forbidden"
+	case apierrors.IsConflict(err):
+		return EXIT_CONFLICT, "Conflict"
+	case apierrors.IsTimeout(err), apierrors.IsServerTimeout(err):
+		return EXIT_TIMEOUT, "Timeout"
+	case apierrors.IsUnauthorized(err):
+		return EXIT_UNAUTHORIZED, "Unauthorized"
+	}
+
+	return EXIT_ERROR, "Error"
+}
+
+// exitOnError 输出一行错误信息（或一个 JSON 对象）到标准错误，并以错误类别对应的退出码结束进程，err 为 nil 时什么也不做
+func exitOnError(err error) {
+	if err == nil {
+		return
+	}
+
+	code, reason := classifyError(err)
+	message := strings.ReplaceAll(err.Error(), "\n", " ")
+
+	if errorFormat != "json" {
+		fmt.Fprintf(os.Stderr, "error: %s: %s\n", reason, message)
+		os.Exit(code)
+	}
+
+	report := map[string]interface{}{
+		"reason":   reason,
+		"exitCode": code,
+		"message":  message,
+	}
+
+	var status apierrors.APIStatus
+	if errors.As(err, &status) {
+		report["httpStatus"] = status.Status().Code
+	}
+
+	data, _ := json.Marshal(report)
+	fmt.Fprintln(os.Stderr, string(data))
+	os.Exit(code)
+}
@@ -21,24 +21,30 @@ func main() {
 		kubeconfig = flag.String("kubeconfig", "", "absolute path to the kubeconfig file")
 	}
 
+	flag.StringVar(&errorFormat, "error-format", errorFormat, "how errors are reported on stderr: text or json")
 	flag.Parse()
 
+	if format := errorFormat; format != "text" && format != "json" {
+		errorFormat = "text"
+		exitUsage("unknown error format %q, must be text or json", format)
+	}
+
 	config, err := clientcmd.BuildConfigFromFlags("", *kubeconfig)
 
 	if err != nil {
-		panic(err.Error())
+		exitOnError(err)
 	}
 
 	discoveryClient, err := discovery.NewDiscoveryClientForConfig(config)
 
 	if err != nil {
-		panic(err.Error())
+		exitOnError(err)
 	}
 
 	APIGroup, APIResourceListSlice, err := discoveryClient.ServerGroupsAndResources()
 
 	if err != nil {
-		panic(err.Error())
+		exitOnError(err)
 	}
 
 	fmt.Printf("APIGroup:\n\n %v\n\n\n\n", APIGroup)
@@ -48,7 +54,7 @@ func main() {
 		gv, err := schema.ParseGroupVersion(groupVersionStr)
 
 		if err != nil {
-			panic(err.Error())
+			exitOnError(err)
 		}
 
 		fmt.Println("************************************************************")
@@ -24,19 +24,25 @@ func main() {
 		kubeconfig = flag.String("kubeconfig", "", "absolute path to the kubeconfig file")
 	}
 
+	flag.StringVar(&errorFormat, "error-format", errorFormat, "how errors are reported on stderr: text or json")
 	flag.Parse()
 
+	if format := errorFormat; format != "text" && format != "json" {
+		errorFormat = "text"
+		exitUsage("unknown error format %q, must be text or json", format)
+	}
+
 	config, err := clientcmd.BuildConfigFromFlags("", *kubeconfig)
 
 	if err != nil {
-		panic(err.Error())
+		exitOnError(err)
 	}
 
 	// 通过 k8s.io/client-go/dynamic 包中的 NewForConfig() 方法创建 DynamicClient 对象，该对象可以与 Kubernetes API 中的动态 API 资源交互。
 	dynamicClient, err := dynamic.NewForConfig(config)
 
 	if err != nil {
-		panic(err.Error())
+		exitOnError(err)
 	}
 
 	// 定义一个 GroupVersionResource 类型变量 gvr，用于指示 Kubernetes API 中的资源对象、组和版本。
@@ -62,7 +68,7 @@ func main() {
 			metav1.ListOptions{Limit: 100})
 
 	if err != nil {
-		panic(err.Error())
+		exitOnError(err)
 	}
 
 	podList := &apiv1.PodList{}
@@ -79,7 +85,7 @@ func main() {
 	err = runtime.DefaultUnstructuredConverter.FromUnstructured(unstructObj.UnstructuredContent(), podList)
 
 	if err != nil {
-		panic(err.Error())
+		exitOnError(err)
 	}
 
 	fmt.Printf("namespace\t status\t\t name\n")
@@ -23,11 +23,17 @@ func main() {
 	} else {
 		kubeconfig = flag.String("kubeconfig", "", "absolute path to the kubeconfig file")
 	}
+	flag.StringVar(&errorFormat, "error-format", errorFormat, "how errors are reported on stderr: text or json")
 	flag.Parse()
 
+	if format := errorFormat; format != "text" && format != "json" {
+		errorFormat = "text"
+		exitUsage("unknown error format %q, must be text or json", format)
+	}
+
 	config, err := clientcmd.BuildConfigFromFlags("", *kubeconfig)
 	if err != nil {
-		panic(err.Error())
+		exitOnError(err)
 	}
 
 	config.APIPath = "api"
@@ -36,19 +42,19 @@ func main() {
 
 	restClient, err := rest.RESTClientFor(config)
 	if err != nil {
-		panic(err.Error())
+		exitOnError(err)
 	}
 
 	clientSet, err := kubernetes.NewForConfig(config)
 	if err != nil {
-		panic(err.Error())
+		exitOnError(err)
 	}
 
 	result := &corev1.PodList{}
 
 	namespaces, err := clientSet.CoreV1().Namespaces().List(context.TODO(), v1.ListOptions{})
 	if err != nil {
-		panic(err.Error())
+		exitOnError(err)
 	}
 
 	fmt.Printf("namespace\t status\t name\n")
@@ -57,7 +63,7 @@ func main() {
 
 		err = restClient.Get().Namespace(namespace).Resource("pods").VersionedParams(&metav1.ListOptions{Limit: 500}, scheme.ParameterCodec).Do(context.TODO()).Into(result)
 		if err != nil {
-			panic(err.Error())
+			exitOnError(err)
 		}
 
 		for _, d := range result.Items {
@@ -33,16 +33,22 @@ func main() {
 		kubeconfig = flag.String("kubeconfig", "", "absolute path to the kubeconfig file")
 	}
 
+	flag.StringVar(&errorFormat, "error-format", errorFormat, "how errors are reported on stderr: text or json")
 	flag.Parse() // flag 包中的函数，用于解析命令行参数。命令行参数是指在终端输入参数
+
+	if format := errorFormat; format != "text" && format != "json" {
+		errorFormat = "text"
+		exitUsage("unknown error format %q, must be text or json", format)
+	}
+
 	config, err := clientcmd.BuildConfigFromFlags("", *kubeconfig)
 	// 使用 clientcmd 库来加载 kubeconfig 文件，并返回一个 Kubernetes 客户端配置对象 config
 	// 是从指定 kubeconfig 文件路径参数中加载 Kubernetes API Server 的连接参数，并生成一个Kubernetes客户端的配置对象 config
 	// BuildConfigFromFlags 函数使用 client-go 库来读取和解析 kubeconfig 文件
 
 	if err != nil {
-		panic(err.Error())
-		// panic() 函数是用于抛出运行时异常的 Go 语言内置函数。当程序执行到 panic() 时，程序会立即停止运行，然后将错误信息打印到控制台，并输出调用栈信息，以便更好地追踪和调试问题
-		// err.Error() 表示将错误信息转化为字符串类型输出
+		exitOnError(err)
+		// exitOnError() 把错误输出为一行信息（-error-format=json 时为 JSON），并按错误类型以不同的退出码结束进程，而不是像 panic() 那样打印整段调用栈
 	}
 
 	// 初始化 Kubernetes REST Client 的配置信息
@@ -60,7 +66,7 @@ func main() {
 	// 这个 REST Client 对象包括了发送 HTTP 请求的功能和必需的身份验证信息，是管理 Kubernetes 资源和状态的核心组件之一
 
 	if err != nil {
-		panic(err.Error())
+		exitOnError(err)
 	}
 
 	result := &corev1.PodList{}
@@ -70,6 +76,10 @@ func main() {
 	// namespace := "kube-system"
 	clientSet, err := kubernetes.NewForConfig(config)
 
+	if err != nil {
+		exitOnError(err)
+	}
+
 	/*
 		clientset.CoreV1()：通过前面生成的 Kubernetes 客户端集合对象 clientset，获取与 Kubernetes 核心 API 相关的客户端方法。
 		clientset.CoreV1().Namespaces()：通过链式调用，访问 Kubernetes 核心 API 中的 Namespaces 资源对象，以获得所有命名空间的信息和状态。
@@ -79,7 +89,7 @@ func main() {
 	*/
 	namespaces, err := clientSet.CoreV1().Namespaces().List(context.TODO(), v1.ListOptions{})
 	if err != nil {
-		panic(err)
+		exitOnError(err)
 	}
 
 	// 打印表头
@@ -124,7 +134,7 @@ func main() {
 			*/
 
 		if err != nil {
-			panic(err.Error())
+			exitOnError(err)
 		}
 
 		// 每个pod都打印namespace,status.Phase,name三个字段